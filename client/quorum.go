@@ -0,0 +1,175 @@
+// Package client has helpers for clients of a dcache cluster.
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nireo/dcache/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrNoQuorum is returned by GetQuorum when a majority of the nodes didn't respond
+// or didn't agree on a value.
+var ErrNoQuorum = errors.New("no quorum for the read")
+
+// quorumError is the error returned when a majority of the nodes failed. It
+// matches ErrNoQuorum and has the gRPC status code of the last failure.
+type quorumError struct {
+	err error
+}
+
+func (e *quorumError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrNoQuorum, e.err)
+}
+
+func (e *quorumError) Is(target error) bool {
+	return target == ErrNoQuorum
+}
+
+func (e *quorumError) Unwrap() error {
+	return e.err
+}
+
+// GRPCStatus returns the status of the last failure with the message of e.
+func (e *quorumError) GRPCStatus() *status.Status {
+	return status.New(status.Code(e.err), e.Error())
+}
+
+// isNotFound reports whether a node responded that it doesn't have the key.
+func isNotFound(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+// quorumResult is the response of a single node to a quorum read.
+type quorumResult struct {
+	res *pb.GetResponse
+	err error
+}
+
+// GetQuorum reads key from every node in clients in parallel and returns the value
+// of the majority, without involving the leader. Each node reads from its local
+// cache, so a node that hasn't applied the latest write yet returns an older
+// value. If the nodes report versions, the value with the highest version among a
+// majority of responses is returned. Otherwise a majority of the nodes needs to
+// return the same value.
+//
+// The read is not linearizable. A committed write is in the log of a majority, but
+// the nodes answer from the writes they have applied, so a write that none of the
+// responding nodes has applied yet is missed. A quorum read only keeps a single
+// lagging node from causing a stale read.
+//
+// A node that doesn't have the key counts as a response. If a majority of the nodes
+// doesn't have it, a NotFound status is returned. Nodes that fail to respond are
+// ignored as long as a majority responds. If that's not possible, ErrNoQuorum is
+// returned with the status code of the last failure. Requests still in flight are
+// canceled once the result is known.
+func GetQuorum(
+	ctx context.Context, clients []pb.CacheClient, key string,
+) (*pb.GetResponse, error) {
+	if len(clients) == 0 {
+		return nil, ErrNoQuorum
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the channel is buffered so the requests finishing after the result is known
+	// don't block.
+	results := make(chan quorumResult, len(clients))
+	for _, client := range clients {
+		go func(client pb.CacheClient) {
+			res, err := client.Get(ctx, &pb.GetRequest{Key: key, Stale: true})
+			results <- quorumResult{res: res, err: err}
+		}(client)
+	}
+
+	majority := len(clients)/2 + 1
+	var (
+		responses []*pb.GetResponse
+		lastErr   error
+	)
+	for i := 0; i < len(clients); i++ {
+		r := <-results
+		switch {
+		case r.err == nil:
+			responses = append(responses, r.res)
+		case isNotFound(r.err):
+			// a missing key is stored as a nil response.
+			responses = append(responses, nil)
+		default:
+			lastErr = r.err
+		}
+
+		res, ok := quorumValue(responses, majority, len(clients)-i-1)
+		if !ok {
+			continue
+		}
+		if res == nil {
+			return nil, status.Errorf(codes.NotFound, "key %q not found on a majority of the nodes", key)
+		}
+		return res, nil
+	}
+
+	if lastErr != nil {
+		return nil, &quorumError{err: lastErr}
+	}
+	return nil, ErrNoQuorum
+}
+
+// quorumValue picks the result of a quorum read from responses, where nil means
+// that the node doesn't have the key. pending is the number of nodes that haven't
+// responded yet. ok is false if the responses don't make up a majority yet, or if
+// the pending nodes could still make the key missing on a majority. A nil result
+// with ok set means that the key is missing on a majority.
+func quorumValue(
+	responses []*pb.GetResponse, majority, pending int,
+) (*pb.GetResponse, bool) {
+	if len(responses) < majority {
+		return nil, false
+	}
+
+	var (
+		latest *pb.GetResponse
+		absent int
+	)
+	for _, res := range responses {
+		if res == nil {
+			absent++
+			continue
+		}
+		if latest == nil || res.Version > latest.Version {
+			latest = res
+		}
+	}
+	if absent >= majority {
+		return nil, true
+	}
+	if absent+pending >= majority {
+		return nil, false
+	}
+	if latest.Version != 0 {
+		return latest, true
+	}
+
+	// without versions, the nodes need to agree on the value.
+	for _, res := range responses {
+		if res == nil {
+			continue
+		}
+
+		agreed := 0
+		for _, other := range responses {
+			if other != nil && bytes.Equal(res.Value, other.Value) {
+				agreed++
+			}
+		}
+		if agreed >= majority {
+			return res, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,121 @@
+package client_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nireo/dcache/client"
+	"github.com/nireo/dcache/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// nodeClient is a client of a single node returning a fixed response.
+type nodeClient struct {
+	pb.CacheClient
+	res *pb.GetResponse
+	err error
+}
+
+func (c *nodeClient) Get(
+	ctx context.Context, req *pb.GetRequest, opts ...grpc.CallOption,
+) (*pb.GetResponse, error) {
+	return c.res, c.err
+}
+
+func TestGetQuorum(t *testing.T) {
+	down := status.Error(codes.Unavailable, "node is down")
+	missing := status.Error(codes.NotFound, "entry not found")
+
+	tests := map[string]struct {
+		clients []pb.CacheClient
+		want    []byte
+		err     error
+		code    codes.Code
+	}{
+		"stale node": {
+			clients: []pb.CacheClient{
+				&nodeClient{res: &pb.GetResponse{Value: []byte("old"), Version: 1}},
+				&nodeClient{res: &pb.GetResponse{Value: []byte("new"), Version: 2}},
+				&nodeClient{res: &pb.GetResponse{Value: []byte("new"), Version: 2}},
+			},
+			want: []byte("new"),
+		},
+		"stale and failed node": {
+			clients: []pb.CacheClient{
+				&nodeClient{res: &pb.GetResponse{Value: []byte("old"), Version: 1}},
+				&nodeClient{err: down},
+				&nodeClient{res: &pb.GetResponse{Value: []byte("new"), Version: 2}},
+			},
+			want: []byte("new"),
+		},
+		"stale node without versions": {
+			clients: []pb.CacheClient{
+				&nodeClient{res: &pb.GetResponse{Value: []byte("old")}},
+				&nodeClient{res: &pb.GetResponse{Value: []byte("new")}},
+				&nodeClient{res: &pb.GetResponse{Value: []byte("new")}},
+			},
+			want: []byte("new"),
+		},
+		"no agreement without versions": {
+			clients: []pb.CacheClient{
+				&nodeClient{res: &pb.GetResponse{Value: []byte("old")}},
+				&nodeClient{err: down},
+				&nodeClient{res: &pb.GetResponse{Value: []byte("new")}},
+			},
+			err: client.ErrNoQuorum,
+		},
+		"majority failed": {
+			clients: []pb.CacheClient{
+				&nodeClient{res: &pb.GetResponse{Value: []byte("new"), Version: 2}},
+				&nodeClient{err: down},
+				&nodeClient{err: down},
+			},
+			err:  client.ErrNoQuorum,
+			code: codes.Unavailable,
+		},
+		"missing on a minority": {
+			clients: []pb.CacheClient{
+				&nodeClient{res: &pb.GetResponse{Value: []byte("new"), Version: 2}},
+				&nodeClient{err: missing},
+				&nodeClient{res: &pb.GetResponse{Value: []byte("new"), Version: 2}},
+			},
+			want: []byte("new"),
+		},
+		"missing on a majority": {
+			clients: []pb.CacheClient{
+				&nodeClient{res: &pb.GetResponse{Value: []byte("old"), Version: 1}},
+				&nodeClient{err: missing},
+				&nodeClient{err: status.Error(codes.NotFound, "not found")},
+			},
+			code: codes.NotFound,
+		},
+		"missing and failed": {
+			clients: []pb.CacheClient{
+				&nodeClient{err: missing},
+				&nodeClient{err: down},
+				&nodeClient{err: missing},
+			},
+			code: codes.NotFound,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			res, err := client.GetQuorum(context.Background(), tc.clients, "key")
+			if tc.err != nil || tc.code != codes.OK {
+				if tc.err != nil {
+					require.ErrorIs(t, err, tc.err)
+				}
+				if tc.code != codes.OK {
+					require.Equal(t, tc.code, status.Code(err))
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, res.Value)
+		})
+	}
+}
@@ -7,12 +7,22 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/nireo/dcache/pb"
+	"github.com/nireo/dcache/server"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
 )
 
+// retryBackoff is the time waited before the first retry. It's doubled for every
+// following retry.
+const retryBackoff = 100 * time.Millisecond
+
 func main() {
 	// configuration flags.
 	addr := flag.String("addr", "localhost:9200", "Address for the gRPC server")
@@ -22,12 +32,32 @@ func main() {
 
 	// key is given as flag, but value is read from stdin.
 	key := flag.String("key", "", "Key for set operation.")
+
+	retries := flag.Int("retries", 5, "Number of times a failed set is retried.")
+
+	// large values compress well, the server responds with the same compressor.
+	compress := flag.Bool("gzip", false, "Compress requests and responses with gzip.")
+
+	maxReadLag := flag.Uint64("max-read-lag", 0,
+		"Don't read from followers trailing the leader by more log entries. Zero disables the check.")
 	flag.Parse()
 
-	conn, err := grpc.Dial(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	// the resolver finds the servers of the cluster through the given address, so
+	// writes are sent to the leader even if addr is a follower.
+	r := server.NewResolver(server.ResolverConfig{MaxReadLag: *maxReadLag})
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(r),
+	}
+	if *compress {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+	}
+
+	conn, err := grpc.Dial(fmt.Sprintf("%s:///%s", server.ResolverName, *addr), opts...)
 	if err != nil {
 		log.Fatalf("cannot dial addr: %s", err)
 	}
+	defer conn.Close()
 	client := pb.NewCacheClient(conn)
 
 	if *getServers {
@@ -52,13 +82,48 @@ func main() {
 		log.Fatalf("error reading stdin: %s", err)
 	}
 
-	_, err = client.Set(context.Background(), &pb.SetRequest{
+	err = setWithRetry(context.Background(), client, r, &pb.SetRequest{
 		Key:   *key,
 		Value: val,
-	})
+	}, *retries)
 	if err != nil {
 		log.Fatalf("failed setting value: %s", err)
 	}
 
 	log.Printf("set value successfully.")
 }
+
+// retryable reports whether a request that failed with err could succeed once the
+// leader has been resolved again.
+func retryable(err error) bool {
+	code := status.Code(err)
+	return code == codes.FailedPrecondition || code == codes.Unavailable
+}
+
+// setWithRetry sends req and retries it up to retries times if the leader has
+// changed or isn't available. The servers are resolved again before every retry.
+func setWithRetry(
+	ctx context.Context,
+	client pb.CacheClient,
+	r *server.Resolver,
+	req *pb.SetRequest,
+	retries int,
+) error {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		_, err := client.Set(ctx, req)
+		if err == nil || !retryable(err) || attempt >= retries {
+			return err
+		}
+
+		log.Printf("set failed, retrying in %s: %s", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+
+		r.ResolveNow(resolver.ResolveNowOptions{})
+	}
+}
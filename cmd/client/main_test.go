@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nireo/dcache/pb"
+	"github.com/nireo/dcache/server"
+	"github.com/nireo/dcache/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func getFreePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func setupCluster(t *testing.T, n int) []*service.Service {
+	var services []*service.Service
+	for i := 0; i < n; i++ {
+		datadir, err := os.MkdirTemp("", "client-test")
+		require.NoError(t, err)
+
+		var join []string
+		if i != 0 {
+			join = append(join, services[0].Config.BindAddr)
+		}
+
+		serv, err := service.New(service.Config{
+			NodeName:       fmt.Sprintf("%d", i),
+			Bootstrap:      i == 0,
+			StartJoinAddrs: join,
+			BindAddr:       fmt.Sprintf("127.0.0.1:%d", getFreePort(t)),
+			DataDir:        datadir,
+			RPCPort:        getFreePort(t),
+			EnableGRPC:     true,
+		})
+		require.NoError(t, err)
+		services = append(services, serv)
+	}
+
+	t.Cleanup(func() {
+		for _, s := range services {
+			s.Close()
+			os.RemoveAll(s.Config.DataDir)
+		}
+	})
+	return services
+}
+
+func dial(t *testing.T, target string, opts ...grpc.DialOption) pb.CacheClient {
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.Dial(target, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewCacheClient(conn)
+}
+
+// flakyClient fails the first failures Sets with err before sending them on.
+type flakyClient struct {
+	pb.CacheClient
+	failures int
+	err      error
+	calls    int
+}
+
+func (c *flakyClient) Set(
+	ctx context.Context, req *pb.SetRequest, opts ...grpc.CallOption,
+) (*pb.SetResponse, error) {
+	c.calls++
+	if c.calls <= c.failures {
+		return nil, c.err
+	}
+	return c.CacheClient.Set(ctx, req, opts...)
+}
+
+func TestSetWithRetryThroughFollower(t *testing.T) {
+	services := setupCluster(t, 2)
+	followerAddr, err := services[1].Config.RPCAddr()
+	require.NoError(t, err)
+
+	// wait until the follower knows about the leader.
+	follower := dial(t, followerAddr)
+	require.Eventually(t, func() bool {
+		res, err := follower.GetServers(context.Background(), &pb.Empty{})
+		if err != nil || len(res.Server) != 2 {
+			return false
+		}
+		for _, srv := range res.Server {
+			if srv.IsLeader {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// writing to the follower directly fails with an error worth retrying.
+	_, err = follower.Set(context.Background(), &pb.SetRequest{Key: "key", Value: []byte("value")})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.True(t, retryable(err))
+
+	r := &server.Resolver{}
+	client := dial(t, fmt.Sprintf("%s:///%s", server.ResolverName, followerAddr), grpc.WithResolvers(r))
+
+	// the first attempt fails like a write sent to a node that's no longer the
+	// leader, so the write only succeeds if it's retried.
+	flaky := &flakyClient{
+		CacheClient: client,
+		failures:    1,
+		err:         status.Error(codes.FailedPrecondition, "node is not the leader"),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, setWithRetry(ctx, flaky, r, &pb.SetRequest{
+		Key:   "key",
+		Value: []byte("value"),
+	}, 3))
+	require.Equal(t, 2, flaky.calls)
+
+	leaderAddr, err := services[0].Config.RPCAddr()
+	require.NoError(t, err)
+	res, err := dial(t, leaderAddr).Get(context.Background(), &pb.GetRequest{Key: "key"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), res.Value)
+
+	// other errors aren't retried.
+	flaky = &flakyClient{
+		CacheClient: client,
+		failures:    1,
+		err:         status.Error(codes.InvalidArgument, "invalid key"),
+	}
+	err = setWithRetry(ctx, flaky, r, &pb.SetRequest{Key: "key"}, 3)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Equal(t, 1, flaky.calls)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"os"
+
+	"github.com/nireo/dcache/pb"
+	"github.com/nireo/dcache/store"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd returns a command that writes every key-value pair of a running node
+// into a file. The file uses the same format as warmup files, so it can also be
+// used as one. Only the keys and values are exported: the versions are indices
+// of the log of the cluster, and the TTLs aren't returned by Scan.
+func exportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write every key-value pair of a running node into a file, without versions or TTLs.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			addr, err := cmd.Flags().GetString("addr")
+			if err != nil {
+				return err
+			}
+
+			out, err := cmd.Flags().GetString("out")
+			if err != nil {
+				return err
+			}
+
+			client, conn, err := dialNode(addr)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			f, err := os.Create(out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			count, err := exportEntries(context.Background(), client, f)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("exported %d entries from %s", count, addr)
+			return f.Close()
+		},
+	}
+	cmd.Flags().String("addr", "localhost:9200", "gRPC address of the node.")
+	cmd.Flags().String("out", "dcache.export", "Path of the file to write the entries into.")
+	return cmd
+}
+
+// importCmd returns a command that sets every key-value pair in a file written by
+// the export command. The address should point to the leader of the cluster. The
+// keys get new versions and are set without a TTL.
+func importCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Set every key-value pair of an exported file into the cluster, without TTLs.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			addr, err := cmd.Flags().GetString("addr")
+			if err != nil {
+				return err
+			}
+
+			in, err := cmd.Flags().GetString("in")
+			if err != nil {
+				return err
+			}
+
+			client, conn, err := dialNode(addr)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			f, err := os.Open(in)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			count, err := importEntries(context.Background(), client, f)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("imported %d entries into %s", count, addr)
+			return nil
+		},
+	}
+	cmd.Flags().String("addr", "localhost:9200", "gRPC address of the leader.")
+	cmd.Flags().String("in", "dcache.export", "Path of the exported file.")
+	return cmd
+}
+
+// exportEntries scans every key-value pair of the node and writes them into w.
+// Returns the number of entries written.
+func exportEntries(ctx context.Context, client pb.CacheClient, w io.Writer) (int, error) {
+	stream, err := client.Scan(ctx, &pb.ScanRequest{})
+	if err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	count := 0
+	for {
+		entry, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if err := store.WriteWarmupEntry(bw, entry.Key, entry.Value); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, bw.Flush()
+}
+
+// importEntries sets every entry read from r. Returns the number of entries set.
+func importEntries(ctx context.Context, client pb.CacheClient, r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	count := 0
+	for {
+		key, value, err := store.ReadWarmupEntry(br)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if _, err := client.Set(ctx, &pb.SetRequest{Key: key, Value: value}); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nireo/dcache/pb"
+	"github.com/nireo/dcache/service"
+	"github.com/stretchr/testify/require"
+)
+
+func getFreePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func setupNode(t *testing.T, name string) pb.CacheClient {
+	datadir, err := os.MkdirTemp("", "backup-test")
+	require.NoError(t, err)
+
+	serv, err := service.New(service.Config{
+		NodeName:   name,
+		Bootstrap:  true,
+		BindAddr:   fmt.Sprintf("127.0.0.1:%d", getFreePort(t)),
+		DataDir:    datadir,
+		RPCPort:    getFreePort(t),
+		EnableGRPC: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		serv.Close()
+		os.RemoveAll(datadir)
+	})
+
+	addr, err := serv.Config.RPCAddr()
+	require.NoError(t, err)
+	client, conn, err := dialNode(addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	// wait for the node to elect itself as the leader.
+	require.Eventually(t, func() bool {
+		_, err := client.Set(context.Background(), &pb.SetRequest{Key: "ready", Value: []byte("ok")})
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	return client
+}
+
+func TestExportImport(t *testing.T) {
+	src := setupNode(t, "src")
+	ctx := context.Background()
+
+	want := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		value := []byte(fmt.Sprintf("value-%d", i))
+		_, err := src.Set(ctx, &pb.SetRequest{Key: key, Value: value})
+		require.NoError(t, err)
+		want[key] = value
+	}
+	want["ready"] = []byte("ok")
+
+	var buf bytes.Buffer
+	count, err := exportEntries(ctx, src, &buf)
+	require.NoError(t, err)
+	require.Equal(t, len(want), count)
+
+	dst := setupNode(t, "dst")
+	count, err = importEntries(ctx, dst, &buf)
+	require.NoError(t, err)
+	require.Equal(t, len(want), count)
+
+	got := make(map[string][]byte)
+	for key := range want {
+		res, err := dst.Get(ctx, &pb.GetRequest{Key: key})
+		require.NoError(t, err)
+		got[key] = res.Value
+	}
+	require.Equal(t, want, got)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// redacted replaces the values of secret settings in the config dump.
+const redacted = "<redacted>"
+
+// configCmd returns a command that prints the configuration a node started with the
+// same flags and config file would use.
+func configCmd() (*cobra.Command, error) {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Print the effective configuration after merging flags, the config file and defaults.",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return loadConf(cmd)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return dumpConfig(cmd.OutOrStdout())
+		},
+	}
+
+	if err := parseFlags(cmd); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// dumpConfig writes every setting as a "key: value" line sorted by key. Secrets are
+// redacted, so the output can be shared.
+func dumpConfig(w io.Writer) error {
+	keys := viper.AllKeys()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := fmt.Sprint(viper.Get(key))
+		if isSecret(key) && value != "" {
+			value = redacted
+		}
+
+		if _, err := fmt.Fprintf(w, "%s: %s\n", key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSecret reports whether the setting contains secret material, such as the path
+// to a private key.
+func isSecret(key string) bool {
+	return strings.HasSuffix(key, "key-file") || strings.Contains(key, "encrypt")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigDump(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	dir := t.TempDir()
+	confFile := filepath.Join(dir, "dcache.yaml")
+	require.NoError(t, os.WriteFile(confFile, []byte("log-level: debug\n"), 0600))
+
+	cmd, err := configCmd()
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{
+		"--conf", confFile,
+		"--rpc-port", "9999",
+		"--server-tls-key-file", "/secret/server-key.pem",
+	})
+	require.NoError(t, cmd.Execute())
+
+	dump := out.String()
+	require.Contains(t, dump, "rpc-port: 9999\n")
+	require.Contains(t, dump, "log-level: debug\n")
+	require.Contains(t, dump, "http-max-body-size: 4194304\n")
+	require.Contains(t, dump, "server-tls-key-file: <redacted>\n")
+	require.Contains(t, dump, "peer-tls-key-file: \n")
+	require.NotContains(t, dump, "/secret/server-key.pem")
+}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
+	"github.com/nireo/dcache/pb"
 	"github.com/nireo/dcache/security"
+	"github.com/nireo/dcache/server"
 	"github.com/nireo/dcache/service"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 type config struct {
@@ -31,6 +41,14 @@ func main() {
 		log.Fatalf("error parsing flags: %s", err)
 	}
 
+	confCmd, err := configCmd()
+	if err != nil {
+		log.Fatalf("error parsing flags: %s", err)
+	}
+	cmd.AddCommand(
+		compactCmd(), checksumCmd(), membersCmd(), exportCmd(), importCmd(), recoverCmd(), confCmd,
+	)
+
 	if err := cmd.Execute(); err != nil {
 		log.Fatalf("error running service: %s", err)
 	}
@@ -44,6 +62,11 @@ func parseFlags(cmd *cobra.Command) error {
 			"Whether to keep even raft logs in memory. Improves performance but makes system less tolerant to failures.",
 		)
 
+	cmd.Flags().String("fastlog-level", "medium",
+		"Durability of the raft log on disk: low, medium or high. Lower levels sync less often. Only used without --in-memory.")
+	cmd.Flags().Bool("recover-corrupt-log", false,
+		"Move a corrupt raft log aside and catch up from the leader instead of failing. Only used without --in-memory.")
+
 	hostname, err := os.Hostname()
 	if err != nil {
 		return err
@@ -52,32 +75,121 @@ func parseFlags(cmd *cobra.Command) error {
 		String("data-dir", filepath.Join(os.TempDir(), "dcache"), "Where to store raft logs.")
 	cmd.Flags().String("id", hostname, "Identifier on the cluster.")
 	cmd.Flags().Int("rpc-port", 9200, "Port for gRPC clients and Raft connections.")
+	cmd.Flags().Int("raft-port", 0,
+		"Separate port for Raft connections. Zero shares the rpc port with gRPC and HTTP.")
 	cmd.Flags().
 		StringSlice("join", nil, "Existing addresses in the cluster where you want this node to attempt connection")
-	cmd.Flags().Bool("bootstrap", false, "Whether this node should bootstrap the cluster.")
+	cmd.Flags().Bool("retry-join", false,
+		"Keep trying to join in the background if none of the join addresses can be reached.")
+	cmd.Flags().Duration("reap-timeout", 0,
+		"Remove nodes that have been failed for this long from the cluster. Zero keeps failed nodes.")
+	cmd.Flags().Bool("read-replica", false,
+		"Join as a read replica, which serves reads but never becomes a voter.")
+	cmd.Flags().Int("event-buffer-size", 0,
+		"Number of membership events that can wait to be handled before they're dropped. Zero uses the default.")
+	cmd.Flags().Bool("bootstrap", false, "Whether this node should bootstrap the cluster. Cannot be used with --join.")
+	cmd.Flags().Int("bootstrap-expect",
+		0,
+		"Bootstrap the cluster once this many nodes have been discovered.")
+	cmd.Flags().Int("max-voters", 0,
+		"Maximum number of voters, nodes joining after that are non-voters. Zero means no limit.")
+	cmd.Flags().Int("max-inflight-applies", 0,
+		"Maximum number of writes waiting to be applied, writes over it are rejected. Zero means no limit.")
+	cmd.Flags().Int("max-upload-size", 0,
+		"Maximum size in bytes of a value streamed with SetStream. Zero means no limit.")
+	cmd.Flags().Duration("apply-batch-window", 0,
+		"Apply the writes received within this window as a single log entry. Zero disables batching.")
+	cmd.Flags().String("encryption-key-file", "",
+		"File with a 16, 24 or 32 byte key for encrypting the cached values with AES-GCM.")
+	cmd.Flags().String("cache-backend", "bigcache",
+		"Local cache: bigcache evicts the oldest entries first, lru the least recently used.")
+	cmd.Flags().Int("max-cache-entries", 100000, "Maximum number of entries in the lru cache.")
+	cmd.Flags().String("warmup-file", "",
+		"File of exported entries loaded into the local cache on startup. The entries aren't replicated.")
+	cmd.Flags().Duration("cache-clean-window", 0,
+		"How often bigcache removes entries that have outlived their life window. Zero uses the bigcache default.")
+	cmd.Flags().Bool("cache-stats", false, "Report the hits, misses and collisions of bigcache in the Stats RPC.")
+	cmd.Flags().Duration("snapshot-interval", 0,
+		"How often the leader takes a snapshot. Zero leaves snapshots to raft.")
+	cmd.Flags().Int("retain-snapshots", 0,
+		"Number of snapshots kept on disk. Zero uses the default of 2.")
+	cmd.Flags().Int("snapshot-key-delta", 0,
+		"Take a snapshot once this many keys have been added since the last one. Zero disables it.")
+	cmd.Flags().Duration("ttl-sweep-interval", 0,
+		"How often the leader deletes expired keys. Zero only hides them from reads.")
+	cmd.Flags().Bool("strong-consistency", false,
+		"Read through the leader unless the client asks for eventual consistency.")
+	cmd.Flags().Bool("linearizable-reads", false,
+		"Read through the leader using a read barrier instead of the raft log.")
+	cmd.Flags().Bool("barrier-reads", false,
+		"Read through the leader after a raft barrier instead of the raft log.")
+	cmd.Flags().Bool("stale-on-leader-failure", false,
+		"Serve reads from the local cache when no leader can be reached, instead of failing.")
+	cmd.Flags().Bool("track-hot-keys", false, "Estimate read counts of keys for the HotKeys RPC.")
 	cmd.Flags().String("addr", "127.0.0.1:9000", "Address where serf is binded.")
+	cmd.Flags().String("advertise-addr", "",
+		"Address advertised to other nodes, if it differs from addr. The rpc port is advertised on the same host.")
+	cmd.Flags().String("gossip-profile", "lan",
+		"Gossip timings for the network: lan, wan for geo-distributed clusters, or local.")
 	cmd.Flags().Bool("http", false, "Enable HTTP server for client communication")
+	cmd.Flags().Int("http-max-body-size", 4*1024*1024,
+		"Maximum size of a HTTP request body in bytes.")
 	cmd.Flags().Bool("grpc", false, "Enable gRPC server for client communication")
+	cmd.Flags().Bool("grpc-reflection", false, "Enable gRPC reflection for debugging tools.")
+	cmd.Flags().Bool("forward-writes", false, "Forward writes received by followers to the leader.")
+	cmd.Flags().Bool("stepdown-on-shutdown", false,
+		"Transfer the leadership to another node before shutting down the leader.")
+	cmd.Flags().Bool("allow-address-change", false,
+		"Let a node rejoin with the same id but a different address, replacing the old one.")
+	cmd.Flags().Bool("grpc-compression", false, "Compress gRPC requests sent to other nodes with gzip.")
+	cmd.Flags().Uint32("grpc-max-streams", server.DefaultMaxConcurrentStreams,
+		"Maximum concurrent streams of a gRPC client connection.")
+	cmd.Flags().Duration("servers-cache-ttl", 0,
+		"How long GetServers responses are cached unless the cluster changes. Zero disables caching.")
+	cmd.Flags().String("log-level", "info", "Minimum log level: debug, info, warn or error.")
+	cmd.Flags().String("log-format", "json", "Format of the logs: json or console.")
+	cmd.Flags().Int("log-sampling-initial", 0,
+		"Request logs with the same message written every second before sampling. Zero logs every request.")
+	cmd.Flags().Int("log-sampling-thereafter", 100,
+		"After the initial request logs, only every this many are written in the same second.")
+	cmd.Flags().String("metrics-addr", "",
+		"Address serving Prometheus metrics and pprof profiles. Disabled if empty.")
+	cmd.Flags().Bool("tracing", false, "Export OpenTelemetry traces of requests.")
+	cmd.Flags().String("tracing-endpoint", "localhost:4317", "Address of the OTLP gRPC trace collector.")
 
 	cmd.Flags().String("server-tls-cert-file", "", "Path to server tls cert.")
 	cmd.Flags().String("server-tls-key-file", "", "Path to server tls key.")
 	cmd.Flags().String("server-tls-ca-file",
 		"",
 		"Path to server certificate authority.")
+	cmd.Flags().Bool("server-tls-require-client-cert",
+		true,
+		"Require clients to present a certificate signed by the server CA.")
+
+	cmd.Flags().String("tls-min-version", "1.2", "Minimum accepted TLS version.")
+	cmd.Flags().StringSlice("tls-cipher-suites",
+		nil,
+		"Allowed TLS 1.2 cipher suites. Defaults to Go's secure cipher suites.")
 
 	cmd.Flags().String("peer-tls-cert-file", "", "Path to peer tls cert.")
 	cmd.Flags().String("peer-tls-key-file", "", "Path to peer tls key.")
 	cmd.Flags().String("peer-tls-ca-file",
 		"",
 		"Path to peer certificate authority.")
+	cmd.Flags().String("peer-tls-server-name",
+		"",
+		"Server name to verify peer certificates against.")
+	return nil
+}
 
+// loadConf binds the flags of cmd and reads the config file. The flags are bound
+// here instead of parseFlags, since both the root and config commands define them
+// and only the flags of the executed command should be used.
+func loadConf(cmd *cobra.Command) error {
 	if err := viper.BindPFlags(cmd.Flags()); err != nil {
 		return err
 	}
-	return nil
-}
 
-func (c *config) setupConf(cmd *cobra.Command, args []string) error {
 	// try overriding flag values with values from a config file. However this config might not
 	// exist. We need to check if the config file is valid; if not just use the flag values.
 	confFile, err := cmd.Flags().GetString("conf")
@@ -93,48 +205,147 @@ func (c *config) setupConf(cmd *cobra.Command, args []string) error {
 			return err
 		}
 	}
+	return nil
+}
+
+func (c *config) setupConf(cmd *cobra.Command, args []string) error {
+	if err := loadConf(cmd); err != nil {
+		return err
+	}
 
 	c.DataDir = viper.GetString("data-dir")
+	c.PersistLog = !viper.GetBool("in-memory")
+	c.FastlogLevel = viper.GetString("fastlog-level")
+	c.RecoverFromCorruption = viper.GetBool("recover-corrupt-log")
 	c.BindAddr = viper.GetString("addr")
+	c.AdvertiseAddr = viper.GetString("advertise-addr")
+	c.GossipProfile = viper.GetString("gossip-profile")
 	c.RPCPort = viper.GetInt("rpc-port")
+	c.SeparateRaftPort = viper.GetInt("raft-port")
 	c.Bootstrap = viper.GetBool("bootstrap")
+	c.RetryJoin = viper.GetBool("retry-join")
+	c.ReapTimeout = viper.GetDuration("reap-timeout")
+	c.ReadReplica = viper.GetBool("read-replica")
+	c.EventBufferSize = viper.GetInt("event-buffer-size")
+	c.ExpectedNodes = viper.GetInt("bootstrap-expect")
+	c.MaxVoters = viper.GetInt("max-voters")
+	c.StrongConsistency = viper.GetBool("strong-consistency")
+	c.LinearizableReads = viper.GetBool("linearizable-reads")
+	c.BarrierReads = viper.GetBool("barrier-reads")
+	c.StaleOnLeaderFailure = viper.GetBool("stale-on-leader-failure")
+	c.TrackHotKeys = viper.GetBool("track-hot-keys")
+	c.SnapshotInterval = viper.GetDuration("snapshot-interval")
+	c.RetainSnapshots = viper.GetInt("retain-snapshots")
+	c.SnapshotKeyDelta = viper.GetInt("snapshot-key-delta")
+	c.TTLSweepInterval = viper.GetDuration("ttl-sweep-interval")
+	c.CacheBackend = viper.GetString("cache-backend")
+	c.CacheCleanWindow = viper.GetDuration("cache-clean-window")
+	c.CacheStats = viper.GetBool("cache-stats")
+	c.MaxCacheEntries = viper.GetInt("max-cache-entries")
+	c.WarmupFile = viper.GetString("warmup-file")
+	c.MaxInflightApplies = viper.GetInt("max-inflight-applies")
+	c.MaxUploadSize = viper.GetInt("max-upload-size")
+	c.ApplyBatchWindow = viper.GetDuration("apply-batch-window")
 	c.StartJoinAddrs = viper.GetStringSlice("join")
 	c.EnableHTTP = viper.GetBool("http")
 	c.NodeName = viper.GetString("id")
 	c.EnableGRPC = viper.GetBool("grpc")
 	c.EnableHTTP = viper.GetBool("http")
+	c.LogLevel = viper.GetString("log-level")
+	c.LogFormat = viper.GetString("log-format")
+	if initial := viper.GetInt("log-sampling-initial"); initial > 0 {
+		c.LogSampling = &zap.SamplingConfig{
+			Initial:    initial,
+			Thereafter: viper.GetInt("log-sampling-thereafter"),
+		}
+	}
+	c.MetricsAddr = viper.GetString("metrics-addr")
+	c.EnableTracing = viper.GetBool("tracing")
+	c.TracingEndpoint = viper.GetString("tracing-endpoint")
+	c.EnableReflection = viper.GetBool("grpc-reflection")
+	c.ForwardWrites = viper.GetBool("forward-writes")
+	c.AllowAddressChange = viper.GetBool("allow-address-change")
+	c.StepdownOnShutdown = viper.GetBool("stepdown-on-shutdown")
+	c.EnableGRPCCompression = viper.GetBool("grpc-compression")
+	c.MaxConcurrentStreams = viper.GetUint32("grpc-max-streams")
+	c.ServersCacheTTL = viper.GetDuration("servers-cache-ttl")
+	c.HTTPMaxBodySize = viper.GetInt("http-max-body-size")
 	c.serverconf.CertFile = viper.GetString("server-tls-cert-file")
 	c.serverconf.KeyFile = viper.GetString("server-tls-key-file")
 	c.serverconf.CAFile = viper.GetString("server-tls-ca-file")
+	c.serverconf.RequireClientCert = viper.GetBool("server-tls-require-client-cert")
 	c.peerconf.CertFile = viper.GetString("peer-tls-cert-file")
 	c.peerconf.KeyFile = viper.GetString("peer-tls-key-file")
 	c.peerconf.CAFile = viper.GetString("peer-tls-ca-file")
+	c.peerconf.ServerAddr = viper.GetString("peer-tls-server-name")
 
+	minVersion, err := security.ParseTLSVersion(viper.GetString("tls-min-version"))
+	if err != nil {
+		return err
+	}
+
+	cipherSuites, err := security.ParseCipherSuites(viper.GetStringSlice("tls-cipher-suites"))
+	if err != nil {
+		return err
+	}
+
+	c.serverconf.MinVersion = minVersion
+	c.serverconf.CipherSuites = cipherSuites
+	c.peerconf.MinVersion = minVersion
+	c.peerconf.CipherSuites = cipherSuites
+
+	if path := viper.GetString("encryption-key-file"); path != "" {
+		c.EncryptionKey, err = readEncryptionKey(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the certificates are reloaded when the files change, so they can be rotated
+	// without restarting the node.
 	if c.serverconf.CertFile != "" &&
 		c.serverconf.KeyFile != "" {
 		c.serverconf.IsServer = true
-		c.ServerTLS, err = security.MakeTLSConfig(
-			c.serverconf,
-		)
+		serverTLS, err := security.NewReloadableTLS(c.serverconf)
 		if err != nil {
 			return err
 		}
+		c.ServerTLS = serverTLS.Config()
 	}
 
 	if c.peerconf.CertFile != "" &&
 		c.peerconf.KeyFile != "" {
-		c.PeerTLS, err = security.MakeTLSConfig(
-			c.peerconf,
-		)
+		peerTLS, err := security.NewReloadableTLS(c.peerconf)
 		if err != nil {
 			return err
 		}
+		c.PeerTLS = peerTLS.Config()
 	}
 
 	return nil
 }
 
+// readEncryptionKey reads the key from path. Surrounding whitespace is trimmed,
+// since key files usually end with a newline that would change the key length.
+func readEncryptionKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(key), nil
+}
+
 func (c *config) runService(cmd *cobra.Command, args []string) error {
+	// build the logger here, so that it can also replace the global logger used
+	// by components that aren't given a logger.
+	logger, err := service.NewLogger(c.LogLevel, c.LogFormat)
+	if err != nil {
+		return err
+	}
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+	c.Logger = logger
+
 	serv, err := service.New(c.Config)
 	if err != nil {
 		return err
@@ -145,3 +356,109 @@ func (c *config) runService(cmd *cobra.Command, args []string) error {
 	<-sigChan
 	return serv.Close()
 }
+
+// dialNode creates a gRPC client for the node listening on addr.
+func dialNode(addr string) (pb.CacheClient, *grpc.ClientConn, error) {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return pb.NewCacheClient(conn), conn, nil
+}
+
+// compactCmd returns a command that makes a running node take a snapshot. Raft then
+// compacts the log up to the snapshot and older snapshots are pruned.
+func compactCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "compact",
+		Short: "Take a snapshot on a running node to compact its raft log.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			addr, err := cmd.Flags().GetString("addr")
+			if err != nil {
+				return err
+			}
+
+			client, conn, err := dialNode(addr)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			res, err := client.ForceSnapshot(ctx, &pb.Empty{})
+			if err != nil {
+				return err
+			}
+
+			log.Printf(
+				"snapshot taken on %s: %s (%d bytes, took %s)",
+				addr, res.Path, res.Size, time.Duration(res.Duration),
+			)
+			return nil
+		},
+	}
+	cmd.Flags().String("addr", "localhost:9200", "gRPC address of the node.")
+	return cmd
+}
+
+// errChecksumMismatch is returned by the checksum command when the nodes don't have
+// the same data.
+var errChecksumMismatch = errors.New("checksums differ between nodes")
+
+// checksumCmd returns a command that compares the checksums of the given nodes to
+// detect nodes whose caches have diverged.
+func checksumCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "checksum",
+		Short: "Compare the checksums of the data on nodes to detect divergence.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			addrs, err := cmd.Flags().GetStringSlice("addrs")
+			if err != nil {
+				return err
+			}
+			prefix, err := cmd.Flags().GetString("prefix")
+			if err != nil {
+				return err
+			}
+
+			var first []byte
+			mismatch := false
+			for i, addr := range addrs {
+				res, err := nodeChecksum(addr, prefix)
+				if err != nil {
+					return fmt.Errorf("checksum of %s: %w", addr, err)
+				}
+				log.Printf("%s: %x (%d keys)", addr, res.Hash, res.Count)
+
+				if i == 0 {
+					first = res.Hash
+				} else if !bytes.Equal(first, res.Hash) {
+					mismatch = true
+				}
+			}
+
+			if mismatch {
+				return errChecksumMismatch
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringSlice("addrs", []string{"localhost:9200"}, "gRPC addresses of the nodes.")
+	cmd.Flags().String("prefix", "", "Only compare keys starting with the prefix.")
+	return cmd
+}
+
+// nodeChecksum requests the checksum of the keys under prefix from the node at addr.
+func nodeChecksum(addr, prefix string) (*pb.ChecksumResponse, error) {
+	client, conn, err := dialNode(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return client.Checksum(ctx, &pb.ChecksumRequest{Prefix: prefix})
+}
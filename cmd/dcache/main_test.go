@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestReadEncryptionKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(path, []byte("0123456789abcdef\n"), 0o600))
+
+	key, err := readEncryptionKey(path)
+	require.NoError(t, err)
+	require.Equal(t, []byte("0123456789abcdef"), key)
+
+	_, err = readEncryptionKey(filepath.Join(t.TempDir(), "missing"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLogSamplingFlags(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	parse := func(args ...string) *config {
+		cmd := &cobra.Command{}
+		require.NoError(t, parseFlags(cmd))
+		require.NoError(t, cmd.ParseFlags(args))
+
+		c := &config{}
+		require.NoError(t, c.setupConf(cmd, nil))
+		return c
+	}
+
+	require.Nil(t, parse().LogSampling)
+	require.Equal(t,
+		&zap.SamplingConfig{Initial: 5, Thereafter: 50},
+		parse("--log-sampling-initial=5", "--log-sampling-thereafter=50").LogSampling,
+	)
+}
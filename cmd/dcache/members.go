@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nireo/dcache/pb"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// membersCmd returns a command that prints the servers of the cluster as a table.
+// The raft configuration of the node is combined with its serf membership, so the
+// table shows both the voting status and whether the node is alive.
+func membersCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "members",
+		Short: "Print a table of the cluster members as seen by a running node.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			addr, err := cmd.Flags().GetString("addr")
+			if err != nil {
+				return err
+			}
+
+			client, conn, err := dialNode(addr)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			servers, err := client.GetServers(ctx, &pb.Empty{})
+			if err != nil {
+				return err
+			}
+
+			// nodes without a membership registry still have a raft view to show.
+			var members []*pb.Member
+			res, err := client.Members(ctx, &pb.Empty{})
+			if err == nil {
+				members = res.Members
+			} else if status.Code(err) != codes.Unimplemented {
+				return err
+			}
+
+			return writeMembers(os.Stdout, servers.Server, members)
+		},
+	}
+	cmd.Flags().String("addr", "localhost:9200", "gRPC address of the node.")
+	return cmd
+}
+
+// writeMembers writes a table of the raft servers and serf members into w. The
+// leader is marked with an asterisk. Serf members that aren't part of the raft
+// configuration are listed last and dashes are written for the missing columns.
+func writeMembers(w io.Writer, servers []*pb.Server, members []*pb.Member) error {
+	serfStatus := make(map[string]string, len(members))
+	for _, m := range members {
+		serfStatus[m.Name] = m.Status
+	}
+
+	servers = append([]*pb.Server(nil), servers...)
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Id < servers[j].Id
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tRPC ADDR\tLEADER\tVOTER\tSERF")
+
+	inRaft := make(map[string]bool, len(servers))
+	for _, srv := range servers {
+		inRaft[srv.Id] = true
+
+		leader := ""
+		if srv.IsLeader {
+			leader = "*"
+		}
+
+		serf, ok := serfStatus[srv.Id]
+		if !ok {
+			serf = "-"
+		}
+		voter := srv.VoteStatus
+		if srv.ReadReplica {
+			voter = "ReadReplica"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", srv.Id, srv.RpcAddr, leader, voter, serf)
+	}
+
+	members = append([]*pb.Member(nil), members...)
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	for _, m := range members {
+		if inRaft[m.Name] {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t-\t\t-\t%s\n", m.Name, m.Status)
+	}
+
+	return tw.Flush()
+}
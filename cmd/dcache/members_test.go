@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/nireo/dcache/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteMembers(t *testing.T) {
+	servers := []*pb.Server{
+		{Id: "node-2", RpcAddr: "10.0.0.2:9200", VoteStatus: "Voter"},
+		{Id: "node-1", RpcAddr: "10.0.0.1:9200", IsLeader: true, VoteStatus: "Voter"},
+		{Id: "node-3", RpcAddr: "10.0.0.3:9200", VoteStatus: "Nonvoter"},
+	}
+	members := []*pb.Member{
+		{Name: "node-4", Status: "alive"},
+		{Name: "node-3", Status: "failed"},
+		{Name: "node-1", Status: "alive"},
+		{Name: "node-2", Status: "alive"},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, writeMembers(&buf, servers, members))
+
+	want := `ID      RPC ADDR       LEADER  VOTER     SERF
+node-1  10.0.0.1:9200  *       Voter     alive
+node-2  10.0.0.2:9200          Voter     alive
+node-3  10.0.0.3:9200          Nonvoter  failed
+node-4  -                      -         alive
+`
+	require.Equal(t, want, buf.String())
+}
+
+func TestMembersTable(t *testing.T) {
+	client := setupNode(t, "members")
+
+	servers, err := client.GetServers(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	res, err := client.Members(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, writeMembers(&buf, servers.Server, res.Members))
+	require.Contains(t, buf.String(), "members")
+	require.Contains(t, buf.String(), "*")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/raft"
+	"github.com/nireo/dcache/store"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// errNoPeers is returned by the recover command when --peers is empty.
+var errNoPeers = errors.New("at least one peer is needed to recover the cluster")
+
+// recoverCmd returns a command that replaces the cluster configuration of a
+// stopped node, for when a majority of the cluster has been lost for good. Usually
+// the node is recovered as a single-node cluster and the other nodes join it again.
+func recoverCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "recover",
+		Short: "Replace the cluster configuration of a stopped node after losing quorum.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dataDir, err := cmd.Flags().GetString("data-dir")
+			if err != nil {
+				return err
+			}
+
+			id, err := cmd.Flags().GetString("id")
+			if err != nil {
+				return err
+			}
+
+			peers, err := cmd.Flags().GetStringSlice("peers")
+			if err != nil {
+				return err
+			}
+
+			inMemory, err := cmd.Flags().GetBool("in-memory")
+			if err != nil {
+				return err
+			}
+
+			configuration, err := parsePeers(peers)
+			if err != nil {
+				return err
+			}
+
+			err = store.RecoverCluster(store.Config{
+				DataDir:    dataDir,
+				LocalID:    raft.ServerID(id),
+				PersistLog: !inMemory,
+				Logger:     zap.NewNop(),
+			}, configuration)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("recovered %s with %d servers", id, len(configuration.Servers))
+			return nil
+		},
+	}
+
+	// the defaults match the main command, so a node is recovered with the same
+	// flags it was started with.
+	hostname, _ := os.Hostname()
+	cmd.Flags().String("data-dir", filepath.Join(os.TempDir(), "dcache"),
+		"Data directory of the node, its raft state is in the raft subdirectory.")
+	cmd.Flags().String("id", hostname, "Identifier of the node on the cluster.")
+	cmd.Flags().StringSlice("peers", nil,
+		"Servers of the new configuration as id=raft-address pairs, usually only this node.")
+	cmd.Flags().Bool("in-memory", true,
+		"Whether the node keeps its raft log in memory. Only the latest snapshot is recovered if it does.")
+	return cmd
+}
+
+// parsePeers parses id=address pairs into a raft configuration of voters. The
+// servers are sorted by id, so every node recovered with the same peers gets the
+// same configuration.
+func parsePeers(peers []string) (raft.Configuration, error) {
+	if len(peers) == 0 {
+		return raft.Configuration{}, errNoPeers
+	}
+
+	sort.Strings(peers)
+	conf := raft.Configuration{}
+	seen := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		id, addr, ok := strings.Cut(peer, "=")
+		if !ok || id == "" || addr == "" {
+			return raft.Configuration{}, fmt.Errorf("malformed peer %q, expected id=address", peer)
+		}
+		if seen[id] {
+			return raft.Configuration{}, fmt.Errorf("duplicate peer id %q", id)
+		}
+		seen[id] = true
+
+		conf.Servers = append(conf.Servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(id),
+			Address:  raft.ServerAddress(addr),
+		})
+	}
+	return conf, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePeers(t *testing.T) {
+	conf, err := parsePeers([]string{"node-2=10.0.0.2:9200", "node-1=10.0.0.1:9200"})
+	require.NoError(t, err)
+	require.Equal(t, []raft.Server{
+		{Suffrage: raft.Voter, ID: "node-1", Address: "10.0.0.1:9200"},
+		{Suffrage: raft.Voter, ID: "node-2", Address: "10.0.0.2:9200"},
+	}, conf.Servers)
+
+	_, err = parsePeers(nil)
+	require.ErrorIs(t, err, errNoPeers)
+
+	_, err = parsePeers([]string{"node-1"})
+	require.Error(t, err)
+
+	_, err = parsePeers([]string{"node-1=a:1", "node-1=b:1"})
+	require.Error(t, err)
+}
+
+func TestRecoverDefaultsMatchMain(t *testing.T) {
+	root := &cobra.Command{}
+	require.NoError(t, parseFlags(root))
+	rec := recoverCmd()
+
+	for _, name := range []string{"data-dir", "in-memory", "id"} {
+		require.Equal(t,
+			root.Flags().Lookup(name).DefValue,
+			rec.Flags().Lookup(name).DefValue,
+			name,
+		)
+	}
+}
@@ -3,37 +3,184 @@ package http
 // http.go - A very simple HTTP interface to interact with the store.
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+
+	"github.com/allegro/bigcache/v3"
+	"github.com/hashicorp/raft"
 	"github.com/nireo/dcache/store"
 	"github.com/valyala/fasthttp"
 )
 
+// Store represents the store operations that the HTTP interface needs. In actual
+// use the store.Store is passed here.
+type Store interface {
+	Set(key string, value []byte) error
+	Get(key string) ([]byte, error)
+}
+
+// LeaderLocator is implemented by stores that know the address of the leader. It's
+// used to tell clients where to send writes that this node cannot handle.
+type LeaderLocator interface {
+	LeaderRPCAddr() string
+}
+
+// NodeReporter is implemented by stores that can identify their node. It's used to
+// tell clients which node served a request.
+type NodeReporter interface {
+	NodeID() string
+	IsLeader() bool
+}
+
 type Server struct {
-	store *store.Store
+	store Store
+}
+
+// jsonBody represents the body of a JSON request or response. The value is a byte
+// slice so encoding/json handles the base64 encoding of binary values for us.
+type jsonBody struct {
+	Value []byte `json:"value"`
+	Found bool   `json:"found"`
 }
 
 // New creates a Server instance with given raft store.
-func New(s *store.Store) (*Server, error) {
+func New(s Store) (*Server, error) {
 	return &Server{store: s}, nil
 }
 
+const (
+	// keyHeader can be used to pass the key instead of the request URI, which
+	// allows keys containing slashes or other special characters.
+	keyHeader = "X-Cache-Key"
+
+	// keyEncodingHeader can be set to "base64" to pass binary keys in keyHeader.
+	keyEncodingHeader = "X-Cache-Key-Encoding"
+
+	// leaderAddrHeader contains the rpc address of the leader in responses to
+	// writes sent to a follower.
+	leaderAddrHeader = "X-Leader-Addr"
+
+	// nodeIDHeader and nodeRoleHeader identify the node that served the request
+	// and whether it was the leader or a follower.
+	nodeIDHeader   = "X-Node-Id"
+	nodeRoleHeader = "X-Node-Role"
+)
+
+// requestKey returns the key of the request. The X-Cache-Key header takes
+// precedence over the request URI. Keys in the request URI are percent-decoded,
+// so "/users%2F1" is the key "users/1".
+func requestKey(ctx *fasthttp.RequestCtx) (string, error) {
+	hdr := ctx.Request.Header.Peek(keyHeader)
+	if len(hdr) == 0 {
+		return url.PathUnescape(string(ctx.RequestURI()[1:]))
+	}
+
+	if string(ctx.Request.Header.Peek(keyEncodingHeader)) != "base64" {
+		return string(hdr), nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(string(hdr))
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// isJSON checks whether the client wants to use JSON bodies instead of raw bodies.
+// Both Content-Type and Accept are checked, since GET requests usually don't have
+// a body to describe.
+func isJSON(ctx *fasthttp.RequestCtx) bool {
+	jsonType := []byte("application/json")
+	return bytes.HasPrefix(ctx.Request.Header.ContentType(), jsonType) ||
+		bytes.Contains(ctx.Request.Header.Peek(fasthttp.HeaderAccept), jsonType)
+}
+
 // Handler handles HTTP requests in the following way:
 //
 //   - POST = Create entry, key is the request URI so 'localhost:0/testkey' key = "testkey"
-//     and the body of the request will be the key-value pair's value.
+//     and the body of the request will be the key-value pair's value. The key is
+//     percent-decoded, so special characters can be URL-encoded.
 //
 //   - GET = Same thing with keys, but the value will be written as a response.
+//
+//   - HEAD = Like GET, but only the size of the value is returned in the
+//     Content-Length header. Missing keys respond with 404.
+//
+// If the request has the 'Content-Type: application/json' header the bodies are
+// in the format {"value": "<base64>", "found": true} instead of raw bytes.
+//
+// Keys that cannot be expressed in the URI can be passed in the 'X-Cache-Key'
+// header instead. Binary keys can be base64 encoded by also setting the
+// 'X-Cache-Key-Encoding: base64' header.
+//
+// If the store is a NodeReporter, every response has the 'X-Node-Id' and
+// 'X-Node-Role' headers set to identify the node that served the request.
 func (s *Server) Handler(ctx *fasthttp.RequestCtx) {
-	if !ctx.IsPost() && !ctx.IsGet() {
-		ctx.Error("only post or get request", fasthttp.StatusMethodNotAllowed)
+	s.handle(ctx)
+
+	// the headers are set last, since ctx.Error resets the response.
+	if nr, ok := s.store.(NodeReporter); ok {
+		role := "follower"
+		if nr.IsLeader() {
+			role = "leader"
+		}
+		ctx.Response.Header.Set(nodeIDHeader, nr.NodeID())
+		ctx.Response.Header.Set(nodeRoleHeader, role)
+	}
+}
+
+// handle responds to a request as described in Handler.
+func (s *Server) handle(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsPost() && !ctx.IsGet() && !ctx.IsHead() {
+		ctx.Error("only post, get or head request", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	useJSON := isJSON(ctx)
+	key, err := requestKey(ctx)
+	if err != nil {
+		ctx.Error("malformed key", fasthttp.StatusBadRequest)
 		return
 	}
 
-	key := string(ctx.RequestURI()[1:])
 	if ctx.IsPost() {
 		var postData []byte
-		postData = append(postData, ctx.PostBody()...)
+		if useJSON {
+			var body jsonBody
+			if err := json.Unmarshal(ctx.PostBody(), &body); err != nil {
+				ctx.Error("malformed json body", fasthttp.StatusBadRequest)
+				return
+			}
+			postData = body.Value
+		} else {
+			postData = append(postData, ctx.PostBody()...)
+		}
 
 		err := s.store.Set(key, postData)
+		if errors.Is(err, store.ErrNoLeaderElected) {
+			ctx.Error("no leader elected, try again later", fasthttp.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, store.ErrPaused) {
+			ctx.Error("node is paused", fasthttp.StatusServiceUnavailable)
+			return
+		}
+		if isNotLeader(err) {
+			s.writeNotLeader(ctx)
+			return
+		}
+		if isInvalid(err) {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, store.ErrTooManyInflightApplies) {
+			ctx.Error("too many writes in progress, try again later", fasthttp.StatusTooManyRequests)
+			return
+		}
 		if err != nil {
 			ctx.Error("error writing to cluster", fasthttp.StatusInternalServerError)
 			return
@@ -43,6 +190,33 @@ func (s *Server) Handler(ctx *fasthttp.RequestCtx) {
 	}
 
 	data, err := s.store.Get(key)
+	if errors.Is(err, store.ErrNoLeaderElected) {
+		ctx.Error("no leader elected, try again later", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, store.ErrPaused) {
+		ctx.Error("node is paused", fasthttp.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, store.ErrNotClusterMember) {
+		ctx.Error("node has left the cluster", fasthttp.StatusGone)
+		return
+	}
+	if isInvalid(err) {
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	if ctx.IsHead() {
+		s.writeHead(ctx, data, err)
+		return
+	}
+
+	if useJSON {
+		s.writeJSON(ctx, data, err)
+		return
+	}
+
 	if err != nil {
 		ctx.Error("error getting from cluster", fasthttp.StatusInternalServerError)
 		return
@@ -51,3 +225,88 @@ func (s *Server) Handler(ctx *fasthttp.RequestCtx) {
 	ctx.SetStatusCode(fasthttp.StatusOK)
 	ctx.SetBody(data)
 }
+
+// isInvalid checks whether the store rejected the key or value of the request.
+func isInvalid(err error) bool {
+	return errors.Is(err, store.ErrInvalidKey) || errors.Is(err, store.ErrInvalidValue)
+}
+
+// isNotLeader checks whether err was caused by sending a write to a node that isn't
+// the leader.
+func isNotLeader(err error) bool {
+	return errors.Is(err, raft.ErrNotLeader) ||
+		errors.Is(err, raft.ErrLeadershipLost) ||
+		errors.Is(err, raft.ErrLeadershipTransferInProgress)
+}
+
+// writeNotLeader responds with 421 Misdirected Request. The address of the leader
+// is set in the X-Leader-Addr header if it's known, so the client can retry there.
+func (s *Server) writeNotLeader(ctx *fasthttp.RequestCtx) {
+	// Error resets the response, so the header is set after it.
+	ctx.Error("node is not the leader", fasthttp.StatusMisdirectedRequest)
+	if ll, ok := s.store.(LeaderLocator); ok {
+		if addr := ll.LeaderRPCAddr(); addr != "" {
+			ctx.Response.Header.Set(leaderAddrHeader, addr)
+		}
+	}
+}
+
+// ErrorHandler writes the response for requests that fasthttp couldn't read. It's
+// meant to be used as fasthttp.Server.ErrorHandler, since the default handler
+// responds with 400 to bodies over the size limit.
+func (s *Server) ErrorHandler(ctx *fasthttp.RequestCtx, err error) {
+	var smallBuffer *fasthttp.ErrSmallBuffer
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, fasthttp.ErrBodyTooLarge):
+		ctx.Error("request body too large", fasthttp.StatusRequestEntityTooLarge)
+	case errors.As(err, &smallBuffer):
+		ctx.Error("request header too large", fasthttp.StatusRequestHeaderFieldsTooLarge)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		ctx.Error("request timeout", fasthttp.StatusRequestTimeout)
+	default:
+		ctx.Error("error parsing request", fasthttp.StatusBadRequest)
+	}
+}
+
+// writeHead writes the response to a HEAD request. Only the length of the value is
+// sent, so clients can check the size before fetching large values.
+func (s *Server) writeHead(ctx *fasthttp.RequestCtx, data []byte, err error) {
+	if errors.Is(err, bigcache.ErrEntryNotFound) {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.Response.SkipBody = true
+	ctx.Response.Header.SetContentLength(len(data))
+}
+
+// writeJSON writes the result of a get operation as a JSON body. A missing key is
+// not treated as an error, instead the found field is set to false.
+func (s *Server) writeJSON(ctx *fasthttp.RequestCtx, data []byte, err error) {
+	if err != nil && !errors.Is(err, bigcache.ErrEntryNotFound) {
+		ctx.Error("error getting from cluster", fasthttp.StatusInternalServerError)
+		return
+	}
+
+	found := err == nil
+	body, err := json.Marshal(jsonBody{Value: data, Found: found})
+	if err != nil {
+		ctx.Error("error encoding json", fasthttp.StatusInternalServerError)
+		return
+	}
+
+	if found {
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	} else {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	}
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
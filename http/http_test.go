@@ -0,0 +1,311 @@
+package http_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/allegro/bigcache/v3"
+	"github.com/hashicorp/raft"
+	httpd "github.com/nireo/dcache/http"
+	"github.com/nireo/dcache/store"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+)
+
+type mockStore struct {
+	sync.Mutex
+	data map[string][]byte
+}
+
+func newMockStore() *mockStore {
+	return &mockStore{data: make(map[string][]byte)}
+}
+
+func (m *mockStore) Set(key string, value []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	m.data[key] = value
+	return nil
+}
+
+func (m *mockStore) Get(key string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	val, ok := m.data[key]
+	if !ok {
+		return nil, bigcache.ErrEntryNotFound
+	}
+	return val, nil
+}
+
+func doRequest(
+	t *testing.T, srv *httpd.Server, method, uri, contentType string, body []byte,
+) *fasthttp.RequestCtx {
+	t.Helper()
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	if contentType != "" {
+		ctx.Request.Header.SetContentType(contentType)
+	}
+	ctx.Request.SetBody(body)
+
+	srv.Handler(ctx)
+	return ctx
+}
+
+func TestRawRoundTrip(t *testing.T) {
+	srv, err := httpd.New(newMockStore())
+	require.NoError(t, err)
+
+	ctx := doRequest(t, srv, fasthttp.MethodPost, "/testkey", "text/plain", []byte("testval"))
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+	ctx = doRequest(t, srv, fasthttp.MethodGet, "/testkey", "", nil)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	require.Equal(t, []byte("testval"), ctx.Response.Body())
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	store := newMockStore()
+	srv, err := httpd.New(store)
+	require.NoError(t, err)
+
+	value := []byte{0x00, 0xff, 'h', 'i'}
+	body, err := json.Marshal(map[string][]byte{"value": value})
+	require.NoError(t, err)
+
+	ctx := doRequest(t, srv, fasthttp.MethodPost, "/testkey", "application/json", body)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+	stored, err := store.Get("testkey")
+	require.NoError(t, err)
+	require.Equal(t, value, stored)
+
+	ctx = doRequest(t, srv, fasthttp.MethodGet, "/testkey", "application/json", nil)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	require.Equal(t, "application/json", string(ctx.Response.Header.ContentType()))
+
+	var res struct {
+		Value []byte `json:"value"`
+		Found bool   `json:"found"`
+	}
+	require.NoError(t, json.Unmarshal(ctx.Response.Body(), &res))
+	require.True(t, res.Found)
+	require.Equal(t, value, res.Value)
+
+	ctx = doRequest(t, srv, fasthttp.MethodGet, "/missing", "application/json", nil)
+	require.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode())
+	require.NoError(t, json.Unmarshal(ctx.Response.Body(), &res))
+	require.False(t, res.Found)
+}
+
+func TestJSONMalformedBody(t *testing.T) {
+	srv, err := httpd.New(newMockStore())
+	require.NoError(t, err)
+
+	ctx := doRequest(t, srv, fasthttp.MethodPost, "/testkey", "application/json", []byte("{"))
+	require.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+}
+
+type noLeaderStore struct{}
+
+func (noLeaderStore) Set(key string, value []byte) error {
+	return store.ErrNoLeaderElected
+}
+
+func (noLeaderStore) Get(key string) ([]byte, error) {
+	return nil, store.ErrNoLeaderElected
+}
+
+func TestNoLeaderElected(t *testing.T) {
+	srv, err := httpd.New(noLeaderStore{})
+	require.NoError(t, err)
+
+	ctx := doRequest(t, srv, fasthttp.MethodPost, "/testkey", "", []byte("testval"))
+	require.Equal(t, fasthttp.StatusServiceUnavailable, ctx.Response.StatusCode())
+
+	ctx = doRequest(t, srv, fasthttp.MethodGet, "/testkey", "", nil)
+	require.Equal(t, fasthttp.StatusServiceUnavailable, ctx.Response.StatusCode())
+}
+
+type followerStore struct{}
+
+func (followerStore) Set(key string, value []byte) error {
+	return raft.ErrNotLeader
+}
+
+func (followerStore) Get(key string) ([]byte, error) {
+	return nil, nil
+}
+
+func (followerStore) LeaderRPCAddr() string {
+	return "10.0.0.1:9200"
+}
+
+func TestLeaderAddrHeader(t *testing.T) {
+	srv, err := httpd.New(followerStore{})
+	require.NoError(t, err)
+
+	ctx := doRequest(t, srv, fasthttp.MethodPost, "/testkey", "", []byte("testval"))
+	require.Equal(t, fasthttp.StatusMisdirectedRequest, ctx.Response.StatusCode())
+	require.Equal(t, "10.0.0.1:9200", string(ctx.Response.Header.Peek("X-Leader-Addr")))
+}
+
+type removedStore struct{}
+
+func (removedStore) Set(key string, value []byte) error {
+	return nil
+}
+
+func (removedStore) Get(key string) ([]byte, error) {
+	return nil, store.ErrNotClusterMember
+}
+
+func TestNotClusterMember(t *testing.T) {
+	srv, err := httpd.New(removedStore{})
+	require.NoError(t, err)
+
+	ctx := doRequest(t, srv, fasthttp.MethodGet, "/testkey", "", nil)
+	require.Equal(t, fasthttp.StatusGone, ctx.Response.StatusCode())
+}
+
+func TestKeyHeader(t *testing.T) {
+	store := newMockStore()
+	srv, err := httpd.New(store)
+	require.NoError(t, err)
+
+	keyRequest := func(method, key, encoding string, body []byte) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(method)
+		ctx.Request.SetRequestURI("/")
+		ctx.Request.Header.Set("X-Cache-Key", key)
+		if encoding != "" {
+			ctx.Request.Header.Set("X-Cache-Key-Encoding", encoding)
+		}
+		ctx.Request.SetBody(body)
+
+		srv.Handler(ctx)
+		return ctx
+	}
+
+	ctx := keyRequest(fasthttp.MethodPost, "a/b/c", "", []byte("slashes"))
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+	stored, err := store.Get("a/b/c")
+	require.NoError(t, err)
+	require.Equal(t, []byte("slashes"), stored)
+
+	ctx = keyRequest(fasthttp.MethodGet, "a/b/c", "", nil)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	require.Equal(t, []byte("slashes"), ctx.Response.Body())
+
+	binaryKey := string([]byte{'/', 0x00, 0xff, '\n'})
+	encoded := base64.StdEncoding.EncodeToString([]byte(binaryKey))
+
+	ctx = keyRequest(fasthttp.MethodPost, encoded, "base64", []byte("binary"))
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+	stored, err = store.Get(binaryKey)
+	require.NoError(t, err)
+	require.Equal(t, []byte("binary"), stored)
+
+	ctx = keyRequest(fasthttp.MethodGet, encoded, "base64", nil)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	require.Equal(t, []byte("binary"), ctx.Response.Body())
+
+	ctx = keyRequest(fasthttp.MethodGet, "not base64!", "base64", nil)
+	require.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+}
+
+func TestErrorHandler(t *testing.T) {
+	srv, err := httpd.New(newMockStore())
+	require.NoError(t, err)
+
+	ctx := &fasthttp.RequestCtx{}
+	srv.ErrorHandler(ctx, fasthttp.ErrBodyTooLarge)
+	require.Equal(t, fasthttp.StatusRequestEntityTooLarge, ctx.Response.StatusCode())
+
+	ctx = &fasthttp.RequestCtx{}
+	srv.ErrorHandler(ctx, errors.New("broken request"))
+	require.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+}
+
+func TestHead(t *testing.T) {
+	srv, err := httpd.New(newMockStore())
+	require.NoError(t, err)
+
+	ctx := doRequest(t, srv, fasthttp.MethodPost, "/testkey", "", []byte("testval"))
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+	ctx = doRequest(t, srv, fasthttp.MethodHead, "/testkey", "", nil)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	require.Equal(t, len("testval"), ctx.Response.Header.ContentLength())
+	require.Empty(t, ctx.Response.Body())
+
+	ctx = doRequest(t, srv, fasthttp.MethodHead, "/missing", "", nil)
+	require.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode())
+}
+
+// nodeStore is a mockStore that identifies its node.
+type nodeStore struct {
+	*mockStore
+	leader bool
+}
+
+func (nodeStore) NodeID() string {
+	return "node-1"
+}
+
+func (s nodeStore) IsLeader() bool {
+	return s.leader
+}
+
+func TestNodeHeaders(t *testing.T) {
+	srv, err := httpd.New(nodeStore{mockStore: newMockStore(), leader: true})
+	require.NoError(t, err)
+
+	ctx := doRequest(t, srv, fasthttp.MethodPost, "/testkey", "", []byte("testval"))
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	require.Equal(t, "node-1", string(ctx.Response.Header.Peek("X-Node-Id")))
+	require.Equal(t, "leader", string(ctx.Response.Header.Peek("X-Node-Role")))
+
+	// the headers are set on errors too.
+	srv, err = httpd.New(nodeStore{mockStore: newMockStore()})
+	require.NoError(t, err)
+
+	ctx = doRequest(t, srv, fasthttp.MethodGet, "/missing", "", nil)
+	require.Equal(t, fasthttp.StatusInternalServerError, ctx.Response.StatusCode())
+	require.Equal(t, "node-1", string(ctx.Response.Header.Peek("X-Node-Id")))
+	require.Equal(t, "follower", string(ctx.Response.Header.Peek("X-Node-Role")))
+
+	// stores that cannot identify their node don't set the headers.
+	srv, err = httpd.New(newMockStore())
+	require.NoError(t, err)
+
+	ctx = doRequest(t, srv, fasthttp.MethodGet, "/missing", "", nil)
+	require.Empty(t, ctx.Response.Header.Peek("X-Node-Id"))
+}
+
+func TestEncodedKey(t *testing.T) {
+	store := newMockStore()
+	srv, err := httpd.New(store)
+	require.NoError(t, err)
+
+	key := "users/1 name?"
+	ctx := doRequest(t, srv, fasthttp.MethodPost, "/"+url.PathEscape(key), "", []byte("testval"))
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	require.Contains(t, store.data, key)
+
+	ctx = doRequest(t, srv, fasthttp.MethodGet, "/users%2F1%20name%3F", "", nil)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	require.Equal(t, []byte("testval"), ctx.Response.Body())
+
+	ctx = doRequest(t, srv, fasthttp.MethodGet, "/bad%zzkey", "", nil)
+	require.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+}
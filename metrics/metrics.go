@@ -0,0 +1,182 @@
+package metrics
+
+// metrics.go - Minimal counters and gauges that can be written in the Prometheus
+// text format. This avoids pulling in a full metrics library for a few values.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ClusterMembers is the number of alive serf members seen by this node.
+	ClusterMembers = NewGauge(
+		"dcache_cluster_members",
+		"Number of alive cluster members observed by this node.",
+	)
+
+	// LeaderChanges is incremented whenever this node gains or loses leadership.
+	LeaderChanges = NewCounter(
+		"dcache_leader_changes_total",
+		"Number of leadership changes observed by this node.",
+	)
+
+	// RegistryEventQueue is the number of serf events waiting to be handled.
+	RegistryEventQueue = NewGauge(
+		"dcache_registry_event_queue",
+		"Number of membership events waiting to be handled by this node.",
+	)
+
+	// DroppedRegistryEvents is incremented for every serf event dropped because the
+	// event queue was full.
+	DroppedRegistryEvents = NewCounter(
+		"dcache_registry_dropped_events_total",
+		"Number of membership events dropped because the event queue was full.",
+	)
+
+	// ExpiredKeys is incremented for every expired key deleted by the leader.
+	ExpiredKeys = NewCounter(
+		"dcache_expired_keys_total",
+		"Number of expired keys deleted from the cluster by this node.",
+	)
+)
+
+// metric is implemented by every metric type so they can be written out.
+type metric interface {
+	write(w io.Writer) error
+}
+
+var (
+	mu      sync.Mutex
+	metrics = make(map[string]metric)
+)
+
+// register adds a metric to the set of metrics written by WritePrometheus. It
+// panics on duplicate names since that is always a programming error.
+func register(name string, m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := metrics[name]; ok {
+		panic(fmt.Sprintf("metric %q registered twice", name))
+	}
+	metrics[name] = m
+}
+
+// Counter is a value that only increases.
+type Counter struct {
+	name string
+	help string
+	v    atomic.Uint64
+}
+
+// NewCounter creates and registers a counter with the given name.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(name, c)
+	return c
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+func (c *Counter) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+		c.name, c.help, c.name, c.name, c.Value())
+	return err
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	name string
+	help string
+	v    atomic.Int64
+}
+
+// NewGauge creates and registers a gauge with the given name.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(name, g)
+	return g
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v int64) {
+	g.v.Store(v)
+}
+
+// Add adds delta to the gauge, delta can be negative.
+func (g *Gauge) Add(delta int64) {
+	g.v.Add(delta)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n",
+		g.name, g.help, g.name, g.name, g.Value())
+	return err
+}
+
+// WritePrometheus writes all of the registered metrics into w using the Prometheus
+// text exposition format. Metrics are sorted by name to keep the output stable.
+func WritePrometheus(w io.Writer) error {
+	mu.Lock()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	mu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		mu.Lock()
+		m := metrics[name]
+		mu.Unlock()
+
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler returns a handler serving the metrics at /metrics and the runtime
+// profiles at /debug/pprof/. It should be served on a separate listener to keep
+// the profiles away from clients.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := WritePrometheus(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
@@ -0,0 +1,34 @@
+package metrics_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nireo/dcache/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	c := metrics.NewCounter("test_counter_total", "A test counter.")
+	g := metrics.NewGauge("test_gauge", "A test gauge.")
+
+	c.Inc()
+	c.Add(2)
+	g.Set(5)
+	g.Add(-1)
+
+	var buf bytes.Buffer
+	require.NoError(t, metrics.WritePrometheus(&buf))
+
+	out := buf.String()
+	require.Contains(t, out, "# TYPE test_counter_total counter\ntest_counter_total 3\n")
+	require.Contains(t, out, "# TYPE test_gauge gauge\ntest_gauge 4\n")
+	require.Contains(t, out, "# HELP dcache_cluster_members")
+}
+
+func TestDuplicateRegistration(t *testing.T) {
+	metrics.NewCounter("test_duplicate", "")
+	require.Panics(t, func() {
+		metrics.NewGauge("test_duplicate", "")
+	})
+}
@@ -22,9 +22,24 @@ const _ = grpc.SupportPackageIsVersion7
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type CacheClient interface {
-	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*Empty, error)
+	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error)
 	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
 	GetServers(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*GetServer, error)
+	Stats(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*StatsResponse, error)
+	ForceSnapshot(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*SnapshotResponse, error)
+	GetLeader(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*LeaderResponse, error)
+	TransferLeadership(ctx context.Context, in *TransferRequest, opts ...grpc.CallOption) (*Empty, error)
+	Diagnostics(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*DiagnosticsResponse, error)
+	Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error)
+	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (Cache_ScanClient, error)
+	Members(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*MembersResponse, error)
+	Head(ctx context.Context, in *HeadRequest, opts ...grpc.CallOption) (*HeadResponse, error)
+	GetLogEntry(ctx context.Context, in *LogEntryRequest, opts ...grpc.CallOption) (*LogEntryResponse, error)
+	HotKeys(ctx context.Context, in *HotKeysRequest, opts ...grpc.CallOption) (*HotKeysResponse, error)
+	GetPrefix(ctx context.Context, in *GetPrefixRequest, opts ...grpc.CallOption) (Cache_GetPrefixClient, error)
+	Checksum(ctx context.Context, in *ChecksumRequest, opts ...grpc.CallOption) (*ChecksumResponse, error)
+	SetStream(ctx context.Context, opts ...grpc.CallOption) (Cache_SetStreamClient, error)
+	GetStream(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (Cache_GetStreamClient, error)
 }
 
 type cacheClient struct {
@@ -35,8 +50,8 @@ func NewCacheClient(cc grpc.ClientConnInterface) CacheClient {
 	return &cacheClient{cc}
 }
 
-func (c *cacheClient) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*Empty, error) {
-	out := new(Empty)
+func (c *cacheClient) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error) {
+	out := new(SetResponse)
 	err := c.cc.Invoke(ctx, "/pb.Cache/Set", in, out, opts...)
 	if err != nil {
 		return nil, err
@@ -62,13 +77,257 @@ func (c *cacheClient) GetServers(ctx context.Context, in *Empty, opts ...grpc.Ca
 	return out, nil
 }
 
+func (c *cacheClient) Stats(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*StatsResponse, error) {
+	out := new(StatsResponse)
+	err := c.cc.Invoke(ctx, "/pb.Cache/Stats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheClient) ForceSnapshot(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*SnapshotResponse, error) {
+	out := new(SnapshotResponse)
+	err := c.cc.Invoke(ctx, "/pb.Cache/ForceSnapshot", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheClient) GetLeader(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*LeaderResponse, error) {
+	out := new(LeaderResponse)
+	err := c.cc.Invoke(ctx, "/pb.Cache/GetLeader", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheClient) TransferLeadership(ctx context.Context, in *TransferRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/pb.Cache/TransferLeadership", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheClient) Diagnostics(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*DiagnosticsResponse, error) {
+	out := new(DiagnosticsResponse)
+	err := c.cc.Invoke(ctx, "/pb.Cache/Diagnostics", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheClient) Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error) {
+	out := new(PingResponse)
+	err := c.cc.Invoke(ctx, "/pb.Cache/Ping", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (Cache_ScanClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Cache_ServiceDesc.Streams[0], "/pb.Cache/Scan", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &cacheScanClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Cache_ScanClient interface {
+	Recv() (*ScanEntry, error)
+	grpc.ClientStream
+}
+
+type cacheScanClient struct {
+	grpc.ClientStream
+}
+
+func (x *cacheScanClient) Recv() (*ScanEntry, error) {
+	m := new(ScanEntry)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *cacheClient) Members(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*MembersResponse, error) {
+	out := new(MembersResponse)
+	err := c.cc.Invoke(ctx, "/pb.Cache/Members", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheClient) Head(ctx context.Context, in *HeadRequest, opts ...grpc.CallOption) (*HeadResponse, error) {
+	out := new(HeadResponse)
+	err := c.cc.Invoke(ctx, "/pb.Cache/Head", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheClient) GetLogEntry(ctx context.Context, in *LogEntryRequest, opts ...grpc.CallOption) (*LogEntryResponse, error) {
+	out := new(LogEntryResponse)
+	err := c.cc.Invoke(ctx, "/pb.Cache/GetLogEntry", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheClient) HotKeys(ctx context.Context, in *HotKeysRequest, opts ...grpc.CallOption) (*HotKeysResponse, error) {
+	out := new(HotKeysResponse)
+	err := c.cc.Invoke(ctx, "/pb.Cache/HotKeys", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheClient) GetPrefix(ctx context.Context, in *GetPrefixRequest, opts ...grpc.CallOption) (Cache_GetPrefixClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Cache_ServiceDesc.Streams[1], "/pb.Cache/GetPrefix", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &cacheGetPrefixClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Cache_GetPrefixClient interface {
+	Recv() (*KeyValue, error)
+	grpc.ClientStream
+}
+
+type cacheGetPrefixClient struct {
+	grpc.ClientStream
+}
+
+func (x *cacheGetPrefixClient) Recv() (*KeyValue, error) {
+	m := new(KeyValue)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *cacheClient) Checksum(ctx context.Context, in *ChecksumRequest, opts ...grpc.CallOption) (*ChecksumResponse, error) {
+	out := new(ChecksumResponse)
+	err := c.cc.Invoke(ctx, "/pb.Cache/Checksum", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cacheClient) SetStream(ctx context.Context, opts ...grpc.CallOption) (Cache_SetStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Cache_ServiceDesc.Streams[2], "/pb.Cache/SetStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &cacheSetStreamClient{stream}
+	return x, nil
+}
+
+type Cache_SetStreamClient interface {
+	Send(*Chunk) error
+	CloseAndRecv() (*Empty, error)
+	grpc.ClientStream
+}
+
+type cacheSetStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *cacheSetStreamClient) Send(m *Chunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *cacheSetStreamClient) CloseAndRecv() (*Empty, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(Empty)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *cacheClient) GetStream(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (Cache_GetStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Cache_ServiceDesc.Streams[3], "/pb.Cache/GetStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &cacheGetStreamClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Cache_GetStreamClient interface {
+	Recv() (*Chunk, error)
+	grpc.ClientStream
+}
+
+type cacheGetStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *cacheGetStreamClient) Recv() (*Chunk, error) {
+	m := new(Chunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // CacheServer is the server API for Cache service.
 // All implementations must embed UnimplementedCacheServer
 // for forward compatibility
 type CacheServer interface {
-	Set(context.Context, *SetRequest) (*Empty, error)
+	Set(context.Context, *SetRequest) (*SetResponse, error)
 	Get(context.Context, *GetRequest) (*GetResponse, error)
 	GetServers(context.Context, *Empty) (*GetServer, error)
+	Stats(context.Context, *Empty) (*StatsResponse, error)
+	ForceSnapshot(context.Context, *Empty) (*SnapshotResponse, error)
+	GetLeader(context.Context, *Empty) (*LeaderResponse, error)
+	TransferLeadership(context.Context, *TransferRequest) (*Empty, error)
+	Diagnostics(context.Context, *Empty) (*DiagnosticsResponse, error)
+	Ping(context.Context, *PingRequest) (*PingResponse, error)
+	Scan(*ScanRequest, Cache_ScanServer) error
+	Members(context.Context, *Empty) (*MembersResponse, error)
+	Head(context.Context, *HeadRequest) (*HeadResponse, error)
+	GetLogEntry(context.Context, *LogEntryRequest) (*LogEntryResponse, error)
+	HotKeys(context.Context, *HotKeysRequest) (*HotKeysResponse, error)
+	GetPrefix(*GetPrefixRequest, Cache_GetPrefixServer) error
+	Checksum(context.Context, *ChecksumRequest) (*ChecksumResponse, error)
+	SetStream(Cache_SetStreamServer) error
+	GetStream(*GetRequest, Cache_GetStreamServer) error
 	mustEmbedUnimplementedCacheServer()
 }
 
@@ -76,7 +335,7 @@ type CacheServer interface {
 type UnimplementedCacheServer struct {
 }
 
-func (UnimplementedCacheServer) Set(context.Context, *SetRequest) (*Empty, error) {
+func (UnimplementedCacheServer) Set(context.Context, *SetRequest) (*SetResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Set not implemented")
 }
 func (UnimplementedCacheServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
@@ -85,6 +344,51 @@ func (UnimplementedCacheServer) Get(context.Context, *GetRequest) (*GetResponse,
 func (UnimplementedCacheServer) GetServers(context.Context, *Empty) (*GetServer, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetServers not implemented")
 }
+func (UnimplementedCacheServer) Stats(context.Context, *Empty) (*StatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stats not implemented")
+}
+func (UnimplementedCacheServer) ForceSnapshot(context.Context, *Empty) (*SnapshotResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ForceSnapshot not implemented")
+}
+func (UnimplementedCacheServer) GetLeader(context.Context, *Empty) (*LeaderResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLeader not implemented")
+}
+func (UnimplementedCacheServer) TransferLeadership(context.Context, *TransferRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TransferLeadership not implemented")
+}
+func (UnimplementedCacheServer) Diagnostics(context.Context, *Empty) (*DiagnosticsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Diagnostics not implemented")
+}
+func (UnimplementedCacheServer) Ping(context.Context, *PingRequest) (*PingResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ping not implemented")
+}
+func (UnimplementedCacheServer) Scan(*ScanRequest, Cache_ScanServer) error {
+	return status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
+func (UnimplementedCacheServer) Members(context.Context, *Empty) (*MembersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Members not implemented")
+}
+func (UnimplementedCacheServer) Head(context.Context, *HeadRequest) (*HeadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Head not implemented")
+}
+func (UnimplementedCacheServer) GetLogEntry(context.Context, *LogEntryRequest) (*LogEntryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLogEntry not implemented")
+}
+func (UnimplementedCacheServer) HotKeys(context.Context, *HotKeysRequest) (*HotKeysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method HotKeys not implemented")
+}
+func (UnimplementedCacheServer) GetPrefix(*GetPrefixRequest, Cache_GetPrefixServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetPrefix not implemented")
+}
+func (UnimplementedCacheServer) Checksum(context.Context, *ChecksumRequest) (*ChecksumResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Checksum not implemented")
+}
+func (UnimplementedCacheServer) SetStream(Cache_SetStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method SetStream not implemented")
+}
+func (UnimplementedCacheServer) GetStream(*GetRequest, Cache_GetStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetStream not implemented")
+}
 func (UnimplementedCacheServer) mustEmbedUnimplementedCacheServer() {}
 
 // UnsafeCacheServer may be embedded to opt out of forward compatibility for this service.
@@ -152,6 +456,293 @@ func _Cache_GetServers_Handler(srv interface{}, ctx context.Context, dec func(in
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Cache_Stats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheServer).Stats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Cache/Stats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheServer).Stats(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cache_ForceSnapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheServer).ForceSnapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Cache/ForceSnapshot",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheServer).ForceSnapshot(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cache_GetLeader_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheServer).GetLeader(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Cache/GetLeader",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheServer).GetLeader(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cache_TransferLeadership_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TransferRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheServer).TransferLeadership(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Cache/TransferLeadership",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheServer).TransferLeadership(ctx, req.(*TransferRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cache_Diagnostics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheServer).Diagnostics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Cache/Diagnostics",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheServer).Diagnostics(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cache_Ping_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheServer).Ping(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Cache/Ping",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheServer).Ping(ctx, req.(*PingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cache_Scan_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ScanRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CacheServer).Scan(m, &cacheScanServer{stream})
+}
+
+type Cache_ScanServer interface {
+	Send(*ScanEntry) error
+	grpc.ServerStream
+}
+
+type cacheScanServer struct {
+	grpc.ServerStream
+}
+
+func (x *cacheScanServer) Send(m *ScanEntry) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Cache_Members_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheServer).Members(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Cache/Members",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheServer).Members(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cache_Head_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HeadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheServer).Head(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Cache/Head",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheServer).Head(ctx, req.(*HeadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cache_GetLogEntry_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LogEntryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheServer).GetLogEntry(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Cache/GetLogEntry",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheServer).GetLogEntry(ctx, req.(*LogEntryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cache_HotKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HotKeysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheServer).HotKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Cache/HotKeys",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheServer).HotKeys(ctx, req.(*HotKeysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cache_GetPrefix_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetPrefixRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CacheServer).GetPrefix(m, &cacheGetPrefixServer{stream})
+}
+
+type Cache_GetPrefixServer interface {
+	Send(*KeyValue) error
+	grpc.ServerStream
+}
+
+type cacheGetPrefixServer struct {
+	grpc.ServerStream
+}
+
+func (x *cacheGetPrefixServer) Send(m *KeyValue) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Cache_Checksum_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChecksumRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CacheServer).Checksum(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/pb.Cache/Checksum",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CacheServer).Checksum(ctx, req.(*ChecksumRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cache_SetStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CacheServer).SetStream(&cacheSetStreamServer{stream})
+}
+
+type Cache_SetStreamServer interface {
+	SendAndClose(*Empty) error
+	Recv() (*Chunk, error)
+	grpc.ServerStream
+}
+
+type cacheSetStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *cacheSetStreamServer) SendAndClose(m *Empty) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *cacheSetStreamServer) Recv() (*Chunk, error) {
+	m := new(Chunk)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Cache_GetStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CacheServer).GetStream(m, &cacheGetStreamServer{stream})
+}
+
+type Cache_GetStreamServer interface {
+	Send(*Chunk) error
+	grpc.ServerStream
+}
+
+type cacheGetStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *cacheGetStreamServer) Send(m *Chunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // Cache_ServiceDesc is the grpc.ServiceDesc for Cache service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -171,7 +762,72 @@ var Cache_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetServers",
 			Handler:    _Cache_GetServers_Handler,
 		},
+		{
+			MethodName: "Stats",
+			Handler:    _Cache_Stats_Handler,
+		},
+		{
+			MethodName: "ForceSnapshot",
+			Handler:    _Cache_ForceSnapshot_Handler,
+		},
+		{
+			MethodName: "GetLeader",
+			Handler:    _Cache_GetLeader_Handler,
+		},
+		{
+			MethodName: "TransferLeadership",
+			Handler:    _Cache_TransferLeadership_Handler,
+		},
+		{
+			MethodName: "Diagnostics",
+			Handler:    _Cache_Diagnostics_Handler,
+		},
+		{
+			MethodName: "Ping",
+			Handler:    _Cache_Ping_Handler,
+		},
+		{
+			MethodName: "Members",
+			Handler:    _Cache_Members_Handler,
+		},
+		{
+			MethodName: "Head",
+			Handler:    _Cache_Head_Handler,
+		},
+		{
+			MethodName: "GetLogEntry",
+			Handler:    _Cache_GetLogEntry_Handler,
+		},
+		{
+			MethodName: "HotKeys",
+			Handler:    _Cache_HotKeys_Handler,
+		},
+		{
+			MethodName: "Checksum",
+			Handler:    _Cache_Checksum_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Scan",
+			Handler:       _Cache_Scan_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "GetPrefix",
+			Handler:       _Cache_GetPrefix_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "SetStream",
+			Handler:       _Cache_SetStream_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "GetStream",
+			Handler:       _Cache_GetStream_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "pb/pb.proto",
 }
@@ -0,0 +1,29 @@
+package registry
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfiles(t *testing.T) {
+	lan, err := memberlistConfig("lan")
+	require.NoError(t, err)
+
+	wan, err := memberlistConfig("wan")
+	require.NoError(t, err)
+	require.Greater(t, wan.GossipInterval, lan.GossipInterval)
+	require.Greater(t, wan.ProbeInterval, lan.ProbeInterval)
+	require.Greater(t, wan.TCPTimeout, lan.TCPTimeout)
+
+	local, err := memberlistConfig("local")
+	require.NoError(t, err)
+	require.Less(t, local.ProbeTimeout, lan.ProbeTimeout)
+
+	def, err := memberlistConfig("")
+	require.NoError(t, err)
+	require.Equal(t, lan.GossipInterval, def.GossipInterval)
+
+	_, err = New(nil, Config{BindAddr: "127.0.0.1:0", Profile: "mars"})
+	require.ErrorIs(t, err, ErrUnknownProfile)
+}
@@ -1,10 +1,17 @@
 package registry
 
 import (
+	"errors"
 	"io"
 	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/hashicorp/memberlist"
 	"github.com/hashicorp/serf/serf"
+	"github.com/nireo/dcache/metrics"
 	"go.uber.org/zap"
 )
 
@@ -14,8 +21,98 @@ type Config struct {
 	BindAddr       string
 	Tags           map[string]string
 	StartJoinAddrs []string
+
+	// AdvertiseAddr is the address advertised to other members, if it differs from
+	// BindAddr.
+	AdvertiseAddr string
+
+	// Logger is used for logging registry events. Defaults to the global logger.
+	Logger *zap.Logger
+
+	// ExpectedNodes is the number of members that need to be discovered before the
+	// cluster is bootstrapped with all of them. Zero disables this and the handler
+	// needs to be a Bootstrapper for this to have any effect.
+	ExpectedNodes int
+
+	// LeaveTimeout is the maximum time Leave waits for the leave to be propagated
+	// to the rest of the cluster. Defaults to 10 seconds.
+	LeaveTimeout time.Duration
+
+	// BroadcastTimeout is the timeout for broadcasting events to the cluster, such
+	// as the leave intent. Zero uses the serf default.
+	BroadcastTimeout time.Duration
+
+	// LeavePropagateDelay is how long Leave keeps answering the other members after
+	// the leave has been broadcast, so that they learn about the leave before this
+	// member goes away. Zero uses the serf default of 1 second.
+	LeavePropagateDelay time.Duration
+
+	// Profile selects the gossip timings for the network the members are in:
+	// "lan", "wan" or "local". WAN uses longer intervals and timeouts that suit
+	// geo-distributed clusters. Defaults to "lan".
+	Profile string
+
+	// RetryJoin keeps trying to join StartJoinAddrs in the background if none of
+	// them can be reached, instead of failing New. The wait between attempts starts
+	// at RetryInterval and doubles after every failed attempt up to
+	// maxRetryInterval.
+	RetryJoin bool
+
+	// RetryInterval is the wait before the first retry. Defaults to 1 second.
+	RetryInterval time.Duration
+
+	// RetryMaxAttempts is the number of retries after which joining is given up.
+	// Zero retries until the registry is shut down.
+	RetryMaxAttempts int
+
+	// ReapTimeout is how long a member can be failed before it's removed from the
+	// cluster with Handler.Leave, so that a member that never comes back doesn't
+	// count towards the quorum. Only the leader removes members if the handler is a
+	// LeaderChecker. Zero keeps failed members until serf reaps them.
+	ReapTimeout time.Duration
+
+	// EventBufferSize is the number of serf events that can wait to be handled.
+	// Handling an event can block on raft, so events are queued to keep serf from
+	// blocking. If the queue is full, events are dropped and the members are synced
+	// from serf once the queue has room. Defaults to 256.
+	EventBufferSize int
 }
 
+const (
+	// defaultLeaveTimeout is used if Config.LeaveTimeout is not set.
+	defaultLeaveTimeout = 10 * time.Second
+
+	// defaultRetryInterval is used if Config.RetryInterval is not set.
+	defaultRetryInterval = time.Second
+
+	// maxRetryInterval caps the backoff between join retries.
+	maxRetryInterval = 30 * time.Second
+
+	// maxReapInterval caps how often failed members are checked for removal.
+	maxReapInterval = 10 * time.Second
+
+	// defaultEventBufferSize is used if Config.EventBufferSize is not set.
+	defaultEventBufferSize = 256
+)
+
+// ReadReplicaTag is the tag set to "true" on members that are read replicas. Read
+// replicas are joined as non-voters and are left out of bootstrapping, so they never
+// take part in elections.
+const ReadReplicaTag = "read_replica"
+
+// BootstrappedTag is the tag set to "true" on members that are part of a cluster
+// bootstrapped with Config.ExpectedNodes. Nodes that discover a member with it
+// join the existing cluster instead of bootstrapping a new one.
+const BootstrappedTag = "bootstrapped"
+
+// ErrUnknownProfile is returned by New when Config.Profile isn't one of the known
+// profiles.
+var ErrUnknownProfile = errors.New("unknown gossip profile, expected lan, wan or local")
+
+// ErrLeaveTimeout is returned when leaving the cluster takes longer than the
+// configured LeaveTimeout.
+var ErrLeaveTimeout = errors.New("timed out leaving the cluster")
+
 // Handler represents a interface to a internal handler that also needs information about
 // any possible joins or leaves. In actual use the store.Store is passed here because Raft
 // needs to know of any possible changes to the cluster.
@@ -24,6 +121,38 @@ type Handler interface {
 	Leave(id string) error
 }
 
+// NonVoterJoiner is implemented by handlers that can add members to the cluster as
+// non-voters. It's needed for read replicas, which are joined as voters otherwise.
+type NonVoterJoiner interface {
+	JoinNonVoter(id, addr string) error
+}
+
+// isReadReplica checks whether the member has the read replica tag set.
+func isReadReplica(member serf.Member) bool {
+	return member.Tags[ReadReplicaTag] == "true"
+}
+
+// raftAddr returns the raft address of the member. Members that serve raft on the
+// rpc port don't set the raft_addr tag.
+func raftAddr(member serf.Member) string {
+	if addr, ok := member.Tags["raft_addr"]; ok {
+		return addr
+	}
+	return member.Tags["rpc_addr"]
+}
+
+// LeaderChecker is implemented by handlers that know whether the local node is the
+// leader. Failed members are only removed by the leader.
+type LeaderChecker interface {
+	IsLeader() bool
+}
+
+// Bootstrapper is implemented by handlers that can bootstrap a cluster from a set of
+// discovered members. The servers map member names to their raft addresses.
+type Bootstrapper interface {
+	BootstrapCluster(servers map[string]string) error
+}
+
 // Registry handles service discovery by using serf. Registry helps with managing a
 // cluster.
 type Registry struct {
@@ -32,16 +161,52 @@ type Registry struct {
 	serf    *serf.Serf
 	events  chan serf.Event
 	logger  *zap.Logger
+
+	// resync is signaled when events have been dropped, so the event handler syncs
+	// the members from serf.
+	resync chan struct{}
+
+	// done is closed once the event handler has stopped after a shutdown.
+	done chan struct{}
+
+	bootstrapped bool
+
+	// leaving is closed once the last leave has finished, which might be after
+	// Leave has timed out.
+	leaving chan struct{}
+
+	// tagsMu protects Config.Tags, which are updated with SetTag.
+	tagsMu sync.Mutex
+
+	// failed contains the members that serf has marked as failed, so they can be
+	// told apart from new members once they reconnect.
+	failed map[string]*failedMember
+}
+
+// failedMember tracks when a member failed and whether it has been removed from the
+// cluster after ReapTimeout.
+type failedMember struct {
+	member serf.Member
+	since  time.Time
+	reaped bool
 }
 
 // New creates a registry instance and sets up serf for service discovery. This function
 // starts up the whole registry functionality by running an event handler, connection to
 // existing nodes and managing possible joins/leaves.
 func New(handler Handler, config Config) (*Registry, error) {
+	logger := config.Logger
+	if logger == nil {
+		logger = zap.L()
+	}
+
 	r := &Registry{
 		Config:  config,
 		handler: handler,
-		logger:  zap.L().Named("registry"),
+		logger:  logger.Named("registry"),
+		failed:  make(map[string]*failedMember),
+		resync:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
 	}
 
 	if err := r.setupSerf(); err != nil {
@@ -63,57 +228,408 @@ func (r *Registry) setupSerf() error {
 	config := serf.DefaultConfig()
 	config.Init() // allocate subdata structures
 
+	config.MemberlistConfig, err = memberlistConfig(r.Profile)
+	if err != nil {
+		return err
+	}
+
 	config.LogOutput = io.Discard
 	config.MemberlistConfig.BindAddr = addr.IP.String()
 	config.MemberlistConfig.BindPort = addr.Port
+	if r.AdvertiseAddr != "" {
+		advertise, err := net.ResolveTCPAddr("tcp", r.AdvertiseAddr)
+		if err != nil {
+			return err
+		}
+		config.MemberlistConfig.AdvertiseAddr = advertise.IP.String()
+		config.MemberlistConfig.AdvertisePort = advertise.Port
+	}
 
-	r.events = make(chan serf.Event)
-	config.EventCh = r.events
+	size := r.EventBufferSize
+	if size <= 0 {
+		size = defaultEventBufferSize
+	}
+	r.events = make(chan serf.Event, size)
+
+	in := make(chan serf.Event)
+	config.EventCh = in
 	config.Tags = r.Tags
 	config.NodeName = r.NodeName
+	if r.BroadcastTimeout != 0 {
+		config.BroadcastTimeout = r.BroadcastTimeout
+	}
+	if r.LeavePropagateDelay != 0 {
+		config.LeavePropagateDelay = r.LeavePropagateDelay
+	}
 
 	r.serf, err = serf.Create(config)
 	if err != nil {
 		return err
 	}
 
+	// update the bind address with the port serf chose, if an ephemeral port was
+	// requested.
+	if addr.Port == 0 {
+		port := r.serf.Memberlist().LocalNode().Port
+		r.BindAddr = net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(port)))
+	}
+
+	go r.queueEvents(in)
 	go r.eventHandler()
 	if r.StartJoinAddrs != nil {
 		if _, err := r.serf.Join(r.StartJoinAddrs, true); err != nil {
-			return err
+			if !r.RetryJoin {
+				r.serf.Shutdown()
+				return err
+			}
+
+			r.logger.Warn("failed to join, retrying in the background", zap.Error(err))
+			go r.retryJoin()
 		}
 	}
 
 	return nil
 }
 
+// retryJoin tries to join StartJoinAddrs with an exponential backoff until a join
+// succeeds, RetryMaxAttempts is reached or the registry is shut down.
+func (r *Registry) retryJoin() {
+	interval := r.RetryInterval
+	if interval == 0 {
+		interval = defaultRetryInterval
+	}
+
+	for attempt := 1; r.RetryMaxAttempts == 0 || attempt <= r.RetryMaxAttempts; attempt++ {
+		select {
+		case <-time.After(interval):
+		case <-r.serf.ShutdownCh():
+			return
+		}
+
+		n, err := r.serf.Join(r.StartJoinAddrs, true)
+		if err == nil {
+			r.logger.Info("joined the cluster", zap.Int("attempt", attempt), zap.Int("joined", n))
+			return
+		}
+
+		interval *= 2
+		if interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+		r.logger.Warn("failed to join",
+			zap.Int("attempt", attempt),
+			zap.Duration("retry_in", interval),
+			zap.Error(err),
+		)
+	}
+
+	r.logger.Error("giving up joining the cluster", zap.Int("attempts", r.RetryMaxAttempts))
+}
+
+// memberlistConfig returns the default memberlist configuration of the profile.
+func memberlistConfig(profile string) (*memberlist.Config, error) {
+	switch profile {
+	case "", "lan":
+		return memberlist.DefaultLANConfig(), nil
+	case "wan":
+		return memberlist.DefaultWANConfig(), nil
+	case "local":
+		return memberlist.DefaultLocalConfig(), nil
+	}
+	return nil, ErrUnknownProfile
+}
+
+// queueEvents moves the events sent by serf to the event queue. It never blocks, so
+// a slow handler cannot hold up serf. If the queue is full, the event is dropped
+// and the event handler is told to sync the members from serf instead. serf never
+// closes in, so the queue is closed once serf has shut down, which stops the event
+// handler after it has handled the queued events.
+func (r *Registry) queueEvents(in <-chan serf.Event) {
+	defer close(r.events)
+
+	shutdown := r.serf.ShutdownCh()
+	for {
+		var e serf.Event
+		select {
+		case e = <-in:
+		case <-shutdown:
+			return
+		}
+
+		select {
+		case r.events <- e:
+			metrics.RegistryEventQueue.Set(int64(len(r.events)))
+			continue
+		default:
+		}
+
+		metrics.DroppedRegistryEvents.Inc()
+		r.logger.Warn("event queue is full, dropping event",
+			zap.String("event", e.String()),
+			zap.Int("size", cap(r.events)),
+		)
+		select {
+		case r.resync <- struct{}{}:
+		default:
+		}
+	}
+}
+
 // eventHandler is run concurrently and it listens for items in the event channel.
-// Then events that arrive in the event channel are handled. The only events that
-// matter here are serf.EventMemberJoin and serv.EventMemberLeave
+// If ReapTimeout is set, it also periodically removes members that have been failed
+// for too long. The failed members are only accessed from this goroutine.
 func (r *Registry) eventHandler() {
-	for e := range r.events {
-		switch e.EventType() {
-		case serf.EventMemberJoin:
-			for _, member := range e.(serf.MemberEvent).Members {
-				if r.isLocal(member) {
-					continue
-				}
-				r.handleJoin(member)
+	defer close(r.done)
+
+	var reap <-chan time.Time
+	shutdown := r.serf.ShutdownCh()
+	if r.ReapTimeout > 0 {
+		interval := r.ReapTimeout / 2
+		if interval > maxReapInterval {
+			interval = maxReapInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		reap = ticker.C
+	}
+
+	for {
+		select {
+		case e, ok := <-r.events:
+			if !ok {
+				return
 			}
-		case serf.EventMemberLeave:
-			for _, member := range e.(serf.MemberEvent).Members {
-				if r.isLocal(member) {
-					continue
-				}
-				r.handleLeave(member)
+			metrics.RegistryEventQueue.Set(int64(len(r.events)))
+			r.handleEvent(e)
+		case <-r.resync:
+			// the queued events are older than the state of serf, so they're
+			// handled first.
+			for len(r.events) > 0 {
+				r.handleEvent(<-r.events)
 			}
+			metrics.RegistryEventQueue.Set(0)
+			r.syncMembers()
+		case <-reap:
+			r.reapFailed()
+		case <-shutdown:
+			// keep handling the queued events until queueEvents closes the queue.
+			reap, shutdown = nil, nil
 		}
 	}
 }
 
+// handleEvent handles a serf event. Joins and updates add the member to the
+// cluster, while leaves and reaps remove it. Failed members are kept in the cluster,
+// since they might reconnect.
+func (r *Registry) handleEvent(e serf.Event) {
+	if _, ok := e.(serf.MemberEvent); ok {
+		r.updateMemberCount()
+	}
+
+	switch e.EventType() {
+	case serf.EventMemberJoin:
+		r.maybeBootstrap()
+		for _, member := range e.(serf.MemberEvent).Members {
+			if r.isLocal(member) {
+				continue
+			}
+			if _, ok := r.failed[member.Name]; ok {
+				r.handleReconnect(member)
+				continue
+			}
+			r.handleJoin(member)
+		}
+	case serf.EventMemberUpdate:
+		// a member waiting for the bootstrap might see the members that did it.
+		r.maybeBootstrap()
+
+		// the address of the member might have changed.
+		for _, member := range e.(serf.MemberEvent).Members {
+			if r.isLocal(member) {
+				continue
+			}
+			r.handleJoin(member)
+		}
+	case serf.EventMemberFailed:
+		for _, member := range e.(serf.MemberEvent).Members {
+			r.failed[member.Name] = &failedMember{member: member, since: time.Now()}
+		}
+	case serf.EventMemberLeave, serf.EventMemberReap:
+		for _, member := range e.(serf.MemberEvent).Members {
+			if r.isLocal(member) {
+				continue
+			}
+			delete(r.failed, member.Name)
+			r.handleLeave(member)
+		}
+	}
+}
+
+// syncMembers brings the handler up to date with the members of serf after events
+// have been dropped. The cluster is bootstrapped if the dropped joins were needed
+// for it. Alive members are joined, members that have left are removed and failed
+// members are tracked for reaping. Joining existing members and removing unknown
+// ones are no-ops.
+func (r *Registry) syncMembers() {
+	r.logger.Info("syncing members after dropped events")
+	r.updateMemberCount()
+	r.maybeBootstrap()
+
+	for _, member := range r.serf.Members() {
+		if r.isLocal(member) {
+			continue
+		}
+
+		switch member.Status {
+		case serf.StatusAlive:
+			delete(r.failed, member.Name)
+			r.handleJoin(member)
+		case serf.StatusFailed:
+			if _, ok := r.failed[member.Name]; !ok {
+				r.failed[member.Name] = &failedMember{member: member, since: time.Now()}
+			}
+		case serf.StatusLeft:
+			delete(r.failed, member.Name)
+			r.handleLeave(member)
+		}
+	}
+}
+
+// reapFailed removes the members that have been failed for longer than
+// ReapTimeout from the cluster. The members are kept in failed, so they're joined
+// back like any other failed member if they reconnect.
+func (r *Registry) reapFailed() {
+	if lc, ok := r.handler.(LeaderChecker); ok && !lc.IsLeader() {
+		return
+	}
+
+	for name, f := range r.failed {
+		if f.reaped || time.Since(f.since) < r.ReapTimeout {
+			continue
+		}
+
+		r.logger.Info("removing failed member",
+			zap.String("name", name),
+			zap.Duration("failed_for", time.Since(f.since)),
+		)
+		if err := r.handler.Leave(name); err != nil {
+			r.logError(err, "failed to remove failed member", f.member)
+			continue
+		}
+		f.reaped = true
+	}
+}
+
+// handleReconnect joins every alive member after a failed member has reconnected.
+// The member might have been on the other side of a partition, where a different
+// leader could have missed joins, so joining only the reconnected member isn't
+// enough to heal the raft configuration. Joining existing members is a no-op.
+func (r *Registry) handleReconnect(member serf.Member) {
+	r.logger.Info("failed member reconnected", zap.String("name", member.Name))
+	delete(r.failed, member.Name)
+
+	for _, m := range r.serf.Members() {
+		if m.Status != serf.StatusAlive || r.isLocal(m) {
+			continue
+		}
+		r.handleJoin(m)
+	}
+}
+
+// updateMemberCount updates the cluster members gauge with the number of alive
+// members.
+func (r *Registry) updateMemberCount() {
+	alive := 0
+	for _, member := range r.serf.Members() {
+		if member.Status == serf.StatusAlive {
+			alive++
+		}
+	}
+	metrics.ClusterMembers.Set(int64(alive))
+}
+
+// maybeBootstrap bootstraps the cluster once ExpectedNodes alive members have been
+// discovered. Every member does this with the same set of members, so they all end
+// up with the same initial configuration instead of each bootstrapping their own.
+// If more members have been discovered, the first ExpectedNodes by name are used
+// and the others wait to be joined. Nothing is bootstrapped if a member of an
+// existing cluster has been discovered, since the leader joins this node to it.
+func (r *Registry) maybeBootstrap() {
+	if r.ExpectedNodes <= 0 || r.bootstrapped {
+		return
+	}
+
+	b, ok := r.handler.(Bootstrapper)
+	if !ok {
+		return
+	}
+
+	servers := make(map[string]string)
+	var names []string
+	for _, member := range r.serf.Members() {
+		if member.Status != serf.StatusAlive {
+			continue
+		}
+
+		if member.Tags[BootstrappedTag] == "true" {
+			r.logger.Info("found an existing cluster, not bootstrapping",
+				zap.String("member", member.Name))
+			r.markBootstrapped()
+			return
+		}
+
+		// read replicas join the cluster once it has been bootstrapped.
+		if !isReadReplica(member) {
+			servers[member.Name] = raftAddr(member)
+			names = append(names, member.Name)
+		}
+	}
+
+	if len(servers) < r.ExpectedNodes {
+		r.logger.Info("waiting for expected nodes",
+			zap.Int("discovered", len(servers)),
+			zap.Int("expected", r.ExpectedNodes),
+		)
+		return
+	}
+
+	sort.Strings(names)
+	for _, name := range names[r.ExpectedNodes:] {
+		if name == r.NodeName {
+			r.logger.Info("more nodes than expected, waiting to be joined",
+				zap.Int("discovered", len(servers)),
+				zap.Int("expected", r.ExpectedNodes),
+			)
+			return
+		}
+		delete(servers, name)
+	}
+
+	if err := b.BootstrapCluster(servers); err != nil {
+		r.logger.Error("failed to bootstrap cluster", zap.Error(err))
+		return
+	}
+	r.markBootstrapped()
+}
+
+// markBootstrapped stops bootstrapping and tags this member as part of the cluster,
+// so nodes started later join it instead of bootstrapping their own.
+func (r *Registry) markBootstrapped() {
+	r.bootstrapped = true
+	if err := r.SetTag(BootstrappedTag, "true"); err != nil {
+		r.logger.Error("failed to set bootstrapped tag", zap.Error(err))
+	}
+}
+
 // handleJoin sends information to the internal handler to add given node to the cluster.
+// Read replicas are added as non-voters if the handler supports it.
 func (r *Registry) handleJoin(member serf.Member) {
-	if err := r.handler.Join(member.Name, member.Tags["rpc_addr"]); err != nil {
+	join := r.handler.Join
+	if nj, ok := r.handler.(NonVoterJoiner); ok && isReadReplica(member) {
+		join = nj.JoinNonVoter
+	}
+
+	if err := join(member.Name, raftAddr(member)); err != nil {
 		r.logError(err, "failed to join", member)
 	}
 }
@@ -136,9 +652,115 @@ func (r *Registry) Members() []serf.Member {
 	return r.serf.Members()
 }
 
-// Leave tells this member to leave the cluster.
+// RPCAddr returns the rpc address of the member with the given name.
+func (r *Registry) RPCAddr(name string) (string, bool) {
+	for _, member := range r.serf.Members() {
+		if member.Name == name {
+			addr, ok := member.Tags["rpc_addr"]
+			return addr, ok
+		}
+	}
+	return "", false
+}
+
+// IsPaused checks whether the member with the given name has the paused tag set.
+func (r *Registry) IsPaused(name string) bool {
+	for _, member := range r.serf.Members() {
+		if member.Name == name {
+			return member.Tags["paused"] == "true"
+		}
+	}
+	return false
+}
+
+// IsReadReplica checks whether the member with the given name is a read replica.
+func (r *Registry) IsReadReplica(name string) bool {
+	for _, member := range r.serf.Members() {
+		if member.Name == name {
+			return isReadReplica(member)
+		}
+	}
+	return false
+}
+
+// SetTag sets a tag of this member and gossips the new tags to the other members.
+// An empty value removes the tag.
+func (r *Registry) SetTag(key, value string) error {
+	r.tagsMu.Lock()
+	defer r.tagsMu.Unlock()
+
+	tags := make(map[string]string, len(r.Tags)+1)
+	for k, v := range r.Tags {
+		tags[k] = v
+	}
+	if value == "" {
+		delete(tags, key)
+	} else {
+		tags[key] = value
+	}
+
+	if err := r.serf.SetTags(tags); err != nil {
+		return err
+	}
+	r.Tags = tags
+	return nil
+}
+
+// IsAlive checks whether the member with the given name is alive. Unknown members
+// are not considered alive.
+func (r *Registry) IsAlive(name string) bool {
+	for _, member := range r.serf.Members() {
+		if member.Name == name {
+			return member.Status == serf.StatusAlive
+		}
+	}
+	return false
+}
+
+// Leave tells this member to leave the cluster. If the leave isn't done in
+// LeaveTimeout, ErrLeaveTimeout is returned and the leave continues in the
+// background, so that a congested cluster cannot block shutting down.
 func (r *Registry) Leave() error {
-	return r.serf.Leave()
+	timeout := r.LeaveTimeout
+	if timeout == 0 {
+		timeout = defaultLeaveTimeout
+	}
+
+	errCh := make(chan error, 1)
+	leaving := make(chan struct{})
+	r.leaving = leaving
+	go func() {
+		defer close(leaving)
+		errCh <- r.serf.Leave()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-timer.C:
+		r.logger.Warn("leaving the cluster timed out", zap.Duration("timeout", timeout))
+		return ErrLeaveTimeout
+	}
+}
+
+// Shutdown stops serf without leaving the cluster, so the other members see this
+// member as failed. Leave should be called first for a graceful exit. A leave that
+// timed out is waited for, since serf cannot be shut down in the middle of leaving.
+// The wait is bounded by the serf broadcast timeouts.
+func (r *Registry) Shutdown() error {
+	if r.leaving != nil {
+		<-r.leaving
+	}
+	return r.serf.Shutdown()
+}
+
+// Done returns a channel that is closed once the registry has stopped handling
+// events after Shutdown.
+func (r *Registry) Done() <-chan struct{} {
+	return r.done
 }
 
 func (r *Registry) logError(err error, msg string, member serf.Member) {
@@ -3,11 +3,15 @@ package registry_test
 import (
 	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
+	"github.com/nireo/dcache/metrics"
 	"github.com/nireo/dcache/registry"
+	"github.com/nireo/dcache/store"
 	"github.com/stretchr/testify/require"
 )
 
@@ -88,14 +92,506 @@ func TestRegistry(t *testing.T) {
 	require.Eventually(t, func() bool {
 		return len(handler.joins) == 2 &&
 			len(m[0].Members()) == 3 &&
-			len(handler.leaves) == 0
+			len(handler.leaves) == 0 &&
+			metrics.ClusterMembers.Value() == 3
 	}, 3*time.Second, 250*time.Millisecond)
+	require.True(t, m[0].IsAlive("2"))
+	require.False(t, m[0].IsAlive("unknown"))
 	require.NoError(t, m[2].Leave())
 	require.Eventually(t, func() bool {
 		return len(handler.joins) == 2 &&
 			len(m[0].Members()) == 3 &&
 			serf.StatusLeft == m[0].Members()[2].Status &&
-			len(handler.leaves) == 1
+			len(handler.leaves) == 1 &&
+			metrics.ClusterMembers.Value() == 2
 	}, 3*time.Second, 250*time.Millisecond)
 	require.Equal(t, fmt.Sprintf("%d", 2), <-handler.leaves)
+	require.False(t, m[0].IsAlive("2"))
+}
+
+// blockingHandler never returns from Join, which blocks the member's event handling
+// like an unresponsive peer.
+type blockingHandler struct {
+	done chan struct{}
+}
+
+func (h *blockingHandler) Join(id, addr string) error {
+	<-h.done
+	return nil
+}
+
+func (h *blockingHandler) Leave(id string) error {
+	return nil
+}
+
+func TestLeaveTimeout(t *testing.T) {
+	port, _ := getFreePort()
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	h := &blockingHandler{done: make(chan struct{})}
+	defer close(h.done)
+
+	peer, err := registry.New(h, registry.Config{
+		NodeName: "peer",
+		BindAddr: addr,
+		Tags:     map[string]string{"rpc_addr": addr},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { peer.Shutdown() })
+
+	// the propagate delay is shortened, so only waiting for the peer to receive
+	// the leave can take longer than the timeout.
+	conf := func(name string, join []string) registry.Config {
+		port, _ := getFreePort()
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		return registry.Config{
+			NodeName:            name,
+			BindAddr:            addr,
+			Tags:                map[string]string{"rpc_addr": addr},
+			StartJoinAddrs:      join,
+			LeaveTimeout:        200 * time.Millisecond,
+			BroadcastTimeout:    time.Second,
+			LeavePropagateDelay: 10 * time.Millisecond,
+		}
+	}
+
+	// without other members there's nobody to wait for.
+	alone, err := registry.New(&handler{}, conf("alone", nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { alone.Shutdown() })
+	require.NoError(t, alone.Leave())
+
+	r, err := registry.New(&handler{}, conf("local", []string{peer.BindAddr}))
+	require.NoError(t, err)
+	t.Cleanup(func() { r.Shutdown() })
+
+	require.Eventually(t, func() bool {
+		return len(r.Members()) == 2
+	}, 3*time.Second, 100*time.Millisecond)
+
+	start := time.Now()
+	require.ErrorIs(t, r.Leave(), registry.ErrLeaveTimeout)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+// configHandler keeps the joined members like the raft configuration would.
+type configHandler struct {
+	mu      sync.Mutex
+	servers map[string]string
+}
+
+func (h *configHandler) Join(id, addr string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.servers[id] = addr
+	return nil
+}
+
+func (h *configHandler) Leave(id string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.servers, id)
+	return nil
+}
+
+func (h *configHandler) has(ids ...string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.servers) != len(ids) {
+		return false
+	}
+	for _, id := range ids {
+		if _, ok := h.servers[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRejoin(t *testing.T) {
+	newMember := func(name, addr string, h registry.Handler, join []string) *registry.Registry {
+		r, err := registry.New(h, registry.Config{
+			NodeName:       name,
+			BindAddr:       addr,
+			Tags:           map[string]string{"rpc_addr": addr},
+			StartJoinAddrs: join,
+		})
+		require.NoError(t, err)
+		return r
+	}
+
+	addrs := make([]string, 3)
+	for i := range addrs {
+		port, _ := getFreePort()
+		addrs[i] = fmt.Sprintf("127.0.0.1:%d", port)
+	}
+
+	h := &configHandler{servers: make(map[string]string)}
+	leader := newMember("0", addrs[0], h, nil)
+	defer leader.Shutdown()
+
+	follower := newMember("1", addrs[1], &handler{}, []string{addrs[0]})
+	defer follower.Shutdown()
+
+	member := newMember("2", addrs[2], &handler{}, []string{addrs[0]})
+	require.Eventually(t, func() bool {
+		return h.has("1", "2")
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// a member that leaves is removed and added back when it joins again.
+	require.NoError(t, member.Leave())
+	require.NoError(t, member.Shutdown())
+	require.Eventually(t, func() bool {
+		return h.has("1")
+	}, 3*time.Second, 50*time.Millisecond)
+
+	member = newMember("2", addrs[2], &handler{}, []string{addrs[0]})
+	require.Eventually(t, func() bool {
+		return h.has("1", "2")
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// a failed member stays in the configuration.
+	require.NoError(t, member.Shutdown())
+	require.Eventually(t, func() bool {
+		return !leader.IsAlive("2")
+	}, 10*time.Second, 50*time.Millisecond)
+	require.True(t, h.has("1", "2"))
+
+	// simulate a join that was missed during the partition, which should be
+	// repaired once the failed member reconnects.
+	require.NoError(t, h.Leave("1"))
+
+	member = newMember("2", addrs[2], &handler{}, []string{addrs[0]})
+	defer member.Shutdown()
+	require.Eventually(t, func() bool {
+		return h.has("1", "2")
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+func TestRetryJoin(t *testing.T) {
+	port, _ := getFreePort()
+	seedAddr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	port, _ = getFreePort()
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	// without retrying, a node whose seeds are down fails to start.
+	_, err := registry.New(&handler{}, registry.Config{
+		NodeName:       "local",
+		BindAddr:       addr,
+		Tags:           map[string]string{"rpc_addr": addr},
+		StartJoinAddrs: []string{seedAddr},
+	})
+	require.Error(t, err)
+
+	port, _ = getFreePort()
+	addr = fmt.Sprintf("127.0.0.1:%d", port)
+	r, err := registry.New(&handler{}, registry.Config{
+		NodeName:       "local",
+		BindAddr:       addr,
+		Tags:           map[string]string{"rpc_addr": addr},
+		StartJoinAddrs: []string{seedAddr},
+		RetryJoin:      true,
+		RetryInterval:  50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer r.Shutdown()
+	require.Len(t, r.Members(), 1)
+
+	// the seed comes up later and the node joins it without a restart.
+	time.Sleep(200 * time.Millisecond)
+	h := &configHandler{servers: make(map[string]string)}
+	seed, err := registry.New(h, registry.Config{
+		NodeName: "seed",
+		BindAddr: seedAddr,
+		Tags:     map[string]string{"rpc_addr": seedAddr},
+	})
+	require.NoError(t, err)
+	defer seed.Shutdown()
+
+	require.Eventually(t, func() bool {
+		return len(r.Members()) == 2 && h.has("local")
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// reapMember is a raft node with its own registry, like a service without the
+// servers.
+type reapMember struct {
+	store    *store.Store
+	reg      *registry.Registry
+	raftAddr string
+}
+
+func newReapMember(t *testing.T, id string, bootstrap bool, join []string) *reapMember {
+	raftPort, _ := getFreePort()
+	bindPort, _ := getFreePort()
+	return startReapMember(t, id, bootstrap, join,
+		fmt.Sprintf("127.0.0.1:%d", raftPort),
+		fmt.Sprintf("127.0.0.1:%d", bindPort),
+	)
+}
+
+// startReapMember starts a member on the given addresses, so a member can be
+// restarted with the same identity.
+func startReapMember(
+	t *testing.T, id string, bootstrap bool, join []string, raftAddr, bindAddr string,
+) *reapMember {
+	ln, err := net.Listen("tcp", raftAddr)
+	require.NoError(t, err)
+
+	conf := store.Config{}
+	conf.BindAddr = raftAddr
+	conf.LocalID = raft.ServerID(id)
+	conf.Bootstrap = bootstrap
+	conf.DataDir = t.TempDir()
+	conf.HeartbeatTimeout = 200 * time.Millisecond
+	conf.ElectionTimeout = 200 * time.Millisecond
+	conf.LeaderLeaseTimeout = 100 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.Transport = store.NewTransport(ln)
+
+	s, err := store.New(conf)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	if bootstrap {
+		_, err = s.WaitForLeader(3 * time.Second)
+		require.NoError(t, err)
+	}
+
+	r, err := registry.New(s, registry.Config{
+		NodeName:       id,
+		BindAddr:       bindAddr,
+		Tags:           map[string]string{"rpc_addr": raftAddr},
+		StartJoinAddrs: join,
+		ReapTimeout:    500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { r.Shutdown() })
+
+	return &reapMember{store: s, reg: r, raftAddr: raftAddr}
+}
+
+// hasServers checks whether the raft configuration of s has exactly ids.
+func hasServers(s *store.Store, ids ...string) bool {
+	servers, err := s.GetServers()
+	if err != nil || len(servers) != len(ids) {
+		return false
+	}
+	for _, id := range ids {
+		found := false
+		for _, server := range servers {
+			found = found || server.Id == id
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReapFailed(t *testing.T) {
+	leader := newReapMember(t, "0", true, nil)
+	join := []string{leader.reg.BindAddr}
+	follower := newReapMember(t, "1", false, join)
+	member := newReapMember(t, "2", false, join)
+
+	require.Eventually(t, func() bool {
+		return hasServers(leader.store, "0", "1", "2") &&
+			hasServers(follower.store, "0", "1", "2")
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// kill the member without leaving, so it's seen as failed.
+	require.NoError(t, member.reg.Shutdown())
+	require.NoError(t, member.store.Close())
+	require.Eventually(t, func() bool {
+		return !leader.reg.IsAlive("2")
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// the leader removes the member from the raft configuration once the grace
+	// period has passed.
+	require.Eventually(t, func() bool {
+		return hasServers(leader.store, "0", "1") &&
+			hasServers(follower.store, "0", "1")
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// a reaped member is added back once it reconnects.
+	startReapMember(t, "2", false, join, member.raftAddr, member.reg.BindAddr)
+	require.Eventually(t, func() bool {
+		return hasServers(leader.store, "0", "1", "2")
+	}, 10*time.Second, 50*time.Millisecond)
+}
+
+// gatedHandler blocks joins until the gate is opened, like a handler waiting on a
+// slow raft, and records the joined members.
+type gatedHandler struct {
+	gate chan struct{}
+
+	mu           sync.Mutex
+	joined       map[string]bool
+	bootstrapped map[string]string
+}
+
+func (h *gatedHandler) BootstrapCluster(servers map[string]string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bootstrapped = servers
+	return nil
+}
+
+func (h *gatedHandler) bootstrapSize() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.bootstrapped)
+}
+
+func (h *gatedHandler) Join(id, addr string) error {
+	<-h.gate
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.joined[id] = true
+	return nil
+}
+
+func (h *gatedHandler) Leave(id string) error {
+	return nil
+}
+
+func (h *gatedHandler) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.joined)
+}
+
+func TestEventFlood(t *testing.T) {
+	const peers = 8
+
+	port, _ := getFreePort()
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	h := &gatedHandler{gate: make(chan struct{}), joined: make(map[string]bool)}
+	r, err := registry.New(h, registry.Config{
+		NodeName:        "local",
+		BindAddr:        addr,
+		Tags:            map[string]string{"rpc_addr": addr},
+		EventBufferSize: 1,
+		ExpectedNodes:   peers + 1,
+	})
+	require.NoError(t, err)
+	defer r.Shutdown()
+
+	dropped := metrics.DroppedRegistryEvents.Value()
+	for i := 0; i < peers; i++ {
+		port, _ := getFreePort()
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		peer, err := registry.New(&handler{}, registry.Config{
+			NodeName:       fmt.Sprintf("peer-%d", i),
+			BindAddr:       addr,
+			Tags:           map[string]string{"rpc_addr": addr},
+			StartJoinAddrs: []string{r.BindAddr},
+		})
+		require.NoError(t, err)
+		defer peer.Shutdown()
+	}
+
+	// serf keeps working even though the handler is stuck and the events don't fit
+	// in the queue.
+	require.Eventually(t, func() bool {
+		return len(r.Members()) == peers+1
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Greater(t, metrics.DroppedRegistryEvents.Value(), dropped)
+
+	// the dropped joins are caught up once the handler is unblocked.
+	close(h.gate)
+	require.Eventually(t, func() bool {
+		return h.count() == peers
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the cluster is bootstrapped with every member, even if the join that reached
+	// the expected nodes was dropped.
+	require.Eventually(t, func() bool {
+		return h.bootstrapSize() == peers+1
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestBootstrapExpectExistingCluster(t *testing.T) {
+	const expected = 3
+
+	var members []*registry.Registry
+	var handlers []*gatedHandler
+	start := func(name string) {
+		port, _ := getFreePort()
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		h := &gatedHandler{gate: make(chan struct{}), joined: make(map[string]bool)}
+		close(h.gate)
+		c := registry.Config{
+			NodeName:      name,
+			BindAddr:      addr,
+			Tags:          map[string]string{"rpc_addr": addr},
+			ExpectedNodes: expected,
+		}
+		if len(members) > 0 {
+			c.StartJoinAddrs = []string{members[0].BindAddr}
+		}
+		r, err := registry.New(h, c)
+		require.NoError(t, err)
+		t.Cleanup(func() { r.Shutdown() })
+		members = append(members, r)
+		handlers = append(handlers, h)
+	}
+
+	for i := 0; i < expected; i++ {
+		start(fmt.Sprintf("node-%d", i))
+	}
+	// members that see the bootstrapped tag before the others wait to be joined,
+	// the rest bootstrap with the same members.
+	require.Eventually(t, func() bool {
+		for _, m := range members[0].Members() {
+			if m.Tags[registry.BootstrappedTag] != "true" {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+	bootstrapped := 0
+	for _, h := range handlers {
+		if size := h.bootstrapSize(); size != 0 {
+			require.Equal(t, expected, size)
+			bootstrapped++
+		}
+	}
+	require.NotZero(t, bootstrapped)
+
+	// a node started later with the same expect value sees enough members, but
+	// they're already part of a cluster, so it waits to be joined. Its name sorts
+	// first, so it would otherwise be one of the expected nodes.
+	start("late")
+	require.Eventually(t, func() bool {
+		return len(members[expected].Members()) == expected+1
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Never(t, func() bool {
+		return handlers[expected].bootstrapSize() != 0
+	}, time.Second, 50*time.Millisecond)
+}
+
+func TestShutdownStopsEventHandling(t *testing.T) {
+	port, _ := getFreePort()
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	r, err := registry.New(&handler{}, registry.Config{
+		NodeName: "local",
+		BindAddr: addr,
+		Tags:     map[string]string{"rpc_addr": addr},
+	})
+	require.NoError(t, err)
+
+	select {
+	case <-r.Done():
+		t.Fatal("event handling stopped before shutdown")
+	default:
+	}
+
+	require.NoError(t, r.Shutdown())
+	select {
+	case <-r.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("event handling didn't stop after shutdown")
+	}
 }
@@ -0,0 +1,127 @@
+package security
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// ReloadableTLS is a TLS configuration that reloads its certificates from disk when
+// the files change, so that certificates can be rotated without a restart. The
+// files are checked on every handshake, but only read again if their modification
+// time or size has changed. If the new files cannot be loaded, for example since
+// only the certificate has been replaced so far, the previous configuration is
+// kept.
+type ReloadableTLS struct {
+	cfg TLSConf
+
+	mu      sync.Mutex
+	conf    *tls.Config
+	fileMod []fileStamp
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloadableTLS loads the certificates in cfg. An error is returned if they
+// cannot be loaded.
+func NewReloadableTLS(cfg TLSConf) (*ReloadableTLS, error) {
+	r := &ReloadableTLS{cfg: cfg}
+	if _, err := r.current(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Config returns a *tls.Config that always uses the latest certificates. A server
+// configuration reloads the certificate and the client CA. A client configuration
+// reloads the client certificate, but the root CA is only loaded once.
+func (r *ReloadableTLS) Config() *tls.Config {
+	conf, _ := r.current()
+	if r.cfg.IsServer {
+		return &tls.Config{
+			MinVersion: conf.MinVersion,
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return r.current()
+			},
+		}
+	}
+
+	conf = conf.Clone()
+	conf.Certificates = nil
+	conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		curr, err := r.current()
+		if err != nil {
+			return nil, err
+		}
+		if len(curr.Certificates) == 0 {
+			// no certificate is sent.
+			return &tls.Certificate{}, nil
+		}
+		return &curr.Certificates[0], nil
+	}
+	return conf
+}
+
+// current returns the configuration built from the latest files.
+func (r *ReloadableTLS) current() (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stamps, err := r.stamps()
+	if err != nil {
+		if r.conf != nil {
+			return r.conf, nil
+		}
+		return nil, err
+	}
+
+	if r.conf != nil && equalStamps(stamps, r.fileMod) {
+		return r.conf, nil
+	}
+
+	conf, err := MakeTLSConfig(r.cfg)
+	if err != nil {
+		if r.conf != nil {
+			return r.conf, nil
+		}
+		return nil, err
+	}
+
+	r.conf = conf
+	r.fileMod = stamps
+	return conf, nil
+}
+
+// stamps returns the versions of the files in the configuration.
+func (r *ReloadableTLS) stamps() ([]fileStamp, error) {
+	var stamps []fileStamp
+	for _, path := range []string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.CAFile} {
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{modTime: info.ModTime(), size: info.Size()})
+	}
+	return stamps, nil
+}
+
+func equalStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
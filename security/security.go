@@ -3,10 +3,15 @@ package security
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"os"
 )
 
+// ErrMissingServerAddr is returned when a client configuration verifies the server
+// using a CA, but the name of the server to verify is not set.
+var ErrMissingServerAddr = errors.New("server address is required to verify the server")
+
 // TLSConf stores all of the parameters the MakeTLSConfig
 type TLSConf struct {
 	CertFile   string
@@ -14,11 +19,64 @@ type TLSConf struct {
 	CAFile     string
 	IsServer   bool
 	ServerAddr string
+
+	// RequireClientCert makes a server with a CA require mutual TLS, so clients
+	// must present a certificate signed by the CA. Otherwise only the server is
+	// authenticated, and client certificates are verified if given.
+	RequireClientCert bool
+
+	// MinVersion is the minimum accepted TLS version. Defaults to TLS 1.2.
+	MinVersion uint16
+
+	// CipherSuites limits the cipher suites used for TLS 1.2 and below. If empty, Go's
+	// default cipher suites are used. TLS 1.3 suites are not configurable.
+	CipherSuites []uint16
+}
+
+// ParseTLSVersion converts a version such as "1.2" into a tls version constant.
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown tls version: %s", version)
+}
+
+// ParseCipherSuites converts cipher suite names, such as
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", into their ids. Only secure cipher
+// suites are accepted.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, len(names))
+	for i, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: %s", name)
+		}
+		ids[i] = id
+	}
+	return ids, nil
 }
 
 // MakeTLSConfig takes in the custom config and creates a *tls.Config instance
 func MakeTLSConfig(cfg TLSConf) (*tls.Config, error) {
-	tlsConf := &tls.Config{}
+	tlsConf := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: cfg.CipherSuites,
+	}
+	if cfg.MinVersion != 0 {
+		tlsConf.MinVersion = cfg.MinVersion
+	}
 
 	var err error
 	if cfg.CertFile != "" && cfg.KeyFile != "" {
@@ -46,10 +104,17 @@ func MakeTLSConfig(cfg TLSConf) (*tls.Config, error) {
 		if cfg.IsServer {
 			tlsConf.ClientCAs = ca
 
-			// make sure that at least one valid certificate is given
-			// during a handshake.
-			tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+			if cfg.RequireClientCert {
+				// make sure that at least one valid certificate is given
+				// during a handshake.
+				tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+			} else {
+				tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+			}
 		} else {
+			if cfg.ServerAddr == "" {
+				return nil, ErrMissingServerAddr
+			}
 			tlsConf.RootCAs = ca
 		}
 
@@ -0,0 +1,342 @@
+package security_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nireo/dcache/security"
+	"github.com/stretchr/testify/require"
+)
+
+type certFiles struct {
+	caFile     string
+	serverCert string
+	serverKey  string
+	clientCert string
+	clientKey  string
+}
+
+// writePEM writes a single pem block into a new file in dir.
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+// writeCert creates a certificate signed by the given CA and writes the certificate
+// and key into dir. If ca is nil, the certificate is a self-signed CA.
+func writeCert(
+	t *testing.T, dir, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey,
+) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parent, signer = ca, caKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := writePEM(t, dir, name+".pem", "CERTIFICATE", der)
+	keyFile := writePEM(t, dir, name+"-key.pem", "EC PRIVATE KEY", keyDer)
+	return cert, key, certFile, keyFile
+}
+
+// genCerts creates a CA and a server and client certificate signed by it.
+func genCerts(t *testing.T) certFiles {
+	t.Helper()
+
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCert(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := writeCert(t, dir, "server", ca, caKey)
+	_, _, clientCert, clientKey := writeCert(t, dir, "client", ca, caKey)
+
+	return certFiles{
+		caFile:     caFile,
+		serverCert: serverCert,
+		serverKey:  serverKey,
+		clientCert: clientCert,
+		clientKey:  clientKey,
+	}
+}
+
+// handshakeResult contains the errors of both sides of a handshake.
+type handshakeResult struct {
+	serverErr error
+	clientErr error
+}
+
+// handshake starts a TLS listener with serverConf and dials it with clientConf.
+func handshake(t *testing.T, serverConf, clientConf *tls.Config) handshakeResult {
+	t.Helper()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverConf)
+	require.NoError(t, err)
+	defer l.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, clientErr := tls.Dial("tcp", l.Addr().String(), clientConf)
+	if clientErr == nil {
+		// make sure the server has processed the client's certificates.
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+
+	return handshakeResult{serverErr: <-serverErr, clientErr: clientErr}
+}
+
+func TestServerAuthOnly(t *testing.T) {
+	files := genCerts(t)
+
+	serverConf, err := security.MakeTLSConfig(security.TLSConf{
+		CertFile: files.serverCert,
+		KeyFile:  files.serverKey,
+		CAFile:   files.caFile,
+		IsServer: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, tls.VerifyClientCertIfGiven, serverConf.ClientAuth)
+
+	clientConf, err := security.MakeTLSConfig(security.TLSConf{
+		CAFile:     files.caFile,
+		ServerAddr: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	res := handshake(t, serverConf, clientConf)
+	require.NoError(t, res.serverErr)
+	require.NoError(t, res.clientErr)
+}
+
+func TestRequireClientCert(t *testing.T) {
+	files := genCerts(t)
+
+	serverConf, err := security.MakeTLSConfig(security.TLSConf{
+		CertFile:          files.serverCert,
+		KeyFile:           files.serverKey,
+		CAFile:            files.caFile,
+		IsServer:          true,
+		RequireClientCert: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, serverConf.ClientAuth)
+
+	clientConf, err := security.MakeTLSConfig(security.TLSConf{
+		CertFile:   files.clientCert,
+		KeyFile:    files.clientKey,
+		CAFile:     files.caFile,
+		ServerAddr: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	res := handshake(t, serverConf, clientConf)
+	require.NoError(t, res.serverErr)
+	require.NoError(t, res.clientErr)
+
+	// a client without a certificate should be rejected.
+	noCertConf, err := security.MakeTLSConfig(security.TLSConf{
+		CAFile:     files.caFile,
+		ServerAddr: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	res = handshake(t, serverConf, noCertConf)
+	require.Error(t, res.serverErr)
+}
+
+func TestMissingServerAddr(t *testing.T) {
+	files := genCerts(t)
+
+	_, err := security.MakeTLSConfig(security.TLSConf{
+		CAFile: files.caFile,
+	})
+	require.Equal(t, security.ErrMissingServerAddr, err)
+}
+
+func TestMinVersion(t *testing.T) {
+	files := genCerts(t)
+
+	serverConf, err := security.MakeTLSConfig(security.TLSConf{
+		CertFile: files.serverCert,
+		KeyFile:  files.serverKey,
+		IsServer: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), serverConf.MinVersion)
+
+	clientConf, err := security.MakeTLSConfig(security.TLSConf{
+		CAFile:     files.caFile,
+		ServerAddr: "127.0.0.1",
+		MinVersion: tls.VersionTLS11,
+	})
+	require.NoError(t, err)
+	clientConf.MaxVersion = tls.VersionTLS11
+
+	res := handshake(t, serverConf, clientConf)
+	require.Error(t, res.serverErr)
+	require.Error(t, res.clientErr)
+
+	clientConf.MaxVersion = 0
+	res = handshake(t, serverConf, clientConf)
+	require.NoError(t, res.serverErr)
+	require.NoError(t, res.clientErr)
+}
+
+func TestCipherSuites(t *testing.T) {
+	ids, err := security.ParseCipherSuites([]string{
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, ids)
+
+	// insecure suites are not accepted.
+	_, err = security.ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	require.Error(t, err)
+
+	conf, err := security.MakeTLSConfig(security.TLSConf{CipherSuites: ids})
+	require.NoError(t, err)
+	require.Equal(t, ids, conf.CipherSuites)
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	v, err := security.ParseTLSVersion("1.3")
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), v)
+
+	_, err = security.ParseTLSVersion("2.0")
+	require.Error(t, err)
+}
+
+// peerSerial dials addr and returns the serial number of the server certificate.
+func peerSerial(t *testing.T, addr string, clientConf *tls.Config) *big.Int {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, clientConf)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber
+}
+
+func TestReloadableTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCert(t, dir, "ca", nil, nil)
+	oldCert, _, serverCert, serverKey := writeCert(t, dir, "server", ca, caKey)
+
+	reloadable, err := security.NewReloadableTLS(security.TLSConf{
+		CertFile: serverCert,
+		KeyFile:  serverKey,
+		CAFile:   caFile,
+		IsServer: true,
+	})
+	require.NoError(t, err)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", reloadable.Config())
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	clientConf, err := security.MakeTLSConfig(security.TLSConf{
+		CAFile:     caFile,
+		ServerAddr: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, oldCert.SerialNumber, peerSerial(t, l.Addr().String(), clientConf))
+
+	// replace the certificate and key with a new pair.
+	newCert, _, _, _ := writeCert(t, dir, "server", ca, caKey)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(serverCert, future, future))
+	require.NoError(t, os.Chtimes(serverKey, future, future))
+
+	require.Equal(t, newCert.SerialNumber, peerSerial(t, l.Addr().String(), clientConf))
+}
+
+func TestReloadableTLSKeepsValidConfig(t *testing.T) {
+	files := genCerts(t)
+
+	reloadable, err := security.NewReloadableTLS(security.TLSConf{
+		CertFile: files.serverCert,
+		KeyFile:  files.serverKey,
+		IsServer: true,
+	})
+	require.NoError(t, err)
+
+	// a half-written rotation doesn't break new handshakes.
+	require.NoError(t, os.WriteFile(files.serverKey, []byte("garbage"), 0o600))
+
+	clientConf, err := security.MakeTLSConfig(security.TLSConf{
+		CAFile:     files.caFile,
+		ServerAddr: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	res := handshake(t, reloadable.Config(), clientConf)
+	require.NoError(t, res.serverErr)
+	require.NoError(t, res.clientErr)
+}
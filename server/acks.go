@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/nireo/dcache/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultAckTimeout is used if Config.AckTimeout is not set.
+	defaultAckTimeout = 5 * time.Second
+
+	// ackPollInterval is how often the applied indices of the followers are
+	// checked while waiting for acks.
+	ackPollInterval = 10 * time.Millisecond
+)
+
+// followerConns caches the connections to the other nodes used for checking their
+// applied indices and forwarding reads targeted at them.
+type followerConns struct {
+	sync.Mutex
+	conns  map[string]*grpc.ClientConn
+	closed bool
+
+	// tls is used to connect to the other nodes. The connections are insecure if
+	// it's nil.
+	tls *tls.Config
+}
+
+// client returns a client to the node at addr, reusing an earlier connection.
+func (f *followerConns) client(addr string) (pb.CacheClient, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return nil, status.Error(codes.Unavailable, "server is stopped")
+	}
+
+	if conn, ok := f.conns[addr]; ok {
+		return pb.NewCacheClient(conn), nil
+	}
+
+	creds := insecure.NewCredentials()
+	if f.tls != nil {
+		creds = credentials.NewTLS(f.tls)
+	}
+
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	if f.conns == nil {
+		f.conns = make(map[string]*grpc.ClientConn)
+	}
+	f.conns[addr] = conn
+	return pb.NewCacheClient(conn), nil
+}
+
+// prune closes the connections to the nodes that are not in servers, so nodes
+// removed from the cluster don't keep their connections open.
+func (f *followerConns) prune(servers []*pb.Server) {
+	listed := make(map[string]bool, len(servers))
+	for _, srv := range servers {
+		listed[srv.RpcAddr] = true
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	for addr, conn := range f.conns {
+		if !listed[addr] {
+			conn.Close()
+			delete(f.conns, addr)
+		}
+	}
+}
+
+// close closes every connection. Clients cannot be created after it.
+func (f *followerConns) close() {
+	f.Lock()
+	defer f.Unlock()
+
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+	f.closed = true
+}
+
+// ackFollowers returns the rpc addresses of the followers that can ack a write.
+// It fails with FailedPrecondition if there are fewer than minAcks followers, so
+// the write can be rejected before it's applied.
+func (s *grpcImpl) ackFollowers(minAcks int) ([]string, error) {
+	if s.sf == nil {
+		return nil, status.Error(codes.Unimplemented, "cache doesn't know the followers")
+	}
+
+	servers, err := s.sf.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	s.followers.prune(servers)
+
+	var followers []string
+	for _, srv := range servers {
+		if !srv.IsLeader {
+			followers = append(followers, srv.RpcAddr)
+		}
+	}
+	if len(followers) < minAcks {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"cluster has %d followers, cannot wait for %d acks", len(followers), minAcks)
+	}
+	return followers, nil
+}
+
+// waitForAcks blocks until at least minAcks of the followers have applied the log
+// entry at index. The applied indices are polled through the Diagnostics RPC of
+// every follower.
+func (s *grpcImpl) waitForAcks(
+	ctx context.Context, index uint64, followers []string, minAcks int,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, s.ackTimeout)
+	defer cancel()
+
+	acked := make(map[string]bool, len(followers))
+	ticker := time.NewTicker(ackPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, addr := range followers {
+			if acked[addr] {
+				continue
+			}
+
+			client, err := s.followers.client(addr)
+			if err != nil {
+				continue
+			}
+
+			diag, err := client.Diagnostics(ctx, &pb.Empty{})
+			if err == nil && diag.AppliedIndex >= index {
+				acked[addr] = true
+			}
+		}
+
+		if len(acked) >= minAcks {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return status.Errorf(codes.DeadlineExceeded,
+				"write was committed, but only %d of %d followers acked it", len(acked), minAcks)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+
+	"github.com/nireo/dcache/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Checksum hashes the key-value pairs of the node whose keys start with the
+// requested prefix. The cache is iterated in no particular order, so the pairs are
+// sorted by key before hashing. Comparing the checksums of every node shows whether
+// their caches have diverged.
+func (s *grpcImpl) Checksum(ctx context.Context, req *pb.ChecksumRequest) (
+	*pb.ChecksumResponse, error,
+) {
+	sc, ok := s.c.(Scanner)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "cache doesn't support scanning")
+	}
+
+	var entries []*pb.KeyValue
+	err := sc.Scan(req.Prefix, 0, func(key string, value []byte) error {
+		// the value might be reused by the cache after fn returns.
+		entries = append(entries, &pb.KeyValue{
+			Key:   key,
+			Value: append([]byte(nil), value...),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	// the lengths are hashed too, so that pairs cannot be split differently into
+	// the same bytes.
+	h := sha256.New()
+	var size [4]byte
+	for _, e := range entries {
+		binary.BigEndian.PutUint32(size[:], uint32(len(e.Key)))
+		h.Write(size[:])
+		h.Write([]byte(e.Key))
+
+		binary.BigEndian.PutUint32(size[:], uint32(len(e.Value)))
+		h.Write(size[:])
+		h.Write(e.Value)
+	}
+
+	return &pb.ChecksumResponse{
+		Hash:  h.Sum(nil),
+		Count: uint64(len(entries)),
+	}, nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+
+	"github.com/nireo/dcache/pb"
+	"github.com/nireo/dcache/store"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Consistency is the read consistency a client can ask for in the consistency
+// metadata of its requests.
+type Consistency string
+
+const (
+	// ConsistencyMetadata is the metadata key containing the read consistency of
+	// the client. Requests without it use the consistency the store is configured
+	// with.
+	ConsistencyMetadata = "consistency"
+
+	// ConsistencyStrong reads through the leader, even if the store is configured
+	// for eventually consistent reads.
+	ConsistencyStrong Consistency = "strong"
+
+	// ConsistencyEventual reads from the local cache of the node handling the
+	// request, even if the store is configured for strongly consistent reads.
+	ConsistencyEventual Consistency = "eventual"
+)
+
+// consistencyKey is the context key of the consistency requested by the client.
+type consistencyKey struct{}
+
+// WithConsistency returns a dial option that sets the consistency metadata on every
+// unary request of the connection, so the consistency doesn't need to be set on
+// every request.
+func WithConsistency(c Consistency) grpc.DialOption {
+	return grpc.WithChainUnaryInterceptor(func(
+		ctx context.Context,
+		method string,
+		req, reply any,
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		ctx = metadata.AppendToOutgoingContext(ctx, ConsistencyMetadata, string(c))
+		return invoker(ctx, method, req, reply, cc, opts...)
+	})
+}
+
+// unaryConsistencyInterceptor returns an interceptor that reads the consistency
+// metadata of the request into the context. Unknown values are rejected with
+// InvalidArgument. Only unary requests are intercepted, so streaming reads such
+// as GetStream and GetPrefix ignore the metadata.
+func unaryConsistencyInterceptor() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		vals := md.Get(ConsistencyMetadata)
+		if len(vals) == 0 {
+			return handler(ctx, req)
+		}
+
+		switch c := Consistency(vals[len(vals)-1]); c {
+		case ConsistencyStrong, ConsistencyEventual:
+			return handler(context.WithValue(ctx, consistencyKey{}, c), req)
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unknown consistency %q", c)
+		}
+	}
+}
+
+// readOptions returns the options of a read. The Stale field of the request takes
+// precedence over the consistency of the client.
+func readOptions(ctx context.Context, req *pb.GetRequest) store.GetOptions {
+	if req.Stale {
+		return store.GetOptions{Stale: true}
+	}
+
+	c, _ := ctx.Value(consistencyKey{}).(Consistency)
+	return store.GetOptions{
+		Stale:  c == ConsistencyEventual,
+		Strong: c == ConsistencyStrong,
+	}
+}
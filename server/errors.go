@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/allegro/bigcache/v3"
+	"github.com/hashicorp/raft"
+	"github.com/nireo/dcache/store"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// errorDomain and notLeaderReason identify the ErrorInfo detail of not-leader
+	// errors.
+	errorDomain     = "dcache"
+	notLeaderReason = "NOT_LEADER"
+
+	// leaderAddrKey is the metadata key of the leader's rpc address in the
+	// ErrorInfo detail.
+	leaderAddrKey = "leader_addr"
+)
+
+// toStatus converts the errors of the store into gRPC status errors, so that
+// clients can tell which requests are worth retrying on another node. Not-leader
+// errors have the rpc address of the leader attached if sf knows it. Other errors
+// are returned as is.
+func toStatus(err error, sf ServerFinder) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, raft.ErrNotLeader),
+		errors.Is(err, raft.ErrLeadershipLost),
+		errors.Is(err, raft.ErrLeadershipTransferInProgress):
+		return notLeaderStatus(err, leaderRPCAddr(sf))
+	case errors.Is(err, store.ErrNoLeaderElected),
+		errors.Is(err, store.ErrNoVoters),
+		errors.Is(err, store.ErrPaused),
+		errors.Is(err, raft.ErrRaftShutdown):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, store.ErrNotClusterMember),
+		errors.Is(err, store.ErrHotKeysDisabled),
+		errors.Is(err, store.ErrChunkedTransform):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, store.ErrVersionConflict),
+		errors.Is(err, store.ErrScanInterrupted):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, store.ErrTooManyInflightApplies),
+		errors.Is(err, store.ErrUploadTooLarge):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, store.ErrLogIndexOutOfRange):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, store.ErrInvalidKey),
+		errors.Is(err, store.ErrInvalidValue):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, bigcache.ErrEntryNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return err
+}
+
+// notLeaderStatus returns a FailedPrecondition status for err. If leaderAddr is
+// known, it's attached as an ErrorInfo detail so clients can retry against the
+// leader right away.
+func notLeaderStatus(err error, leaderAddr string) error {
+	st := status.New(codes.FailedPrecondition, err.Error())
+	if leaderAddr == "" {
+		return st.Err()
+	}
+
+	withHint, derr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   notLeaderReason,
+		Domain:   errorDomain,
+		Metadata: map[string]string{leaderAddrKey: leaderAddr},
+	})
+	if derr != nil {
+		return st.Err()
+	}
+	return withHint.Err()
+}
+
+// leaderRPCAddr returns the rpc address of the leader, or an empty string if it
+// isn't known.
+func leaderRPCAddr(sf ServerFinder) string {
+	if sf == nil {
+		return ""
+	}
+
+	servers, err := sf.GetServers()
+	if err != nil {
+		return ""
+	}
+	for _, srv := range servers {
+		if srv.IsLeader {
+			return srv.RpcAddr
+		}
+	}
+	return ""
+}
+
+// LeaderHint returns the rpc address of the leader attached to a not-leader error
+// returned by the server.
+func LeaderHint(err error) (string, bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.FailedPrecondition {
+		return "", false
+	}
+
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != errorDomain || info.Reason != notLeaderReason {
+			continue
+		}
+		addr, ok := info.Metadata[leaderAddrKey]
+		return addr, ok && addr != ""
+	}
+	return "", false
+}
+
+// unaryStatusInterceptor returns an interceptor that converts the errors returned
+// by unary handlers using toStatus.
+func unaryStatusInterceptor(sf ServerFinder) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		res, err := handler(ctx, req)
+		return res, toStatus(err, sf)
+	}
+}
+
+// streamStatusInterceptor returns an interceptor that converts the errors returned
+// by stream handlers using toStatus.
+func streamStatusInterceptor(sf ServerFinder) grpc.StreamServerInterceptor {
+	return func(
+		srv any,
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		return toStatus(handler(srv, ss), sf)
+	}
+}
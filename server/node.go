@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// NodeIDTrailer is the trailer containing the id of the node that served the
+	// request.
+	NodeIDTrailer = "x-node-id"
+
+	// NodeRoleTrailer is the trailer containing the role of the node that served
+	// the request, either "leader" or "follower".
+	NodeRoleTrailer = "x-node-role"
+
+	// forwardedMetadata marks a Get that has been forwarded to the node named in
+	// its node_id. A node that doesn't have that id rejects the request instead of
+	// forwarding it again, so misconfigured ids can't make a request loop.
+	forwardedMetadata = "x-forwarded"
+)
+
+// forwarded reports whether the request has already been forwarded by another
+// node.
+func forwarded(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return len(md.Get(forwardedMetadata)) > 0
+}
+
+// LeaderChecker is implemented by caches that know whether the node is the leader
+// of the cluster. The store.Store implements this.
+type LeaderChecker interface {
+	IsLeader() bool
+}
+
+// nodeTrailer returns the trailer identifying the node. The role is only included
+// if c is a LeaderChecker. The role is checked after the request has been handled,
+// so it's the role the node had when it responded.
+func nodeTrailer(nodeID string, c Cache) metadata.MD {
+	md := metadata.MD{}
+	if nodeID != "" {
+		md.Set(NodeIDTrailer, nodeID)
+	}
+	if lc, ok := c.(LeaderChecker); ok {
+		role := "follower"
+		if lc.IsLeader() {
+			role = "leader"
+		}
+		md.Set(NodeRoleTrailer, role)
+	}
+	return md
+}
+
+// unaryNodeInterceptor returns an interceptor that sets the node trailer on every
+// unary response, including errors, so clients can tell which node answered.
+func unaryNodeInterceptor(nodeID string, c Cache) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		res, err := handler(ctx, req)
+		if md := nodeTrailer(nodeID, c); md.Len() > 0 {
+			grpc.SetTrailer(ctx, md)
+		}
+		return res, err
+	}
+}
+
+// streamNodeInterceptor returns an interceptor that sets the node trailer on every
+// stream.
+func streamNodeInterceptor(nodeID string, c Cache) grpc.StreamServerInterceptor {
+	return func(
+		srv any,
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		err := handler(srv, ss)
+		if md := nodeTrailer(nodeID, c); md.Len() > 0 {
+			ss.SetTrailer(md)
+		}
+		return err
+	}
+}
@@ -4,9 +4,20 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// ewmaWeight is the weight of a new latency sample in the moving average.
+	ewmaWeight = 0.3
+
+	// exploreEvery makes every n:th follower pick plain round-robin, so slow
+	// followers still get requests and their average can recover.
+	exploreEvery = 10
 )
 
 type Picker struct {
@@ -14,6 +25,11 @@ type Picker struct {
 	leader    balancer.SubConn
 	followers []balancer.SubConn
 	curr      uint64
+
+	// latencies contains the moving average of the response times of followers in
+	// nanoseconds.
+	latencyMu sync.Mutex
+	latencies map[balancer.SubConn]float64
 }
 
 func init() {
@@ -34,23 +50,76 @@ func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
 			continue
 		}
 
+		// followers that are too far behind the leader are not used for reads.
+		if lagging, _ := scInfo.Address.Attributes.Value("lagging").(bool); lagging {
+			continue
+		}
+
 		followers = append(followers, sc)
 	}
 
 	p.followers = followers
 
+	// forget the latencies of followers that are gone.
+	p.latencyMu.Lock()
+	latencies := make(map[balancer.SubConn]float64, len(followers))
+	for _, sc := range followers {
+		if l, ok := p.latencies[sc]; ok {
+			latencies[sc] = l
+		}
+	}
+	p.latencies = latencies
+	p.latencyMu.Unlock()
+
 	return p
 }
 
+// followerMethods are the reads that followers can serve, so they're spread over
+// the followers. Every other method goes to the leader, since writes and most admin
+// calls only succeed there.
+var followerMethods = map[string]bool{
+	"Get":       true,
+	"GetStream": true,
+	"GetPrefix": true,
+	"Head":      true,
+	"Scan":      true,
+}
+
+// methodName returns the name of a method without its service, such as "Get" for
+// "/pb.Cache/Get".
+func methodName(fullMethodName string) string {
+	return fullMethodName[strings.LastIndex(fullMethodName, "/")+1:]
+}
+
+// readsFromFollower reports whether the request can be served by a follower.
+// Reads with strong consistency metadata only succeed on the leader.
+func readsFromFollower(info balancer.PickInfo) bool {
+	if !followerMethods[methodName(info.FullMethodName)] {
+		return false
+	}
+	if info.Ctx == nil {
+		return true
+	}
+
+	md, _ := metadata.FromOutgoingContext(info.Ctx)
+	vals := md.Get(ConsistencyMetadata)
+	return len(vals) == 0 || Consistency(vals[len(vals)-1]) != ConsistencyStrong
+}
+
 func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	p.RLock()
 	defer p.RUnlock()
 
 	var res balancer.PickResult
-	if strings.Contains(info.FullMethodName, "Set") || len(p.followers) == 0 {
+	if !readsFromFollower(info) || len(p.followers) == 0 {
 		res.SubConn = p.leader
-	} else if strings.Contains(info.FullMethodName, "Get") {
-		res.SubConn = p.nextFollower()
+	} else {
+		sc := p.nextFollower()
+		start := time.Now()
+		res.SubConn = sc
+		res.Done = func(balancer.DoneInfo) {
+			p.observe(sc, time.Since(start))
+		}
 	}
 
 	if res.SubConn == nil {
@@ -60,10 +129,47 @@ func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	return res, nil
 }
 
+// nextFollower picks the next follower in round-robin order, unless the follower
+// after it has a lower average latency. Comparing two candidates instead of
+// always picking the fastest follower keeps the load spread out.
 func (p *Picker) nextFollower() balancer.SubConn {
 	cur := atomic.AddUint64(&p.curr, uint64(1))
 	len := uint64(len(p.followers))
 	idx := int(cur % len)
 
-	return p.followers[idx]
+	candidate := p.followers[idx]
+	if len == 1 || cur%exploreEvery == 0 {
+		return candidate
+	}
+
+	other := p.followers[int((cur+1)%len)]
+	if p.latency(other) < p.latency(candidate) {
+		return other
+	}
+	return candidate
+}
+
+// latency returns the average latency of sc. Followers without samples are
+// treated as the fastest so they'll get requests.
+func (p *Picker) latency(sc balancer.SubConn) float64 {
+	p.latencyMu.Lock()
+	defer p.latencyMu.Unlock()
+	return p.latencies[sc]
+}
+
+// observe adds a latency sample of a follower into its moving average.
+func (p *Picker) observe(sc balancer.SubConn, d time.Duration) {
+	p.latencyMu.Lock()
+	defer p.latencyMu.Unlock()
+
+	if p.latencies == nil {
+		p.latencies = make(map[balancer.SubConn]float64)
+	}
+
+	prev, ok := p.latencies[sc]
+	if !ok {
+		p.latencies[sc] = float64(d)
+		return
+	}
+	p.latencies[sc] = ewmaWeight*float64(d) + (1-ewmaWeight)*prev
 }
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestIDMetadata is the metadata key of the request id. Clients can set it to
+// correlate their own logs with the logs of the server, otherwise the server
+// generates one. The id is returned in the trailer with the same key.
+const RequestIDMetadata = "x-request-id"
+
+// maxRequestIDLen is the longest request id accepted from clients. The id is
+// logged with every request, so ids that are longer are replaced.
+const maxRequestIDLen = 128
+
+// requestIDKey is the context key of the request id.
+type requestIDKey struct{}
+
+// RequestID returns the id of the request handled with ctx, or an empty string if
+// it doesn't have one.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random request id.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID checks that a request id sent by a client is short and only
+// contains printable ASCII characters, so it's safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// incomingRequestID returns the request id sent by the client, or a new one if the
+// client didn't send a valid id.
+func incomingRequestID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(RequestIDMetadata); len(ids) > 0 && validRequestID(ids[0]) {
+			return ids[0]
+		}
+	}
+	return newRequestID()
+}
+
+// unaryRequestIDInterceptor returns an interceptor that reads or generates the
+// request id, adds it to the log fields of the request and sets it in the trailer.
+// It needs to run after the logging interceptor, so the fields end up in its logs.
+func unaryRequestIDInterceptor() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req any,
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (any, error) {
+		id := incomingRequestID(ctx)
+		ctxzap.AddFields(ctx, zap.String("request_id", id))
+		grpc.SetTrailer(ctx, metadata.Pairs(RequestIDMetadata, id))
+
+		return handler(context.WithValue(ctx, requestIDKey{}, id), req)
+	}
+}
+
+// withOutgoingRequestID passes the request id of ctx on to requests sent to other
+// nodes, so their logs can be correlated with this node's logs.
+func withOutgoingRequestID(ctx context.Context) context.Context {
+	if id := RequestID(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, RequestIDMetadata, id)
+	}
+	return ctx
+}
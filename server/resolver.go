@@ -2,14 +2,17 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/nireo/dcache/pb"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/serviceconfig"
 )
@@ -18,14 +21,62 @@ const ResolverName string = "dcache"
 
 type Resolver struct {
 	sync.Mutex
+
+	// Logger is used to log resolving errors. Defaults to the global logger.
+	Logger *zap.Logger
+
+	// Keepalive controls the keepalive pings sent on the connection used for
+	// resolving servers. Defaults to DefaultClientKeepalive.
+	Keepalive keepalive.ClientParameters
+
+	// MaxReadLag is the maximum number of log entries a follower's applied index
+	// can trail the leader's commit index before it's no longer used for reads.
+	// Checking the lag needs a connection to every node. Zero disables the check.
+	MaxReadLag uint64
+
 	clientConn    resolver.ClientConn
 	resolverConn  *grpc.ClientConn
+	dialOpts      []grpc.DialOption
+	nodeConns     map[string]*grpc.ClientConn
 	serviceConfig *serviceconfig.ParseResult
 	log           *zap.Logger
 }
 
+// ResolverConfig contains the configurable fields of a Resolver.
+type ResolverConfig struct {
+	// Logger is used to log resolving errors. Defaults to the global logger.
+	Logger *zap.Logger
+
+	// Keepalive controls the keepalive pings sent on the connection used for
+	// resolving servers. Defaults to DefaultClientKeepalive.
+	Keepalive keepalive.ClientParameters
+
+	// MaxReadLag is the maximum number of log entries a follower's applied index
+	// can trail the leader's commit index before it's no longer used for reads.
+	// Zero disables the check.
+	MaxReadLag uint64
+}
+
+// NewResolver returns a resolver configured with conf. It can be passed to a
+// single connection with grpc.WithResolvers.
+func NewResolver(conf ResolverConfig) *Resolver {
+	return &Resolver{
+		Logger:     conf.Logger,
+		Keepalive:  conf.Keepalive,
+		MaxReadLag: conf.MaxReadLag,
+	}
+}
+
+// RegisterResolver registers a resolver configured with conf for the dcache
+// scheme, replacing the default one. It's used by every connection dialed with a
+// dcache:/// target without its own resolver, so it should be called during
+// initialization before such connections are dialed.
+func RegisterResolver(conf ResolverConfig) {
+	resolver.Register(NewResolver(conf))
+}
+
 func init() {
-	resolver.Register(&Resolver{})
+	RegisterResolver(ResolverConfig{})
 }
 
 func (r *Resolver) Build(
@@ -33,7 +84,11 @@ func (r *Resolver) Build(
 	cc resolver.ClientConn,
 	opts resolver.BuildOptions,
 ) (resolver.Resolver, error) {
-	r.log = zap.L().Named("resolver")
+	logger := r.Logger
+	if logger == nil {
+		logger = zap.L()
+	}
+	r.log = logger.Named("resolver")
 	r.clientConn = cc
 
 	r.serviceConfig = r.clientConn.ParseServiceConfig(
@@ -41,8 +96,17 @@ func (r *Resolver) Build(
 	)
 
 	var err error
-	dialopts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
-	r.resolverConn, err = grpc.Dial(target.Endpoint, dialopts...)
+	kp := r.Keepalive
+	if kp == (keepalive.ClientParameters{}) {
+		kp = DefaultClientKeepalive
+	}
+
+	r.dialOpts = []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithKeepaliveParams(kp),
+	}
+	r.nodeConns = make(map[string]*grpc.ClientConn)
+	r.resolverConn, err = grpc.Dial(target.Endpoint, r.dialOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -55,11 +119,20 @@ func (r *Resolver) Scheme() string {
 	return ResolverName
 }
 
+// DefaultClientKeepalive pings idle connections often enough that intermediaries
+// don't drop them. It's allowed by the server's DefaultKeepalivePolicy.
+var DefaultClientKeepalive = keepalive.ClientParameters{
+	Time:                30 * time.Second,
+	Timeout:             10 * time.Second,
+	PermitWithoutStream: true,
+}
+
 var _ resolver.Resolver = (*Resolver)(nil)
 
+// ResolveNow requests the servers and updates the addresses of the client
+// connection. The lock is only held while looking up the node connections, so
+// slow nodes don't block Close.
 func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
-	r.Lock()
-	defer r.Unlock()
 	client := pb.NewCacheClient(r.resolverConn)
 	ctx := context.Background()
 	res, err := client.GetServers(ctx, &pb.Empty{})
@@ -71,14 +144,28 @@ func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
 		return
 	}
 
-	addrs := make([]resolver.Address, len(res.Server))
-	for i := range res.Server {
-		addrs[i] = resolver.Address{
-			Addr: res.Server[i].RpcAddr,
-			Attributes: attributes.New(
-				"is_leader", res.Server[i].IsLeader,
-			),
+	var lagging map[string]bool
+	if r.MaxReadLag > 0 {
+		lagging = r.laggingFollowers(res.Server)
+	}
+
+	addrs := make([]resolver.Address, 0, len(res.Server))
+	for _, srv := range res.Server {
+		// don't route reads to followers that are known to have failed or that have
+		// been paused.
+		if (srv.Failed || srv.Paused) && !srv.IsLeader {
+			continue
+		}
+
+		attrs := attributes.New("is_leader", srv.IsLeader)
+		if lagging[srv.RpcAddr] {
+			attrs = attrs.WithValue("lagging", true)
 		}
+
+		addrs = append(addrs, resolver.Address{
+			Addr:       srv.RpcAddr,
+			Attributes: attrs,
+		})
 	}
 
 	r.clientConn.UpdateState(resolver.State{
@@ -87,6 +174,121 @@ func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
 	})
 }
 
+// laggingFollowers returns the addresses of followers whose applied index trails
+// the leader's commit index by more than MaxReadLag. Followers that cannot be
+// reached are also considered lagging.
+func (r *Resolver) laggingFollowers(servers []*pb.Server) map[string]bool {
+	conns := r.connsTo(servers)
+
+	var leaderAddr string
+	for _, srv := range servers {
+		if srv.IsLeader {
+			leaderAddr = srv.RpcAddr
+		}
+	}
+	if leaderAddr == "" {
+		return nil
+	}
+
+	// the nodes are queried concurrently, so a slow node doesn't delay the others.
+	var (
+		wg    sync.WaitGroup
+		diags = make([]*pb.DiagnosticsResponse, len(servers))
+		errs  = make([]error, len(servers))
+	)
+	for i, srv := range servers {
+		wg.Add(1)
+		go func(i int, conn *grpc.ClientConn) {
+			defer wg.Done()
+			diags[i], errs[i] = diagnostics(conn)
+		}(i, conns[srv.RpcAddr])
+	}
+	wg.Wait()
+
+	var leader *pb.DiagnosticsResponse
+	for i, srv := range servers {
+		if !srv.IsLeader {
+			continue
+		}
+		if errs[i] != nil {
+			r.log.Error("failed to get leader diagnostics", zap.Error(errs[i]))
+			return nil
+		}
+		leader = diags[i]
+	}
+
+	lagging := make(map[string]bool)
+	for i, srv := range servers {
+		if srv.IsLeader {
+			continue
+		}
+
+		if errs[i] != nil {
+			r.log.Warn("failed to get follower diagnostics",
+				zap.String("addr", srv.RpcAddr),
+				zap.Error(errs[i]),
+			)
+			lagging[srv.RpcAddr] = true
+			continue
+		}
+
+		if diags[i].AppliedIndex+r.MaxReadLag < leader.CommitIndex {
+			lagging[srv.RpcAddr] = true
+		}
+	}
+	return lagging
+}
+
+// connsTo returns the connections to servers. The connections are kept open
+// between resolves, but the ones to nodes that are no longer listed are closed.
+// Servers that couldn't be dialed are missing from the returned map.
+func (r *Resolver) connsTo(servers []*pb.Server) map[string]*grpc.ClientConn {
+	r.Lock()
+	defer r.Unlock()
+
+	conns := make(map[string]*grpc.ClientConn, len(servers))
+	// the connections have been closed with the resolver.
+	if r.nodeConns == nil {
+		return conns
+	}
+
+	for _, srv := range servers {
+		conn, ok := r.nodeConns[srv.RpcAddr]
+		if !ok {
+			var err error
+			conn, err = grpc.Dial(srv.RpcAddr, r.dialOpts...)
+			if err != nil {
+				r.log.Warn("failed to dial node",
+					zap.String("addr", srv.RpcAddr),
+					zap.Error(err),
+				)
+				continue
+			}
+			r.nodeConns[srv.RpcAddr] = conn
+		}
+		conns[srv.RpcAddr] = conn
+	}
+
+	for addr, conn := range r.nodeConns {
+		if _, ok := conns[addr]; !ok {
+			conn.Close()
+			delete(r.nodeConns, addr)
+		}
+	}
+	return conns
+}
+
+// diagnostics requests diagnostics from the node behind conn.
+func diagnostics(conn *grpc.ClientConn) (*pb.DiagnosticsResponse, error) {
+	if conn == nil {
+		return nil, errors.New("no connection to the node")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return pb.NewCacheClient(conn).Diagnostics(ctx, &pb.Empty{})
+}
+
 // Close tears down clientConn and all underlying connections
 func (r *Resolver) Close() {
 	if err := r.resolverConn.Close(); err != nil {
@@ -95,4 +297,11 @@ func (r *Resolver) Close() {
 			zap.Error(err),
 		)
 	}
+
+	r.Lock()
+	defer r.Unlock()
+	for _, conn := range r.nodeConns {
+		conn.Close()
+	}
+	r.nodeConns = nil
 }
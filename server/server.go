@@ -2,16 +2,36 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 
+	"github.com/allegro/bigcache/v3"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
 	"github.com/nireo/dcache/pb"
+	"github.com/nireo/dcache/store"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+
+	// registers the gzip compressor, so clients can send compressed requests. The
+	// responses are compressed with the same compressor as the request.
+	_ "google.golang.org/grpc/encoding/gzip"
+
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 )
 
 // Cache interface that represents the most basic operations of the cache.
@@ -27,10 +47,101 @@ type ServerFinder interface {
 	GetServers() ([]*pb.Server, error)
 }
 
+// ServerWatcher is implemented by ServerFinders that can tell when their servers
+// might have changed, so cached servers are refreshed before Config.ServersCacheTTL
+// has passed. The store.Store implements this.
+type ServerWatcher interface {
+	ServersVersion() uint64
+}
+
+// StatsProvider is implemented by caches that can report statistics about
+// themselves. The store.Store implements this.
+type StatsProvider interface {
+	Stats() (*pb.StatsResponse, error)
+}
+
+// Diagnoser is implemented by caches that can report diagnostics about their
+// replication state.
+type Diagnoser interface {
+	Diagnostics() (*pb.DiagnosticsResponse, error)
+}
+
+// Snapshotter is implemented by caches that can be forced to take a snapshot and
+// describe it.
+type Snapshotter interface {
+	ForceSnapshot() (*pb.SnapshotResponse, error)
+}
+
+// Scanner is implemented by caches that can iterate their entries. fn is called
+// for every key starting with prefix, up to limit keys if limit is positive, and
+// an error returned from fn stops the scan.
+type Scanner interface {
+	Scan(prefix string, limit int, fn func(key string, value []byte) error) error
+}
+
+// Versioner is implemented by caches that keep a version for every key and
+// support conditional and idempotent writes.
+type Versioner interface {
+	GetVersioned(key string) ([]byte, uint64, error)
+	SetWithOptions(
+		ctx context.Context, key string, value []byte, opts store.SetOptions,
+	) (uint64, error)
+}
+
+// StaleReader is implemented by caches that can be asked to read from their local
+// cache even if they are configured for strongly consistent reads.
+type StaleReader interface {
+	GetWithOptions(key string, opts store.GetOptions) ([]byte, uint64, error)
+}
+
+// ResultGetter is implemented by caches that can fall back to reading from their
+// local cache when the leader cannot be reached, and report when they did so.
+type ResultGetter interface {
+	GetWithResult(key string, opts store.GetOptions) (store.GetResult, error)
+}
+
+// IndexedSetter is implemented by caches that can report the raft log index at
+// which a write was committed.
+type IndexedSetter interface {
+	SetWithIndex(key string, value []byte) (uint64, error)
+}
+
+// LogInspector is implemented by caches that can return the entries of their raft
+// log for debugging.
+type LogInspector interface {
+	LogEntry(index uint64) (*raft.Log, error)
+}
+
+// HotKeyTracker is implemented by caches that can estimate how often their keys
+// are read.
+type HotKeyTracker interface {
+	HotKeys(limit int) ([]*pb.HotKey, error)
+}
+
+// MemberLister lists the members of the cluster as seen by the gossip protocol.
+// The registry.Registry implements this.
+type MemberLister interface {
+	Members() []serf.Member
+}
+
+// LeaderManager is implemented by caches that can report and transfer the
+// leadership of the cluster.
+type LeaderManager interface {
+	LeaderID() (string, error)
+	LeaderRPCAddr() string
+	StepdownTo(id string, wait bool) error
+}
+
 type grpcImpl struct {
 	pb.UnsafeCacheServer
 	c  Cache
 	sf ServerFinder
+	ml MemberLister
+
+	nodeID     string
+	ackTimeout time.Duration
+	followers  followerConns
+	servers    serversCache
 }
 
 func newimpl(c Cache) *grpcImpl {
@@ -39,11 +150,96 @@ func newimpl(c Cache) *grpcImpl {
 	}
 }
 
-// NewServer returns a grpc.Server with the given options applied.
-func NewServer(cache Cache, grpcOpts ...grpc.ServerOption) (
-	*grpc.Server, error,
-) {
-	logger := zap.L().Named("server")
+// Config contains all of the configurable fields for the gRPC server. Only Cache
+// is required.
+type Config struct {
+	Cache        Cache
+	ServerFinder ServerFinder
+
+	// NodeID is the raft server id of the node. Get requests with a different
+	// node_id are forwarded to that node. It's also sent to clients in the
+	// NodeIDTrailer of every response.
+	NodeID string
+
+	// MemberLister is used to respond to Members requests. Optional.
+	MemberLister MemberLister
+
+	// Logger is used by the logging interceptors. Defaults to the global logger.
+	Logger *zap.Logger
+
+	// LogSampling caps the number of request logs written every second. The first
+	// Initial logs with the same message and level are written, after which only
+	// every Thereafter:th one is. Sampling is disabled if it's nil.
+	LogSampling *zap.SamplingConfig
+
+	// EnableReflection registers the gRPC reflection service, so tools like grpcurl
+	// can be used without the proto file. Should be kept off in production.
+	EnableReflection bool
+
+	// KeepaliveParams controls the keepalive pings the server sends on idle
+	// connections. The gRPC defaults are used if it's not set.
+	KeepaliveParams keepalive.ServerParameters
+
+	// KeepalivePolicy controls how often clients are allowed to send keepalive
+	// pings. Defaults to DefaultKeepalivePolicy.
+	KeepalivePolicy keepalive.EnforcementPolicy
+
+	// PeerTLS is used to connect to the other nodes, when waiting for the acks of
+	// a write or forwarding a read. It should be set if the other nodes serve gRPC
+	// with TLS. The connections are insecure if it's nil.
+	PeerTLS *tls.Config
+
+	// AckTimeout is the maximum time a Set with min_acks waits for the followers
+	// to apply the write. Defaults to 5 seconds.
+	AckTimeout time.Duration
+
+	// TracerProvider is used to start a span for every request. The span is passed
+	// to the cache in the request context. Tracing is disabled if it's not set.
+	TracerProvider trace.TracerProvider
+
+	// ServersCacheTTL is how long the servers returned by GetServers are cached,
+	// since every resolver requests them and reading them from raft isn't free.
+	// If the ServerFinder is a ServerWatcher, the cache is also refreshed when the
+	// servers change. Zero disables caching.
+	ServersCacheTTL time.Duration
+
+	// MaxConcurrentStreams limits the number of concurrent streams on a single
+	// client connection. Streams over the limit wait until earlier ones finish.
+	// Defaults to DefaultMaxConcurrentStreams.
+	MaxConcurrentStreams uint32
+
+	// Done should be closed once the server has stopped. The connections the
+	// server opened to the other nodes are closed then. Optional.
+	Done <-chan struct{}
+}
+
+// DefaultMaxConcurrentStreams bounds the concurrency of a single connection, so
+// that a client opening many long-running Scan streams cannot overwhelm the
+// server. gRPC doesn't limit the streams by default.
+const DefaultMaxConcurrentStreams = 256
+
+// DefaultKeepalivePolicy allows clients, such as the resolver, to keep idle
+// connections alive with pings. The gRPC default only allows a ping every 5 minutes
+// which is too rare to stop intermediaries from dropping idle connections.
+var DefaultKeepalivePolicy = keepalive.EnforcementPolicy{
+	MinTime:             10 * time.Second,
+	PermitWithoutStream: true,
+}
+
+// New returns a grpc.Server configured with conf and the given options applied.
+func New(conf Config, grpcOpts ...grpc.ServerOption) (*grpc.Server, error) {
+	logger := conf.Logger
+	if logger == nil {
+		logger = zap.L()
+	}
+	logger = logger.Named("server")
+
+	if sc := conf.LogSampling; sc != nil {
+		logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewSamplerWithOptions(core, time.Second, sc.Initial, sc.Thereafter)
+		}))
+	}
+
 	zapOpts := []grpc_zap.Option{
 		grpc_zap.WithDurationField(
 			func(duration time.Duration) zapcore.Field {
@@ -55,74 +251,189 @@ func NewServer(cache Cache, grpcOpts ...grpc.ServerOption) (
 		),
 	}
 
+	policy := conf.KeepalivePolicy
+	if policy == (keepalive.EnforcementPolicy{}) {
+		policy = DefaultKeepalivePolicy
+	}
+
+	maxStreams := conf.MaxConcurrentStreams
+	if maxStreams == 0 {
+		maxStreams = DefaultMaxConcurrentStreams
+	}
+
+	var (
+		streamInterceptors []grpc.StreamServerInterceptor
+		unaryInterceptors  []grpc.UnaryServerInterceptor
+	)
+	if conf.TracerProvider != nil {
+		tracer := conf.TracerProvider.Tracer(tracerName)
+		streamInterceptors = append(streamInterceptors, streamTracingInterceptor(tracer))
+		unaryInterceptors = append(unaryInterceptors, unaryTracingInterceptor(tracer))
+	}
+
+	streamInterceptors = append(streamInterceptors,
+		grpc_ctxtags.StreamServerInterceptor(),
+		grpc_zap.StreamServerInterceptor(logger, zapOpts...),
+		streamNodeInterceptor(conf.NodeID, conf.Cache),
+		streamStatusInterceptor(conf.ServerFinder),
+	)
+	unaryInterceptors = append(unaryInterceptors,
+		grpc_ctxtags.UnaryServerInterceptor(),
+		grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
+		unaryRequestIDInterceptor(),
+		unaryNodeInterceptor(conf.NodeID, conf.Cache),
+		unaryStatusInterceptor(conf.ServerFinder),
+		unaryConsistencyInterceptor(),
+	)
+
 	grpcOpts = append(grpcOpts,
-		grpc.StreamInterceptor(
-			grpc_middleware.ChainStreamServer(
-				grpc_ctxtags.StreamServerInterceptor(),
-				grpc_zap.StreamServerInterceptor(logger, zapOpts...),
-			)), grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-			grpc_ctxtags.UnaryServerInterceptor(),
-			grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
-		)),
+		grpc.KeepaliveParams(conf.KeepaliveParams),
+		grpc.KeepaliveEnforcementPolicy(policy),
+		grpc.MaxConcurrentStreams(maxStreams),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryInterceptors...)),
 	)
 
 	grsv := grpc.NewServer(grpcOpts...)
-	srv := newimpl(cache)
+	srv := newimpl(conf.Cache)
+	srv.sf = conf.ServerFinder
+	srv.ml = conf.MemberLister
+	srv.nodeID = conf.NodeID
+	srv.servers.ttl = conf.ServersCacheTTL
+	srv.followers.tls = conf.PeerTLS
+	srv.ackTimeout = conf.AckTimeout
+	if srv.ackTimeout == 0 {
+		srv.ackTimeout = defaultAckTimeout
+	}
 	pb.RegisterCacheServer(grsv, srv)
 
+	if conf.Done != nil {
+		go func() {
+			<-conf.Done
+			srv.followers.close()
+		}()
+	}
+
+	if conf.EnableReflection {
+		reflection.Register(grsv)
+	}
+
 	return grsv, nil
 }
 
 // NewServer returns a grpc.Server with the given options applied.
-func NewServerWithGetter(cache Cache, getter ServerFinder, grpcOpts ...grpc.ServerOption) (
+func NewServer(cache Cache, grpcOpts ...grpc.ServerOption) (
 	*grpc.Server, error,
 ) {
-	logger := zap.L().Named("server")
-	zapOpts := []grpc_zap.Option{
-		grpc_zap.WithDurationField(
-			func(duration time.Duration) zapcore.Field {
-				return zap.Int64(
-					"grpc.time_ns",
-					duration.Nanoseconds(),
-				)
-			},
-		),
-	}
-
-	grpcOpts = append(grpcOpts,
-		grpc.StreamInterceptor(
-			grpc_middleware.ChainStreamServer(
-				grpc_ctxtags.StreamServerInterceptor(),
-				grpc_zap.StreamServerInterceptor(logger, zapOpts...),
-			)), grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
-			grpc_ctxtags.UnaryServerInterceptor(),
-			grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
-		)),
-	)
-
-	grsv := grpc.NewServer(grpcOpts...)
-	srv := newimpl(cache)
-	srv.sf = getter
-	pb.RegisterCacheServer(grsv, srv)
+	return New(Config{Cache: cache}, grpcOpts...)
+}
 
-	return grsv, nil
+// NewServerWithGetter returns a grpc.Server that can also respond to GetServers
+// requests using getter.
+func NewServerWithGetter(cache Cache, getter ServerFinder, grpcOpts ...grpc.ServerOption) (
+	*grpc.Server, error,
+) {
+	return New(Config{Cache: cache, ServerFinder: getter}, grpcOpts...)
 }
 
-// Set handles Set requests by calling the internal Cache's Set function
+// Set handles Set requests by calling the internal Cache's Set function. If the
+// cache supports versions, the write is versioned and the new version returned.
+// Conditional and idempotent writes need version support.
 func (s *grpcImpl) Set(ctx context.Context, req *pb.SetRequest) (
-	*pb.Empty, error,
+	*pb.SetResponse, error,
 ) {
+	if v, ok := s.c.(Versioner); ok {
+		// a follower forwards the write with min_acks, and the leader waits for the
+		// acks. Otherwise the followers are counted before the write is applied, so
+		// a write that cannot be acked isn't applied either.
+		minAcks := int(req.MinAcks)
+		waitLocally := minAcks > 0
+		if lc, ok := s.c.(LeaderChecker); ok && !lc.IsLeader() {
+			waitLocally = false
+		}
+
+		var followers []string
+		if waitLocally {
+			var err error
+			if followers, err = s.ackFollowers(minAcks); err != nil {
+				return nil, err
+			}
+		}
+
+		// the request id is passed on if the store forwards the write to the leader.
+		version, err := v.SetWithOptions(withOutgoingRequestID(ctx), req.Key, req.Value, store.SetOptions{
+			ExpectedVersion: req.ExpectedVersion,
+			IdempotencyKey:  req.IdempotencyKey,
+			MinAcks:         req.MinAcks,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if waitLocally {
+			if err := s.waitForAcks(ctx, version, followers, minAcks); err != nil {
+				return nil, err
+			}
+		}
+		return &pb.SetResponse{Version: version, Index: version}, nil
+	}
+
+	if req.ExpectedVersion != 0 || req.IdempotencyKey != "" || req.MinAcks > 0 {
+		return nil, status.Error(codes.Unimplemented, "cache doesn't support versions")
+	}
+
+	if is, ok := s.c.(IndexedSetter); ok {
+		index, err := is.SetWithIndex(req.Key, req.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.SetResponse{Index: index}, nil
+	}
+
 	err := s.c.Set(req.Key, req.Value)
 	if err != nil {
 		return nil, err
 	}
-	return &pb.Empty{}, nil
+	return &pb.SetResponse{}, nil
 }
 
 // Get handles Get requests by calling the internal Cache's Get function.
 func (s *grpcImpl) Get(ctx context.Context, req *pb.GetRequest) (
 	*pb.GetResponse, error,
 ) {
+	if req.NodeId != "" && req.NodeId != s.nodeID {
+		if forwarded(ctx) {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"read forwarded to node %q was received by node %q", req.NodeId, s.nodeID)
+		}
+		return s.forwardGet(ctx, req)
+	}
+
+	opts := readOptions(ctx, req)
+	if sr, ok := s.c.(StaleReader); ok && opts.Stale {
+		val, version, err := sr.GetWithOptions(req.Key, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.GetResponse{Value: val, Version: version}, nil
+	}
+
+	if rg, ok := s.c.(ResultGetter); ok {
+		res, err := rg.GetWithResult(req.Key, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.GetResponse{Value: res.Value, Version: res.Version, Stale: res.Stale}, nil
+	}
+
+	if v, ok := s.c.(Versioner); ok {
+		val, version, err := v.GetVersioned(req.Key)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.GetResponse{Value: val, Version: version}, nil
+	}
+
 	val, err := s.c.Get(req.Key)
 	if err != nil {
 		return nil, err
@@ -130,13 +441,278 @@ func (s *grpcImpl) Get(ctx context.Context, req *pb.GetRequest) (
 	return &pb.GetResponse{Value: val}, nil
 }
 
+// forwardGet sends a Get request to the node named in the request, so the value is
+// read from that node's cache. The request is only forwarded once.
+func (s *grpcImpl) forwardGet(ctx context.Context, req *pb.GetRequest) (
+	*pb.GetResponse, error,
+) {
+	if s.sf == nil {
+		return nil, status.Error(codes.Unimplemented, "cache doesn't know the other nodes")
+	}
+
+	servers, err := s.sf.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	s.followers.prune(servers)
+
+	for _, srv := range servers {
+		if srv.Id != req.NodeId {
+			continue
+		}
+
+		client, err := s.followers.client(srv.RpcAddr)
+		if err != nil {
+			return nil, err
+		}
+		ctx = metadata.AppendToOutgoingContext(withOutgoingRequestID(ctx), forwardedMetadata, "true")
+		return client.Get(ctx, req)
+	}
+	return nil, status.Errorf(codes.NotFound, "node %q not found in the cluster", req.NodeId)
+}
+
+// Head handles Head requests by getting the value from the internal Cache and only
+// returning its size. A missing key isn't an error.
+func (s *grpcImpl) Head(ctx context.Context, req *pb.HeadRequest) (
+	*pb.HeadResponse, error,
+) {
+	val, err := s.c.Get(req.Key)
+	if errors.Is(err, bigcache.ErrEntryNotFound) {
+		return &pb.HeadResponse{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pb.HeadResponse{Found: true, SizeBytes: uint64(len(val))}, nil
+}
+
+// GetLogEntry returns the raft log entry at the requested index of the node
+// handling the request. Command entries are decoded.
+func (s *grpcImpl) GetLogEntry(ctx context.Context, req *pb.LogEntryRequest) (
+	*pb.LogEntryResponse, error,
+) {
+	li, ok := s.c.(LogInspector)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "cache doesn't have a raft log")
+	}
+
+	l, err := li.LogEntry(req.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.LogEntryResponse{
+		Index: l.Index,
+		Term:  l.Term,
+		Type:  l.Type.String(),
+	}
+	if l.Type != raft.LogCommand {
+		return res, nil
+	}
+
+	op, key, value, err := store.DecodeLogEntry(l.Data)
+	if err != nil {
+		return nil, err
+	}
+	res.Operation = store.OperationName(op)
+	res.Key = key
+	res.Value = value
+	return res, nil
+}
+
+// HotKeys returns the most read keys of the node handling the request.
+func (s *grpcImpl) HotKeys(ctx context.Context, req *pb.HotKeysRequest) (
+	*pb.HotKeysResponse, error,
+) {
+	ht, ok := s.c.(HotKeyTracker)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "cache doesn't track hot keys")
+	}
+
+	keys, err := ht.HotKeys(int(req.Limit))
+	if err != nil {
+		return nil, err
+	}
+	return &pb.HotKeysResponse{Keys: keys}, nil
+}
+
 // GetServers returns addresses to all of the Raft servers.
 func (s *grpcImpl) GetServers(ctx context.Context, req *pb.Empty) (
 	*pb.GetServer, error,
 ) {
-	servers, err := s.sf.GetServers()
+	servers, err := s.servers.get(s.sf)
 	if err != nil {
 		return nil, err
 	}
 	return &pb.GetServer{Server: servers}, nil
 }
+
+// serversCache caches the servers of a ServerFinder for ttl.
+type serversCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	servers []*pb.Server
+	fetched time.Time
+	version uint64
+}
+
+// get returns the cached servers if they are fresh. Otherwise the servers are
+// requested from sf. The returned servers are shared between callers and must not
+// be modified.
+func (c *serversCache) get(sf ServerFinder) ([]*pb.Server, error) {
+	if c.ttl == 0 {
+		return sf.GetServers()
+	}
+
+	// the version is read before the servers, so a change during the request
+	// invalidates them on the next call.
+	var version uint64
+	sw, watched := sf.(ServerWatcher)
+	if watched {
+		version = sw.ServersVersion()
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.fetched.IsZero() && time.Since(c.fetched) < c.ttl && c.version == version {
+		return c.servers, nil
+	}
+
+	servers, err := sf.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	c.servers, c.fetched, c.version = servers, time.Now(), version
+	return servers, nil
+}
+
+// Stats returns statistics about the cache of the node handling the request.
+func (s *grpcImpl) Stats(ctx context.Context, req *pb.Empty) (
+	*pb.StatsResponse, error,
+) {
+	sp, ok := s.c.(StatsProvider)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "cache doesn't provide stats")
+	}
+	return sp.Stats()
+}
+
+// ForceSnapshot makes the node handling the request take a snapshot, and returns
+// the path, size and duration of the snapshot.
+func (s *grpcImpl) ForceSnapshot(ctx context.Context, req *pb.Empty) (
+	*pb.SnapshotResponse, error,
+) {
+	sn, ok := s.c.(Snapshotter)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "cache doesn't support snapshots")
+	}
+	return sn.ForceSnapshot()
+}
+
+// GetLeader returns the ID and rpc address of the current leader of the cluster.
+func (s *grpcImpl) GetLeader(ctx context.Context, req *pb.Empty) (
+	*pb.LeaderResponse, error,
+) {
+	lm, ok := s.c.(LeaderManager)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "cache doesn't support leadership")
+	}
+
+	id, err := lm.LeaderID()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.LeaderResponse{Id: id, RpcAddr: lm.LeaderRPCAddr()}, nil
+}
+
+// TransferLeadership transfers the leadership to the given server. The request
+// must be sent to the current leader.
+func (s *grpcImpl) TransferLeadership(ctx context.Context, req *pb.TransferRequest) (
+	*pb.Empty, error,
+) {
+	lm, ok := s.c.(LeaderManager)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "cache doesn't support leadership")
+	}
+
+	if req.TargetId == "" {
+		return nil, status.Error(codes.InvalidArgument, "target_id is required")
+	}
+
+	if err := lm.StepdownTo(req.TargetId, true); err != nil {
+		return nil, err
+	}
+	return &pb.Empty{}, nil
+}
+
+// Diagnostics returns the replication state of the node handling the request.
+func (s *grpcImpl) Diagnostics(ctx context.Context, req *pb.Empty) (
+	*pb.DiagnosticsResponse, error,
+) {
+	d, ok := s.c.(Diagnoser)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "cache doesn't provide diagnostics")
+	}
+	return d.Diagnostics()
+}
+
+// Ping echoes the payload back with the server's time. Clients can use it to
+// measure the round-trip time and clock skew to the node.
+func (s *grpcImpl) Ping(ctx context.Context, req *pb.PingRequest) (
+	*pb.PingResponse, error,
+) {
+	return &pb.PingResponse{
+		Payload:    req.Payload,
+		ServerTime: time.Now().UnixNano(),
+	}, nil
+}
+
+// Scan streams every key-value pair of the node handling the request whose key
+// starts with the requested prefix.
+func (s *grpcImpl) Scan(req *pb.ScanRequest, stream pb.Cache_ScanServer) error {
+	sc, ok := s.c.(Scanner)
+	if !ok {
+		return status.Error(codes.Unimplemented, "cache doesn't support scanning")
+	}
+
+	return sc.Scan(req.Prefix, 0, func(key string, value []byte) error {
+		return stream.Send(&pb.ScanEntry{Key: key, Value: value})
+	})
+}
+
+// GetPrefix streams the key-value pairs of the node whose keys start with the
+// requested prefix, up to the requested limit. The cache copies the pairs a chunk
+// at a time and stops at the limit, so only a chunk of a large result is buffered.
+func (s *grpcImpl) GetPrefix(req *pb.GetPrefixRequest, stream pb.Cache_GetPrefixServer) error {
+	sc, ok := s.c.(Scanner)
+	if !ok {
+		return status.Error(codes.Unimplemented, "cache doesn't support scanning")
+	}
+
+	return sc.Scan(req.Prefix, int(req.Limit), func(key string, value []byte) error {
+		return stream.Send(&pb.KeyValue{Key: key, Value: value})
+	})
+}
+
+// Members returns the members of the cluster known to the gossip protocol. Unlike
+// GetServers this includes members that haven't been added to raft.
+func (s *grpcImpl) Members(ctx context.Context, req *pb.Empty) (
+	*pb.MembersResponse, error,
+) {
+	if s.ml == nil {
+		return nil, status.Error(codes.Unimplemented, "server doesn't know the cluster members")
+	}
+
+	members := s.ml.Members()
+	res := &pb.MembersResponse{Members: make([]*pb.Member, 0, len(members))}
+	for _, m := range members {
+		res.Members = append(res.Members, &pb.Member{
+			Name:   m.Name,
+			Addr:   net.JoinHostPort(m.Addr.String(), strconv.Itoa(int(m.Port))),
+			Status: m.Status.String(),
+			Tags:   m.Tags,
+		})
+	}
+	return res, nil
+}
@@ -1,22 +1,40 @@
 package server_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/allegro/bigcache/v3"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
 	"github.com/nireo/dcache/pb"
 	"github.com/nireo/dcache/server"
+	"github.com/nireo/dcache/store"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
 )
 
 type mockCache struct{}
@@ -156,6 +174,75 @@ func TestPickerUsesFollowers(t *testing.T) {
 	}
 }
 
+func TestPickerStrongReadsUseLeader(t *testing.T) {
+	picker, subConns := setupPickerTest()
+
+	strong := metadata.AppendToOutgoingContext(
+		context.Background(), server.ConsistencyMetadata, string(server.ConsistencyStrong),
+	)
+	eventual := metadata.AppendToOutgoingContext(
+		context.Background(), server.ConsistencyMetadata, string(server.ConsistencyEventual),
+	)
+	for i := 0; i < 10; i++ {
+		pick, err := picker.Pick(balancer.PickInfo{FullMethodName: "/pb.Cache/Get", Ctx: strong})
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], pick.SubConn)
+
+		pick, err = picker.Pick(balancer.PickInfo{FullMethodName: "/pb.Cache/Get", Ctx: eventual})
+		require.NoError(t, err)
+		require.NotEqual(t, subConns[0], pick.SubConn)
+	}
+}
+
+func TestPickerDefaultsToLeader(t *testing.T) {
+	picker, subConns := setupPickerTest()
+
+	// methods that aren't reads go to the leader instead of finding no SubConn.
+	for _, method := range []string{
+		"/pb.Cache/TransferLeadership",
+		"/pb.Cache/Diagnostics",
+		"/pb.Cache/Ping",
+		"/pb.Cache/Checksum",
+		"/pb.Cache/Stats",
+		"/pb.Cache/Members",
+		"/pb.Cache/GetServers",
+		"/pb.Cache/SetStream",
+	} {
+		pick, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+		require.NoError(t, err, method)
+		require.Equal(t, subConns[0], pick.SubConn, method)
+	}
+
+	pick, err := picker.Pick(balancer.PickInfo{FullMethodName: "/pb.Cache/GetPrefix"})
+	require.NoError(t, err)
+	require.NotEqual(t, subConns[0], pick.SubConn)
+}
+
+func TestPickerPrefersFastFollowers(t *testing.T) {
+	picker, subConns := setupPickerTest()
+	slow := subConns[1]
+	info := balancer.PickInfo{
+		FullMethodName: "/cache.v1.Cache/Get",
+	}
+
+	picks := make(map[balancer.SubConn]int)
+	for i := 0; i < 200; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.NotNil(t, pick.Done)
+
+		if pick.SubConn == slow {
+			time.Sleep(2 * time.Millisecond)
+		}
+		pick.Done(balancer.DoneInfo{})
+		picks[pick.SubConn]++
+	}
+
+	// the slow follower still gets some requests to keep its latency up to date.
+	require.Greater(t, picks[slow], 0)
+	require.Less(t, picks[slow], picks[subConns[2]]/4)
+}
+
 type getServers struct{}
 
 func (s *getServers) GetServers() ([]*pb.Server, error) {
@@ -166,6 +253,11 @@ func (s *getServers) GetServers() ([]*pb.Server, error) {
 	}, {
 		Id:      "follower",
 		RpcAddr: "localhost:9002",
+	}, {
+		// failed followers are not given to the picker.
+		Id:      "failed",
+		RpcAddr: "localhost:9003",
+		Failed:  true,
 	}}, nil
 }
 
@@ -221,3 +313,1232 @@ func TestResolver(t *testing.T) {
 	r.ResolveNow(resolver.ResolveNowOptions{})
 	require.Equal(t, wantState, conn.state)
 }
+
+func TestReflection(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := server.New(server.Config{
+		Cache:            &mockCache{},
+		EnableReflection: true,
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	stream, err := reflectionpb.NewServerReflectionClient(cc).
+		ServerReflectionInfo(context.Background())
+	require.NoError(t, err)
+
+	err = stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	})
+	require.NoError(t, err)
+
+	res, err := stream.Recv()
+	require.NoError(t, err)
+
+	var names []string
+	for _, s := range res.GetListServicesResponse().GetService() {
+		names = append(names, s.Name)
+	}
+	require.Contains(t, names, "pb.Cache")
+}
+
+// idleProxy forwards connections to target and drops them if no data has moved in
+// either direction for idleTimeout, like a load balancer or NAT would.
+type idleProxy struct {
+	l        net.Listener
+	target   string
+	timeout  time.Duration
+	accepted atomic.Int32
+}
+
+func newIdleProxy(t *testing.T, target string, idleTimeout time.Duration) *idleProxy {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	p := &idleProxy{l: l, target: target, timeout: idleTimeout}
+	go p.serve()
+	return p
+}
+
+func (p *idleProxy) serve() {
+	for {
+		conn, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+		p.accepted.Add(1)
+
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+
+		var lastActive atomic.Int64
+		lastActive.Store(time.Now().UnixNano())
+		pipe := func(dst, src net.Conn) {
+			defer dst.Close()
+			defer src.Close()
+
+			buf := make([]byte, 32*1024)
+			for {
+				src.SetReadDeadline(time.Now().Add(p.timeout))
+				n, err := src.Read(buf)
+				if n > 0 {
+					lastActive.Store(time.Now().UnixNano())
+					if _, err := dst.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					// the other direction might still be active.
+					if time.Since(time.Unix(0, lastActive.Load())) < p.timeout {
+						continue
+					}
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}
+		go pipe(upstream, conn)
+		go pipe(conn, upstream)
+	}
+}
+
+func TestKeepaliveSurvivesIdleTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := server.New(server.Config{
+		Cache: &mockCache{},
+		// grpc doesn't allow pinging more often than once a second.
+		KeepaliveParams: keepalive.ServerParameters{
+			Time:    time.Second,
+			Timeout: time.Second,
+		},
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	idleTimeout := 1500 * time.Millisecond
+	proxy := newIdleProxy(t, l.Addr().String(), idleTimeout)
+	defer proxy.l.Close()
+
+	cc, err := grpc.Dial(
+		proxy.l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	client := pb.NewCacheClient(cc)
+	_, err = client.Set(context.Background(), &pb.SetRequest{Key: "key", Value: []byte("val")})
+	require.NoError(t, err)
+
+	// keep the connection idle for multiple idle timeout windows.
+	time.Sleep(2 * idleTimeout)
+
+	_, err = client.Get(context.Background(), &pb.GetRequest{Key: "key"})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), proxy.accepted.Load())
+}
+
+type leaderCache struct {
+	mockCache
+	leader string
+	addrs  map[string]string
+}
+
+func (c *leaderCache) LeaderID() (string, error) {
+	return c.leader, nil
+}
+
+func (c *leaderCache) LeaderRPCAddr() string {
+	return c.addrs[c.leader]
+}
+
+func (c *leaderCache) StepdownTo(id string, wait bool) error {
+	if _, ok := c.addrs[id]; !ok {
+		return errors.New("unknown server")
+	}
+	c.leader = id
+	return nil
+}
+
+func TestLeadership(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cache := &leaderCache{
+		leader: "1",
+		addrs:  map[string]string{"1": "localhost:9000", "2": "localhost:9001"},
+	}
+	srv, err := server.New(server.Config{Cache: cache})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := pb.NewCacheClient(cc)
+
+	ctx := context.Background()
+	res, err := client.GetLeader(ctx, &pb.Empty{})
+	require.NoError(t, err)
+	require.Equal(t, "1", res.Id)
+	require.Equal(t, "localhost:9000", res.RpcAddr)
+
+	_, err = client.TransferLeadership(ctx, &pb.TransferRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = client.TransferLeadership(ctx, &pb.TransferRequest{TargetId: "3"})
+	require.Error(t, err)
+
+	_, err = client.TransferLeadership(ctx, &pb.TransferRequest{TargetId: "2"})
+	require.NoError(t, err)
+
+	res, err = client.GetLeader(ctx, &pb.Empty{})
+	require.NoError(t, err)
+	require.Equal(t, "2", res.Id)
+	require.Equal(t, "localhost:9001", res.RpcAddr)
+}
+
+func TestLeadershipUnimplemented(t *testing.T) {
+	client, cleanup := setupTest(t, nil)
+	defer cleanup()
+
+	_, err := client.GetLeader(context.Background(), &pb.Empty{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestPing(t *testing.T) {
+	client, cleanup := setupTest(t, nil)
+	defer cleanup()
+
+	before := time.Now().UnixNano()
+	res, err := client.Ping(context.Background(), &pb.PingRequest{Payload: []byte("ping")})
+	require.NoError(t, err)
+	require.Equal(t, []byte("ping"), res.Payload)
+	require.GreaterOrEqual(t, res.ServerTime, before)
+	require.LessOrEqual(t, res.ServerTime, time.Now().UnixNano())
+}
+
+type diagCache struct {
+	mockCache
+	diag *pb.DiagnosticsResponse
+}
+
+func (c *diagCache) Diagnostics() (*pb.DiagnosticsResponse, error) {
+	return c.diag, nil
+}
+
+type staticServers []*pb.Server
+
+func (s staticServers) GetServers() ([]*pb.Server, error) {
+	return s, nil
+}
+
+func TestResolverExcludesLaggingFollowers(t *testing.T) {
+	diags := []*pb.DiagnosticsResponse{
+		{CommitIndex: 100, AppliedIndex: 100},
+		{CommitIndex: 100, AppliedIndex: 90},
+		{CommitIndex: 100, AppliedIndex: 10},
+	}
+
+	var servers staticServers
+	var listeners []net.Listener
+	for i := range diags {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners = append(listeners, l)
+		servers = append(servers, &pb.Server{
+			Id:       fmt.Sprintf("%d", i),
+			RpcAddr:  l.Addr().String(),
+			IsLeader: i == 0,
+		})
+	}
+
+	for i, l := range listeners {
+		srv, err := server.NewServerWithGetter(&diagCache{diag: diags[i]}, servers)
+		require.NoError(t, err)
+		go srv.Serve(l)
+		defer srv.Stop()
+	}
+
+	conn := &clientConn{}
+	r := &server.Resolver{MaxReadLag: 50}
+	_, err := r.Build(resolver.Target{
+		Endpoint: listeners[0].Addr().String(),
+	}, conn, resolver.BuildOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+
+	require.Len(t, conn.state.Addresses, 3)
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	subConns := make(map[string]*subConn)
+	for _, addr := range conn.state.Addresses {
+		sc := &subConn{}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns[addr.Addr] = sc
+	}
+
+	picker := &server.Picker{}
+	picker.Build(buildInfo)
+
+	lagging := subConns[servers[2].RpcAddr]
+	info := balancer.PickInfo{FullMethodName: "/cache.v1.Cache/Get"}
+	for i := 0; i < 20; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[servers[1].RpcAddr], pick.SubConn)
+		require.NotEqual(t, lagging, pick.SubConn)
+	}
+}
+
+func TestRegisteredResolverMaxReadLag(t *testing.T) {
+	diags := []*pb.DiagnosticsResponse{
+		{CommitIndex: 100, AppliedIndex: 100},
+		{CommitIndex: 100, AppliedIndex: 90},
+		{CommitIndex: 100, AppliedIndex: 10},
+	}
+
+	var servers staticServers
+	var listeners []net.Listener
+	for i := range diags {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners = append(listeners, l)
+		servers = append(servers, &pb.Server{
+			Id:       fmt.Sprintf("%d", i),
+			RpcAddr:  l.Addr().String(),
+			IsLeader: i == 0,
+		})
+	}
+
+	for i, l := range listeners {
+		srv, err := server.New(server.Config{
+			Cache:        &diagCache{diag: diags[i]},
+			ServerFinder: servers,
+			NodeID:       servers[i].Id,
+		})
+		require.NoError(t, err)
+		go srv.Serve(l)
+		defer srv.Stop()
+	}
+
+	server.RegisterResolver(server.ResolverConfig{MaxReadLag: 50})
+	t.Cleanup(func() { server.RegisterResolver(server.ResolverConfig{}) })
+
+	conn, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", server.ResolverName, servers[0].RpcAddr),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewCacheClient(conn)
+
+	// reads go to the follower that is close enough to the leader.
+	for i := 0; i < 20; i++ {
+		var trailer metadata.MD
+		_, err := client.Get(context.Background(), &pb.GetRequest{Key: "key"}, grpc.Trailer(&trailer))
+		require.NoError(t, err)
+		require.Equal(t, []string{servers[1].Id}, trailer.Get(server.NodeIDTrailer))
+	}
+}
+
+func TestResolverClosesRemovedNodeConns(t *testing.T) {
+	finder := &countingFinder{}
+	var nodes []*connCounter
+	var servers []*pb.Server
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		counter := &connCounter{Listener: l}
+		nodes = append(nodes, counter)
+		servers = append(servers, &pb.Server{
+			Id:       fmt.Sprintf("%d", i),
+			RpcAddr:  l.Addr().String(),
+			IsLeader: i == 0,
+		})
+
+		cache := &diagCache{diag: &pb.DiagnosticsResponse{CommitIndex: 10, AppliedIndex: 10}}
+		srv, err := server.NewServerWithGetter(cache, finder)
+		require.NoError(t, err)
+		go srv.Serve(counter)
+		defer srv.Stop()
+	}
+	finder.set(servers)
+
+	conn := &clientConn{}
+	r := &server.Resolver{MaxReadLag: 50}
+	_, err := r.Build(resolver.Target{
+		Endpoint: servers[0].RpcAddr,
+	}, conn, resolver.BuildOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+
+	require.Len(t, conn.state.Addresses, 3)
+	require.Equal(t, int32(1), nodes[2].open.Load())
+
+	// the connection to a node that left the cluster is closed.
+	finder.set(servers[:2])
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Len(t, conn.state.Addresses, 2)
+	require.Eventually(t, func() bool {
+		return nodes[2].open.Load() == 0
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(1), nodes[1].open.Load())
+}
+
+func TestLogSampling(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := server.New(server.Config{
+		Cache:       &mockCache{},
+		Logger:      zap.New(core),
+		LogSampling: &zap.SamplingConfig{Initial: 5, Thereafter: 100},
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := pb.NewCacheClient(cc)
+
+	for i := 0; i < 100; i++ {
+		_, err := client.Ping(context.Background(), &pb.PingRequest{})
+		require.NoError(t, err)
+	}
+
+	require.Greater(t, logs.Len(), 0)
+	require.LessOrEqual(t, logs.Len(), 10)
+}
+
+type errCache struct {
+	err error
+}
+
+func (c *errCache) Get(key string) ([]byte, error) {
+	return nil, c.err
+}
+
+func (c *errCache) Set(key string, val []byte) error {
+	return c.err
+}
+
+func TestErrorStatus(t *testing.T) {
+	for err, want := range map[error]codes.Code{
+		raft.ErrNotLeader:               codes.FailedPrecondition,
+		store.ErrNoLeaderElected:        codes.Unavailable,
+		store.ErrPaused:                 codes.Unavailable,
+		store.ErrLogIndexOutOfRange:     codes.OutOfRange,
+		store.ErrNotClusterMember:       codes.FailedPrecondition,
+		store.ErrHotKeysDisabled:        codes.FailedPrecondition,
+		store.ErrChunkedTransform:       codes.FailedPrecondition,
+		store.ErrVersionConflict:        codes.Aborted,
+		store.ErrTooManyInflightApplies: codes.ResourceExhausted,
+		store.ErrUploadTooLarge:         codes.ResourceExhausted,
+		bigcache.ErrEntryNotFound:       codes.NotFound,
+	} {
+		l, lerr := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, lerr)
+
+		srv, serr := server.NewServer(&errCache{err: err})
+		require.NoError(t, serr)
+		go srv.Serve(l)
+
+		cc, derr := grpc.Dial(
+			l.Addr().String(),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		require.NoError(t, derr)
+		client := pb.NewCacheClient(cc)
+
+		_, gotErr := client.Set(context.Background(), &pb.SetRequest{Key: "key"})
+		require.Equal(t, want, status.Code(gotErr), err.Error())
+
+		cc.Close()
+		srv.Stop()
+	}
+}
+
+type members []serf.Member
+
+func (m members) Members() []serf.Member {
+	return m
+}
+
+func TestLeaderHint(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := server.New(server.Config{
+		Cache: &errCache{err: raft.ErrNotLeader},
+		ServerFinder: staticServers{
+			{Id: "0", RpcAddr: "10.0.0.1:9200", IsLeader: true},
+			{Id: "1", RpcAddr: "10.0.0.2:9200"},
+		},
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+
+	_, err = pb.NewCacheClient(cc).Set(context.Background(), &pb.SetRequest{Key: "key"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	addr, ok := server.LeaderHint(err)
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.1:9200", addr)
+
+	_, ok = server.LeaderHint(status.Error(codes.FailedPrecondition, "other"))
+	require.False(t, ok)
+}
+
+func TestMembers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// member 1 has joined serf, but hasn't been added to raft yet.
+	lister := members{{
+		Name:   "0",
+		Addr:   net.ParseIP("127.0.0.1"),
+		Port:   9000,
+		Status: serf.StatusAlive,
+		Tags:   map[string]string{"rpc_addr": "127.0.0.1:9200"},
+	}, {
+		Name:   "1",
+		Addr:   net.ParseIP("127.0.0.1"),
+		Port:   9001,
+		Status: serf.StatusAlive,
+		Tags:   map[string]string{"rpc_addr": "127.0.0.1:9201"},
+	}}
+	servers := staticServers{{Id: "0", RpcAddr: "127.0.0.1:9200", IsLeader: true}}
+
+	srv, err := server.New(server.Config{
+		Cache:        &mockCache{},
+		ServerFinder: servers,
+		MemberLister: lister,
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := pb.NewCacheClient(cc)
+
+	res, err := client.GetServers(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Len(t, res.Server, 1)
+
+	mres, err := client.Members(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Len(t, mres.Members, 2)
+	require.Equal(t, "1", mres.Members[1].Name)
+	require.Equal(t, "127.0.0.1:9001", mres.Members[1].Addr)
+	require.Equal(t, "alive", mres.Members[1].Status)
+	require.Equal(t, "127.0.0.1:9201", mres.Members[1].Tags["rpc_addr"])
+}
+
+func TestMembersUnimplemented(t *testing.T) {
+	client, cleanup := setupTest(t, nil)
+	defer cleanup()
+
+	_, err := client.Members(context.Background(), &pb.Empty{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestHead(t *testing.T) {
+	client, cleanup := setupTest(t, nil)
+	defer cleanup()
+
+	ctx := context.Background()
+	_, err := client.Set(ctx, &pb.SetRequest{
+		Key:   "testkey",
+		Value: []byte("testvalue"),
+	})
+	require.NoError(t, err)
+
+	res, err := client.Head(ctx, &pb.HeadRequest{Key: "testkey"})
+	require.NoError(t, err)
+	require.True(t, res.Found)
+	require.Equal(t, uint64(len("testvalue")), res.SizeBytes)
+
+	res, err = client.Head(ctx, &pb.HeadRequest{Key: "missing"})
+	require.NoError(t, err)
+	require.False(t, res.Found)
+	require.Zero(t, res.SizeBytes)
+}
+
+// countingConn counts the bytes read from and written to the connection.
+type countingConn struct {
+	net.Conn
+	read, written *atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestGzipCompression(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	testCache, err := bigcache.New(context.Background(), bigcache.DefaultConfig(10*time.Minute))
+	require.NoError(t, err)
+	defer testCache.Close()
+
+	srv, err := server.New(server.Config{Cache: testCache})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	var read, written atomic.Int64
+	cc, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			return &countingConn{Conn: conn, read: &read, written: &written}, nil
+		}),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	value := bytes.Repeat([]byte("compressible value "), 1<<15)
+	client := pb.NewCacheClient(cc)
+
+	_, err = client.Set(context.Background(), &pb.SetRequest{Key: "key", Value: value})
+	require.NoError(t, err)
+
+	res, err := client.Get(context.Background(), &pb.GetRequest{Key: "key"})
+	require.NoError(t, err)
+	require.Equal(t, value, res.Value)
+
+	// both the request and the response should've been compressed.
+	require.Less(t, written.Load(), int64(len(value)/10))
+	require.Less(t, read.Load(), int64(len(value)/10))
+}
+
+// blockingScanner blocks scans until release is closed, keeping track of how many
+// scans are running at once.
+type blockingScanner struct {
+	mockCache
+	release chan struct{}
+	active  atomic.Int32
+	maxSeen atomic.Int32
+}
+
+func (c *blockingScanner) Scan(prefix string, limit int, fn func(key string, value []byte) error) error {
+	n := c.active.Add(1)
+	defer c.active.Add(-1)
+	for {
+		seen := c.maxSeen.Load()
+		if n <= seen || c.maxSeen.CompareAndSwap(seen, n) {
+			break
+		}
+	}
+
+	<-c.release
+	return fn(prefix, []byte("value"))
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cache := &blockingScanner{release: make(chan struct{})}
+	srv, err := server.New(server.Config{
+		Cache:                cache,
+		MaxConcurrentStreams: 2,
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := pb.NewCacheClient(cc)
+
+	// make sure the client has received the limit before opening the streams.
+	_, err = client.Ping(context.Background(), &pb.PingRequest{})
+	require.NoError(t, err)
+
+	const streams = 5
+	errs := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		go func() {
+			stream, err := client.Scan(context.Background(), &pb.ScanRequest{Prefix: "key"})
+			if err != nil {
+				errs <- err
+				return
+			}
+			_, err = stream.Recv()
+			errs <- err
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		return cache.active.Load() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// the excess streams wait for the running ones instead of reaching the server.
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, int32(2), cache.active.Load())
+
+	close(cache.release)
+	for i := 0; i < streams; i++ {
+		require.NoError(t, <-errs)
+	}
+	require.Equal(t, int32(2), cache.maxSeen.Load())
+}
+
+// sliceScanner iterates its entries in the order they are in the slice.
+type sliceScanner struct {
+	mockCache
+	entries []*pb.KeyValue
+}
+
+func (c *sliceScanner) Scan(
+	prefix string, limit int, fn func(key string, value []byte) error,
+) error {
+	found := 0
+	for _, e := range c.entries {
+		if !strings.HasPrefix(e.Key, prefix) {
+			continue
+		}
+		if limit > 0 && found == limit {
+			return nil
+		}
+		found++
+		if err := fn(e.Key, e.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestChecksum(t *testing.T) {
+	checksum := func(entries []*pb.KeyValue, prefix string) *pb.ChecksumResponse {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		srv, err := server.NewServer(&sliceScanner{entries: entries})
+		require.NoError(t, err)
+		go srv.Serve(l)
+		defer srv.Stop()
+
+		cc, err := grpc.Dial(
+			l.Addr().String(),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		require.NoError(t, err)
+		defer cc.Close()
+
+		res, err := pb.NewCacheClient(cc).Checksum(
+			context.Background(), &pb.ChecksumRequest{Prefix: prefix},
+		)
+		require.NoError(t, err)
+		return res
+	}
+
+	a := &pb.KeyValue{Key: "users/1", Value: []byte("alice")}
+	b := &pb.KeyValue{Key: "users/2", Value: []byte("bob")}
+	c := &pb.KeyValue{Key: "other", Value: []byte("x")}
+
+	// the order the cache is iterated in doesn't matter.
+	want := checksum([]*pb.KeyValue{a, b, c}, "")
+	require.Equal(t, uint64(3), want.Count)
+	require.Equal(t, want.Hash, checksum([]*pb.KeyValue{c, b, a}, "").Hash)
+
+	// a changed value changes the checksum.
+	changed := &pb.KeyValue{Key: "users/2", Value: []byte("bobby")}
+	require.NotEqual(t, want.Hash, checksum([]*pb.KeyValue{a, changed, c}, "").Hash)
+
+	// only the keys under the prefix are included.
+	users := checksum([]*pb.KeyValue{c, a, b}, "users/")
+	require.Equal(t, uint64(2), users.Count)
+	require.Equal(t, users.Hash, checksum([]*pb.KeyValue{a, b}, "").Hash)
+}
+
+// countingFinder counts the GetServers calls and reports a version that is
+// increased when its servers are changed.
+type countingFinder struct {
+	mu      sync.Mutex
+	servers []*pb.Server
+	calls   int
+	version uint64
+}
+
+func (f *countingFinder) GetServers() ([]*pb.Server, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	return f.servers, nil
+}
+
+func (f *countingFinder) ServersVersion() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.version
+}
+
+func (f *countingFinder) set(servers []*pb.Server) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.servers = servers
+	f.version++
+}
+
+func (f *countingFinder) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func TestServersCache(t *testing.T) {
+	finder := &countingFinder{servers: []*pb.Server{{Id: "0", IsLeader: true}}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := server.New(server.Config{
+		Cache:           &mockCache{},
+		ServerFinder:    finder,
+		ServersCacheTTL: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := pb.NewCacheClient(cc)
+
+	getServers := func() []*pb.Server {
+		res, err := client.GetServers(context.Background(), &pb.Empty{})
+		require.NoError(t, err)
+		return res.Server
+	}
+
+	// repeated requests within the TTL are served from the cache.
+	for i := 0; i < 10; i++ {
+		require.Len(t, getServers(), 1)
+	}
+	require.Equal(t, 1, finder.callCount())
+
+	// a change invalidates the cache right away.
+	finder.set([]*pb.Server{{Id: "0", IsLeader: true}, {Id: "1"}})
+	require.Len(t, getServers(), 2)
+	require.Len(t, getServers(), 2)
+	require.Equal(t, 2, finder.callCount())
+
+	// the servers are requested again once the TTL has passed.
+	time.Sleep(250 * time.Millisecond)
+	require.Len(t, getServers(), 2)
+	require.Equal(t, 3, finder.callCount())
+}
+
+// connCounter is a listener that counts its open connections.
+type connCounter struct {
+	net.Listener
+	open atomic.Int32
+}
+
+func (l *connCounter) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.open.Add(1)
+	return &countedConn{Conn: conn, l: l}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	l    *connCounter
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.l.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+func TestForwardConnsClosed(t *testing.T) {
+	var nodes []*connCounter
+	for _, id := range []string{"1", "2"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		counter := &connCounter{Listener: l}
+		nodes = append(nodes, counter)
+
+		srv, err := server.New(server.Config{Cache: &mockCache{}, NodeID: id})
+		require.NoError(t, err)
+		go srv.Serve(counter)
+		defer srv.Stop()
+	}
+
+	finder := &countingFinder{servers: []*pb.Server{
+		{Id: "1", RpcAddr: nodes[0].Addr().String()},
+		{Id: "2", RpcAddr: nodes[1].Addr().String()},
+	}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	srv, err := server.New(server.Config{
+		Cache:        &mockCache{},
+		ServerFinder: finder,
+		NodeID:       "0",
+		Done:         done,
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := pb.NewCacheClient(cc)
+
+	for _, id := range []string{"1", "2"} {
+		_, err = client.Get(context.Background(), &pb.GetRequest{Key: "key", NodeId: id})
+		require.NoError(t, err)
+	}
+	require.Equal(t, int32(1), nodes[0].open.Load())
+	require.Equal(t, int32(1), nodes[1].open.Load())
+
+	// the connection to a node that left the cluster is closed.
+	finder.set(finder.servers[1:])
+	_, err = client.Get(context.Background(), &pb.GetRequest{Key: "key", NodeId: "2"})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return nodes[0].open.Load() == 0
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, int32(1), nodes[1].open.Load())
+
+	// the rest are closed once the server is done.
+	close(done)
+	require.Eventually(t, func() bool {
+		return nodes[1].open.Load() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestForwardGetOnce(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	// the node doesn't know its own id, so it would keep forwarding the request
+	// to itself.
+	srv, err := server.New(server.Config{
+		Cache:        &mockCache{},
+		ServerFinder: &countingFinder{servers: []*pb.Server{{Id: "1", RpcAddr: l.Addr().String()}}},
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = pb.NewCacheClient(cc).Get(ctx, &pb.GetRequest{Key: "key", NodeId: "1"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+// roleCache is a cache that reports whether its node is the leader.
+type roleCache struct {
+	mockCache
+	leader atomic.Bool
+}
+
+func (c *roleCache) IsLeader() bool {
+	return c.leader.Load()
+}
+
+func TestNodeTrailers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cache := &roleCache{}
+	srv, err := server.New(server.Config{Cache: cache, NodeID: "node-1"})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+	client := pb.NewCacheClient(cc)
+
+	var trailer metadata.MD
+	_, err = client.Get(context.Background(), &pb.GetRequest{Key: "key"}, grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	require.Equal(t, []string{"node-1"}, trailer.Get(server.NodeIDTrailer))
+	require.Equal(t, []string{"follower"}, trailer.Get(server.NodeRoleTrailer))
+
+	cache.leader.Store(true)
+	_, err = client.Set(context.Background(), &pb.SetRequest{Key: "key"}, grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	require.Equal(t, []string{"node-1"}, trailer.Get(server.NodeIDTrailer))
+	require.Equal(t, []string{"leader"}, trailer.Get(server.NodeRoleTrailer))
+
+	// streams have the trailer as well, even if they fail.
+	stream, err := client.Scan(context.Background(), &pb.ScanRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	require.Equal(t, []string{"node-1"}, stream.Trailer().Get(server.NodeIDTrailer))
+	require.Equal(t, []string{"leader"}, stream.Trailer().Get(server.NodeRoleTrailer))
+}
+
+// fallbackCache is a cache that always falls back to a stale local read.
+type fallbackCache struct {
+	mockCache
+}
+
+func (c *fallbackCache) GetWithResult(
+	key string, opts store.GetOptions,
+) (store.GetResult, error) {
+	return store.GetResult{Value: []byte("old"), Version: 3, Stale: true}, nil
+}
+
+func TestStaleGetResponse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := server.New(server.Config{Cache: &fallbackCache{}})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+
+	res, err := pb.NewCacheClient(cc).Get(context.Background(), &pb.GetRequest{Key: "key"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), res.Value)
+	require.Equal(t, uint64(3), res.Version)
+	require.True(t, res.Stale)
+}
+
+// replicaCache is a cache whose local copy lags behind the leader, so only strong
+// reads see the latest value.
+type replicaCache struct {
+	mockCache
+}
+
+func (c *replicaCache) GetWithResult(
+	key string, opts store.GetOptions,
+) (store.GetResult, error) {
+	if opts.Strong {
+		return store.GetResult{Value: []byte("new"), Version: 2}, nil
+	}
+	return store.GetResult{Value: []byte("old"), Version: 1}, nil
+}
+
+func TestConsistencyMetadata(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := server.New(server.Config{Cache: &replicaCache{}})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	dial := func(opts ...grpc.DialOption) pb.CacheClient {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		cc, err := grpc.Dial(l.Addr().String(), opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { cc.Close() })
+		return pb.NewCacheClient(cc)
+	}
+
+	strong := dial(server.WithConsistency(server.ConsistencyStrong))
+	for i := 0; i < 5; i++ {
+		res, err := strong.Get(context.Background(), &pb.GetRequest{Key: "key"})
+		require.NoError(t, err)
+		require.Equal(t, []byte("new"), res.Value)
+	}
+
+	res, err := dial().Get(context.Background(), &pb.GetRequest{Key: "key"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), res.Value)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		server.ConsistencyMetadata, "sometimes")
+	_, err = dial().Get(ctx, &pb.GetRequest{Key: "key"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestRequestID(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := server.New(server.Config{Cache: &mockCache{}, Logger: zap.New(core)})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+	client := pb.NewCacheClient(cc)
+
+	logged := func(id string) bool {
+		for _, entry := range logs.All() {
+			if entry.ContextMap()["request_id"] == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	// the id sent by the client is logged and returned.
+	var trailer metadata.MD
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		server.RequestIDMetadata, "my-request")
+	_, err = client.Ping(ctx, &pb.PingRequest{}, grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	require.Equal(t, []string{"my-request"}, trailer.Get(server.RequestIDMetadata))
+	require.True(t, logged("my-request"))
+
+	// otherwise the server generates one.
+	trailer = nil
+	_, err = client.Ping(context.Background(), &pb.PingRequest{}, grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	ids := trailer.Get(server.RequestIDMetadata)
+	require.Len(t, ids, 1)
+	require.NotEmpty(t, ids[0])
+	require.NotEqual(t, "my-request", ids[0])
+	require.True(t, logged(ids[0]))
+
+	// ids that are too long are replaced.
+	trailer = nil
+	long := strings.Repeat("a", 129)
+	ctx = metadata.AppendToOutgoingContext(context.Background(), server.RequestIDMetadata, long)
+	_, err = client.Ping(ctx, &pb.PingRequest{}, grpc.Trailer(&trailer))
+	require.NoError(t, err)
+	ids = trailer.Get(server.RequestIDMetadata)
+	require.Len(t, ids, 1)
+	require.NotEmpty(t, ids[0])
+	require.NotEqual(t, long, ids[0])
+	require.False(t, logged(long))
+}
+
+// forwardingCache records the outgoing metadata of the writes, which the store
+// sends when it forwards a write to the leader.
+type forwardingCache struct {
+	mockCache
+	mu sync.Mutex
+	md metadata.MD
+}
+
+func (c *forwardingCache) GetVersioned(key string) ([]byte, uint64, error) {
+	return nil, 0, bigcache.ErrEntryNotFound
+}
+
+func (c *forwardingCache) SetWithOptions(
+	ctx context.Context, key string, value []byte, opts store.SetOptions,
+) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.md, _ = metadata.FromOutgoingContext(ctx)
+	return 1, nil
+}
+
+func TestRequestIDForwardedWrites(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cache := &forwardingCache{}
+	srv, err := server.New(server.Config{Cache: cache})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+	client := pb.NewCacheClient(cc)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		server.RequestIDMetadata, "my-request")
+	_, err = client.Set(ctx, &pb.SetRequest{Key: "key", Value: []byte("value")})
+	require.NoError(t, err)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	require.Equal(t, []string{"my-request"}, cache.md.Get(server.RequestIDMetadata))
+}
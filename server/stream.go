@@ -0,0 +1,103 @@
+package server
+
+import (
+	"io"
+
+	"github.com/nireo/dcache/pb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// streamChunkSize is the size of the chunks GetStream splits values into.
+const streamChunkSize = 64 << 10
+
+// ChunkedSetter is implemented by caches that can write a value in chunks, so a
+// large value isn't held in a single request. next returns io.EOF after the last
+// chunk. The store.Store implements this.
+type ChunkedSetter interface {
+	SetChunked(key string, next func() ([]byte, error)) error
+}
+
+// SetStream handles values streamed by the client in chunks. The key is taken from
+// the first chunk. If the cache is a ChunkedSetter the chunks are passed on as they
+// arrive, otherwise they're reassembled and set with a single Set.
+func (s *grpcImpl) SetStream(stream pb.Cache_SetStreamServer) error {
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "no chunks were sent")
+	}
+	if err != nil {
+		return err
+	}
+
+	// the first chunk has already been received, so it's returned before reading
+	// the rest from the stream.
+	pending := first.Data
+	next := func() ([]byte, error) {
+		if pending != nil {
+			data := pending
+			pending = nil
+			return data, nil
+		}
+
+		chunk, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		return chunk.Data, nil
+	}
+
+	if cs, ok := s.c.(ChunkedSetter); ok {
+		err = cs.SetChunked(first.Key, next)
+	} else {
+		err = setReassembled(s.c, first.Key, next)
+	}
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&pb.Empty{})
+}
+
+// setReassembled reads every chunk from next and sets the whole value into c.
+func setReassembled(c Cache, key string, next func() ([]byte, error)) error {
+	var value []byte
+	for {
+		chunk, err := next()
+		if err == io.EOF {
+			return c.Set(key, value)
+		}
+		if err != nil {
+			return err
+		}
+		value = append(value, chunk...)
+	}
+}
+
+// GetStream reads a value like Get and streams it back in chunks of
+// streamChunkSize bytes. The key is only set in the first chunk, which is sent even
+// if the value is empty.
+func (s *grpcImpl) GetStream(req *pb.GetRequest, stream pb.Cache_GetStreamServer) error {
+	res, err := s.Get(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+
+	value := res.Value
+	chunk := &pb.Chunk{Key: req.Key}
+	for {
+		n := len(value)
+		if n > streamChunkSize {
+			n = streamChunkSize
+		}
+		chunk.Data = value[:n]
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+
+		value = value[n:]
+		if len(value) == 0 {
+			return nil
+		}
+		chunk = &pb.Chunk{}
+	}
+}
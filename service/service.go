@@ -1,46 +1,391 @@
 package service
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"net"
+	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
 	httpd "github.com/nireo/dcache/http"
+	"github.com/nireo/dcache/metrics"
 	"github.com/nireo/dcache/registry"
 	"github.com/nireo/dcache/server"
 	"github.com/nireo/dcache/store"
 	"github.com/soheilhy/cmux"
 	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding/gzip"
 )
 
-var ErrNoCommunication = errors.New("no communication pathways for clients")
+var (
+	ErrNoCommunication = errors.New("no communication pathways for clients")
+
+	// ErrInvalidLogFormat is returned when LogFormat is not json or console.
+	ErrInvalidLogFormat = errors.New("log format must be json or console")
+
+	// ErrBootstrapConflict is returned when both Bootstrap and ExpectedNodes are set.
+	ErrBootstrapConflict = errors.New("bootstrap and expected nodes cannot both be set")
+
+	// ErrBootstrapJoinConflict is returned when Bootstrap is set together with
+	// StartJoinAddrs. The node would bootstrap a cluster of its own, which then
+	// conflicts with the cluster it joins.
+	ErrBootstrapJoinConflict = errors.New(
+		"bootstrap cannot be set when joining an existing cluster, remove bootstrap or the join addresses",
+	)
+
+	// ErrReadReplicaBootstrap is returned when ReadReplica is set together with
+	// Bootstrap. A read replica never becomes a voter, so it cannot bootstrap a
+	// cluster.
+	ErrReadReplicaBootstrap = errors.New("a read replica cannot bootstrap the cluster")
+
+	// ErrInvalidBindAddr is returned when BindAddr or AdvertiseAddr isn't a valid
+	// host:port address.
+	ErrInvalidBindAddr = errors.New("invalid bind address")
+
+	// ErrInvalidRPCPort is returned when RPCPort isn't a valid port number.
+	ErrInvalidRPCPort = errors.New("rpc port must be between 0 and 65535")
+)
+
+const (
+	// defaultMuxReadTimeout is used when Config.MuxReadTimeout is not set.
+	defaultMuxReadTimeout = 5 * time.Second
+
+	// defaultShutdownGraceTimeout is used when Config.ShutdownGraceTimeout is
+	// not set.
+	defaultShutdownGraceTimeout = 10 * time.Second
+
+	// stepdownTimeout is how long Close waits for a new leader after transferring
+	// the leadership with Config.StepdownOnShutdown.
+	stepdownTimeout = 10 * time.Second
+
+	// defaultTracingEndpoint is used when Config.TracingEndpoint is not set.
+	defaultTracingEndpoint = "localhost:4317"
+)
 
 // Config handles all of the customizable values for Service.
 type Config struct {
 	DataDir        string   // where to store raft data.
-	BindAddr       string   // serf addr.
-	RPCPort        int      // port for raft and client connections
+	BindAddr       string   // serf addr, port 0 picks a free port.
+	AdvertiseAddr  string   // serf addr advertised to other nodes, defaults to BindAddr.
+	RPCPort        int      // port for raft and client connections, 0 picks a free port
 	StartJoinAddrs []string // addresses to join to
+	RetryJoin      bool     // keep retrying StartJoinAddrs in the background if they can't be reached
 	Bootstrap      bool     // should bootstrap cluster?
 	NodeName       string   // raft server id
+	GossipProfile  string   // serf timings: lan, wan or local. defaults to lan.
+
+	// PersistLog keeps the raft log in DataDir instead of memory, so the node can
+	// be restarted or recovered with the writes it had. Snapshots are always kept
+	// in DataDir.
+	PersistLog bool
+
+	// FastlogLevel is the durability level of the persisted raft log: "low",
+	// "medium" or "high". Lower levels sync to disk less often. Defaults to medium.
+	// Only used with PersistLog.
+	FastlogLevel string
+
+	// RecoverFromCorruption moves a corrupt raft log file aside and starts with an
+	// empty log instead of failing, so the node catches up from the leader. Only
+	// used with PersistLog. The term and vote of the node are lost with the log.
+	RecoverFromCorruption bool
+
+	// ReapTimeout is how long a node can be failed before the leader removes it
+	// from the raft configuration. Zero keeps failed nodes in the configuration.
+	ReapTimeout time.Duration
+
+	// ReadReplica makes the node join the cluster as a non-voter that is never
+	// promoted, so it serves reads without taking part in elections or the write
+	// quorum. The node is tagged as a read replica in the membership.
+	ReadReplica bool
+
+	// EventBufferSize is the number of membership events that can wait to be
+	// handled before they're dropped. Zero uses the registry default.
+	EventBufferSize int
+
+	// SeparateRaftPort makes raft listen on its own port instead of sharing RPCPort
+	// with gRPC and HTTP. Zero keeps raft on RPCPort.
+	SeparateRaftPort int
+
+	// ExpectedNodes delays bootstrapping until this many nodes have been discovered,
+	// and then bootstraps the cluster with all of them. This avoids a split brain
+	// when multiple nodes would bootstrap. Cannot be used together with Bootstrap.
+	ExpectedNodes int
+
+	// MaxVoters is the maximum number of voters in the cluster. Nodes joining
+	// after that are added as non-voters. Zero means no limit.
+	MaxVoters int
+
+	// MaxInflightApplies limits the number of writes waiting to be applied. Writes
+	// over the limit are rejected, which gRPC clients see as ResourceExhausted.
+	// Zero means no limit.
+	MaxInflightApplies int
+
+	// MaxUploadSize limits the size in bytes of the values streamed with SetStream.
+	// Larger uploads are rejected, which gRPC clients see as ResourceExhausted.
+	// Zero means no limit.
+	MaxUploadSize int
+
+	// ApplyBatchWindow makes the leader collect the writes received within the
+	// window and apply them as a single log entry. Zero disables batching.
+	ApplyBatchWindow time.Duration
+
+	// CacheBackend selects the local cache: "bigcache" evicts the oldest entries
+	// first and "lru" the least recently used ones. Defaults to bigcache.
+	CacheBackend string
+
+	// CacheCleanWindow is how often the bigcache backend removes entries that have
+	// outlived its life window. Zero uses the bigcache default.
+	CacheCleanWindow time.Duration
+
+	// CacheStats makes the Stats RPC report the hits, misses and hash collisions of
+	// the bigcache backend.
+	CacheStats bool
+
+	// MaxCacheEntries is the maximum number of entries in the lru cache backend.
+	MaxCacheEntries int
+
+	// WarmupFile is a file written by the export command or store.WriteWarmupEntry
+	// whose entries are loaded into the local cache before raft is started. The
+	// entries are not replicated to the other nodes, and they're lost once a
+	// snapshot is restored.
+	WarmupFile string
+
+	// EncryptionKey encrypts the values in the local cache with AES-GCM. It must be
+	// 16, 24 or 32 bytes. Disabled if it's nil.
+	EncryptionKey []byte
+
+	// SnapshotInterval makes the leader take a snapshot this often. Zero leaves
+	// snapshots to raft's own triggers.
+	SnapshotInterval time.Duration
+
+	// RetainSnapshots is the number of snapshot files kept in DataDir, so an older
+	// snapshot can be used if the latest one is corrupt. Defaults to 2.
+	RetainSnapshots int
+
+	// SnapshotKeyDelta makes the node take a snapshot once the number of keys has
+	// grown by this many since the last snapshot. Zero disables it.
+	SnapshotKeyDelta int
+
+	// TTLSweepInterval is how often the leader deletes expired keys from the
+	// cluster. Zero disables the sweeper, expired keys are then only hidden from
+	// reads until they're overwritten or evicted.
+	TTLSweepInterval time.Duration
+
+	// StrongConsistency makes reads go through the leader unless the client asks
+	// for eventual consistency in the request metadata. Otherwise reads are served
+	// from the local cache unless the client asks for strong consistency.
+	StrongConsistency bool
+
+	// LinearizableReads makes reads go through the leader, which confirms its
+	// leadership with a read barrier and reads from its cache instead of applying
+	// the read through the raft log. Takes precedence over StrongConsistency.
+	LinearizableReads bool
+
+	// BarrierReads makes reads go through the leader, which issues a raft barrier
+	// and reads from its cache once every earlier write has been applied. Takes
+	// precedence over StrongConsistency.
+	BarrierReads bool
+
+	// StaleOnLeaderFailure serves reads that need the leader from the local cache
+	// when no leader can be reached, instead of failing. Only used with
+	// StrongConsistency, LinearizableReads or BarrierReads.
+	StaleOnLeaderFailure bool
+
+	// TrackHotKeys estimates how often keys are read, so the most read keys can be
+	// requested with the HotKeys RPC.
+	TrackHotKeys bool
 
 	// Enable different communications protocols for clients
 	EnableHTTP bool
 	EnableGRPC bool
 
+	// HTTPMaxBodySize is the maximum size of a HTTP request body in bytes. Larger
+	// requests are rejected with 413. Defaults to 4MB.
+	HTTPMaxBodySize int
+
+	// HTTPReadTimeout and HTTPWriteTimeout limit the time spent reading a HTTP
+	// request and writing the response. Zero means no timeout.
+	HTTPReadTimeout  time.Duration
+	HTTPWriteTimeout time.Duration
+
+	// MuxReadTimeout is the time a new connection has to send enough data for the
+	// connection multiplexer to match its protocol. Connections that don't are
+	// closed. Defaults to 5 seconds.
+	MuxReadTimeout time.Duration
+
+	// MetricsAddr is the address of a separate listener serving Prometheus metrics
+	// at /metrics and profiles at /debug/pprof/. Disabled if empty.
+	MetricsAddr string
+
+	// ShutdownGraceTimeout is how long Close waits for in-flight gRPC requests to
+	// finish before closing their connections. Defaults to 10 seconds.
+	ShutdownGraceTimeout time.Duration
+
+	// StepdownOnShutdown makes Close transfer the leadership to another node and
+	// wait for it to take over before shutting down, if this node is the leader.
+	// Otherwise the cluster is without a leader until the other nodes notice that
+	// the leader is gone and elect a new one.
+	StepdownOnShutdown bool
+
+	// ForwardWrites makes followers forward writes to the leader instead of
+	// returning an error. Requires gRPC to be enabled on every node.
+	ForwardWrites bool
+
+	// AllowAddressChange lets a node rejoin with the same name but a different
+	// address, replacing the old one. By default such joins are rejected, since
+	// they usually mean that two nodes have been started with the same name.
+	AllowAddressChange bool
+
+	// EnableGRPCCompression compresses the requests this node sends to other nodes
+	// with gzip, such as forwarded writes. Every node accepts compressed requests
+	// regardless of this setting.
+	EnableGRPCCompression bool
+
+	// EnableReflection registers the gRPC reflection service for debugging.
+	EnableReflection bool
+
+	// MaxConcurrentStreams limits the concurrent streams of a gRPC client
+	// connection. Defaults to server.DefaultMaxConcurrentStreams.
+	MaxConcurrentStreams uint32
+
+	// ServersCacheTTL caches the servers returned to GetServers requests for this
+	// long, unless the cluster changes before that. Zero disables caching.
+	ServersCacheTTL time.Duration
+
 	ServerTLS *tls.Config
 	PeerTLS   *tls.Config
+
+	// LogLevel is the minimum level of logged messages: debug, info, warn or
+	// error. Defaults to info. Ignored if Logger is set.
+	LogLevel string
+
+	// LogFormat is the encoding of the logs: json or console. Defaults to json.
+	// Ignored if Logger is set.
+	LogFormat string
+
+	// Logger is shared by all of the components in the service. If not set, a
+	// production logger is built using LogLevel and LogFormat.
+	Logger *zap.Logger
+
+	// LogSampling caps the number of gRPC request logs written every second. Nil
+	// logs every request.
+	LogSampling *zap.SamplingConfig
+
+	// EnableTracing traces gRPC requests and the operations applied through raft
+	// with OpenTelemetry. The spans are exported with OTLP to TracingEndpoint.
+	EnableTracing bool
+
+	// TracingEndpoint is the address of the OTLP gRPC collector. Defaults to
+	// localhost:4317.
+	TracingEndpoint string
+
+	// TracerProvider is used for tracing if EnableTracing is set. If not set, a
+	// provider exporting to TracingEndpoint is created.
+	TracerProvider trace.TracerProvider
+}
+
+// NewLogger creates a production logger that logs messages at or above level in the
+// given format. The format is either json or console, and defaults to json.
+func NewLogger(level, format string) (*zap.Logger, error) {
+	conf := zap.NewProductionConfig()
+	if level != "" {
+		lvl, err := zap.ParseAtomicLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		conf.Level = lvl
+	}
+
+	switch format {
+	case "", "json":
+	case "console":
+		conf.Encoding = "console"
+		conf.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		conf.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+	default:
+		return nil, ErrInvalidLogFormat
+	}
+
+	return conf.Build()
+}
+
+// Validate checks the configuration for mistakes that would otherwise only show up
+// as unclear errors while setting up the service.
+func (c *Config) Validate() error {
+	// check that either HTTP or gRPC is enabled. Otherwise user cannot really
+	// interact with the cluster.
+	if !c.EnableGRPC && !c.EnableHTTP {
+		return ErrNoCommunication
+	}
+
+	if c.Bootstrap && c.ExpectedNodes > 0 {
+		return ErrBootstrapConflict
+	}
+	if c.Bootstrap && len(c.StartJoinAddrs) > 0 {
+		return fmt.Errorf("%w: joining %v", ErrBootstrapJoinConflict, c.StartJoinAddrs)
+	}
+	if c.ReadReplica && c.Bootstrap {
+		return ErrReadReplicaBootstrap
+	}
+
+	if err := validateAddr(c.BindAddr); err != nil {
+		return err
+	}
+	if c.AdvertiseAddr != "" {
+		if err := validateAddr(c.AdvertiseAddr); err != nil {
+			return err
+		}
+	}
+
+	if c.RPCPort < 0 || c.RPCPort > 65535 {
+		return fmt.Errorf("%w, got %d", ErrInvalidRPCPort, c.RPCPort)
+	}
+	if c.SeparateRaftPort < 0 || c.SeparateRaftPort > 65535 {
+		return fmt.Errorf("%w, got raft port %d", ErrInvalidRPCPort, c.SeparateRaftPort)
+	}
+	return nil
+}
+
+// validateAddr checks that addr is a host:port address with a valid port.
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidBindAddr, addr, err)
+	}
+
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("%w %q: port must be between 0 and 65535", ErrInvalidBindAddr, addr)
+	}
+	return nil
+}
+
+// advertiseAddr returns the address other nodes use to reach this node.
+func (c *Config) advertiseAddr() string {
+	if c.AdvertiseAddr != "" {
+		return c.AdvertiseAddr
+	}
+	return c.BindAddr
 }
 
-// RPCAddr returns the host:RPCPort string
+// RPCAddr returns the host:RPCPort string using the host of the advertise address.
+// It's the address advertised to other nodes and clients.
 func (c *Config) RPCAddr() (string, error) {
-	host, _, err := net.SplitHostPort(c.BindAddr)
+	host, _, err := net.SplitHostPort(c.advertiseAddr())
 	if err != nil {
 		return "", err
 	}
@@ -48,9 +393,24 @@ func (c *Config) RPCAddr() (string, error) {
 	return fmt.Sprintf("%s:%d", host, c.RPCPort), nil
 }
 
+// RaftAddr returns the address advertised to other raft nodes. It's the rpc address
+// unless raft has a separate port.
+func (c *Config) RaftAddr() (string, error) {
+	if c.SeparateRaftPort == 0 {
+		return c.RPCAddr()
+	}
+
+	host, _, err := net.SplitHostPort(c.advertiseAddr())
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s:%d", host, c.SeparateRaftPort), nil
+}
+
 // HTTPAddr returns the HTTP address to the server.
 func (c *Config) HTTPAddr() (string, error) {
-	host, _, err := net.SplitHostPort(c.BindAddr)
+	host, _, err := net.SplitHostPort(c.advertiseAddr())
 	if err != nil {
 		return "", err
 	}
@@ -67,8 +427,22 @@ type Service struct {
 	reg    *registry.Registry
 
 	httpListener net.Listener
+	httpServer   *fasthttp.Server
 	grpcListener net.Listener
 
+	// serverDone is closed once the gRPC server has stopped.
+	serverDone chan struct{}
+
+	metricsServer *http.Server
+
+	// tracerProvider is the provider created for exporting spans. It's nil if
+	// Config.TracerProvider was given.
+	tracerProvider *sdktrace.TracerProvider
+
+	// members lists the serf members for the gRPC server, which is set up before
+	// the registry.
+	members memberLister
+
 	shutdown     bool
 	shutdowns    chan struct{}
 	shutdownlock sync.Mutex
@@ -82,10 +456,16 @@ func New(conf Config) (*Service, error) {
 		shutdowns: make(chan struct{}),
 	}
 
-	// check that either HTTP or gRPC is enabled. Otherwise user cannot really
-	// interact with the cluster.
-	if !s.Config.EnableGRPC && !s.Config.EnableHTTP {
-		return nil, ErrNoCommunication
+	if err := s.Config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if s.Config.Logger == nil {
+		var err error
+		s.Config.Logger, err = NewLogger(s.Config.LogLevel, s.Config.LogFormat)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if err := s.setupMux(); err != nil {
@@ -105,14 +485,17 @@ func New(conf Config) (*Service, error) {
 	}
 
 	setupFns := []func() error{
+		s.setupTracing,
 		s.setupStore,
 		s.setupServer,
 		s.setupHTTP,
+		s.setupMetrics,
 		s.setupRegistry,
 	}
 
 	for _, fn := range setupFns {
 		if err := fn(); err != nil {
+			s.Close()
 			return nil, err
 		}
 	}
@@ -134,18 +517,24 @@ func (s *Service) setupMux() error {
 		return err
 	}
 	s.mux = cmux.New(l)
+
+	// use the port that was actually bound, in case RPCPort is 0.
+	s.Config.RPCPort = l.Addr().(*net.TCPAddr).Port
+
+	timeout := s.Config.MuxReadTimeout
+	if timeout == 0 {
+		timeout = defaultMuxReadTimeout
+	}
+	s.mux.SetReadTimeout(timeout)
 	return nil
 }
 
 // setupStore sets up the raft store.
 func (s *Service) setupStore() error {
-	raftListener := s.mux.Match(func(reader io.Reader) bool {
-		b := make([]byte, 1)
-		if _, err := reader.Read(b); err != nil {
-			return false
-		}
-		return b[0] == 1
-	})
+	raftListener, err := s.raftListener()
+	if err != nil {
+		return err
+	}
 
 	conf := store.Config{}
 	conf.Transport = store.NewTLSTransport(
@@ -154,10 +543,52 @@ func (s *Service) setupStore() error {
 		s.Config.PeerTLS,
 	)
 
+	if s.Config.AdvertiseAddr != "" {
+		raftAddr, err := s.Config.RaftAddr()
+		if err != nil {
+			return err
+		}
+
+		advertise, err := net.ResolveTCPAddr("tcp", raftAddr)
+		if err != nil {
+			return err
+		}
+		conf.Transport.SetAdvertise(advertise)
+	}
+
 	conf.LocalID = raft.ServerID(s.Config.NodeName)
+	conf.DataDir = s.Config.DataDir
+	conf.PersistLog = s.Config.PersistLog
+	conf.FastlogLevel = s.Config.FastlogLevel
+	conf.RecoverFromCorruption = s.Config.RecoverFromCorruption
+	conf.TracerProvider = s.Config.TracerProvider
 	conf.Bootstrap = s.Config.Bootstrap
+	conf.Logger = s.Config.Logger
+	conf.StrongConsistency = s.Config.StrongConsistency
+	conf.LinearizableReads = s.Config.LinearizableReads
+	conf.BarrierReads = s.Config.BarrierReads
+	conf.StaleOnLeaderFailure = s.Config.StaleOnLeaderFailure
+	conf.ForwardWrites = s.Config.ForwardWrites
+	conf.AllowAddressChange = s.Config.AllowAddressChange
+	if s.Config.EnableGRPCCompression {
+		conf.LeaderCallOptions = []grpc.CallOption{grpc.UseCompressor(gzip.Name)}
+	}
+	conf.MaxVoters = s.Config.MaxVoters
+	conf.TrackHotKeys = s.Config.TrackHotKeys
+	conf.MaxInflightApplies = s.Config.MaxInflightApplies
+	conf.MaxUploadSize = s.Config.MaxUploadSize
+	conf.ApplyBatchWindow = s.Config.ApplyBatchWindow
+	conf.SnapshotInterval = s.Config.SnapshotInterval
+	conf.RetainSnapshots = s.Config.RetainSnapshots
+	conf.SnapshotKeyDelta = s.Config.SnapshotKeyDelta
+	conf.TTLSweepInterval = s.Config.TTLSweepInterval
+	conf.CacheBackend = s.Config.CacheBackend
+	conf.CacheCleanWindow = s.Config.CacheCleanWindow
+	conf.CacheStats = s.Config.CacheStats
+	conf.MaxCacheEntries = s.Config.MaxCacheEntries
+	conf.WarmupFile = s.Config.WarmupFile
+	conf.EncryptionKey = s.Config.EncryptionKey
 
-	var err error
 	s.store, err = store.New(conf)
 	if err != nil {
 		return err
@@ -168,6 +599,20 @@ func (s *Service) setupStore() error {
 	return err
 }
 
+// raftListener returns the listener for raft connections. Raft shares the mux with
+// gRPC and HTTP unless it has a separate port.
+func (s *Service) raftListener() (net.Listener, error) {
+	if s.Config.SeparateRaftPort == 0 {
+		return s.mux.Match(store.MatchRaft), nil
+	}
+
+	host, _, err := net.SplitHostPort(s.Config.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen("tcp", fmt.Sprintf("%s:%d", host, s.Config.SeparateRaftPort))
+}
+
 // setupServer sets up the grpc server. The grpc server is for clients to interact
 // with the service.
 func (s *Service) setupServer() error {
@@ -180,7 +625,22 @@ func (s *Service) setupServer() error {
 		err  error
 	)
 
-	s.server, err = server.NewServer(s.store, opts...)
+	s.serverDone = make(chan struct{})
+	// gRPC is served without TLS, so the server connects to the other nodes
+	// without it as well and PeerTLS isn't passed on.
+	s.server, err = server.New(server.Config{
+		Cache:                s.store,
+		ServerFinder:         s.store,
+		NodeID:               s.Config.NodeName,
+		MemberLister:         &s.members,
+		Logger:               s.Config.Logger,
+		LogSampling:          s.Config.LogSampling,
+		EnableReflection:     s.Config.EnableReflection,
+		TracerProvider:       s.Config.TracerProvider,
+		MaxConcurrentStreams: s.Config.MaxConcurrentStreams,
+		ServersCacheTTL:      s.Config.ServersCacheTTL,
+		Done:                 s.serverDone,
+	}, opts...)
 	if err != nil {
 		return err
 	}
@@ -193,7 +653,57 @@ func (s *Service) setupServer() error {
 	return nil
 }
 
-// Close shuts dwon components and leaves the registry cluster.
+// stopServer gracefully stops the gRPC server, but forcefully closes the remaining
+// connections if the requests don't finish within the grace timeout.
+func (s *Service) stopServer() {
+	timeout := s.Config.ShutdownGraceTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownGraceTimeout
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		s.Config.Logger.Warn("requests didn't finish in time, forcing server stop",
+			zap.Duration("timeout", timeout))
+		s.server.Stop()
+	}
+	close(s.serverDone)
+}
+
+// stepdown transfers the leadership to another node and waits until it's the
+// leader, so writes can continue while this node shuts down. Failing to transfer
+// the leadership doesn't stop the shutdown, the cluster elects a new leader once
+// this node is gone.
+func (s *Service) stepdown() {
+	if !s.store.IsLeader() {
+		return
+	}
+
+	s.Config.Logger.Info("transferring leadership before shutting down")
+	if err := s.store.Stepdown(true); err != nil {
+		s.Config.Logger.Warn("failed to transfer leadership", zap.Error(err))
+		return
+	}
+
+	leader, err := s.store.WaitForLeader(stepdownTimeout)
+	if err != nil {
+		s.Config.Logger.Warn("no new leader after transferring leadership", zap.Error(err))
+		return
+	}
+	s.Config.Logger.Info("leadership transferred", zap.String("leader", leader))
+}
+
+// Close shuts down components and leaves the registry cluster. Close is safe to call
+// multiple times and concurrently, only the first call shuts down the service. Every
+// component is closed even if closing another one fails, and the first error is
+// returned.
 func (s *Service) Close() error {
 	s.shutdownlock.Lock()
 	defer s.shutdownlock.Unlock()
@@ -204,24 +714,81 @@ func (s *Service) Close() error {
 	s.shutdown = true
 	close(s.shutdowns)
 
+	// components might be nil if the service failed during setup.
 	closeFns := []func() error{
-		s.reg.Leave,
 		func() error {
-			if s.Config.EnableGRPC {
-				s.server.GracefulStop()
+			if s.store != nil && s.Config.StepdownOnShutdown {
+				s.stepdown()
+			}
+			return nil
+		},
+		func() error {
+			if s.reg == nil {
+				return nil
+			}
+			return s.reg.Leave()
+		},
+		func() error {
+			if s.server != nil {
+				s.stopServer()
+			}
+			return nil
+		},
+		func() error {
+			if s.httpServer == nil {
+				return nil
+			}
+			return s.httpServer.Shutdown()
+		},
+		func() error {
+			if s.metricsServer == nil {
+				return nil
+			}
+			return s.metricsServer.Close()
+		},
+		func() error {
+			if s.store == nil {
+				return nil
+			}
+			return s.store.Close()
+		},
+		func() error {
+			if s.mux != nil {
+				s.mux.Close()
 			}
 			return nil
 		},
-		s.store.Close,
+		func() error {
+			if s.tracerProvider == nil {
+				return nil
+			}
+			// flush the remaining spans.
+			return s.tracerProvider.Shutdown(context.Background())
+		},
 	}
 
+	var firstErr error
 	for _, fn := range closeFns {
-		if err := fn(); err != nil {
-			return err
+		if err := fn(); err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
 
-	return nil
+	return firstErr
+}
+
+// Pause takes the node out of rotation without removing it from the cluster. The
+// node rejects reads and writes, and the paused tag tells clients resolving the
+// cluster to stop routing requests to it. Raft keeps replicating in the background.
+func (s *Service) Pause() error {
+	s.store.Pause()
+	return s.reg.SetTag("paused", "true")
+}
+
+// Resume makes a paused node serve requests again.
+func (s *Service) Resume() error {
+	s.store.Resume()
+	return s.reg.SetTag("paused", "")
 }
 
 // serve runs the connection multiplexer to start serving connections.
@@ -240,16 +807,55 @@ func (s *Service) setupRegistry() error {
 		return err
 	}
 
+	tags := map[string]string{
+		"rpc_addr": rpcAddr,
+	}
+	if s.Config.SeparateRaftPort != 0 {
+		tags["raft_addr"], err = s.Config.RaftAddr()
+		if err != nil {
+			return err
+		}
+	}
+	if s.Config.ReadReplica {
+		tags[registry.ReadReplicaTag] = "true"
+	}
+
 	s.reg, err = registry.New(s.store, registry.Config{
-		NodeName: s.Config.NodeName,
-		BindAddr: s.Config.BindAddr,
-		Tags: map[string]string{
-			"rpc_addr": rpcAddr,
-		},
-		StartJoinAddrs: s.Config.StartJoinAddrs,
+		NodeName:        s.Config.NodeName,
+		BindAddr:        s.Config.BindAddr,
+		AdvertiseAddr:   s.Config.AdvertiseAddr,
+		Tags:            tags,
+		StartJoinAddrs:  s.Config.StartJoinAddrs,
+		RetryJoin:       s.Config.RetryJoin,
+		ReapTimeout:     s.Config.ReapTimeout,
+		EventBufferSize: s.Config.EventBufferSize,
+		Logger:          s.Config.Logger,
+		ExpectedNodes:   s.Config.ExpectedNodes,
+		Profile:         s.Config.GossipProfile,
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	// serf might have bound an ephemeral port, so other nodes need to use the
+	// address of the registry to join.
+	s.Config.BindAddr = s.reg.BindAddr
+	s.store.SetMemberChecker(s.reg)
+	s.members.reg.Store(s.reg)
+	return nil
+}
+
+// memberLister lists the members of the registry once it has been set up.
+type memberLister struct {
+	reg atomic.Pointer[registry.Registry]
+}
+
+// Members returns the serf members, or nothing if the registry isn't set up yet.
+func (m *memberLister) Members() []serf.Member {
+	if reg := m.reg.Load(); reg != nil {
+		return reg.Members()
+	}
+	return nil
 }
 
 // setupHTTP sets up a HTTP handler to interact with the store.
@@ -264,7 +870,78 @@ func (s *Service) setupHTTP() error {
 		return err
 	}
 
-	go fasthttp.Serve(s.httpListener, httpServer.Handler)
+	maxBodySize := s.Config.HTTPMaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = fasthttp.DefaultMaxRequestBodySize
+	}
+
+	s.httpServer = &fasthttp.Server{
+		Handler:            httpServer.Handler,
+		ErrorHandler:       httpServer.ErrorHandler,
+		MaxRequestBodySize: maxBodySize,
+		ReadTimeout:        s.Config.HTTPReadTimeout,
+		WriteTimeout:       s.Config.HTTPWriteTimeout,
+	}
+	go s.httpServer.Serve(s.httpListener)
+
+	return nil
+}
+
+// setupTracing creates a tracer provider exporting to the configured endpoint, if
+// tracing is enabled without a provider.
+func (s *Service) setupTracing() error {
+	if !s.Config.EnableTracing {
+		s.Config.TracerProvider = nil
+		return nil
+	}
+	if s.Config.TracerProvider != nil {
+		return nil
+	}
+
+	endpoint := s.Config.TracingEndpoint
+	if endpoint == "" {
+		endpoint = defaultTracingEndpoint
+	}
+
+	// the exporter connects in the background, so this doesn't fail if the
+	// collector is down.
+	exporter, err := otlptracegrpc.New(context.Background(),
+		otlptracegrpc.WithEndpoint(endpoint),
+		otlptracegrpc.WithInsecure(),
+	)
+	if err != nil {
+		return err
+	}
+
+	s.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String("dcache"),
+			semconv.ServiceInstanceIDKey.String(s.Config.NodeName),
+		)),
+	)
+	s.Config.TracerProvider = s.tracerProvider
+	return nil
+}
+
+// setupMetrics serves the metrics and profiles on a separate listener, if a
+// metrics address is configured.
+func (s *Service) setupMetrics() error {
+	if s.Config.MetricsAddr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", s.Config.MetricsAddr)
+	if err != nil {
+		return err
+	}
+
+	s.metricsServer = &http.Server{
+		Handler:           metrics.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go s.metricsServer.Serve(l)
 
 	return nil
 }
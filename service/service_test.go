@@ -3,19 +3,33 @@ package service_test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/raft"
 	"github.com/nireo/dcache/pb"
+	"github.com/nireo/dcache/server"
 	"github.com/nireo/dcache/service"
+	"github.com/nireo/dcache/store"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 func getFreePort() (int, error) {
@@ -66,18 +80,39 @@ func httpGetHelper(t *testing.T, addr string) []byte {
 }
 
 type setupConf struct {
-	enablehttp bool
-	enablegrpc bool
+	enablehttp    bool
+	enablegrpc    bool
+	expectedNodes int
+
+	httpMaxBodySize int
+	muxReadTimeout  time.Duration
+	graceTimeout    time.Duration
+	metricsAddr     string
+
+	separateRaftPort bool
+
+	// readReplicas is the number of the last nodes started as read replicas.
+	readReplicas int
+
+	stepdownOnShutdown bool
+	forwardWrites      bool
+	persistLog         bool
+	strongConsistency  bool
 }
 
 func setupNServices(t *testing.T, n int, conf setupConf) []*service.Service {
 	var services []*service.Service
 
 	for i := 0; i < n; i++ {
-		ports := genNPorts(2)
+		ports := genNPorts(3)
 		bindaddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
 		rpcPort := ports[1]
 
+		var raftPort int
+		if conf.separateRaftPort {
+			raftPort = ports[2]
+		}
+
 		datadir, err := os.MkdirTemp("", "service-test")
 		require.NoError(t, err)
 
@@ -88,13 +123,27 @@ func setupNServices(t *testing.T, n int, conf setupConf) []*service.Service {
 
 		service, err := service.New(service.Config{
 			NodeName:       fmt.Sprintf("%d", i),
-			Bootstrap:      i == 0,
+			Bootstrap:      i == 0 && conf.expectedNodes == 0,
+			ExpectedNodes:  conf.expectedNodes,
 			StartJoinAddrs: startJoinAddrs,
 			BindAddr:       bindaddr,
 			DataDir:        datadir,
 			RPCPort:        rpcPort,
 			EnableGRPC:     conf.enablegrpc,
 			EnableHTTP:     conf.enablehttp,
+
+			SeparateRaftPort: raftPort,
+			ReadReplica:      i >= n-conf.readReplicas,
+
+			HTTPMaxBodySize: conf.httpMaxBodySize,
+			MuxReadTimeout:  conf.muxReadTimeout,
+
+			ShutdownGraceTimeout: conf.graceTimeout,
+			StepdownOnShutdown:   conf.stepdownOnShutdown,
+			MetricsAddr:          conf.metricsAddr,
+			PersistLog:           conf.persistLog,
+			ForwardWrites:        conf.forwardWrites,
+			StrongConsistency:    conf.strongConsistency,
 		})
 		require.NoError(t, err)
 
@@ -172,6 +221,25 @@ func TestHTTP(t *testing.T) {
 	require.Equal(t, []byte("testval"), body)
 }
 
+func TestHTTPMaxBodySize(t *testing.T) {
+	services := setupNServices(t, 1, setupConf{
+		enablehttp:      true,
+		httpMaxBodySize: 1024,
+	})
+
+	addr, err := services[0].Config.RPCAddr()
+	require.NoError(t, err)
+
+	resp, err := http.Post(
+		fmt.Sprintf("http://%s/testkey", addr),
+		"text/plain",
+		bytes.NewReader(make([]byte, 2048)),
+	)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
 func TestNoCommunication(t *testing.T) {
 	_, err := service.New(service.Config{
 		NodeName:       "node",
@@ -186,6 +254,64 @@ func TestNoCommunication(t *testing.T) {
 	require.Equal(t, service.ErrNoCommunication, err)
 }
 
+func TestValidate(t *testing.T) {
+	valid := service.Config{
+		BindAddr:   "127.0.0.1:9000",
+		RPCPort:    9200,
+		EnableGRPC: true,
+	}
+	require.NoError(t, valid.Validate())
+
+	for name, tc := range map[string]struct {
+		modify func(*service.Config)
+		want   error
+	}{
+		"missing port": {
+			modify: func(c *service.Config) { c.BindAddr = "127.0.0.1" },
+			want:   service.ErrInvalidBindAddr,
+		},
+		"port out of range": {
+			modify: func(c *service.Config) { c.BindAddr = "127.0.0.1:70000" },
+			want:   service.ErrInvalidBindAddr,
+		},
+		"malformed advertise addr": {
+			modify: func(c *service.Config) { c.AdvertiseAddr = "[::1" },
+			want:   service.ErrInvalidBindAddr,
+		},
+		"negative rpc port": {
+			modify: func(c *service.Config) { c.RPCPort = -1 },
+			want:   service.ErrInvalidRPCPort,
+		},
+		"rpc port out of range": {
+			modify: func(c *service.Config) { c.RPCPort = 65536 },
+			want:   service.ErrInvalidRPCPort,
+		},
+		"bootstrap and join": {
+			modify: func(c *service.Config) {
+				c.Bootstrap = true
+				c.StartJoinAddrs = []string{"127.0.0.1:9001"}
+			},
+			want: service.ErrBootstrapJoinConflict,
+		},
+		"read replica bootstrap": {
+			modify: func(c *service.Config) {
+				c.Bootstrap = true
+				c.ReadReplica = true
+			},
+			want: service.ErrReadReplicaBootstrap,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf := valid
+			tc.modify(&conf)
+			require.ErrorIs(t, conf.Validate(), tc.want)
+
+			_, err := service.New(conf)
+			require.ErrorIs(t, err, tc.want)
+		})
+	}
+}
+
 func TestBothCommunication(t *testing.T) {
 	services := setupNServices(t, 3, setupConf{
 		enablehttp: true,
@@ -239,3 +365,1003 @@ func TestSingleNode(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, []byte("value1"), r.Value)
 }
+
+func TestInvalidLogLevel(t *testing.T) {
+	_, err := service.New(service.Config{
+		NodeName:   "node",
+		Bootstrap:  true,
+		BindAddr:   "localhost:8080",
+		DataDir:    "./data",
+		RPCPort:    9200,
+		EnableGRPC: true,
+		LogLevel:   "verbose",
+	})
+	require.Error(t, err)
+}
+
+// captureLog returns the output of a single message logged by a logger created with
+// the given format.
+func captureLog(t *testing.T, format string) []byte {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+
+	// the production logger writes into stderr, which is read when it's built.
+	stderr := os.Stderr
+	os.Stderr = w
+	logger, err := service.NewLogger("info", format)
+	os.Stderr = stderr
+	require.NoError(t, err)
+
+	logger.Info("test message", zap.String("key", "value"))
+	logger.Sync()
+	require.NoError(t, w.Close())
+
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return bytes.TrimSpace(out)
+}
+
+func TestLogFormat(t *testing.T) {
+	out := captureLog(t, "json")
+	require.True(t, json.Valid(out), string(out))
+
+	out = captureLog(t, "console")
+	require.False(t, json.Valid(out), string(out))
+	require.Contains(t, string(out), "test message")
+
+	_, err := service.NewLogger("info", "xml")
+	require.Equal(t, service.ErrInvalidLogFormat, err)
+}
+
+func TestExpectedNodes(t *testing.T) {
+	services := setupNServices(t, 3, setupConf{
+		enablegrpc:    true,
+		expectedNodes: 3,
+	})
+
+	require.Eventually(t, func() bool {
+		for _, s := range services {
+			res, err := createClient(t, s).GetServers(context.Background(), &pb.Empty{})
+			if err != nil || len(res.Server) != 3 {
+				return false
+			}
+
+			leaders := 0
+			for _, srv := range res.Server {
+				if srv.IsLeader {
+					leaders++
+				}
+				if srv.VoteStatus != "Voter" {
+					return false
+				}
+			}
+
+			if leaders != 1 {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 250*time.Millisecond)
+}
+
+func TestInvalidFastlogLevel(t *testing.T) {
+	ports := genNPorts(2)
+	_, err := service.New(service.Config{
+		NodeName:     "node",
+		Bootstrap:    true,
+		BindAddr:     fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		DataDir:      t.TempDir(),
+		RPCPort:      ports[1],
+		EnableGRPC:   true,
+		PersistLog:   true,
+		FastlogLevel: "extreme",
+	})
+	require.ErrorIs(t, err, store.ErrUnknownFastlogLevel)
+}
+
+func TestBootstrapConflict(t *testing.T) {
+	_, err := service.New(service.Config{
+		NodeName:      "node",
+		Bootstrap:     true,
+		ExpectedNodes: 3,
+		BindAddr:      "localhost:8080",
+		DataDir:       "./data",
+		RPCPort:       9200,
+		EnableGRPC:    true,
+	})
+	require.Equal(t, service.ErrBootstrapConflict, err)
+}
+
+func TestCloseConcurrently(t *testing.T) {
+	services := setupNServices(t, 1, setupConf{
+		enablegrpc: true,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, services[0].Close())
+		}()
+	}
+	wg.Wait()
+
+	require.NoError(t, services[0].Close())
+}
+
+func TestMuxReadTimeout(t *testing.T) {
+	services := setupNServices(t, 1, setupConf{
+		enablegrpc:     true,
+		muxReadTimeout: 200 * time.Millisecond,
+	})
+	rpcaddr, err := services[0].Config.RPCAddr()
+	require.NoError(t, err)
+
+	// a connection that never sends anything can't be matched to a protocol.
+	idle, err := net.Dial("tcp", rpcaddr)
+	require.NoError(t, err)
+	defer idle.Close()
+
+	client := createClient(t, services[0])
+	require.Eventually(t, func() bool {
+		_, err := client.Set(context.Background(), &pb.SetRequest{
+			Key:   "key",
+			Value: []byte("value"),
+		})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// the mux closes the idle connection once the read timeout passes.
+	require.NoError(t, idle.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, err = idle.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestShutdownGraceTimeout(t *testing.T) {
+	services := setupNServices(t, 1, setupConf{
+		enablegrpc:   true,
+		graceTimeout: 500 * time.Millisecond,
+	})
+	client := createClient(t, services[0])
+
+	value := bytes.Repeat([]byte("a"), 1024*1024)
+	require.Eventually(t, func() bool {
+		_, err := client.Set(context.Background(), &pb.SetRequest{Key: "key0", Value: value})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	for i := 1; i < 32; i++ {
+		_, err := client.Set(context.Background(), &pb.SetRequest{
+			Key:   fmt.Sprintf("key%d", i),
+			Value: value,
+		})
+		require.NoError(t, err)
+	}
+
+	// the scan blocks on flow control since the stream is never read.
+	_, err := client.Scan(context.Background(), &pb.ScanRequest{})
+	require.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, services[0].Close())
+	require.Less(t, time.Since(start), 3*time.Second)
+}
+
+// leaderShutdownDowntime closes the leader of a 3-node cluster while writing to it,
+// and returns the longest time between two successful writes. Writes go to every
+// node in turn, so they succeed on whichever node is the leader.
+func leaderShutdownDowntime(t *testing.T, stepdown bool) time.Duration {
+	services := setupNServices(t, 3, setupConf{
+		enablegrpc:         true,
+		stepdownOnShutdown: stepdown,
+	})
+
+	clients := make([]pb.CacheClient, len(services))
+	for i, s := range services {
+		clients[i] = createClient(t, s)
+	}
+	require.Eventually(t, func() bool {
+		res, err := clients[0].GetServers(context.Background(), &pb.Empty{})
+		if err != nil || len(res.Server) != 3 {
+			return false
+		}
+		for _, srv := range res.Server {
+			if srv.IsLeader {
+				return srv.Id == services[0].Config.NodeName
+			}
+		}
+		return false
+	}, 5*time.Second, 50*time.Millisecond)
+
+	writing := make(chan struct{})
+	closed := make(chan struct{})
+	downtime := make(chan time.Duration, 1)
+	go func() {
+		var (
+			longest time.Duration
+			last    time.Time
+		)
+		for i := 0; ; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			_, err := clients[i%len(clients)].Set(ctx, &pb.SetRequest{
+				Key:   fmt.Sprintf("key%d", i),
+				Value: []byte("value"),
+			})
+			cancel()
+			if err != nil {
+				continue
+			}
+
+			// the gaps are only measured once the old leader has taken writes.
+			if last.IsZero() {
+				close(writing)
+			} else if gap := time.Since(last); gap > longest {
+				longest = gap
+			}
+			last = time.Now()
+
+			// the first write after the leader was closed ends the downtime.
+			select {
+			case <-closed:
+				downtime <- longest
+				return
+			default:
+			}
+		}
+	}()
+
+	<-writing
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, services[0].Close())
+	close(closed)
+
+	select {
+	case d := <-downtime:
+		return d
+	case <-time.After(10 * time.Second):
+		t.Fatal("writes didn't recover after the leader was closed")
+		return 0
+	}
+}
+
+func TestStepdownOnShutdown(t *testing.T) {
+	withStepdown := leaderShutdownDowntime(t, true)
+	withoutStepdown := leaderShutdownDowntime(t, false)
+	t.Logf("downtime with stepdown %s, without %s", withStepdown, withoutStepdown)
+
+	// the leadership was transferred before the leader shut down, so the cluster
+	// didn't need to wait for an election timeout.
+	require.Less(t, withStepdown, 500*time.Millisecond)
+	require.Less(t, withStepdown, withoutStepdown)
+}
+
+func TestStreamLargeValue(t *testing.T) {
+	services := setupNServices(t, 3, setupConf{enablegrpc: true})
+
+	leader := createClient(t, services[0])
+	require.Eventually(t, func() bool {
+		res, err := leader.GetServers(context.Background(), &pb.Empty{})
+		return err == nil && len(res.Server) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+
+	value := make([]byte, 8<<20)
+	_, err := rand.Read(value)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	upload, err := leader.SetStream(ctx)
+	require.NoError(t, err)
+	const chunkSize = 256 << 10
+	for i := 0; i < len(value); i += chunkSize {
+		chunk := &pb.Chunk{Data: value[i : i+chunkSize]}
+		if i == 0 {
+			chunk.Key = "large"
+		}
+		require.NoError(t, upload.Send(chunk))
+	}
+	_, err = upload.CloseAndRecv()
+	require.NoError(t, err)
+
+	// the value is reassembled on every node, so it can be streamed from a follower
+	// as well.
+	download := func(client pb.CacheClient) ([]byte, error) {
+		stream, err := client.GetStream(ctx, &pb.GetRequest{Key: "large", Stale: true})
+		if err != nil {
+			return nil, err
+		}
+
+		var got []byte
+		for {
+			chunk, err := stream.Recv()
+			if err == io.EOF {
+				return got, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			got = append(got, chunk.Data...)
+		}
+	}
+	got, err := download(leader)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(value, got))
+
+	follower := createClient(t, services[1])
+	require.Eventually(t, func() bool {
+		got, err := download(follower)
+		return err == nil && bytes.Equal(value, got)
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestMetricsAddr(t *testing.T) {
+	port, err := getFreePort()
+	require.NoError(t, err)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	services := setupNServices(t, 1, setupConf{
+		enablegrpc:  true,
+		metricsAddr: addr,
+	})
+
+	body := httpGetHelper(t, "http://"+addr+"/metrics")
+	require.Contains(t, string(body), "# TYPE dcache_leader_changes_total counter")
+
+	body = httpGetHelper(t, "http://"+addr+"/debug/pprof/goroutine?debug=1")
+	require.Contains(t, string(body), "goroutine profile")
+
+	require.NoError(t, services[0].Close())
+	_, err = http.Get("http://" + addr + "/metrics")
+	require.Error(t, err)
+}
+
+func TestAdvertiseAddr(t *testing.T) {
+	ports := genNPorts(2)
+	datadir, err := os.MkdirTemp("", "service-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(datadir)
+
+	s, err := service.New(service.Config{
+		NodeName:      "0",
+		Bootstrap:     true,
+		BindAddr:      fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		AdvertiseAddr: fmt.Sprintf("127.0.0.2:%d", ports[0]),
+		DataDir:       datadir,
+		RPCPort:       ports[1],
+		EnableGRPC:    true,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	advertised := fmt.Sprintf("127.0.0.2:%d", ports[1])
+	rpcAddr, err := s.Config.RPCAddr()
+	require.NoError(t, err)
+	require.Equal(t, advertised, rpcAddr)
+
+	// the listener is bound to the bind address.
+	conn, err := grpc.Dial(
+		fmt.Sprintf("127.0.0.1:%d", ports[1]),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewCacheClient(conn)
+
+	res, err := client.GetServers(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Len(t, res.Server, 1)
+	require.Equal(t, advertised, res.Server[0].RpcAddr)
+
+	members, err := client.Members(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Len(t, members.Members, 1)
+	require.Equal(t, advertised, members.Members[0].Tags["rpc_addr"])
+	require.Equal(t, fmt.Sprintf("127.0.0.2:%d", ports[0]), members.Members[0].Addr)
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	ports := genNPorts(2)
+	datadir, err := os.MkdirTemp("", "service-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(datadir)
+
+	s, err := service.New(service.Config{
+		NodeName:       "0",
+		Bootstrap:      true,
+		BindAddr:       fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		DataDir:        datadir,
+		RPCPort:        ports[1],
+		EnableGRPC:     true,
+		EnableTracing:  true,
+		TracerProvider: tp,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	client := createClient(t, s)
+	_, err = client.Set(context.Background(), &pb.SetRequest{
+		Key:   "key",
+		Value: []byte("value"),
+	})
+	require.NoError(t, err)
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	rpc, ok := spans["/pb.Cache/Set"]
+	require.True(t, ok)
+	apply, ok := spans["store.Apply"]
+	require.True(t, ok)
+
+	require.Equal(t, rpc.SpanContext.TraceID(), apply.SpanContext.TraceID())
+	require.Equal(t, rpc.SpanContext.SpanID(), apply.Parent.SpanID())
+	require.Contains(t, apply.Attributes, attribute.String("dcache.key", "key"))
+	require.Contains(t, apply.Attributes, attribute.String("dcache.operation", "set_versioned"))
+}
+
+func TestMinAcks(t *testing.T) {
+	services := setupNServices(t, 3, setupConf{
+		enablegrpc:    true,
+		forwardWrites: true,
+	})
+
+	leaderClient := createClient(t, services[0])
+	require.Eventually(t, func() bool {
+		res, err := leaderClient.GetServers(context.Background(), &pb.Empty{})
+		return err == nil && len(res.Server) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+
+	res, err := leaderClient.Set(context.Background(), &pb.SetRequest{
+		Key:     "key",
+		Value:   []byte("value"),
+		MinAcks: 2,
+	})
+	require.NoError(t, err)
+
+	// both followers have applied the write once Set returns.
+	for _, s := range services[1:] {
+		diag, err := createClient(t, s).Diagnostics(context.Background(), &pb.Empty{})
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, diag.AppliedIndex, res.Version)
+	}
+
+	// a write that cannot be acked by enough followers isn't applied.
+	_, err = leaderClient.Set(context.Background(), &pb.SetRequest{
+		Key:     "other",
+		Value:   []byte("value"),
+		MinAcks: 3,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	head, err := leaderClient.Head(context.Background(), &pb.HeadRequest{Key: "other"})
+	require.NoError(t, err)
+	require.False(t, head.Found)
+
+	// a write forwarded by a follower is acked before the leader answers.
+	followerClient := createClient(t, services[1])
+	res, err = followerClient.Set(context.Background(), &pb.SetRequest{
+		Key:     "forwarded",
+		Value:   []byte("value"),
+		MinAcks: 2,
+	})
+	require.NoError(t, err)
+	for _, s := range services[1:] {
+		diag, err := createClient(t, s).Diagnostics(context.Background(), &pb.Empty{})
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, diag.AppliedIndex, res.Version)
+	}
+
+	_, err = followerClient.Set(context.Background(), &pb.SetRequest{
+		Key:     "forwarded-other",
+		Value:   []byte("value"),
+		MinAcks: 3,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	head, err = leaderClient.Head(context.Background(), &pb.HeadRequest{Key: "forwarded-other"})
+	require.NoError(t, err)
+	require.False(t, head.Found)
+}
+
+func TestEphemeralPorts(t *testing.T) {
+	var services []*service.Service
+	for i := 0; i < 2; i++ {
+		datadir, err := os.MkdirTemp("", "service-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(datadir)
+
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = []string{services[0].Config.BindAddr}
+		}
+
+		s, err := service.New(service.Config{
+			NodeName:       fmt.Sprintf("%d", i),
+			Bootstrap:      i == 0,
+			StartJoinAddrs: startJoinAddrs,
+			BindAddr:       "127.0.0.1:0",
+			DataDir:        datadir,
+			RPCPort:        0,
+			EnableGRPC:     true,
+		})
+		require.NoError(t, err)
+		defer s.Close()
+
+		require.NotEqual(t, "127.0.0.1:0", s.Config.BindAddr)
+		require.NotZero(t, s.Config.RPCPort)
+		services = append(services, s)
+	}
+
+	rpcAddr, err := services[1].Config.RPCAddr()
+	require.NoError(t, err)
+
+	client := createClient(t, services[0])
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(context.Background(), &pb.Empty{})
+		if err != nil || len(res.Server) != 2 {
+			return false
+		}
+		return res.Server[1].RpcAddr == rpcAddr
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestGetLogEntry(t *testing.T) {
+	services := setupNServices(t, 1, setupConf{
+		enablegrpc: true,
+	})
+
+	client := createClient(t, services[0])
+	res, err := client.Set(context.Background(), &pb.SetRequest{
+		Key:   "key",
+		Value: []byte("value"),
+	})
+	require.NoError(t, err)
+	require.Equal(t, res.Version, res.Index)
+
+	entry, err := client.GetLogEntry(context.Background(), &pb.LogEntryRequest{Index: res.Index})
+	require.NoError(t, err)
+	require.Equal(t, "LogCommand", entry.Type)
+	require.Equal(t, "set_versioned", entry.Operation)
+	require.Equal(t, "key", entry.Key)
+
+	_, err = client.GetLogEntry(context.Background(), &pb.LogEntryRequest{Index: res.Version + 100})
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func TestVersionConflict(t *testing.T) {
+	services := setupNServices(t, 1, setupConf{
+		enablegrpc: true,
+	})
+
+	client := createClient(t, services[0])
+	res, err := client.Set(context.Background(), &pb.SetRequest{
+		Key:   "key",
+		Value: []byte("value1"),
+	})
+	require.NoError(t, err)
+
+	// a write with a stale version is aborted, so clients know to read the key
+	// again instead of retrying the same write.
+	_, err = client.Set(context.Background(), &pb.SetRequest{
+		Key:             "key",
+		Value:           []byte("value2"),
+		ExpectedVersion: res.Version + 100,
+	})
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	_, err = client.Set(context.Background(), &pb.SetRequest{
+		Key:             "key",
+		Value:           []byte("value2"),
+		ExpectedVersion: res.Version,
+	})
+	require.NoError(t, err)
+}
+
+func TestGetFromNode(t *testing.T) {
+	services := setupNServices(t, 3, setupConf{
+		enablegrpc: true,
+	})
+
+	client := createClient(t, services[0])
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(context.Background(), &pb.Empty{})
+		return err == nil && len(res.Server) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err := client.Set(context.Background(), &pb.SetRequest{
+		Key:   "key",
+		Value: []byte("value"),
+	})
+	require.NoError(t, err)
+
+	// every read goes through the first node, which forwards it to the named node.
+	for _, s := range services {
+		require.Eventually(t, func() bool {
+			res, err := client.Get(context.Background(), &pb.GetRequest{
+				Key:    "key",
+				NodeId: s.Config.NodeName,
+			})
+			return err == nil && bytes.Equal([]byte("value"), res.Value)
+		}, 5*time.Second, 50*time.Millisecond)
+	}
+
+	_, err = client.Get(context.Background(), &pb.GetRequest{Key: "key", NodeId: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestStrongConsistencyDefault(t *testing.T) {
+	services := setupNServices(t, 2, setupConf{
+		enablegrpc:        true,
+		strongConsistency: true,
+	})
+
+	client := createClient(t, services[0])
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(context.Background(), &pb.Empty{})
+		return err == nil && len(res.Server) == 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err := client.Set(context.Background(), &pb.SetRequest{
+		Key:   "key",
+		Value: []byte("value"),
+	})
+	require.NoError(t, err)
+
+	rpcaddr, err := services[1].Config.RPCAddr()
+	require.NoError(t, err)
+
+	eventual, err := grpc.Dial(rpcaddr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		server.WithConsistency(server.ConsistencyEventual),
+	)
+	require.NoError(t, err)
+	defer eventual.Close()
+
+	eventualClient := pb.NewCacheClient(eventual)
+	require.Eventually(t, func() bool {
+		res, err := eventualClient.Get(context.Background(), &pb.GetRequest{Key: "key"})
+		return err == nil && bytes.Equal([]byte("value"), res.Value)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// without metadata the follower uses the configured strong consistency, which
+	// only the leader can serve.
+	_, err = createClient(t, services[1]).Get(context.Background(), &pb.GetRequest{Key: "key"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestReadReplica(t *testing.T) {
+	services := setupNServices(t, 4, setupConf{
+		enablegrpc:   true,
+		readReplicas: 1,
+	})
+	replica := services[3]
+
+	client := createClient(t, services[0])
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(context.Background(), &pb.Empty{})
+		return err == nil && len(res.Server) == 4
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err := client.Set(context.Background(), &pb.SetRequest{
+		Key:   "key",
+		Value: []byte("value"),
+	})
+	require.NoError(t, err)
+
+	replicaClient := createClient(t, replica)
+	require.Eventually(t, func() bool {
+		res, err := replicaClient.Get(context.Background(), &pb.GetRequest{Key: "key"})
+		return err == nil && bytes.Equal([]byte("value"), res.Value)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the replica doesn't take part in the election once the leader is gone.
+	require.NoError(t, services[0].Close())
+
+	client = createClient(t, services[1])
+	var servers []*pb.Server
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(context.Background(), &pb.Empty{})
+		if err != nil {
+			return false
+		}
+		servers = res.Server
+		for _, srv := range servers {
+			if srv.IsLeader && srv.Id != services[0].Config.NodeName {
+				return true
+			}
+		}
+		return false
+	}, 10*time.Second, 100*time.Millisecond)
+
+	for _, srv := range servers {
+		if srv.Id != replica.Config.NodeName {
+			require.False(t, srv.ReadReplica)
+			continue
+		}
+		require.True(t, srv.ReadReplica)
+		require.False(t, srv.IsLeader)
+		require.Equal(t, "Nonvoter", srv.VoteStatus)
+	}
+}
+
+func TestGetPrefix(t *testing.T) {
+	services := setupNServices(t, 1, setupConf{
+		enablegrpc: true,
+	})
+	client := createClient(t, services[0])
+
+	want := map[string][]byte{
+		"users/1": []byte("alice"),
+		"users/2": []byte("bob"),
+		"users/3": []byte("carol"),
+	}
+	require.Eventually(t, func() bool {
+		_, err := client.Set(context.Background(), &pb.SetRequest{Key: "other", Value: []byte("x")})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	for k, v := range want {
+		_, err := client.Set(context.Background(), &pb.SetRequest{Key: k, Value: v})
+		require.NoError(t, err)
+	}
+
+	readAll := func(req *pb.GetPrefixRequest) map[string][]byte {
+		stream, err := client.GetPrefix(context.Background(), req)
+		require.NoError(t, err)
+
+		got := make(map[string][]byte)
+		for {
+			kv, err := stream.Recv()
+			if err == io.EOF {
+				return got
+			}
+			require.NoError(t, err)
+			got[kv.Key] = kv.Value
+		}
+	}
+
+	require.Equal(t, want, readAll(&pb.GetPrefixRequest{Prefix: "users/"}))
+	require.Len(t, readAll(&pb.GetPrefixRequest{Prefix: "users/", Limit: 2}), 2)
+}
+
+func TestSeparateRaftPort(t *testing.T) {
+	services := setupNServices(t, 3, setupConf{
+		enablegrpc:       true,
+		separateRaftPort: true,
+	})
+	time.Sleep(3 * time.Second)
+
+	leaderClient := createClient(t, services[0])
+	_, err := leaderClient.Set(context.Background(), &pb.SetRequest{
+		Key:   "key1",
+		Value: []byte("value1"),
+	})
+	require.NoError(t, err)
+
+	time.Sleep(time.Second)
+	for _, s := range services[1:] {
+		r, err := createClient(t, s).Get(context.Background(), &pb.GetRequest{
+			Key: "key1",
+		})
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), r.Value)
+	}
+
+	// clients are given the gRPC addresses, not the raft addresses.
+	res, err := leaderClient.GetServers(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Len(t, res.Server, 3)
+	for _, srv := range res.Server {
+		id, err := strconv.Atoi(srv.Id)
+		require.NoError(t, err)
+
+		rpcAddr, err := services[id].Config.RPCAddr()
+		require.NoError(t, err)
+		require.Equal(t, rpcAddr, srv.RpcAddr)
+	}
+
+	leader, err := createClient(t, services[1]).GetLeader(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	require.Equal(t, "0", leader.Id)
+	rpcAddr, err := services[0].Config.RPCAddr()
+	require.NoError(t, err)
+	require.Equal(t, rpcAddr, leader.RpcAddr)
+}
+
+func TestPause(t *testing.T) {
+	services := setupNServices(t, 3, setupConf{
+		enablegrpc: true,
+	})
+	time.Sleep(3 * time.Second)
+
+	leaderClient := createClient(t, services[0])
+	_, err := leaderClient.Set(context.Background(), &pb.SetRequest{
+		Key:   "key1",
+		Value: []byte("value1"),
+	})
+	require.NoError(t, err)
+
+	paused := services[1]
+	require.NoError(t, paused.Pause())
+
+	// the paused node rejects requests but keeps replicating.
+	_, err = createClient(t, paused).Get(context.Background(), &pb.GetRequest{Key: "key1"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = leaderClient.Set(context.Background(), &pb.SetRequest{
+		Key:   "key2",
+		Value: []byte("value2"),
+	})
+	require.NoError(t, err)
+
+	// wait for the tag to be gossiped.
+	time.Sleep(time.Second)
+
+	leaderAddr, err := services[0].Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", server.ResolverName, leaderAddr),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewCacheClient(conn)
+
+	res, err := client.GetServers(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	for _, srv := range res.Server {
+		require.Equal(t, srv.Id == paused.Config.NodeName, srv.Paused)
+	}
+
+	// the picker doesn't select the paused follower, so every read succeeds.
+	for i := 0; i < 20; i++ {
+		r, err := client.Get(context.Background(), &pb.GetRequest{Key: "key1"})
+		require.NoError(t, err)
+		require.Equal(t, []byte("value1"), r.Value)
+	}
+
+	require.NoError(t, paused.Resume())
+	time.Sleep(time.Second)
+
+	r, err := createClient(t, paused).Get(context.Background(), &pb.GetRequest{Key: "key2"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value2"), r.Value)
+
+	res, err = leaderClient.GetServers(context.Background(), &pb.Empty{})
+	require.NoError(t, err)
+	for _, srv := range res.Server {
+		require.False(t, srv.Paused)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	services := setupNServices(t, 3, setupConf{
+		enablegrpc: true,
+	})
+	time.Sleep(3 * time.Second)
+
+	var clients []pb.CacheClient
+	for _, s := range services {
+		clients = append(clients, createClient(t, s))
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := clients[0].Set(context.Background(), &pb.SetRequest{
+			Key:   fmt.Sprintf("key%d", i),
+			Value: []byte(fmt.Sprintf("value%d", i)),
+		})
+		require.NoError(t, err)
+	}
+
+	checksum := func(client pb.CacheClient) *pb.ChecksumResponse {
+		res, err := client.Checksum(context.Background(), &pb.ChecksumRequest{})
+		require.NoError(t, err)
+		return res
+	}
+
+	// a node that hasn't received the writes has a different checksum.
+	other := createClient(t, setupNServices(t, 1, setupConf{enablegrpc: true})[0])
+	require.Eventually(t, func() bool {
+		_, err := other.Set(context.Background(), &pb.SetRequest{
+			Key:   "key0",
+			Value: []byte("value0"),
+		})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	require.NotEqual(t, checksum(clients[0]).Hash, checksum(other).Hash)
+
+	// the nodes of the cluster converge to the same checksum.
+	require.Eventually(t, func() bool {
+		want := checksum(clients[0])
+		for _, client := range clients[1:] {
+			if !bytes.Equal(want.Hash, checksum(client).Hash) {
+				return false
+			}
+		}
+		return want.Count == 10
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestRecoverCorruptLog(t *testing.T) {
+	services := setupNServices(t, 1, setupConf{enablegrpc: true, persistLog: true})
+	conf := services[0].Config
+	require.NoError(t, services[0].Close())
+
+	// the log is kept in the data dir, so it can be corrupted between restarts.
+	path := filepath.Join(conf.DataDir, "raft", "log.db")
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0xff})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	ports := genNPorts(2)
+	conf.BindAddr = fmt.Sprintf("127.0.0.1:%d", ports[0])
+	conf.RPCPort = ports[1]
+	_, err = service.New(conf)
+	require.ErrorIs(t, err, store.ErrCorruptLogStore)
+
+	ports = genNPorts(2)
+	conf.BindAddr = fmt.Sprintf("127.0.0.1:%d", ports[0])
+	conf.RPCPort = ports[1]
+	conf.RecoverFromCorruption = true
+	recovered, err := service.New(conf)
+	require.NoError(t, err)
+	defer recovered.Close()
+
+	client := createClient(t, recovered)
+	_, err = client.Set(context.Background(), &pb.SetRequest{Key: "key", Value: []byte("value")})
+	require.NoError(t, err)
+}
+
+func TestRecoverAfterLosingQuorum(t *testing.T) {
+	services := setupNServices(t, 3, setupConf{enablegrpc: true, persistLog: true})
+	client := createClient(t, services[0])
+	require.Eventually(t, func() bool {
+		res, err := client.GetServers(context.Background(), &pb.Empty{})
+		return err == nil && len(res.Server) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err := client.Set(context.Background(), &pb.SetRequest{Key: "key", Value: []byte("value")})
+	require.NoError(t, err)
+
+	// the whole cluster is lost, and the first node is recovered on its own.
+	for i := len(services) - 1; i >= 0; i-- {
+		require.NoError(t, services[i].Close())
+	}
+
+	conf := services[0].Config
+	raftAddr, err := conf.RaftAddr()
+	require.NoError(t, err)
+	require.NoError(t, store.RecoverCluster(store.Config{
+		DataDir:    conf.DataDir,
+		LocalID:    raft.ServerID(conf.NodeName),
+		PersistLog: true,
+		Logger:     zap.NewNop(),
+	}, raft.Configuration{Servers: []raft.Server{{
+		Suffrage: raft.Voter,
+		ID:       raft.ServerID(conf.NodeName),
+		Address:  raft.ServerAddress(raftAddr),
+	}}}))
+
+	port, err := getFreePort()
+	require.NoError(t, err)
+	conf.BindAddr = fmt.Sprintf("127.0.0.1:%d", port)
+	conf.StartJoinAddrs = nil
+	recovered, err := service.New(conf)
+	require.NoError(t, err)
+	defer recovered.Close()
+
+	client = createClient(t, recovered)
+	require.Eventually(t, func() bool {
+		res, err := client.Get(context.Background(), &pb.GetRequest{Key: "key"})
+		return err == nil && bytes.Equal([]byte("value"), res.Value)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, err = client.Set(context.Background(), &pb.SetRequest{Key: "key", Value: []byte("value2")})
+	require.NoError(t, err)
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// defaultSnapshotCheckInterval is used if Config.SnapshotCheckInterval is not set.
+const defaultSnapshotCheckInterval = 5 * time.Second
+
+// runSnapshotTrigger takes a snapshot whenever the number of keys in the cache has
+// grown by delta since the last snapshot. This complements SnapshotThreshold for
+// workloads that add many keys with few log entries.
+func (s *Store) runSnapshotTrigger(delta int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.snapshotIfGrown(delta)
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// snapshotIfGrown takes a snapshot if the cache has grown by at least delta keys
+// since the last snapshot. If raft has nothing new to snapshot, the keys were added
+// without log entries, so the current count becomes the baseline instead of
+// retrying on every check.
+func (s *Store) snapshotIfGrown(delta int) {
+	keys := s.cache.Len()
+	if int64(keys)-s.snapshotKeys.Load() < int64(delta) {
+		return
+	}
+
+	s.logger.Info("taking a snapshot since the number of keys has grown",
+		zap.Int("keys", keys),
+		zap.Int64("last_snapshot_keys", s.snapshotKeys.Load()),
+	)
+	err := s.raft.Snapshot().Error()
+	switch {
+	case err == raft.ErrNothingNewToSnapshot:
+		s.snapshotKeys.Store(int64(keys))
+	case err != nil:
+		s.logger.Warn("failed to take a snapshot", zap.Error(err))
+	}
+}
+
+// runLeaderSnapshots takes a snapshot every interval until stop is closed. It's
+// only run on the leader, so the followers don't repeat the work.
+func (s *Store) runLeaderSnapshots(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := s.raft.Snapshot().Error()
+			if err != nil && err != raft.ErrNothingNewToSnapshot {
+				s.logger.Warn("failed to take a scheduled snapshot", zap.Error(err))
+			}
+		case <-stop:
+			return
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package store
+
+// batch.go - Coalescing concurrent writes into a single raft log entry.
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBatchSize is the maximum number of writes in a single batch. A full batch
+	// is applied right away instead of waiting for the end of the window.
+	maxBatchSize = 1024
+
+	// maxBatchBytes is the maximum size of the writes in a single batch, so that
+	// large values don't make up huge log entries. A write that doesn't fit is
+	// applied in the next batch, and a write larger than this is batched alone.
+	maxBatchBytes = 1 << 20
+)
+
+// batchedSet is a write waiting for its batch to be applied.
+type batchedSet struct {
+	key   string
+	value []byte
+	done  chan applyResult
+}
+
+// batch is the writes collected during one window.
+type batch struct {
+	sets []*batchedSet
+	keys map[string]struct{}
+	size int
+
+	// timer applies the batch at the end of the window. It's stopped if the batch
+	// is applied early.
+	timer *time.Timer
+}
+
+// batcher coalesces the Set calls made within Config.ApplyBatchWindow into a
+// single BatchOperation entry, so high write rates don't need a raft apply for
+// every key.
+type batcher struct {
+	s      *Store
+	window time.Duration
+
+	mu      sync.Mutex
+	pending *batch
+}
+
+// newBatcher returns a batcher applying the writes of s every window.
+func newBatcher(s *Store, window time.Duration) *batcher {
+	return &batcher{s: s, window: window}
+}
+
+// set adds the write to the current batch and waits until the batch has been
+// applied. Returns the index of the batch entry, which is the new version of the
+// key. The first write of a batch starts the window.
+//
+// Every write of a batch gets the same version, so a key is written at most once
+// per batch. Otherwise both writers would get the version of the value that was
+// written last, and the other writer could overwrite it with a conditional write.
+// A second write of a key applies the pending batch early instead.
+func (b *batcher) set(key string, value []byte) (uint64, error) {
+	req := &batchedSet{key: key, value: value, done: make(chan applyResult, 1)}
+	size := entrySize(key, value)
+
+	b.mu.Lock()
+	if p := b.pending; p != nil {
+		if _, ok := p.keys[key]; ok || p.size+size > maxBatchBytes {
+			b.flushLocked()
+		}
+	}
+	if b.pending == nil {
+		p := &batch{keys: make(map[string]struct{})}
+		p.timer = time.AfterFunc(b.window, func() { b.flushWindow(p) })
+		b.pending = p
+	}
+
+	p := b.pending
+	p.sets = append(p.sets, req)
+	p.keys[key] = struct{}{}
+	p.size += size
+	if len(p.sets) == maxBatchSize || p.size >= maxBatchBytes {
+		b.flushLocked()
+	}
+	b.mu.Unlock()
+
+	r := <-req.done
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.res.(uint64), nil
+}
+
+// flushLocked applies the pending batch before its window has ended. b.mu must be
+// held.
+func (b *batcher) flushLocked() {
+	p := b.pending
+	b.pending = nil
+	p.timer.Stop()
+	go b.apply(p)
+}
+
+// flushWindow applies p at the end of its window, unless it has already been
+// applied early.
+func (b *batcher) flushWindow(p *batch) {
+	b.mu.Lock()
+	if b.pending != p {
+		b.mu.Unlock()
+		return
+	}
+	b.pending = nil
+	b.mu.Unlock()
+
+	b.apply(p)
+}
+
+// apply applies the writes of p as one entry and tells every write the result of
+// its own set.
+func (b *batcher) apply(p *batch) {
+	buf := make([]byte, 0, p.size)
+	for _, req := range p.sets {
+		buf = append(buf, serializeEntry(SetOperation, req.key, req.value)...)
+	}
+
+	res, err := b.s.createApplyReq(context.Background(), BatchOperation, "", buf)
+	if err != nil {
+		for _, req := range p.sets {
+			req.done <- applyResult{err: err}
+		}
+		return
+	}
+
+	r := res.(applyResult)
+	results, _ := r.res.([]applyResult)
+	for i, req := range p.sets {
+		switch {
+		case r.err != nil:
+			req.done <- applyResult{err: r.err}
+		case i < len(results):
+			req.done <- results[i]
+		default:
+			req.done <- applyResult{err: ErrMalformedEntry}
+		}
+	}
+}
+
+// entrySize returns the length of the entry serializeEntry creates for key and
+// value.
+func entrySize(key string, value []byte) int {
+	return 1 + 4 + len(key) + 4 + len(value)
+}
+
+// applyBatch applies the set operations of a BatchOperation entry in order. Every
+// key gets the index of the entry as its version. The result has the result of
+// each set, with the version or the error, so one failed set doesn't fail the rest
+// of the batch.
+func (s *Store) applyBatch(data []byte, index uint64) applyResult {
+	var results []applyResult
+	for len(data) > 0 {
+		flag, key, value, err := deserializeEntry(data)
+		if err != nil || flag != SetOperation {
+			return applyResult{res: results, err: ErrMalformedEntry}
+		}
+		data = data[entrySize(key, value):]
+
+		s.clearExpiry(key)
+		if err := s.cache.Set(key, value); err != nil {
+			results = append(results, applyResult{err: err})
+			continue
+		}
+		s.setVersion(key, index)
+		results = append(results, applyResult{res: index})
+	}
+	return applyResult{res: results}
+}
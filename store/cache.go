@@ -6,11 +6,84 @@ import (
 
 	"github.com/VictoriaMetrics/fastcache"
 	"github.com/allegro/bigcache/v3"
+	"github.com/cespare/xxhash/v2"
 )
 
+// Cache is the local storage of the entries applied through raft. Missing keys
+// are reported with bigcache.ErrEntryNotFound regardless of the implementation,
+// since the rest of the code checks for that error.
 type Cache interface {
-	Set(key []byte, value []byte) error
-	Get(key []byte) ([]byte, error)
+	Set(key string, value []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	Len() int
+
+	// Has checks whether key exists without reading its value. Unlike Get, it
+	// doesn't count as a use of the key for the eviction order.
+	Has(key string) bool
+
+	Reset() error
+	Close() error
+
+	// Iterate calls fn for every entry in the cache. Iterating stops at the first
+	// error returned by fn. Entries changed during the iteration may or may not be
+	// seen.
+	Iterate(fn func(key string, value []byte) error) error
+}
+
+const (
+	// BigcacheBackend is the default cache backend. It evicts the oldest entries
+	// first and keeps the entries out of reach of the garbage collector.
+	BigcacheBackend = "bigcache"
+
+	// LRUBackend evicts the least recently used entries first.
+	LRUBackend = "lru"
+)
+
+// bigcacheCache implements Cache using bigcache.
+type bigcacheCache struct {
+	*bigcache.BigCache
+}
+
+// statsCache is implemented by caches that count their hits and misses.
+type statsCache interface {
+	Stats() bigcache.Stats
+}
+
+// cacheStats returns the statistics of c, looking through the encryption wrapper.
+// ok is false if the cache doesn't keep statistics.
+func cacheStats(c Cache) (stats bigcache.Stats, ok bool) {
+	if ec, isEncrypted := c.(*encryptedCache); isEncrypted {
+		c = ec.Cache
+	}
+	sc, ok := c.(statsCache)
+	if !ok {
+		return bigcache.Stats{}, false
+	}
+	return sc.Stats(), true
+}
+
+// Has implements Cache.Has. bigcache has no lookup that doesn't copy the entry, but
+// the copy is never decrypted.
+func (c bigcacheCache) Has(key string) bool {
+	_, err := c.Get(key)
+	return err == nil
+}
+
+// Iterate implements Cache.Iterate using the bigcache iterator.
+func (c bigcacheCache) Iterate(fn func(key string, value []byte) error) error {
+	iter := c.Iterator()
+	for iter.SetNext() {
+		curr, err := iter.Value()
+		if err != nil {
+			return err
+		}
+
+		if err := fn(curr.Key(), curr.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // NewBigcache creates a big cache interface that implements the Cache interface.
@@ -28,3 +101,13 @@ func NewBigcache() (*bigcache.BigCache, error) {
 func NewFastcache(maxbytes int) *fastcache.Cache {
 	return fastcache.New(maxbytes)
 }
+
+// XXHasher is a bigcache.Hasher that uses xxhash. It is faster than the default FNV
+// hasher, especially for long keys. BenchmarkHasherDistribution can be used to compare
+// how evenly each hasher spreads a given key format across shards.
+type XXHasher struct{}
+
+// Sum64 returns the xxhash of key.
+func (XXHasher) Sum64(key string) uint64 {
+	return xxhash.Sum64String(key)
+}
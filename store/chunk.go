@@ -0,0 +1,219 @@
+package store
+
+// chunk.go - Writing large values through the log in chunks.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// uploadTimeout is how long an upload can go without new chunks before it's
+// dropped. Uploads are normally committed or aborted by the leader that started
+// them, so this only cleans up after a leader that failed in the middle of one.
+const uploadTimeout = 10 * time.Minute
+
+var (
+	// ErrChunkedTransform is returned by SetChunked when Config.ValueTransform is
+	// set, since the transform needs the whole value before it's written to the log.
+	ErrChunkedTransform = errors.New("value transforms can't be applied to chunked values")
+
+	// ErrUploadTooLarge is returned by SetChunked when the value grows over
+	// Config.MaxUploadSize.
+	ErrUploadTooLarge = errors.New("chunked value exceeds the maximum upload size")
+)
+
+// upload is a value whose chunks have been applied but that hasn't been committed
+// yet.
+type upload struct {
+	data []byte
+
+	// updated is the time the latest chunk was appended to the log. It comes from
+	// the log, so every node drops an upload at the same entry.
+	updated time.Time
+}
+
+// uploads contains the values being written in chunks by their upload id. It's
+// only used from Apply, so it's not safe for concurrent use.
+type uploads map[string]*upload
+
+// newUploadID returns a random id for an upload.
+func newUploadID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// SetChunked writes key with a value that is read in chunks from next, so the value
+// is never sent through raft as a single entry. next returns io.EOF after the last
+// chunk. Every chunk is applied as its own ChunkOperation entry and the nodes
+// reassemble the value once the CommitChunksOperation entry is applied. The value
+// is only visible after the commit. If next or an apply fails, or the value grows
+// over Config.MaxUploadSize, the chunks applied so far are dropped.
+//
+// Writes aren't forwarded to the leader and the value transform can't be used
+// with chunked values.
+func (s *Store) SetChunked(key string, next func() ([]byte, error)) error {
+	if !s.isLeader() {
+		return s.notLeaderErr()
+	}
+	if s.conf.ValueTransform != nil {
+		return ErrChunkedTransform
+	}
+
+	key, err := s.transformKey(key)
+	if err != nil {
+		return err
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		return err
+	}
+
+	if err := s.applyChunks(id, next); err != nil {
+		s.abortUpload(id)
+		return err
+	}
+
+	res, err := s.createApplyReq(context.Background(), CommitChunksOperation, id, []byte(key))
+	if err != nil {
+		s.abortUpload(id)
+		return err
+	}
+	return res.(applyResult).err
+}
+
+// applyChunks applies the chunks returned by next until it returns io.EOF. The
+// size is checked before a chunk is applied, so the nodes never hold more than
+// Config.MaxUploadSize bytes of an upload.
+func (s *Store) applyChunks(id string, next func() ([]byte, error)) error {
+	size := 0
+	for {
+		chunk, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(chunk) == 0 {
+			continue
+		}
+
+		size += len(chunk)
+		if s.conf.MaxUploadSize > 0 && size > s.conf.MaxUploadSize {
+			return ErrUploadTooLarge
+		}
+
+		res, err := s.createApplyReq(context.Background(), ChunkOperation, id, chunk)
+		if err != nil {
+			return err
+		}
+		if r := res.(applyResult); r.err != nil {
+			return r.err
+		}
+	}
+}
+
+// abortUpload drops the chunks of a failed upload from every node. If the abort
+// can't be applied either, the upload is dropped after uploadTimeout.
+func (s *Store) abortUpload(id string) {
+	_, err := s.createApplyReq(context.Background(), AbortChunksOperation, id, nil)
+	if err != nil {
+		s.logger.Warn("failed to abort upload", zap.String("upload", id), zap.Error(err))
+	}
+}
+
+// dropAbandonedUploads drops the uploads that haven't received chunks within
+// uploadTimeout of now. It's called when any upload entry is applied, so an
+// abandoned upload is dropped even if no new upload is started.
+func (s *Store) dropAbandonedUploads(now time.Time) {
+	for id, u := range s.uploads {
+		if now.Sub(u.updated) > uploadTimeout {
+			s.logger.Warn("dropping abandoned upload", zap.String("upload", id))
+			delete(s.uploads, id)
+		}
+	}
+}
+
+// applyChunk appends a chunk to its upload.
+func (s *Store) applyChunk(id string, chunk []byte, appendedAt time.Time) applyResult {
+	s.dropAbandonedUploads(appendedAt)
+
+	u, ok := s.uploads[id]
+	if !ok {
+		u = &upload{}
+		s.uploads[id] = u
+	}
+	u.data = append(u.data, chunk...)
+	u.updated = appendedAt
+	return applyResult{}
+}
+
+// applyCommitChunks sets key to the reassembled value of the upload. An upload
+// without chunks is an empty value.
+func (s *Store) applyCommitChunks(id, key string, index uint64, appendedAt time.Time) applyResult {
+	s.dropAbandonedUploads(appendedAt)
+
+	var value []byte
+	if u, ok := s.uploads[id]; ok {
+		value = u.data
+		delete(s.uploads, id)
+	}
+
+	s.clearExpiry(key)
+	if err := s.cache.Set(key, value); err != nil {
+		return applyResult{err: err}
+	}
+	s.setVersion(key, index)
+	return applyResult{res: index}
+}
+
+// applyAbortChunks drops the chunks of an upload.
+func (s *Store) applyAbortChunks(id string, appendedAt time.Time) applyResult {
+	s.dropAbandonedUploads(appendedAt)
+	delete(s.uploads, id)
+	return applyResult{}
+}
+
+// copyUploads copies the uploads for a snapshot, so uploads in progress can be
+// finished on nodes that restore it.
+func (s *Store) copyUploads() map[string]upload {
+	copied := make(map[string]upload, len(s.uploads))
+	for id, u := range s.uploads {
+		copied[id] = *u
+	}
+	return copied
+}
+
+// encodeUpload encodes an upload for snapshots.
+func encodeUpload(u upload) []byte {
+	// VALUE: (UPDATED unix nanoseconds 8bytes) + (DATA)
+	buf := make([]byte, 8+len(u.data))
+	binary.LittleEndian.PutUint64(buf, uint64(u.updated.UnixNano()))
+	copy(buf[8:], u.data)
+	return buf
+}
+
+// decodeUpload decodes an upload encoded by encodeUpload.
+func decodeUpload(buf []byte) (*upload, error) {
+	if len(buf) < 8 {
+		return nil, ErrMalformedEntry
+	}
+
+	data := make([]byte, len(buf)-8)
+	copy(data, buf[8:])
+	return &upload{
+		data:    data,
+		updated: time.Unix(0, int64(binary.LittleEndian.Uint64(buf))),
+	}, nil
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// errShortCiphertext is returned when a value in the cache is too short to contain
+// a nonce, which means it wasn't encrypted by encryptedCache.
+var errShortCiphertext = errors.New("encrypted value is shorter than the nonce")
+
+// encryptedCache encrypts values with AES-GCM before storing them in the wrapped
+// cache, and decrypts them when they are read. Every value is stored with a random
+// nonce as its prefix.
+type encryptedCache struct {
+	Cache
+	aead cipher.AEAD
+}
+
+func newEncryptedCache(cache Cache, key []byte) (*encryptedCache, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidEncryptionKey
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedCache{Cache: cache, aead: aead}, nil
+}
+
+// Set encrypts value and stores it under key. The key is used as additional data,
+// so a value cannot be moved under another key without being noticed.
+func (c *encryptedCache) Set(key string, value []byte) error {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(value)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	return c.Cache.Set(key, c.aead.Seal(nonce, nonce, value, []byte(key)))
+}
+
+// Get returns the decrypted value of key.
+func (c *encryptedCache) Get(key string) ([]byte, error) {
+	ciphertext, err := c.Cache.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.decrypt(key, ciphertext)
+}
+
+// Iterate calls fn with the decrypted value of every entry.
+func (c *encryptedCache) Iterate(fn func(key string, value []byte) error) error {
+	return c.Cache.Iterate(func(key string, ciphertext []byte) error {
+		value, err := c.decrypt(key, ciphertext)
+		if err != nil {
+			return err
+		}
+		return fn(key, value)
+	})
+}
+
+func (c *encryptedCache) decrypt(key string, ciphertext []byte) ([]byte, error) {
+	size := c.aead.NonceSize()
+	if len(ciphertext) < size {
+		return nil, errShortCiphertext
+	}
+	return c.aead.Open(nil, ciphertext[:size], ciphertext[size:], []byte(key))
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedCache(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	for _, backend := range []string{BigcacheBackend, LRUBackend} {
+		t.Run(backend, func(t *testing.T) {
+			port, _ := getFreePort()
+			s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+				c.CacheBackend = backend
+				c.EncryptionKey = key
+			})
+			require.NoError(t, err)
+			defer s.Close()
+
+			_, err = s.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+
+			secret := []byte("top secret value")
+			require.NoError(t, s.Set("key", secret))
+
+			val, err := s.Get("key")
+			require.NoError(t, err)
+			require.Equal(t, secret, val)
+
+			// the cache only holds the ciphertext.
+			raw, err := s.cache.(*encryptedCache).Cache.Get("key")
+			require.NoError(t, err)
+			require.False(t, bytes.Contains(raw, secret))
+
+			var scanned []byte
+			require.NoError(t, s.Scan("", 0, func(key string, value []byte) error {
+				scanned = value
+				return nil
+			}))
+			require.Equal(t, secret, scanned)
+		})
+	}
+}
+
+func TestEncryptedCacheNonce(t *testing.T) {
+	cache, err := newEncryptedCache(newLRUCache(10, 1, nil), bytes.Repeat([]byte{1}, 16))
+	require.NoError(t, err)
+
+	// the same value is encrypted differently every time.
+	require.NoError(t, cache.Set("a", []byte("value")))
+	require.NoError(t, cache.Set("b", []byte("value")))
+	a, err := cache.Cache.Get("a")
+	require.NoError(t, err)
+	b, err := cache.Cache.Get("b")
+	require.NoError(t, err)
+	require.NotEqual(t, a, b)
+
+	// a value moved under another key fails to decrypt.
+	require.NoError(t, cache.Cache.Set("c", a))
+	_, err = cache.Get("c")
+	require.Error(t, err)
+}
+
+func TestInvalidEncryptionKey(t *testing.T) {
+	port, _ := getFreePort()
+	_, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.EncryptionKey = []byte("short")
+	})
+	require.ErrorIs(t, err, ErrInvalidEncryptionKey)
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"context"
+
+	"github.com/nireo/dcache/pb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// leaderClient returns a client to the current leader. The connection is reused
+// until the leader changes. The rpc address of the leader is looked up from the
+// members, or the raft address is used when raft and gRPC share the port.
+func (s *Store) leaderClient() (pb.CacheClient, error) {
+	addr := s.LeaderRPCAddr()
+	if addr == "" {
+		return nil, s.notLeaderErr()
+	}
+
+	s.leaderConnMu.Lock()
+	defer s.leaderConnMu.Unlock()
+
+	if s.leaderConn != nil && s.leaderConnAddr == addr {
+		return pb.NewCacheClient(s.leaderConn), nil
+	}
+	s.closeLeaderConnLocked()
+
+	opts := s.conf.LeaderDialOptions
+	if opts == nil {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	if len(s.conf.LeaderCallOptions) > 0 {
+		// copy the options, so the configured slice isn't appended to.
+		opts = append(opts[:len(opts):len(opts)],
+			grpc.WithDefaultCallOptions(s.conf.LeaderCallOptions...))
+	}
+
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.leaderConn = conn
+	s.leaderConnAddr = addr
+
+	return pb.NewCacheClient(conn), nil
+}
+
+// resetLeaderClient closes the cached leader connection, so the next forwarded
+// request connects to the new leader.
+func (s *Store) resetLeaderClient() {
+	s.leaderConnMu.Lock()
+	defer s.leaderConnMu.Unlock()
+	s.closeLeaderConnLocked()
+}
+
+func (s *Store) closeLeaderConnLocked() {
+	if s.leaderConn == nil {
+		return
+	}
+
+	if err := s.leaderConn.Close(); err != nil {
+		s.logger.Warn("failed to close leader connection", zap.Error(err))
+	}
+	s.leaderConn = nil
+	s.leaderConnAddr = ""
+}
+
+// forwardSet sends a write to the leader, when this node isn't the leader and
+// Config.ForwardWrites is set. The write fails if the leader doesn't answer within
+// applyTimeout. The connection is dropped if the leader couldn't be reached, so
+// the next write connects again instead of reusing a broken connection.
+func (s *Store) forwardSet(
+	ctx context.Context, key string, value []byte, opts SetOptions,
+) (*pb.SetResponse, error) {
+	if s.Paused() {
+		return nil, ErrPaused
+	}
+
+	client, err := s.leaderClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, applyTimeout)
+	defer cancel()
+
+	res, err := client.Set(ctx, &pb.SetRequest{
+		Key:             key,
+		Value:           value,
+		ExpectedVersion: opts.ExpectedVersion,
+		IdempotencyKey:  opts.IdempotencyKey,
+		MinAcks:         opts.MinAcks,
+	})
+	if code := status.Code(err); code == codes.Unavailable || code == codes.DeadlineExceeded {
+		s.resetLeaderClient()
+	}
+	return res, err
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/nireo/dcache/pb"
+)
+
+const (
+	// sketchDepth and sketchWidth are the dimensions of the count-min sketch. The
+	// estimate of a key is off by at most 2/width of the sampled reads with
+	// probability 1 - 1/2^depth.
+	sketchDepth = 4
+	sketchWidth = 2048
+
+	// hotKeyCandidates is the number of keys whose estimates are kept, which is
+	// also the maximum number of keys HotKeys returns.
+	hotKeyCandidates = 128
+
+	// defaultHotKeySampleRate records one read out of every ten.
+	defaultHotKeySampleRate = 10
+)
+
+// hotKeys estimates how often keys are read. The counts are kept in a count-min
+// sketch so the memory used doesn't grow with the number of keys, and only the
+// keys with the highest estimates are remembered.
+type hotKeys struct {
+	mu         sync.Mutex
+	sketch     [sketchDepth][sketchWidth]uint32
+	candidates map[string]uint32
+	sampleRate int
+}
+
+func newHotKeys(sampleRate int) *hotKeys {
+	if sampleRate <= 0 {
+		sampleRate = defaultHotKeySampleRate
+	}
+
+	return &hotKeys{
+		candidates: make(map[string]uint32, hotKeyCandidates),
+		sampleRate: sampleRate,
+	}
+}
+
+// record counts a read of key. Only a random sample of the reads are counted to
+// keep the overhead on the read path low.
+func (h *hotKeys) record(key string) {
+	if h.sampleRate > 1 && rand.Intn(h.sampleRate) != 0 {
+		return
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+
+	// the rows are indexed with combinations of two halves of the same hash.
+	h1, h2 := uint32(sum), uint32(sum>>32)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	estimate := ^uint32(0)
+	for i := 0; i < sketchDepth; i++ {
+		idx := (h1 + uint32(i)*h2) % sketchWidth
+		h.sketch[i][idx]++
+		if h.sketch[i][idx] < estimate {
+			estimate = h.sketch[i][idx]
+		}
+	}
+
+	if _, ok := h.candidates[key]; ok || len(h.candidates) < hotKeyCandidates {
+		h.candidates[key] = estimate
+		return
+	}
+
+	// replace the coldest candidate if key has been read more often.
+	var coldest string
+	min := ^uint32(0)
+	for k, c := range h.candidates {
+		if c < min {
+			coldest, min = k, c
+		}
+	}
+	if estimate > min {
+		delete(h.candidates, coldest)
+		h.candidates[key] = estimate
+	}
+}
+
+// top returns at most limit keys with the highest estimated read counts, most
+// read first. The counts are scaled by the sample rate to approximate the actual
+// number of reads. A limit of zero returns every tracked key.
+func (h *hotKeys) top(limit int) []*pb.HotKey {
+	h.mu.Lock()
+	keys := make([]*pb.HotKey, 0, len(h.candidates))
+	for k, c := range h.candidates {
+		keys = append(keys, &pb.HotKey{
+			Key:   k,
+			Reads: uint64(c) * uint64(h.sampleRate),
+		})
+	}
+	h.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Reads != keys[j].Reads {
+			return keys[i].Reads > keys[j].Reads
+		}
+		return keys[i].Key < keys[j].Key
+	})
+
+	if limit > 0 && limit < len(keys) {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// HotKeys returns the most read keys of the node, most read first. The read counts
+// are estimates. ErrHotKeysDisabled is returned if Config.TrackHotKeys isn't set.
+func (s *Store) HotKeys(limit int) ([]*pb.HotKey, error) {
+	if s.hotKeys == nil {
+		return nil, ErrHotKeysDisabled
+	}
+	return s.hotKeys.top(limit), nil
+}
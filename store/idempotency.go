@@ -0,0 +1,127 @@
+package store
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+)
+
+// defaultIdempotencyKeys is the number of idempotency keys remembered if
+// Config.IdempotencyKeys is not set.
+const defaultIdempotencyKeys = 10000
+
+// idempotencyCache remembers the results of the most recently applied writes that
+// had an idempotency key. It's only used from Apply, so it's not safe for
+// concurrent use.
+type idempotencyCache struct {
+	size    int
+	order   *list.List
+	results map[string]*list.Element
+}
+
+// idempotencyEntry is the element stored in the order list.
+type idempotencyEntry struct {
+	key    string
+	result applyResult
+}
+
+func newIdempotencyCache(size int) *idempotencyCache {
+	return &idempotencyCache{
+		size:    size,
+		order:   list.New(),
+		results: make(map[string]*list.Element),
+	}
+}
+
+// get returns the result of the write with the given idempotency key, if it's
+// still remembered.
+func (c *idempotencyCache) get(key string) (applyResult, bool) {
+	elem, ok := c.results[key]
+	if !ok {
+		return applyResult{}, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*idempotencyEntry).result, true
+}
+
+// add records the result of a write. The least recently used key is forgotten if
+// the cache is full.
+func (c *idempotencyCache) add(key string, result applyResult) {
+	c.results[key] = c.order.PushFront(&idempotencyEntry{key: key, result: result})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.results, oldest.Value.(*idempotencyEntry).key)
+	}
+}
+
+// entries returns the remembered results from the least to the most recently used,
+// so that adding them in order recreates the cache.
+func (c *idempotencyCache) entries() []idempotencyEntry {
+	entries := make([]idempotencyEntry, 0, c.order.Len())
+	for elem := c.order.Back(); elem != nil; elem = elem.Prev() {
+		entries = append(entries, *elem.Value.(*idempotencyEntry))
+	}
+	return entries
+}
+
+// idempotencyErrors are the errors whose identity is kept when a remembered result
+// is restored from a snapshot, so a retried write is answered with the same error
+// as the first attempt. Only errors that applying an entry returns alike on every
+// node belong here. Transient errors like losing the leadership are returned
+// before the entry is applied, so they're never remembered. The code of an error
+// is its index plus one, so errors may only be appended to the list.
+var idempotencyErrors = []error{
+	ErrVersionConflict,
+	ErrMalformedEntry,
+}
+
+// idempotencyErrorCode returns the code of err, or zero if it isn't one of
+// idempotencyErrors.
+func idempotencyErrorCode(err error) byte {
+	for i, known := range idempotencyErrors {
+		if errors.Is(err, known) {
+			return byte(i + 1)
+		}
+	}
+	return 0
+}
+
+// encodeIdempotencyResult encodes the result of a write for snapshots.
+func encodeIdempotencyResult(res applyResult) []byte {
+	// VALUE: (VERSION uint64 8bytes) + (ERROR_CODE 1byte) + (ERROR_MESSAGE)
+	var msg string
+	if res.err != nil {
+		msg = res.err.Error()
+	}
+
+	buf := make([]byte, 9+len(msg))
+	if version, ok := res.res.(uint64); ok {
+		binary.LittleEndian.PutUint64(buf, version)
+	}
+	buf[8] = idempotencyErrorCode(res.err)
+	copy(buf[9:], msg)
+	return buf
+}
+
+// decodeIdempotencyResult decodes a result encoded by encodeIdempotencyResult.
+// Errors with a known code are restored as the same error, other errors only keep
+// their message.
+func decodeIdempotencyResult(buf []byte) (applyResult, error) {
+	if len(buf) < 9 {
+		return applyResult{}, ErrMalformedEntry
+	}
+
+	code := int(buf[8])
+	if code > len(idempotencyErrors) {
+		return applyResult{}, ErrMalformedEntry
+	}
+	if code != 0 {
+		return applyResult{err: idempotencyErrors[code-1]}, nil
+	}
+
+	if msg := string(buf[9:]); msg != "" {
+		return applyResult{err: errors.New(msg)}, nil
+	}
+	return applyResult{res: binary.LittleEndian.Uint64(buf)}, nil
+}
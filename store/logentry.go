@@ -0,0 +1,52 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/raft"
+)
+
+// LogEntry returns the raft log entry at index from the log store of this node.
+// Comparing the entries of different nodes helps with diagnosing diverged logs.
+// Returns ErrLogIndexOutOfRange if the entry has been compacted or doesn't exist
+// yet.
+func (s *Store) LogEntry(index uint64) (*raft.Log, error) {
+	first, err := s.logStore.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	last, err := s.logStore.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	if index < first || index > last {
+		return nil, fmt.Errorf("%w: %d is not in [%d, %d]",
+			ErrLogIndexOutOfRange, index, first, last)
+	}
+
+	var l raft.Log
+	if err := s.logStore.GetLog(index, &l); err != nil {
+		if errors.Is(err, raft.ErrLogNotFound) {
+			return nil, fmt.Errorf("%w: %d", ErrLogIndexOutOfRange, index)
+		}
+		return nil, err
+	}
+	return &l, nil
+}
+
+// DecodeLogEntry decodes the data of a command log entry into the operation, key
+// and value.
+func DecodeLogEntry(data []byte) (operation byte, key string, value []byte, err error) {
+	return deserializeEntry(data)
+}
+
+// OperationName returns a human readable name of an operation, such as "set".
+func OperationName(operation byte) string {
+	if name, ok := operationNames[operation]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", operation)
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	fastlog "github.com/tidwall/raft-fastlog"
+	"go.uber.org/zap"
+)
+
+// logStoreFile is the name of the persisted log store file in the raft directory.
+const logStoreFile = "log.db"
+
+const (
+	// FastlogLow leaves flushing the log store file to the operating system. It's
+	// the fastest level, but writes acknowledged just before a crash of the machine
+	// can be lost.
+	FastlogLow = "low"
+
+	// FastlogMedium syncs the log store file to disk every second, so at most a
+	// second of writes can be lost in a crash. It's the default level.
+	FastlogMedium = "medium"
+
+	// FastlogHigh syncs the log store file to disk on every write. No acknowledged
+	// write is lost, but every write waits for the disk.
+	FastlogHigh = "high"
+)
+
+// fastlogLevel returns the durability level of the log store selected by
+// Config.FastlogLevel.
+func (s *Store) fastlogLevel() (fastlog.Level, error) {
+	switch s.conf.FastlogLevel {
+	case FastlogLow:
+		return fastlog.Low, nil
+	case "", FastlogMedium:
+		return fastlog.Medium, nil
+	case FastlogHigh:
+		return fastlog.High, nil
+	}
+	return 0, ErrUnknownFastlogLevel
+}
+
+// openLogStore opens the store used as both the raft log store and stable store.
+// Without Config.PersistLog the store is kept in memory.
+func (s *Store) openLogStore(raftDir string) (*fastlog.FastLogStore, error) {
+	level, err := s.fastlogLevel()
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.conf.PersistLog {
+		return fastlog.NewFastLogStore(":memory:", level, io.Discard)
+	}
+
+	if err := os.MkdirAll(raftDir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(raftDir, logStoreFile)
+	logStore, err := fastlog.NewFastLogStore(path, level, io.Discard)
+	if err == nil || !isCorruption(err) {
+		return logStore, err
+	}
+
+	if !s.conf.RecoverFromCorruption {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptLogStore, err)
+	}
+
+	moved := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+	if err := os.Rename(path, moved); err != nil {
+		return nil, err
+	}
+	s.logger.Error("raft log store is corrupt, starting with an empty log",
+		zap.String("path", path),
+		zap.String("moved_to", moved),
+		zap.Error(err),
+	)
+
+	return fastlog.NewFastLogStore(path, level, io.Discard)
+}
+
+// isCorruption reports whether err is an error from parsing the contents of the
+// log store file. Failing to open or read the file returns a *fs.PathError, every
+// other error comes from an invalid or truncated entry.
+func isCorruption(err error) bool {
+	var pathErr *fs.PathError
+	return !errors.As(err, &pathErr)
+}
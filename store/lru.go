@@ -0,0 +1,189 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/allegro/bigcache/v3"
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	// lruShards is the number of shards of the lru cache. Every shard has its own
+	// lock and eviction order, so the order is only approximately LRU across the
+	// whole cache.
+	lruShards = 16
+
+	// defaultMaxCacheEntries is used if Config.MaxCacheEntries is not set.
+	defaultMaxCacheEntries = 100000
+)
+
+// lruCache implements Cache by evicting the least recently used entries once the
+// number of entries reaches the limit.
+type lruCache struct {
+	shards   []*lruShard
+	onRemove func(key string, value []byte, reason bigcache.RemoveReason)
+}
+
+type lruShard struct {
+	sync.Mutex
+	capacity int
+	order    *list.List // front is the most recently used entry
+	entries  map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value []byte
+}
+
+// newLRUCache creates a lru cache holding at most maxEntries entries split evenly
+// over shards. Like bigcache's OnRemoveWithReason, onRemove is called for every
+// entry evicted to make room with bigcache.NoSpace and for every deleted entry with
+// bigcache.Deleted. It's called without holding the lock of the shard.
+func newLRUCache(
+	maxEntries, shards int,
+	onRemove func(key string, value []byte, reason bigcache.RemoveReason),
+) *lruCache {
+	capacity := (maxEntries + shards - 1) / shards
+	c := &lruCache{
+		shards:   make([]*lruShard, shards),
+		onRemove: onRemove,
+	}
+	for i := range c.shards {
+		c.shards[i] = &lruShard{
+			capacity: capacity,
+			order:    list.New(),
+			entries:  make(map[string]*list.Element),
+		}
+	}
+	return c
+}
+
+func (c *lruCache) shard(key string) *lruShard {
+	return c.shards[xxhash.Sum64String(key)%uint64(len(c.shards))]
+}
+
+// Set stores a copy of value and marks the key as the most recently used.
+func (c *lruCache) Set(key string, value []byte) error {
+	value = append([]byte(nil), value...)
+
+	sh := c.shard(key)
+	sh.Lock()
+	if el, ok := sh.entries[key]; ok {
+		el.Value.(*lruEntry).value = value
+		sh.order.MoveToFront(el)
+		sh.Unlock()
+		return nil
+	}
+
+	sh.entries[key] = sh.order.PushFront(&lruEntry{key: key, value: value})
+
+	var evicted []*lruEntry
+	for sh.order.Len() > sh.capacity {
+		oldest := sh.order.Back()
+		sh.order.Remove(oldest)
+		e := oldest.Value.(*lruEntry)
+		delete(sh.entries, e.key)
+		evicted = append(evicted, e)
+	}
+	sh.Unlock()
+
+	if c.onRemove != nil {
+		for _, e := range evicted {
+			c.onRemove(e.key, e.value, bigcache.NoSpace)
+		}
+	}
+	return nil
+}
+
+// Get returns a copy of the value of key and marks it as the most recently used.
+// Like bigcache, the caller owns the returned slice, so changing it doesn't change
+// the cached value.
+func (c *lruCache) Get(key string) ([]byte, error) {
+	sh := c.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	el, ok := sh.entries[key]
+	if !ok {
+		return nil, bigcache.ErrEntryNotFound
+	}
+	sh.order.MoveToFront(el)
+	return append([]byte(nil), el.Value.(*lruEntry).value...), nil
+}
+
+// Has checks whether key exists without marking it as used.
+func (c *lruCache) Has(key string) bool {
+	sh := c.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	_, ok := sh.entries[key]
+	return ok
+}
+
+func (c *lruCache) Delete(key string) error {
+	sh := c.shard(key)
+	sh.Lock()
+	el, ok := sh.entries[key]
+	if !ok {
+		sh.Unlock()
+		return bigcache.ErrEntryNotFound
+	}
+	sh.order.Remove(el)
+	delete(sh.entries, key)
+	sh.Unlock()
+
+	if c.onRemove != nil {
+		c.onRemove(key, el.Value.(*lruEntry).value, bigcache.Deleted)
+	}
+	return nil
+}
+
+func (c *lruCache) Len() int {
+	n := 0
+	for _, sh := range c.shards {
+		sh.Lock()
+		n += sh.order.Len()
+		sh.Unlock()
+	}
+	return n
+}
+
+func (c *lruCache) Reset() error {
+	for _, sh := range c.shards {
+		sh.Lock()
+		sh.order.Init()
+		sh.entries = make(map[string]*list.Element)
+		sh.Unlock()
+	}
+	return nil
+}
+
+func (c *lruCache) Close() error {
+	return c.Reset()
+}
+
+// Iterate copies the entries of one shard at a time, so fn is called without
+// holding the lock. The values are copied too, so fn may keep them. Iterating
+// doesn't change the eviction order.
+func (c *lruCache) Iterate(fn func(key string, value []byte) error) error {
+	for _, sh := range c.shards {
+		sh.Lock()
+		entries := make([]lruEntry, 0, sh.order.Len())
+		for el := sh.order.Front(); el != nil; el = el.Next() {
+			e := *el.Value.(*lruEntry)
+			e.value = append([]byte(nil), e.value...)
+			entries = append(entries, e)
+		}
+		sh.Unlock()
+
+		for _, e := range entries {
+			if err := fn(e.key, e.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
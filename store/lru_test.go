@@ -0,0 +1,160 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// fillAndTouch writes n entries, reads the first one and then writes one more
+// entry, which doesn't fit into a cache holding n entries.
+func fillAndTouch(t *testing.T, c Cache, n int, value []byte) {
+	for i := 0; i < n; i++ {
+		require.NoError(t, c.Set(fmt.Sprintf("key%d", i), value))
+	}
+	_, err := c.Get("key0")
+	require.NoError(t, err)
+	require.NoError(t, c.Set(fmt.Sprintf("key%d", n), value))
+}
+
+func TestLRUEvictionOrder(t *testing.T) {
+	value := make([]byte, 250*1024)
+
+	// a single shard of 1MB fits four of the values.
+	conf := bigcache.DefaultConfig(10 * time.Minute)
+	conf.Shards = 1
+	conf.HardMaxCacheSize = 1
+	conf.MaxEntrySize = len(value)
+	bc, err := bigcache.New(context.Background(), conf)
+	require.NoError(t, err)
+	defer bc.Close()
+
+	var evicted []string
+	lru := newLRUCache(4, 1, func(key string, value []byte, reason bigcache.RemoveReason) {
+		require.Equal(t, bigcache.NoSpace, reason)
+		evicted = append(evicted, key)
+	})
+
+	fillAndTouch(t, bigcacheCache{bc}, 4, value)
+	fillAndTouch(t, lru, 4, value)
+
+	// bigcache evicts the oldest entry even though it was just read.
+	_, err = bc.Get("key0")
+	require.ErrorIs(t, err, bigcache.ErrEntryNotFound)
+	_, err = bc.Get("key1")
+	require.NoError(t, err)
+
+	// lru evicts the least recently used entry instead.
+	_, err = lru.Get("key0")
+	require.NoError(t, err)
+	_, err = lru.Get("key1")
+	require.ErrorIs(t, err, bigcache.ErrEntryNotFound)
+	require.Equal(t, []string{"key1"}, evicted)
+	require.Equal(t, 4, lru.Len())
+}
+
+func TestLRUHasDoesNotTouch(t *testing.T) {
+	lru := newLRUCache(2, 1, nil)
+	require.NoError(t, lru.Set("key0", []byte("value")))
+	require.NoError(t, lru.Set("key1", []byte("value")))
+
+	// checking key0 doesn't make it more recently used than key1.
+	require.True(t, lru.Has("key0"))
+	require.False(t, lru.Has("missing"))
+	require.NoError(t, lru.Set("key2", []byte("value")))
+	require.False(t, lru.Has("key0"))
+	require.True(t, lru.Has("key1"))
+}
+
+func TestLRUReturnsCopies(t *testing.T) {
+	lru := newLRUCache(2, 1, nil)
+	require.NoError(t, lru.Set("key", []byte("value")))
+
+	val, err := lru.Get("key")
+	require.NoError(t, err)
+	copy(val, "xxxxx")
+
+	require.NoError(t, lru.Iterate(func(key string, value []byte) error {
+		copy(value, "yyyyy")
+		return nil
+	}))
+
+	val, err = lru.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+}
+
+func TestLRUBackend(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.CacheBackend = LRUBackend
+	})
+	require.NoError(t, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.Set(fmt.Sprintf("key%d", i), []byte("value")))
+	}
+	val, err := s.Get("key3")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+
+	// the snapshot iterates the lru cache.
+	_, err = s.ForceSnapshot()
+	require.NoError(t, err)
+	snapshots, err := s.snapshots.List()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+
+	_, rc, err := s.snapshots.Open(snapshots[0].ID)
+	require.NoError(t, err)
+	require.NoError(t, s.Restore(rc))
+	require.Equal(t, 10, s.cache.Len())
+
+	port, _ = getFreePort()
+	_, err = newTestStoreWithConf(t, port, 2, true, func(c *Config) {
+		c.CacheBackend = "lfu"
+	})
+	require.ErrorIs(t, err, ErrUnknownCacheBackend)
+}
+
+func TestLRUFlush(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.CacheBackend = LRUBackend
+	})
+	require.NoError(t, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	key, err := namespacedKey("ns", "key")
+	require.NoError(t, err)
+	ttlKey, err := namespacedKey("ns", "ttl")
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetNS("ns", "key", []byte("value")))
+	require.NoError(t, s.SetTTL(ttlKey, []byte("value"), time.Hour))
+	require.NoError(t, s.Set("other", []byte("value")))
+	_, version, err := s.GetVersioned(key)
+	require.NoError(t, err)
+	require.NotZero(t, version)
+
+	require.NoError(t, s.FlushNS("ns"))
+
+	// the flushed keys don't leave versions or deadlines behind, which would end up
+	// in snapshots.
+	_, _, err = s.GetVersioned(key)
+	require.ErrorIs(t, err, bigcache.ErrEntryNotFound)
+	versions := s.copyVersions()
+	require.NotContains(t, versions, key)
+	require.NotContains(t, versions, ttlKey)
+	require.Contains(t, versions, "other")
+	require.Empty(t, s.copyExpiries())
+}
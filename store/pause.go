@@ -0,0 +1,29 @@
+package store
+
+// Pause takes the node out of rotation without removing it from the cluster. Reads
+// and writes on the node return ErrPaused, but raft keeps replicating in the
+// background so the cache is up to date once the node is resumed. The entries the
+// store applies on its own keep being applied, so a paused leader still deletes
+// expired keys.
+func (s *Store) Pause() {
+	s.paused.Store(true)
+	s.serversChanged()
+}
+
+// Resume makes a paused node serve reads and writes again.
+func (s *Store) Resume() {
+	s.paused.Store(false)
+	s.serversChanged()
+}
+
+// Paused reports whether the node has been paused.
+func (s *Store) Paused() bool {
+	return s.paused.Load()
+}
+
+// internalOperation reports whether entries of type ty are applied by the store
+// itself instead of for a client, like the deletes of the TTL sweeper and the
+// cleanup of failed uploads. They're applied on a paused node too.
+func internalOperation(ty byte) bool {
+	return ty == ExpireOperation || ty == AbortChunksOperation
+}
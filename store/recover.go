@@ -0,0 +1,49 @@
+package store
+
+import (
+	"github.com/hashicorp/raft"
+)
+
+// RecoverCluster replaces the cluster configuration stored in the data directory
+// of conf with configuration. It's meant for when a majority of the cluster has
+// been lost for good, so a leader can never be elected again. The state is rebuilt
+// from the latest snapshot and the log, and a new snapshot is taken with the new
+// configuration.
+//
+// The node must not be running. Every node in the new configuration needs to be
+// recovered with the same configuration before they're started again. Without
+// Config.PersistLog only the latest snapshot can be recovered, since the log isn't
+// kept on disk.
+func RecoverCluster(conf Config, configuration raft.Configuration) error {
+	s, err := newFSM(conf)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	logStore, err := s.openLogStore(s.raftDir)
+	if err != nil {
+		return err
+	}
+	s.logStore = logStore
+
+	snapshotStore, err := s.openSnapshotStore()
+	if err != nil {
+		return err
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = conf.LocalID
+
+	// the transport is only used to encode the servers of the snapshot.
+	_, transport := raft.NewInmemTransport("")
+	return raft.RecoverCluster(
+		config,
+		s,
+		logStore,
+		logStore,
+		snapshotStore,
+		transport,
+		configuration,
+	)
+}
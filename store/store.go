@@ -1,19 +1,27 @@
 package store
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
 	"errors"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/allegro/bigcache/v3"
 	"github.com/hashicorp/raft"
+	"github.com/nireo/dcache/metrics"
 	"github.com/nireo/dcache/pb"
-	fastlog "github.com/tidwall/raft-fastlog"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -22,10 +30,173 @@ const (
 
 	// GetOperation is for handling get operations in raft_apply.
 	GetOperation
+
+	// FlushOperation is for removing every key with a given prefix in raft_apply.
+	FlushOperation
+
+	// GetOrSetOperation is for storing a value only if the key doesn't exist yet in
+	// raft_apply.
+	GetOrSetOperation
+
+	// DeleteOperation is for removing a single key in raft_apply.
+	DeleteOperation
+
+	// SetTTLOperation is for handling set operations with an expiration deadline in
+	// raft_apply. The value is prefixed with the deadline in unix nanoseconds.
+	SetTTLOperation
+
+	// SetVersionedOperation is for handling set operations with SetOptions in
+	// raft_apply. The value is prefixed with the expected version and the
+	// idempotency key.
+	SetVersionedOperation
+
+	// VersionOperation records the version of a key in snapshots. It's never
+	// applied through raft.
+	VersionOperation
+
+	// IdempotencyOperation records the result of a write with an idempotency key
+	// in snapshots. It's never applied through raft.
+	IdempotencyOperation
+
+	// TouchOperation moves the expiration deadline of a key with a TTL in
+	// raft_apply. The value is the deadline the touch was started with followed by
+	// the new deadline, both in unix nanoseconds.
+	TouchOperation
+
+	// BatchOperation applies several set operations in a single log entry in
+	// raft_apply. The value is the serialized set operations one after another.
+	BatchOperation
+
+	// ChunkOperation appends a chunk of a value written with SetChunked in
+	// raft_apply. The key is the id of the upload.
+	ChunkOperation
+
+	// CommitChunksOperation sets a key to the value reassembled from the chunks of
+	// an upload in raft_apply. The key is the id of the upload and the value is the
+	// key being set. In snapshots, ChunkOperation entries contain the uploads that
+	// haven't been committed yet.
+	CommitChunksOperation
+
+	// AbortChunksOperation drops the chunks of a failed upload in raft_apply.
+	AbortChunksOperation
+
+	// ExpiryOperation records the deadline and TTL of a key set with a TTL in
+	// snapshots. It's never applied through raft.
+	ExpiryOperation
+
+	// ExpireOperation deletes a key whose TTL has passed in raft_apply, if its
+	// deadline is still the one the sweeper saw.
+	ExpireOperation
 )
 
-// ErrJoiningSelf represents the situation where a node tries to join itself.
-var ErrJoiningSelf = errors.New("trying to join self")
+// applyTimeout is the maximum time a write waits to be applied by raft or, when it
+// is forwarded, to be answered by the leader.
+const applyTimeout = 10 * time.Second
+
+// readBarrierTimeout is the maximum time a linearizable read waits for committed
+// entries to be applied.
+const readBarrierTimeout = 10 * time.Second
+
+// defaultRetainSnapshots is the number of snapshots kept if Config.RetainSnapshots
+// is not set.
+const defaultRetainSnapshots = 2
+
+// snapshotDir is the directory under the raft directory where the file snapshot
+// store keeps the snapshots.
+const snapshotDir = "snapshots"
+
+// namespaceSeparator separates the namespace from the key in the internal key.
+const namespaceSeparator = "\x00"
+
+var (
+	// ErrJoiningSelf represents the situation where a node tries to join itself.
+	ErrJoiningSelf = errors.New("trying to join self")
+
+	// ErrInvalidNamespace is returned when a namespace contains the separator byte.
+	ErrInvalidNamespace = errors.New("namespace cannot contain a null byte")
+
+	// ErrMalformedEntry is returned when an entry cannot be deserialized.
+	ErrMalformedEntry = errors.New("malformed entry")
+
+	// ErrNoLeaderElected is returned for leader-only operations while the cluster
+	// doesn't have a leader, for example during an election.
+	ErrNoLeaderElected = errors.New("no leader elected")
+
+	// ErrNoVoters is returned when the cluster configuration doesn't contain any
+	// voters. A leader can never be elected in this state, so the cluster needs to be
+	// recovered manually.
+	ErrNoVoters = errors.New("cluster has no voters, a leader cannot be elected")
+
+	// ErrReadBarrierTimeout is returned when the committed entries are not applied
+	// in time for a linearizable read.
+	ErrReadBarrierTimeout = errors.New("timed out waiting for the read barrier")
+
+	// ErrUnknownServer is returned when a server ID cannot be found in the cluster
+	// configuration.
+	ErrUnknownServer = errors.New("server not found in cluster configuration")
+
+	// ErrNotNonVoter is returned when promoting a server that is already a voter.
+	ErrNotNonVoter = errors.New("server is not a non-voter")
+
+	// ErrReadReplica is returned when promoting a read replica to a voter.
+	ErrReadReplica = errors.New("read replicas cannot become voters")
+
+	// ErrVersionConflict is returned when a versioned write expects a different
+	// version than the key currently has.
+	ErrVersionConflict = errors.New("version of the key has changed")
+
+	// ErrLogIndexOutOfRange is returned by LogEntry when the index is not in the
+	// log of the node.
+	ErrLogIndexOutOfRange = errors.New("log index out of range")
+
+	// ErrCorruptLogStore is returned from New when the persisted raft log cannot be
+	// read and Config.RecoverFromCorruption is not set.
+	ErrCorruptLogStore = errors.New("raft log store is corrupt")
+
+	// ErrNotClusterMember is returned by reads on a node that has been removed from
+	// the cluster, since its cache no longer receives writes.
+	ErrNotClusterMember = errors.New("node is not a member of the cluster")
+
+	// ErrHotKeysDisabled is returned by HotKeys when Config.TrackHotKeys isn't set.
+	ErrHotKeysDisabled = errors.New("hot key tracking is disabled")
+
+	// ErrTooManyInflightApplies is returned by writes when Config.MaxInflightApplies
+	// writes are already waiting to be applied.
+	ErrTooManyInflightApplies = errors.New("too many in-flight writes")
+
+	// ErrUnknownCacheBackend is returned from New when Config.CacheBackend isn't
+	// bigcache or lru.
+	ErrUnknownCacheBackend = errors.New("unknown cache backend, expected bigcache or lru")
+
+	// ErrUnknownFastlogLevel is returned from New when Config.FastlogLevel isn't
+	// low, medium or high.
+	ErrUnknownFastlogLevel = errors.New("unknown fastlog level, expected low, medium or high")
+
+	// ErrInvalidEncryptionKey is returned from New when Config.EncryptionKey isn't
+	// 16, 24 or 32 bytes long.
+	ErrInvalidEncryptionKey = errors.New("encryption key must be 16, 24 or 32 bytes")
+
+	// ErrPaused is returned by reads and writes on a node that has been paused with
+	// Pause.
+	ErrPaused = errors.New("node is paused")
+
+	// ErrDuplicateNodeID is returned when a node joins with the id of a server that
+	// is already in the cluster with a different address, unless
+	// Config.AllowAddressChange is set. It usually means that two nodes have been
+	// started with the same name.
+	ErrDuplicateNodeID = errors.New("node id is already used by a server with a different address")
+
+	// ErrInvalidKey is returned when Config.KeyTransform rejects a key.
+	ErrInvalidKey = errors.New("invalid key")
+
+	// ErrInvalidValue is returned when Config.ValueTransform rejects a value.
+	ErrInvalidValue = errors.New("invalid value")
+
+	// ErrScanInterrupted is returned by Scan when a snapshot is restored during
+	// the scan. The rest of the cache has been replaced, so the scan should be
+	// started again.
+	ErrScanInterrupted = errors.New("snapshot restored during scan")
+)
 
 // don't need a complicated serializer/deserializer since our data format is
 // quite simple.
@@ -44,12 +215,27 @@ func serializeEntry(flag byte, key string, val []byte) []byte {
 }
 
 // deserializeEntry takes in the bytes that serializeEntry created and parses the
-// entrie's details.
-func deserializeEntry(buf []byte) (byte, string, []byte) {
-	keySize := binary.LittleEndian.Uint32(buf[1:])
-	key := string(buf[5 : 5+keySize])
-	return buf[0], key,
-		buf[(5 + keySize + 4) : binary.LittleEndian.Uint32(buf[5+keySize:])+(5+keySize+4)]
+// entrie's details. Any bytes after the entry are ignored, and an error is returned
+// if the buffer is too short to contain the entry described by its header.
+func deserializeEntry(buf []byte) (byte, string, []byte, error) {
+	if len(buf) < 5 {
+		return 0, "", nil, ErrMalformedEntry
+	}
+
+	keySize := uint64(binary.LittleEndian.Uint32(buf[1:]))
+	keyStart := uint64(5)
+	valSizeStart := keyStart + keySize
+	if uint64(len(buf)) < valSizeStart+4 {
+		return 0, "", nil, ErrMalformedEntry
+	}
+
+	valSize := uint64(binary.LittleEndian.Uint32(buf[valSizeStart:]))
+	valStart := valSizeStart + 4
+	if uint64(len(buf)) < valStart+valSize {
+		return 0, "", nil, ErrMalformedEntry
+	}
+
+	return buf[0], string(buf[keyStart:valSizeStart]), buf[valStart : valStart+valSize], nil
 }
 
 // Store represents a Raft node. It also implements the FSM interface that
@@ -60,7 +246,118 @@ type Store struct {
 	raftDir string
 	logger  *zap.Logger
 
-	cache *bigcache.BigCache
+	cache     Cache
+	evictions atomic.Uint64
+
+	// expiries contains the deadlines of keys set with a TTL.
+	expiryMu sync.Mutex
+	expiries map[string]expiry
+
+	// touching contains the keys whose TTL is being refreshed by GetTouch, so that
+	// concurrent reads of a key don't all apply a refresh.
+	touching sync.Map
+
+	// applyMu is held for writing while an entry is applied or a snapshot is
+	// restored. Local reads hold it for reading, so they see either all or none of
+	// the changes of an entry, like a value and its version, and wait for a restore
+	// instead of seeing a partially filled cache.
+	applyMu sync.RWMutex
+
+	// restores is the number of snapshots restored, so that scans can tell whether
+	// the cache was replaced while they didn't hold applyMu. It's only changed
+	// while applyMu is held for writing.
+	restores uint64
+
+	// versions contains the index of the log entry that last wrote each key.
+	versionMu sync.Mutex
+	versions  map[string]uint64
+
+	// idempotency contains the results of recent writes with an idempotency key.
+	// It's only used when applying entries, which happens one at a time.
+	idempotency *idempotencyCache
+
+	// uploads contains the values being written in chunks. Like idempotency, it's
+	// only used when applying entries.
+	uploads uploads
+
+	// activeSnapshots is the number of snapshots that haven't been released yet.
+	activeSnapshots atomic.Int32
+
+	// snapshotKeys is the number of keys in the cache when the last snapshot was
+	// taken.
+	snapshotKeys atomic.Int64
+
+	// members is used to report the liveness of servers. It's set after creation
+	// since the registry needs the store.
+	membersMu sync.RWMutex
+	members   MemberChecker
+
+	logStore  raft.LogStore
+	snapshots raft.SnapshotStore
+
+	tracer trace.Tracer
+
+	// leaderConn is the cached connection used to forward writes to the leader.
+	leaderConnMu   sync.Mutex
+	leaderConn     *grpc.ClientConn
+	leaderConnAddr string
+
+	// applySem limits the number of concurrent raft applies. It's nil if
+	// Config.MaxInflightApplies isn't set.
+	applySem chan struct{}
+
+	// batcher coalesces concurrent Set calls into batches. It's nil if
+	// Config.ApplyBatchWindow isn't set.
+	batcher *batcher
+
+	// hotKeys estimates the read counts of keys. It's nil unless
+	// Config.TrackHotKeys is set.
+	hotKeys *hotKeys
+
+	// paused makes the node reject reads and writes while raft keeps replicating.
+	paused atomic.Bool
+
+	// serversVersion is increased whenever the servers returned by GetServers
+	// might have changed.
+	serversVersion atomic.Uint64
+
+	shutdownCh chan struct{}
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+// MemberChecker reports whether cluster members are alive. The registry implements
+// this using the serf membership.
+type MemberChecker interface {
+	IsAlive(id string) bool
+}
+
+// RPCAddrLookup is implemented by MemberCheckers that know the rpc addresses of
+// the servers. It's needed when raft doesn't share the port with gRPC, since the
+// raft configuration only has the raft addresses.
+type RPCAddrLookup interface {
+	RPCAddr(id string) (string, bool)
+}
+
+// PauseChecker is implemented by MemberCheckers that know which servers have been
+// paused, so clients can stop routing requests to them.
+type PauseChecker interface {
+	IsPaused(id string) bool
+}
+
+// ReplicaChecker is implemented by MemberCheckers that know which servers are read
+// replicas. Read replicas are never promoted to voters.
+type ReplicaChecker interface {
+	IsReadReplica(id string) bool
+}
+
+// ServerFilter selects which servers are returned by FilterServers.
+type ServerFilter struct {
+	// VotersOnly leaves out non-voters.
+	VotersOnly bool
+
+	// AliveOnly leaves out servers that the MemberChecker reports as failed.
+	AliveOnly bool
 }
 
 // Config represents all of the user configurable fields for the Raft node.
@@ -74,6 +371,203 @@ type Config struct {
 	SnapshotThreshold uint64
 	StrongConsistency bool
 
+	// LinearizableReads makes Get use a read barrier on the leader instead of
+	// applying a GetOperation through the log. The leader records its commit index,
+	// confirms it's still the leader and waits for the commit index to be applied
+	// before reading from its cache. Takes precedence over StrongConsistency.
+	LinearizableReads bool
+
+	// BarrierReads makes Get issue a raft barrier on the leader and read from its
+	// cache once the barrier has been applied. Every write committed before the
+	// read is visible, without applying the read itself through the FSM like
+	// StrongConsistency does. Takes precedence over StrongConsistency.
+	BarrierReads bool
+
+	// StaleOnLeaderFailure makes reads that need the leader fall back to the local
+	// cache when no leader can be reached, instead of failing. The fallback is
+	// reported in GetResult.Stale. Only used with StrongConsistency,
+	// LinearizableReads or BarrierReads.
+	StaleOnLeaderFailure bool
+
+	// TrailingLogs is the number of log entries kept after a snapshot so followers
+	// can catch up without a snapshot. Zero uses the raft default.
+	TrailingLogs uint64
+
+	// RetainSnapshots is the number of snapshot files kept on disk, so that an older
+	// snapshot can be used if the latest one is corrupt. Defaults to 2.
+	RetainSnapshots int
+
+	// Logger is used for all of the logging done by the store. If it's not set a
+	// production logger is created.
+	Logger *zap.Logger
+
+	// CacheHasher is used to pick the cache shard for a key. Defaults to FNV. Since
+	// hashing only affects the node's local cache layout, nodes in the same cluster
+	// can use different hashers. It can only be set when the store is used as a
+	// library, the service and the dcache command always use the default.
+	CacheHasher bigcache.Hasher
+
+	// MaxCacheSize is the hard limit of the cache size in megabytes. When the limit
+	// is reached the oldest entries are evicted. Zero means no limit. Only used by
+	// the bigcache backend.
+	MaxCacheSize int
+
+	// MaxEntriesInWindow and MaxEntrySize size the bigcache shards up front, so
+	// they don't need to be grown while entries are added. MaxEntriesInWindow is the
+	// expected number of entries and MaxEntrySize their expected size in bytes.
+	// Zero uses the bigcache defaults. Only used by the bigcache backend.
+	MaxEntriesInWindow int
+	MaxEntrySize       int
+
+	// CacheCleanWindow is how often bigcache removes the entries that have been in
+	// the cache for longer than its life window. Zero uses the bigcache default of
+	// one second. Only used by the bigcache backend.
+	CacheCleanWindow time.Duration
+
+	// CacheStats makes Stats report the hits, misses and hash collisions of the
+	// cache. bigcache counts them regardless of this setting, so it doesn't cost
+	// anything. Only used by the bigcache backend.
+	CacheStats bool
+
+	// CacheBackend selects the local cache implementation: "bigcache" evicts the
+	// oldest entries first and "lru" the least recently used ones. Defaults to
+	// bigcache.
+	CacheBackend string
+
+	// EncryptionKey encrypts the values in the local cache with AES-GCM, so they
+	// cannot be read from a memory dump of the process. The key must be 16, 24 or
+	// 32 bytes to select AES-128, AES-192 or AES-256. Values are decrypted when
+	// read, so snapshots and the raft log still contain the plaintext. Encryption
+	// is disabled if it's nil.
+	EncryptionKey []byte
+
+	// MaxCacheEntries is the maximum number of entries in the lru backend. Defaults
+	// to 100000.
+	MaxCacheEntries int
+
+	// WarmupFile is a file of entries written with WriteWarmupEntry that are loaded
+	// into the cache before raft is started. The entries are only loaded locally and
+	// not replicated to the rest of the cluster. Restoring a snapshot resets the
+	// cache, so the entries are lost if raft restores a snapshot on startup or the
+	// leader sends one later. The file suits nodes without snapshots best.
+	WarmupFile string
+
+	// TTLSweepInterval is how often the leader deletes expired keys from the
+	// cluster. Zero disables the sweeper, expired keys are still hidden from reads
+	// but they take space until they're overwritten or evicted.
+	TTLSweepInterval time.Duration
+
+	// MaxVoters is the maximum number of voters in the cluster. Nodes that join
+	// after the limit is reached are added as non-voters, which can be promoted
+	// with PromoteToVoter. Zero means no limit.
+	MaxVoters int
+
+	// SnapshotKeyDelta takes a snapshot when the number of keys in the cache has
+	// grown by this many since the last snapshot, regardless of SnapshotThreshold.
+	// Zero disables it.
+	SnapshotKeyDelta int
+
+	// SnapshotCheckInterval is how often the number of keys is compared against
+	// SnapshotKeyDelta. Defaults to 5 seconds.
+	SnapshotCheckInterval time.Duration
+
+	// MaxInflightApplies limits the number of writes waiting to be applied through
+	// raft. Writes over the limit fail right away with ErrTooManyInflightApplies
+	// instead of queueing, so clients can back off. Zero means no limit.
+	MaxInflightApplies int
+
+	// MaxUploadSize limits the size in bytes of the values written with
+	// SetChunked. Uploads growing over it fail with ErrUploadTooLarge and their
+	// chunks are dropped. Zero means no limit.
+	MaxUploadSize int
+
+	// ApplyBatchWindow makes Set wait this long for other writes and apply them
+	// together in a single log entry. This improves the throughput of concurrent
+	// writes at the cost of adding up to the window to their latency. Zero applies
+	// every write on its own. SetWithIndex and the SetWithOptions writes without an
+	// expected version or idempotency key are batched too, with the index of the
+	// batch entry as the version.
+	ApplyBatchWindow time.Duration
+
+	// SnapshotInterval makes the leader take a snapshot this often, regardless of
+	// SnapshotThreshold. Followers only take snapshots with raft's own triggers.
+	// Zero disables it.
+	SnapshotInterval time.Duration
+
+	// IdempotencyKeys is the number of idempotency keys of recent writes that are
+	// remembered to skip duplicate writes. Defaults to 10000.
+	IdempotencyKeys int
+
+	// PersistLog stores the raft log and stable store in a file in DataDir instead
+	// of memory, so that the node keeps its raft state over restarts.
+	PersistLog bool
+
+	// FastlogLevel is the durability level of the persisted log store: "low",
+	// "medium" or "high". Lower levels sync the file to disk less often, which makes
+	// writes faster but can lose recently acknowledged writes of the node if the
+	// machine crashes. The lost entries are replicated back from the other nodes
+	// unless a majority crashed at once. Defaults to medium. Only used with
+	// PersistLog.
+	FastlogLevel string
+
+	// RecoverFromCorruption moves a corrupt log store file aside and starts with an
+	// empty log instead of failing. The node then catches up from the leader with a
+	// snapshot. Only used with PersistLog.
+	//
+	// The log store is also the stable store, so the current term and the last vote
+	// of the node are lost with the log. The node could then vote twice in a term it
+	// already voted in, which can elect two leaders in that term. Only enable it if
+	// a node failing to start is worse than that risk, or make sure the node is
+	// removed from the cluster and joins again as a new server.
+	RecoverFromCorruption bool
+
+	// AllowAddressChange lets a node join with the id of a server that is already in
+	// the cluster but a different address. The old server is replaced, which is
+	// needed if a node is restarted on another address without leaving the cluster
+	// first. By default such joins are rejected with ErrDuplicateNodeID, since two
+	// nodes started with the same name would otherwise replace each other.
+	AllowAddressChange bool
+
+	// ForwardWrites makes followers forward Set writes (Set, SetWithIndex and
+	// SetWithOptions) to the leader over gRPC instead of returning
+	// raft.ErrNotLeader. Other writes still return raft.ErrNotLeader on followers.
+	// The leader's raft address needs to serve gRPC as well. The connection to the
+	// leader is reused until the leader changes.
+	ForwardWrites bool
+
+	// LeaderDialOptions are used to connect to the leader when forwarding writes.
+	// Defaults to an insecure connection.
+	LeaderDialOptions []grpc.DialOption
+
+	// LeaderCallOptions are added to every request forwarded to the leader, on top
+	// of LeaderDialOptions or the default dial options.
+	LeaderCallOptions []grpc.CallOption
+
+	// TrackHotKeys estimates how often each key is read, so the most read keys can
+	// be listed with HotKeys.
+	TrackHotKeys bool
+
+	// HotKeySampleRate records one out of this many reads when TrackHotKeys is set.
+	// Defaults to 10.
+	HotKeySampleRate int
+
+	// KeyTransform is applied to the key of every read and write, for example to
+	// normalize keys or enforce a naming convention. Keys it returns an error for
+	// are rejected with ErrInvalidKey before anything is applied. Writes forwarded
+	// to the leader are transformed by the leader. The namespaced APIs transform
+	// the key but not the namespace, and the prefixes of Scan, ScanNS and FlushNS
+	// are matched against the transformed keys as is.
+	KeyTransform func(key string) (string, error)
+
+	// ValueTransform is applied to the value of every write. Values it returns an
+	// error for are rejected with ErrInvalidValue. Values are stored as returned by
+	// the transform, so reads return the transformed value.
+	ValueTransform func(value []byte) ([]byte, error)
+
+	// TracerProvider is used to trace the operations applied through raft. Tracing
+	// is disabled if it's not set.
+	TracerProvider trace.TracerProvider
+
 	// Timeouts
 	HeartbeatTimeout   time.Duration
 	ElectionTimeout    time.Duration
@@ -87,8 +581,20 @@ type Config struct {
 // to the cache stored in the Raft node and copies all of the entries into the io.Writer
 // that raft provides.
 type snapshot struct {
-	start time.Time
-	cache *bigcache.BigCache
+	start       time.Time
+	entries     []snapshotEntry
+	versions    map[string]uint64
+	expiries    map[string]expiry
+	idempotency []idempotencyEntry
+	uploads     map[string]upload
+	release     func()
+}
+
+// snapshotEntry is a key-value pair copied from the cache for a snapshot or a
+// scan.
+type snapshotEntry struct {
+	key   string
+	value []byte
 }
 
 // applyResult represents a generic result from raft_apply. We need the error field here
@@ -99,38 +605,47 @@ type applyResult struct {
 	err error
 }
 
+// getOrSetResult is the result of a GetOrSetOperation.
+type getOrSetResult struct {
+	value  []byte
+	stored bool
+}
+
 // New creates a store instance.
 func New(conf Config) (*Store, error) {
-	logger, err := zap.NewProduction()
-	if err != nil {
-		return nil, err
-	}
-
-	raftDir := filepath.Join(conf.DataDir, "raft")
-
-	// setup a cache
-	cache, err := bigcache.New(context.Background(), bigcache.DefaultConfig(10*time.Minute))
+	store, err := newFSM(conf)
 	if err != nil {
 		return nil, err
 	}
+	raftDir := store.raftDir
+	logger := store.logger
 
-	store := &Store{
-		raft:   nil,
-		logger: logger,
-		cache:  cache,
-		conf:   conf,
+	if conf.WarmupFile != "" {
+		count, err := store.loadWarmupFile(conf.WarmupFile)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		logger.Info("loaded warmup file",
+			zap.String("path", conf.WarmupFile),
+			zap.Int("entries", count),
+		)
 	}
 
 	transport := raft.NewNetworkTransport(conf.Transport, 5, 10*time.Second, os.Stderr)
-	stableStore, err := fastlog.NewFastLogStore(":memory:", fastlog.Medium, io.Discard)
+	stableStore, err := store.openLogStore(raftDir)
 	if err != nil {
+		store.Close()
 		return nil, err
 	}
 
-	snapshotStore, err := raft.NewFileSnapshotStore(raftDir, 1, os.Stderr)
+	snapshotStore, err := store.openSnapshotStore()
 	if err != nil {
+		store.Close()
 		return nil, err
 	}
+	store.logStore = stableStore
+	store.snapshots = snapshotStore
 
 	config := raft.DefaultConfig()
 	config.SnapshotThreshold = conf.SnapshotThreshold
@@ -152,6 +667,10 @@ func New(conf Config) (*Store, error) {
 		config.CommitTimeout = conf.CommitTimeout
 	}
 
+	if conf.TrailingLogs != 0 {
+		config.TrailingLogs = conf.TrailingLogs
+	}
+
 	store.raft, err = raft.NewRaft(
 		config,
 		store,
@@ -161,8 +680,21 @@ func New(conf Config) (*Store, error) {
 		transport,
 	)
 	if err != nil {
+		store.Close()
 		return nil, err
 	}
+	go store.observeLeadership()
+	go store.observeLeaderChanges()
+	if conf.TTLSweepInterval > 0 {
+		go store.runSweeper(conf.TTLSweepInterval)
+	}
+	if conf.SnapshotKeyDelta > 0 {
+		interval := conf.SnapshotCheckInterval
+		if interval == 0 {
+			interval = defaultSnapshotCheckInterval
+		}
+		go store.runSnapshotTrigger(conf.SnapshotKeyDelta, interval)
+	}
 
 	if conf.Bootstrap {
 		conf := raft.Configuration{
@@ -171,23 +703,289 @@ func New(conf Config) (*Store, error) {
 				Address: raft.ServerAddress(conf.Transport.Addr().String()),
 			}},
 		}
-		err = store.raft.BootstrapCluster(conf).Error()
+		// a node restarted with a persisted log is already part of a cluster.
+		err := store.raft.BootstrapCluster(conf).Error()
+		if err != nil && err != raft.ErrCantBootstrap {
+			store.Close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// newFSM creates the parts of the store that are needed to apply the log and
+// snapshots, without starting raft.
+func newFSM(conf Config) (*Store, error) {
+	logger := conf.Logger
+	if logger == nil {
+		var err error
+		logger, err = zap.NewProduction()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	raftDir := filepath.Join(conf.DataDir, "raft")
+
+	store := &Store{
+		raft:       nil,
+		raftDir:    raftDir,
+		logger:     logger,
+		conf:       conf,
+		shutdownCh: make(chan struct{}),
+		expiries:   make(map[string]expiry),
+		versions:   make(map[string]uint64),
+		uploads:    make(uploads),
+	}
+
+	idempotencyKeys := conf.IdempotencyKeys
+	if idempotencyKeys == 0 {
+		idempotencyKeys = defaultIdempotencyKeys
+	}
+	store.idempotency = newIdempotencyCache(idempotencyKeys)
+
+	tp := conf.TracerProvider
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	store.tracer = tp.Tracer(tracerName)
+
+	if conf.TrackHotKeys {
+		store.hotKeys = newHotKeys(conf.HotKeySampleRate)
+	}
+
+	if conf.MaxInflightApplies > 0 {
+		store.applySem = make(chan struct{}, conf.MaxInflightApplies)
+	}
+	if conf.ApplyBatchWindow > 0 {
+		store.batcher = newBatcher(store, conf.ApplyBatchWindow)
+	}
+
+	var err error
+	store.cache, err = store.newCache()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// openSnapshotStore opens the file snapshot store in the raft directory.
+func (s *Store) openSnapshotStore() (*raft.FileSnapshotStore, error) {
+	retain := s.conf.RetainSnapshots
+	if retain == 0 {
+		retain = defaultRetainSnapshots
+	}
+	return raft.NewFileSnapshotStore(s.raftDir, retain, os.Stderr)
+}
+
+// BootstrapCluster bootstraps the cluster with the given servers as the initial
+// voters. The servers map ids to raft bind addresses. Every node should be given the
+// same servers, so the initial configuration is the same on every node. If the node
+// already has state, it has already been bootstrapped and nil is returned.
+func (s *Store) BootstrapCluster(servers map[string]string) error {
+	ids := make([]string, 0, len(servers))
+	for id := range servers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	conf := raft.Configuration{}
+	for _, id := range ids {
+		conf.Servers = append(conf.Servers, raft.Server{
+			ID:      raft.ServerID(id),
+			Address: raft.ServerAddress(servers[id]),
+		})
+	}
+
+	s.logger.Info("bootstrapping cluster", zap.Strings("ids", ids))
+	err := s.raft.BootstrapCluster(conf).Error()
+	if err == raft.ErrCantBootstrap {
+		return nil
 	}
-	return store, err
+	return err
 }
 
 // Close down this raft node and flush out possible data in the logger.
+// Calling Close multiple times, even concurrently, is safe and every call returns the
+// result of the first one.
 func (s *Store) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.close()
+	})
+	return s.closeErr
+}
+
+// close shuts down the components that have been set up. The store might be
+// partially constructed if New failed, so every component is checked.
+func (s *Store) close() error {
 	s.logger.Sync()
+	close(s.shutdownCh)
 
 	// close raft
-	f := s.raft.Shutdown()
-	if err := f.Error(); err != nil {
-		return err
+	if s.raft != nil {
+		if err := s.raft.Shutdown().Error(); err != nil {
+			return err
+		}
+	}
+
+	s.resetLeaderClient()
+
+	// close the log store, which flushes it to disk if it's persisted
+	if s.logStore != nil {
+		if err := s.logStore.(io.Closer).Close(); err != nil {
+			return err
+		}
 	}
 
 	// close internal cache
-	return s.cache.Close()
+	if s.cache != nil {
+		return s.cache.Close()
+	}
+	return nil
+}
+
+// observeLeadership counts the leadership changes of this node until the store is
+// closed.
+// The periodic snapshots of Config.SnapshotInterval are run while the node is the
+// leader.
+func (s *Store) observeLeadership() {
+	var stopSnapshots chan struct{}
+	stop := func() {
+		if stopSnapshots != nil {
+			close(stopSnapshots)
+			stopSnapshots = nil
+		}
+	}
+	defer stop()
+
+	for {
+		select {
+		case isLeader := <-s.raft.LeaderCh():
+			metrics.LeaderChanges.Inc()
+			s.resetLeaderClient()
+			s.logger.Info("leadership changed", zap.Bool("is_leader", isLeader))
+
+			stop()
+			if isLeader && s.conf.SnapshotInterval > 0 {
+				stopSnapshots = make(chan struct{})
+				go s.runLeaderSnapshots(s.conf.SnapshotInterval, stopSnapshots)
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// newCache creates the local cache selected by Config.CacheBackend. The values are
+// encrypted if Config.EncryptionKey is set.
+func (s *Store) newCache() (Cache, error) {
+	cache, err := s.newCacheBackend()
+	if err != nil || s.conf.EncryptionKey == nil {
+		return cache, err
+	}
+
+	encrypted, err := newEncryptedCache(cache, s.conf.EncryptionKey)
+	if err != nil {
+		cache.Close()
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// newCacheBackend creates the cache implementation selected by Config.CacheBackend.
+func (s *Store) newCacheBackend() (Cache, error) {
+	switch s.conf.CacheBackend {
+	case "", BigcacheBackend:
+		cache, err := bigcache.New(context.Background(), s.bigcacheConfig())
+		if err != nil {
+			return nil, err
+		}
+		return bigcacheCache{cache}, nil
+	case LRUBackend:
+		maxEntries := s.conf.MaxCacheEntries
+		if maxEntries == 0 {
+			maxEntries = defaultMaxCacheEntries
+		}
+		return newLRUCache(maxEntries, lruShards, s.onRemove), nil
+	}
+	return nil, ErrUnknownCacheBackend
+}
+
+// bigcacheConfig returns the configuration of the bigcache backend.
+func (s *Store) bigcacheConfig() bigcache.Config {
+	conf := bigcache.DefaultConfig(10 * time.Minute)
+	conf.HardMaxCacheSize = s.conf.MaxCacheSize
+	if s.conf.MaxEntriesInWindow != 0 {
+		conf.MaxEntriesInWindow = s.conf.MaxEntriesInWindow
+	}
+	if s.conf.MaxEntrySize != 0 {
+		conf.MaxEntrySize = s.conf.MaxEntrySize
+	}
+	if s.conf.CacheCleanWindow != 0 {
+		conf.CleanWindow = s.conf.CacheCleanWindow
+	}
+	if s.conf.CacheHasher != nil {
+		conf.Hasher = s.conf.CacheHasher
+	}
+	conf.OnRemoveWithReason = s.onRemove
+	return conf
+}
+
+// onRemove is called by the cache whenever an entry is removed from the cache. Explicit
+// deletes are not counted as evictions since they're requested by users.
+func (s *Store) onRemove(key string, entry []byte, reason bigcache.RemoveReason) {
+	s.clearExpiry(key)
+	s.clearVersion(key)
+	if reason == bigcache.Deleted {
+		return
+	}
+
+	s.evictions.Add(1)
+	s.logger.Debug("entry evicted",
+		zap.String("key", key),
+		zap.Bool("expired", reason == bigcache.Expired),
+	)
+}
+
+// Stats returns statistics about the local cache of this node.
+func (s *Store) Stats() (*pb.StatsResponse, error) {
+	res := &pb.StatsResponse{
+		Entries:   uint64(s.cache.Len()),
+		Evictions: s.evictions.Load(),
+	}
+
+	if s.conf.CacheStats {
+		if stats, ok := cacheStats(s.cache); ok {
+			res.Hits = uint64(stats.Hits)
+			res.Misses = uint64(stats.Misses)
+			res.Collisions = uint64(stats.Collisions)
+		}
+	}
+	return res, nil
+}
+
+// Diagnostics returns the raft indices and statistics of the node. A large gap
+// between the commit index and the applied index means the node is lagging.
+func (s *Store) Diagnostics() (*pb.DiagnosticsResponse, error) {
+	stats := s.raft.Stats()
+
+	commitIndex, err := strconv.ParseUint(stats["commit_index"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	term, err := strconv.ParseUint(stats["term"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.DiagnosticsResponse{
+		AppliedIndex: s.raft.AppliedIndex(),
+		CommitIndex:  commitIndex,
+		LastIndex:    s.raft.LastIndex(),
+		Term:         term,
+		RaftStats:    stats,
+	}, nil
 }
 
 // isLeader returns a boolean based on if the node is a leader or not.
@@ -195,10 +993,90 @@ func (s *Store) isLeader() bool {
 	return s.raft.State() == raft.Leader
 }
 
+// NodeID returns the raft server id of this node.
+func (s *Store) NodeID() string {
+	return string(s.conf.LocalID)
+}
+
+// IsLeader checks whether this node is the leader of the cluster.
+func (s *Store) IsLeader() bool {
+	return s.isLeader()
+}
+
+// notLeaderErr returns the error for operations that need the leader on a node that
+// isn't the leader. If no leader has been elected, ErrNoLeaderElected is returned so
+// clients know to back off and retry instead of looking for the leader.
+func (s *Store) notLeaderErr() error {
+	if s.LeaderAddr() != "" {
+		return raft.ErrNotLeader
+	}
+
+	if s.onlyNonVoters() {
+		return ErrNoVoters
+	}
+	return ErrNoLeaderElected
+}
+
+// onlyNonVoters checks whether the latest cluster configuration has servers, but
+// none of them are voters. An empty configuration means the node hasn't joined a
+// cluster yet, which isn't reported.
+func (s *Store) onlyNonVoters() bool {
+	f := s.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return false
+	}
+
+	servers := f.Configuration().Servers
+	return len(servers) > 0 && countVoters(servers, "") == 0
+}
+
+// isClusterMember checks whether the node is in the latest cluster configuration.
+// An empty configuration means the node hasn't joined a cluster yet, so it's not
+// treated as removed.
+func (s *Store) isClusterMember() bool {
+	f := s.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return true
+	}
+
+	servers := f.Configuration().Servers
+	if len(servers) == 0 {
+		return true
+	}
+
+	for _, srv := range servers {
+		if srv.ID == s.conf.LocalID {
+			return true
+		}
+	}
+	return false
+}
+
+// countVoters returns the number of voters in servers, not counting exclude.
+func countVoters(servers []raft.Server, exclude raft.ServerID) int {
+	voters := 0
+	for _, srv := range servers {
+		if srv.Suffrage == raft.Voter && srv.ID != exclude {
+			voters++
+		}
+	}
+	return voters
+}
+
 // remove removes a node from the raft cluster.
 func (s *Store) remove(id string) error {
 	if !s.isLeader() {
-		return raft.ErrNotLeader
+		return s.notLeaderErr()
+	}
+
+	// raft refuses configurations without voters, but only after the request
+	// has gone through the leader loop, so fail fast with a clearer error.
+	cf := s.raft.GetConfiguration()
+	if err := cf.Error(); err != nil {
+		return err
+	}
+	if countVoters(cf.Configuration().Servers, raft.ServerID(id)) == 0 {
+		return ErrNoVoters
 	}
 
 	f := s.raft.RemoveServer(raft.ServerID(id), 0, 0)
@@ -218,9 +1096,13 @@ func (s *Store) remove(id string) error {
 func (s *Store) joinHelper(id, addr string, voter bool) error {
 	s.logger.Info("join request", zap.String("id", id), zap.String("addr", addr))
 
+	// the registry calls this on every node for member events, such as changed
+	// tags, which can change the servers even if the configuration doesn't.
+	s.serversChanged()
+
 	// only leader can make modifications to the cluster.
 	if !s.isLeader() {
-		return raft.ErrNotLeader
+		return s.notLeaderErr()
 	}
 
 	srvID := raft.ServerID(id)
@@ -236,13 +1118,27 @@ func (s *Store) joinHelper(id, addr string, voter bool) error {
 		return err
 	}
 
+	voters := 0
 	for _, srv := range f.Configuration().Servers {
+		if srv.Suffrage == raft.Voter && srv.ID != srvID && srv.Address != srvAddr {
+			voters++
+		}
+
 		if srv.ID == srvID || srv.Address == srvAddr {
 			// already exists in the cluster.
 			if srv.ID == srvID && srv.Address == srvAddr {
 				return nil
 			}
 
+			if srv.ID == srvID && !s.conf.AllowAddressChange {
+				s.logger.Error("rejected join of a node with a duplicate id",
+					zap.String("id", id),
+					zap.String("addr", addr),
+					zap.String("existing_addr", string(srv.Address)),
+				)
+				return ErrDuplicateNodeID
+			}
+
 			if err := s.remove(id); err != nil {
 				s.logger.Error("failed to remove node", zap.Error(err))
 				return err
@@ -252,6 +1148,14 @@ func (s *Store) joinHelper(id, addr string, voter bool) error {
 		}
 	}
 
+	if voter && s.conf.MaxVoters > 0 && voters >= s.conf.MaxVoters {
+		s.logger.Warn("maximum number of voters reached, joining node as a non-voter",
+			zap.String("id", id),
+			zap.Int("max_voters", s.conf.MaxVoters),
+		)
+		voter = false
+	}
+
 	var addFuture raft.IndexFuture
 	if voter {
 		addFuture = s.raft.AddVoter(srvID, srvAddr, 0, 0)
@@ -273,23 +1177,63 @@ func (s *Store) JoinNonVoter(id, addr string) error {
 	return s.joinHelper(id, addr, false)
 }
 
-// Join adds a node with 'id' and 'addr' into the raft cluster. The address is the
-// raft bind address of the node.
-func (s *Store) Join(id, addr string) error {
-	return s.joinHelper(id, addr, true)
-}
-
-// Leave removes a node from the cluster with the given id. This function is called
-// by registry to let the raft node know that a node has left the cluster and that
-// raft should not try to contact it anymore.
-func (s *Store) Leave(id string) error {
-	s.logger.Info("leave request for node", zap.String("id", id))
+// PromoteToVoter makes an existing non-voter a voter, for example after a read
+// replica has caught up with the leader and it should take part in the quorum.
+func (s *Store) PromoteToVoter(id string) error {
+	s.logger.Info("promote request", zap.String("id", id))
 	if !s.isLeader() {
-		return raft.ErrNotLeader
+		return s.notLeaderErr()
 	}
 
-	if err := s.remove(id); err != nil {
-		s.logger.Error("failed removing node", zap.Error(err))
+	s.membersMu.RLock()
+	members := s.members
+	s.membersMu.RUnlock()
+	if rc, ok := members.(ReplicaChecker); ok && rc.IsReadReplica(id) {
+		return ErrReadReplica
+	}
+
+	f := s.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return err
+	}
+
+	for _, srv := range f.Configuration().Servers {
+		if srv.ID != raft.ServerID(id) {
+			continue
+		}
+
+		if srv.Suffrage != raft.Nonvoter {
+			return ErrNotNonVoter
+		}
+
+		if err := s.raft.AddVoter(srv.ID, srv.Address, 0, 0).Error(); err != nil {
+			return err
+		}
+
+		s.logger.Info("node promoted to voter", zap.String("id", id))
+		return nil
+	}
+	return ErrUnknownServer
+}
+
+// Join adds a node with 'id' and 'addr' into the raft cluster. The address is the
+// raft bind address of the node.
+func (s *Store) Join(id, addr string) error {
+	return s.joinHelper(id, addr, true)
+}
+
+// Leave removes a node from the cluster with the given id. This function is called
+// by registry to let the raft node know that a node has left the cluster and that
+// raft should not try to contact it anymore.
+func (s *Store) Leave(id string) error {
+	s.logger.Info("leave request for node", zap.String("id", id))
+	s.serversChanged()
+	if !s.isLeader() {
+		return s.notLeaderErr()
+	}
+
+	if err := s.remove(id); err != nil {
+		s.logger.Error("failed removing node", zap.Error(err))
 		return err
 	}
 
@@ -302,17 +1246,107 @@ func (s *Store) LeaderAddr() string {
 	return string(s.raft.Leader())
 }
 
+// LeaderRPCAddr returns the rpc address of the leader node, which differs from the
+// raft address if raft has its own port. An empty string is returned if there's no
+// leader.
+func (s *Store) LeaderRPCAddr() string {
+	addr, id := s.raft.LeaderWithID()
+	if addr == "" {
+		return ""
+	}
+
+	s.membersMu.RLock()
+	defer s.membersMu.RUnlock()
+	return s.rpcAddr(s.members, id, addr)
+}
+
 // Apply handles the applyRequest made by the createApplyReq function. It returns a
 // applyResult struct such that handler functions can properly handle the given error.
 func (s *Store) Apply(l *raft.Log) interface{} {
-	flag, key, value := deserializeEntry(l.Data)
+	flag, key, value, err := deserializeEntry(l.Data)
+	if err != nil {
+		s.logger.Error("failed to deserialize log entry", zap.Uint64("index", l.Index))
+		return applyResult{res: nil, err: err}
+	}
+
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
 
 	switch flag {
 	case SetOperation:
-		return applyResult{res: nil, err: s.cache.Set(key, value)}
+		s.clearExpiry(key)
+		if err := s.cache.Set(key, value); err != nil {
+			return applyResult{err: err}
+		}
+		s.setVersion(key, l.Index)
+		return applyResult{}
 	case GetOperation:
-		val, err := s.cache.Get(key)
-		return applyResult{res: val, err: err}
+		val, version, err := s.getVersionedAt(key, applyTime(l.AppendedAt))
+		return applyResult{res: versionedValue{value: val, version: version}, err: err}
+	case FlushOperation:
+		return applyResult{res: nil, err: s.deletePrefix(key)}
+	case GetOrSetOperation:
+		return s.applyGetOrSet(key, value, l.Index, applyTime(l.AppendedAt))
+	case DeleteOperation:
+		return s.applyDelete(key)
+	case SetTTLOperation:
+		return s.applySetTTL(key, value, l.Index, l.AppendedAt)
+	case TouchOperation:
+		return s.applyTouch(key, value)
+	case ExpireOperation:
+		return s.applyExpire(key, value, l.AppendedAt)
+	case SetVersionedOperation:
+		return s.applySetVersioned(key, value, l.Index, applyTime(l.AppendedAt))
+	case BatchOperation:
+		return s.applyBatch(value, l.Index)
+	case ChunkOperation:
+		return s.applyChunk(key, value, l.AppendedAt)
+	case CommitChunksOperation:
+		return s.applyCommitChunks(key, string(value), l.Index, l.AppendedAt)
+	case AbortChunksOperation:
+		return s.applyAbortChunks(key, l.AppendedAt)
+	}
+	return nil
+}
+
+// applyGetOrSet returns the existing value of key, or stores value if the key doesn't
+// exist. Since entries are applied one at a time, this is atomic. Whether the
+// existing value has expired is decided at now, so every node keeps the same value.
+func (s *Store) applyGetOrSet(key string, value []byte, index uint64, now time.Time) applyResult {
+	existing, err := s.getAt(key, now)
+	if err == nil {
+		return applyResult{res: getOrSetResult{value: existing}}
+	}
+	if err != bigcache.ErrEntryNotFound {
+		return applyResult{err: err}
+	}
+
+	s.clearExpiry(key)
+	if err := s.cache.Set(key, value); err != nil {
+		return applyResult{err: err}
+	}
+	s.setVersion(key, index)
+	return applyResult{res: getOrSetResult{value: value, stored: true}}
+}
+
+// deletePrefix removes every key starting with prefix from the local cache.
+func (s *Store) deletePrefix(prefix string) error {
+	var keys []string
+	err := s.cache.Iterate(func(key string, value []byte) error {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		// the entry might have been evicted after iterating, which is fine.
+		if err := s.cache.Delete(key); err != nil && err != bigcache.ErrEntryNotFound {
+			return err
+		}
 	}
 	return nil
 }
@@ -321,10 +1355,28 @@ func (s *Store) Apply(l *raft.Log) interface{} {
 // is a leader-only operation, we need to check for that as well.
 func (s *Store) Set(key string, value []byte) error {
 	if !s.isLeader() {
-		return raft.ErrNotLeader
+		if s.conf.ForwardWrites {
+			_, err := s.forwardSet(context.Background(), key, value, SetOptions{})
+			return err
+		}
+		return s.notLeaderErr()
 	}
 
-	res, err := s.createApplyReq(SetOperation, key, value)
+	key, value, err := s.transformEntry(key, value)
+	if err != nil {
+		return err
+	}
+	return s.setTransformed(key, value)
+}
+
+// setTransformed applies a key-value pair that has already been transformed.
+func (s *Store) setTransformed(key string, value []byte) error {
+	if s.batcher != nil {
+		_, err := s.batcher.set(key, value)
+		return err
+	}
+
+	res, err := s.createApplyReq(context.Background(), SetOperation, key, value)
 	if err != nil {
 		// error in raft processing
 		return err
@@ -335,21 +1387,118 @@ func (s *Store) Set(key string, value []byte) error {
 	return r.err
 }
 
+// SetWithIndex works like Set, but also returns the raft log index at which the
+// write was committed. Reads that wait for the applied index to reach it see the
+// write.
+func (s *Store) SetWithIndex(key string, value []byte) (uint64, error) {
+	if !s.isLeader() {
+		if s.conf.ForwardWrites {
+			res, err := s.forwardSet(context.Background(), key, value, SetOptions{})
+			if err != nil {
+				return 0, err
+			}
+			return res.Index, nil
+		}
+		return 0, s.notLeaderErr()
+	}
+
+	key, value, err := s.transformEntry(key, value)
+	if err != nil {
+		return 0, err
+	}
+
+	if s.batcher != nil {
+		return s.batcher.set(key, value)
+	}
+
+	res, index, err := s.applyWithIndex(context.Background(), SetOperation, key, value)
+	if err != nil {
+		return 0, err
+	}
+
+	if r := res.(applyResult); r.err != nil {
+		return 0, r.err
+	}
+	return index, nil
+}
+
+// GetOrSet returns the existing value of key if it exists. Otherwise value is stored
+// and returned. The returned boolean tells whether value was stored. This is done
+// as a single raft operation, so concurrent callers all get the same value. Unlike
+// Set, the write isn't forwarded to the leader.
+func (s *Store) GetOrSet(key string, value []byte) ([]byte, bool, error) {
+	if !s.isLeader() {
+		return nil, false, s.notLeaderErr()
+	}
+
+	key, value, err := s.transformEntry(key, value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	res, err := s.createApplyReq(context.Background(), GetOrSetOperation, key, value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r := res.(applyResult)
+	if r.err != nil {
+		return nil, false, r.err
+	}
+
+	gs := r.res.(getOrSetResult)
+	return gs.value, gs.stored, nil
+}
+
 // createApplyReq sends formulates data in a good way and sends the request with the data
 // to raft.Apply(), which is in turn handled by our Apply() function on another raft node.
-func (s *Store) createApplyReq(ty byte, key string, value []byte) (interface{}, error) {
+// The request is traced as a child of the span in ctx.
+func (s *Store) createApplyReq(
+	ctx context.Context, ty byte, key string, value []byte,
+) (interface{}, error) {
+	res, _, err := s.applyWithIndex(ctx, ty, key, value)
+	return res, err
+}
+
+// applyWithIndex works like createApplyReq, but also returns the index of the log
+// entry of the request.
+func (s *Store) applyWithIndex(
+	ctx context.Context, ty byte, key string, value []byte,
+) (res interface{}, index uint64, err error) {
+	_, span := s.startApplySpan(ctx, ty, key)
+	defer func() {
+		if r, ok := res.(applyResult); ok && err == nil {
+			endSpan(span, r.err)
+			return
+		}
+		endSpan(span, err)
+	}()
+
+	if s.Paused() && !internalOperation(ty) {
+		return nil, 0, ErrPaused
+	}
+
+	if s.applySem != nil {
+		select {
+		case s.applySem <- struct{}{}:
+			defer func() { <-s.applySem }()
+		default:
+			return nil, 0, ErrTooManyInflightApplies
+		}
+	}
+
 	buffer := serializeEntry(ty, key, value)
 
-	f := s.raft.Apply(buffer, 10*time.Second)
+	f := s.raft.Apply(buffer, applyTimeout)
 	if err := f.Error(); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	r := f.Response()
 	if err, ok := r.(error); ok {
-		return nil, err
+		return nil, 0, err
 	}
-	return r, nil
+	return r, f.Index(), nil
 }
 
 // Get finds a value with a given key either from this node's cache, or the leader.
@@ -357,56 +1506,551 @@ func (s *Store) createApplyReq(ty byte, key string, value []byte) (interface{},
 // not existing, or being old. On the other hand, request the value from the leader
 // adds a lot of overhead.
 func (s *Store) Get(key string) ([]byte, error) {
-	// TODO: strong consistency aka get from leader
+	val, _, err := s.GetVersioned(key)
+	return val, err
+}
+
+// GetVersioned works like Get, but also returns the version of the key. The version
+// can be passed to SetVersioned to only update the key if it hasn't changed.
+func (s *Store) GetVersioned(key string) ([]byte, uint64, error) {
+	return s.GetWithOptions(key, GetOptions{})
+}
 
-	if s.conf.StrongConsistency {
-		if !s.isLeader() {
-			return nil, raft.ErrNotLeader
+// GetWithOptions reads the value and version of key using the given options.
+func (s *Store) GetWithOptions(key string, opts GetOptions) ([]byte, uint64, error) {
+	res, err := s.GetWithResult(key, opts)
+	return res.Value, res.Version, err
+}
+
+// GetWithResult works like GetWithOptions, but also reports whether the value was
+// read from the local cache because the leader couldn't be reached.
+func (s *Store) GetWithResult(key string, opts GetOptions) (GetResult, error) {
+	key, err := s.transformKey(key)
+	if err != nil {
+		return GetResult{}, err
+	}
+	return s.getWithResult(key, opts)
+}
+
+// getWithResult works like GetWithResult for a key that has already been
+// transformed.
+func (s *Store) getWithResult(key string, opts GetOptions) (GetResult, error) {
+	if s.Paused() {
+		return GetResult{}, ErrPaused
+	}
+
+	if s.hotKeys != nil {
+		s.hotKeys.record(key)
+	}
+
+	consistent := opts.Strong || s.conf.LinearizableReads || s.conf.BarrierReads ||
+		s.conf.StrongConsistency
+	if opts.Stale || !consistent {
+		val, version, err := s.getLocalMember(key)
+		return GetResult{Value: val, Version: version}, err
+	}
+
+	val, version, err := s.getConsistent(key)
+	if err != nil && s.conf.StaleOnLeaderFailure && s.leaderUnreachable(err) {
+		s.logger.Debug("leader unreachable, serving stale read", zap.Error(err))
+		val, version, err = s.getLocalMember(key)
+		return GetResult{Value: val, Version: version, Stale: true}, err
+	}
+	return GetResult{Value: val, Version: version}, err
+}
+
+// getConsistent reads key with the configured consistency, which needs this node
+// to be the leader.
+func (s *Store) getConsistent(key string) ([]byte, uint64, error) {
+	if s.conf.LinearizableReads {
+		if err := s.readBarrier(readBarrierTimeout); err != nil {
+			return nil, 0, err
 		}
+		return s.getLocalVersioned(key)
+	}
 
-		res, err := s.createApplyReq(GetOperation, key, []byte{})
-		if err != nil {
-			return nil, err
+	if s.conf.BarrierReads {
+		if err := s.Barrier(readBarrierTimeout); err != nil {
+			return nil, 0, err
+		}
+		return s.getLocalVersioned(key)
+	}
+
+	if !s.isLeader() {
+		return nil, 0, s.notLeaderErr()
+	}
+
+	res, err := s.createApplyReq(context.Background(), GetOperation, key, []byte{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r := res.(applyResult)
+	v := r.res.(versionedValue)
+	return v.value, v.version, r.err
+}
+
+// leaderUnreachable checks whether a consistent read failed because there is no
+// leader to serve it. raft.ErrNotLeader only counts if no other leader is known,
+// otherwise the client should retry the read on the leader.
+func (s *Store) leaderUnreachable(err error) bool {
+	switch {
+	case errors.Is(err, ErrNoLeaderElected),
+		errors.Is(err, ErrNoVoters),
+		errors.Is(err, ErrReadBarrierTimeout),
+		errors.Is(err, raft.ErrLeadershipLost),
+		errors.Is(err, raft.ErrEnqueueTimeout):
+		return true
+	case errors.Is(err, raft.ErrNotLeader):
+		return s.LeaderAddr() == ""
+	}
+	return false
+}
+
+// getLocalMember reads key from the local cache, unless the node has been removed
+// from the cluster. A removed node doesn't receive writes anymore, so its cache
+// would be stale.
+func (s *Store) getLocalMember(key string) ([]byte, uint64, error) {
+	if !s.isClusterMember() {
+		return nil, 0, ErrNotClusterMember
+	}
+	return s.getLocalVersioned(key)
+}
+
+// readBarrier makes sure that every write acknowledged before the call is visible
+// in the local cache, without adding an entry to the log.
+func (s *Store) readBarrier(timeout time.Duration) error {
+	if !s.isLeader() {
+		return s.notLeaderErr()
+	}
+
+	commitIndex, err := s.commitIndex()
+	if err != nil {
+		return err
+	}
+
+	// a heartbeat round makes sure that another node hasn't become the leader, in
+	// which case there could be newer committed writes.
+	if err := s.raft.VerifyLeader().Error(); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for s.raft.AppliedIndex() < commitIndex {
+		if time.Now().After(deadline) {
+			return ErrReadBarrierTimeout
 		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
 
-		r := res.(applyResult)
-		return r.res.([]byte), r.err
+// Barrier blocks until every write committed before the call has been applied to
+// the local cache of the leader. It appends a barrier entry to the log, so it
+// fails if the leader cannot reach a majority before the timeout expires. Only the
+// leader can issue barriers.
+func (s *Store) Barrier(timeout time.Duration) error {
+	if !s.isLeader() {
+		return s.notLeaderErr()
 	}
+	return s.raft.Barrier(timeout).Error()
+}
+
+// commitIndex returns the index of the last committed log entry known by the node.
+func (s *Store) commitIndex() (uint64, error) {
+	return strconv.ParseUint(s.raft.Stats()["commit_index"], 10, 64)
+}
+
+// getLocal reads key from the local cache. Keys that have expired but haven't been
+// swept yet are reported as missing.
+func (s *Store) getLocal(key string) ([]byte, error) {
+	s.applyMu.RLock()
+	defer s.applyMu.RUnlock()
+	return s.getAt(key, time.Now())
+}
 
+// getAt works like getLocal, but keys expire relative to now instead of the local
+// clock. The caller must hold applyMu.
+func (s *Store) getAt(key string, now time.Time) ([]byte, error) {
+	if s.expiredAt(key, now) {
+		return nil, bigcache.ErrEntryNotFound
+	}
 	return s.cache.Get(key)
 }
 
+// namespacedKey creates the internal key for a key in a given namespace.
+func namespacedKey(ns, key string) (string, error) {
+	if strings.Contains(ns, namespaceSeparator) {
+		return "", ErrInvalidNamespace
+	}
+	return ns + namespaceSeparator + key, nil
+}
+
+// SetNS works like Set, but the key is stored under the given namespace. Keys in
+// different namespaces never collide with each other. Config.KeyTransform is
+// applied to the key, but not to the namespace. Unlike Set, the write isn't
+// forwarded to the leader, since the leader would transform the namespace too.
+func (s *Store) SetNS(ns, key string, value []byte) error {
+	if !s.isLeader() {
+		return s.notLeaderErr()
+	}
+
+	key, value, err := s.transformEntry(key, value)
+	if err != nil {
+		return err
+	}
+
+	k, err := namespacedKey(ns, key)
+	if err != nil {
+		return err
+	}
+	return s.setTransformed(k, value)
+}
+
+// GetNS works like Get, but the key is read from the given namespace.
+// Config.KeyTransform is applied to the key, but not to the namespace.
+func (s *Store) GetNS(ns, key string) ([]byte, error) {
+	key, err := s.transformKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := namespacedKey(ns, key)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.getWithResult(k, GetOptions{})
+	return res.Value, err
+}
+
+// ScanNS returns all of the keys in the given namespace without the namespace
+// prefix. The keys are read from the local cache, so the same consistency rules
+// as non-strong reads apply. The keys are returned as they were stored, after
+// Config.KeyTransform.
+func (s *Store) ScanNS(ns string) ([]string, error) {
+	prefix, err := namespacedKey(ns, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Paused() {
+		return nil, ErrPaused
+	}
+
+	var keys []string
+	err = s.scanLocal(prefix, func(key string, value []byte) error {
+		keys = append(keys, strings.TrimPrefix(key, prefix))
+		return nil
+	}, func() error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Scan calls fn for every key-value pair in the local cache whose key starts with
+// prefix, up to limit pairs if limit is positive. Expired keys are skipped.
+// Scanning stops at the first error returned by fn. Config.KeyTransform isn't
+// applied to prefix, since the transform of a prefix isn't necessarily a prefix of
+// the transformed keys. The prefix is matched against the keys as they were
+// stored.
+//
+// The matching entries are copied scanChunkSize entries at a time, and fn is
+// called for each chunk without holding applyMu. A slow fn, like a client reading
+// a stream, doesn't block applying entries or restoring a snapshot, and only a
+// chunk of the entries is held in memory. Entries written during the scan may or
+// may not be seen.
+func (s *Store) Scan(prefix string, limit int, fn func(key string, value []byte) error) error {
+	if s.Paused() {
+		return ErrPaused
+	}
+
+	var chunk []snapshotEntry
+	found := 0
+	collect := func(key string, value []byte) error {
+		chunk = append(chunk, snapshotEntry{key: key, value: value})
+		found++
+		if limit > 0 && found == limit {
+			return errStopScan
+		}
+		return nil
+	}
+	yield := func() error {
+		for _, e := range chunk {
+			if err := fn(e.key, e.value); err != nil {
+				return err
+			}
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+	return s.scanLocal(prefix, collect, yield)
+}
+
+// scanChunkSize is the number of entries scanLocal visits before releasing
+// applyMu.
+const scanChunkSize = 256
+
+// errStopScan is returned by the collect function of scanLocal to end the scan
+// early.
+var errStopScan = errors.New("stop scan")
+
+// scanLocal calls collect for every unexpired entry of the local cache whose key
+// starts with prefix. collect is called with applyMu held for reading, which is
+// released every scanChunkSize visited entries so that long scans don't hold up
+// applying entries. yield is called without the lock every time it's released and
+// once the scan ends, so the caller can hand over what it has collected. Returns
+// ErrScanInterrupted if a snapshot is restored while the lock is released.
+func (s *Store) scanLocal(
+	prefix string, collect func(key string, value []byte) error, yield func() error,
+) error {
+	s.applyMu.RLock()
+	locked := true
+	defer func() {
+		if locked {
+			s.applyMu.RUnlock()
+		}
+	}()
+
+	restores := s.restores
+	visited := 0
+	err := s.cache.Iterate(func(key string, value []byte) error {
+		if strings.HasPrefix(key, prefix) && !s.expired(key) {
+			if err := collect(key, value); err != nil {
+				return err
+			}
+		}
+
+		visited++
+		if visited%scanChunkSize != 0 {
+			return nil
+		}
+
+		s.applyMu.RUnlock()
+		locked = false
+		if err := yield(); err != nil {
+			return err
+		}
+		s.applyMu.RLock()
+		locked = true
+
+		if s.restores != restores {
+			return ErrScanInterrupted
+		}
+		return nil
+	})
+	if locked {
+		s.applyMu.RUnlock()
+		locked = false
+	}
+
+	if err != nil && !errors.Is(err, errStopScan) {
+		return err
+	}
+	return yield()
+}
+
+// FlushNS removes every key in the given namespace from the cluster. Other
+// namespaces are not affected. Config.KeyTransform isn't applied to namespaces.
+// Unlike Set, the flush isn't forwarded to the leader.
+func (s *Store) FlushNS(ns string) error {
+	if !s.isLeader() {
+		return s.notLeaderErr()
+	}
+
+	prefix, err := namespacedKey(ns, "")
+	if err != nil {
+		return err
+	}
+
+	res, err := s.createApplyReq(context.Background(), FlushOperation, prefix, []byte{})
+	if err != nil {
+		return err
+	}
+	return res.(applyResult).err
+}
+
 // Snapshot takes a snapshot of the current finite state machine and logs the time
-// so we can see how long a snapshot process took.
+// so we can see how long a snapshot process took. The entries are copied, so the
+// snapshot contains exactly the writes up to its log index even if more writes are
+// applied while it's persisted, and any number of snapshots can be persisted at
+// the same time. The copy needs as much memory as the entries of the cache.
 func (s *Store) Snapshot() (raft.FSMSnapshot, error) {
 	ti := time.Now()
 	s.logger.Info("started snapshot", zap.Time("start_time", ti))
+
+	entries, err := s.copyEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	s.activeSnapshots.Add(1)
+	s.snapshotKeys.Store(int64(len(entries)))
 	return &snapshot{
-		start: ti,
-		cache: s.cache,
+		start:       ti,
+		entries:     entries,
+		versions:    s.copyVersions(),
+		expiries:    s.copyExpiries(),
+		idempotency: s.idempotency.entries(),
+		uploads:     s.copyUploads(),
+		release:     func() { s.activeSnapshots.Add(-1) },
 	}, nil
 }
 
+// copyEntries copies the entries of the cache. Snapshot is called on the same
+// goroutine as Apply, so the copy contains exactly the writes up to the snapshot's
+// log index. Persisting from the live cache instead would mix in writes applied
+// while the snapshot is being written, which don't match the copied versions.
+func (s *Store) copyEntries() ([]snapshotEntry, error) {
+	entries := make([]snapshotEntry, 0, s.cache.Len())
+	err := s.cache.Iterate(func(key string, value []byte) error {
+		entries = append(entries, snapshotEntry{key: key, value: value})
+		return nil
+	})
+	return entries, err
+}
+
 // Restore takes in the bytes generated by snapshot.Persist() and parses the cache
-// state from that.
+// state from that. Local reads are blocked until the whole snapshot is restored.
 func (s *Store) Restore(rc io.ReadCloser) error {
-	// TODO
+	defer rc.Close()
+
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+
+	s.restores++
+	if err := s.cache.Reset(); err != nil {
+		return err
+	}
+	s.expiryMu.Lock()
+	s.expiries = make(map[string]expiry)
+	s.expiryMu.Unlock()
+	s.versionMu.Lock()
+	s.versions = make(map[string]uint64)
+	s.versionMu.Unlock()
+	s.idempotency = newIdempotencyCache(s.idempotency.size)
+	s.uploads = make(uploads)
+
+	r := bufio.NewReader(rc)
+	count := 0
+	for {
+		flag, key, value, err := readEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch flag {
+		case SetOperation:
+			if err := s.cache.Set(key, value); err != nil {
+				return err
+			}
+			count++
+		case VersionOperation:
+			if len(value) != 8 {
+				return ErrMalformedEntry
+			}
+			s.setVersion(key, binary.LittleEndian.Uint64(value))
+		case ExpiryOperation:
+			e, err := decodeExpiry(value)
+			if err != nil {
+				return err
+			}
+			s.expiryMu.Lock()
+			s.expiries[key] = e
+			s.expiryMu.Unlock()
+		case IdempotencyOperation:
+			res, err := decodeIdempotencyResult(value)
+			if err != nil {
+				return err
+			}
+			s.idempotency.add(key, res)
+		case ChunkOperation:
+			u, err := decodeUpload(value)
+			if err != nil {
+				return err
+			}
+			s.uploads[key] = u
+		default:
+			return ErrMalformedEntry
+		}
+	}
+
+	s.logger.Info("restored snapshot", zap.Int("entries", count))
 	return nil
 }
 
+// ForceSnapshot takes a snapshot of the current state right away, instead of waiting
+// for the snapshot threshold. Raft compacts the log up to the snapshot and the
+// snapshot store prunes older snapshots. If nothing has changed since the last
+// snapshot, no new snapshot is needed and the latest snapshot is described
+// instead with a zero duration. The response is empty if the node has no
+// snapshots at all.
+func (s *Store) ForceSnapshot() (*pb.SnapshotResponse, error) {
+	start := time.Now()
+	var took time.Duration
+	switch err := s.raft.Snapshot().Error(); {
+	case err == raft.ErrNothingNewToSnapshot:
+		s.logger.Info("nothing new to snapshot")
+	case err != nil:
+		return nil, err
+	default:
+		took = time.Since(start)
+	}
+
+	snapshots, err := s.snapshots.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return &pb.SnapshotResponse{}, nil
+	}
+
+	// the snapshots are listed newest first.
+	meta := snapshots[0]
+	return &pb.SnapshotResponse{
+		Path:     filepath.Join(s.raftDir, snapshotDir, meta.ID),
+		Size:     meta.Size,
+		Duration: int64(took),
+	}, nil
+}
+
 // Persist writes the cache state into bytes and writes it into raft.SnapshotSink.
 // The data is later parsed by Restore to create fill the finite state machine.
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
 	err := func() error {
-		iter := s.cache.Iterator()
+		for _, e := range s.entries {
+			if _, err := sink.Write(serializeEntry(SetOperation, e.key, e.value)); err != nil {
+				return err
+			}
+		}
 
-		for iter.SetNext() {
-			curr, err := iter.Value()
-			if err != nil {
+		var version [8]byte
+		for key, v := range s.versions {
+			binary.LittleEndian.PutUint64(version[:], v)
+			if _, err := sink.Write(serializeEntry(VersionOperation, key, version[:])); err != nil {
+				return err
+			}
+		}
+
+		for key, e := range s.expiries {
+			if _, err := sink.Write(serializeEntry(ExpiryOperation, key, encodeExpiry(e))); err != nil {
+				return err
+			}
+		}
+
+		for _, entry := range s.idempotency {
+			res := encodeIdempotencyResult(entry.result)
+			if _, err := sink.Write(serializeEntry(IdempotencyOperation, entry.key, res)); err != nil {
 				return err
 			}
+		}
 
-			if _, err = sink.Write(serializeEntry(SetOperation, curr.Key(), curr.Value())); err != nil {
+		for id, u := range s.uploads {
+			if _, err := sink.Write(serializeEntry(ChunkOperation, id, encodeUpload(u))); err != nil {
 				return err
 			}
 		}
@@ -419,7 +2063,9 @@ func (s *snapshot) Persist(sink raft.SnapshotSink) error {
 	return err
 }
 
-func (s *snapshot) Release() {}
+func (s *snapshot) Release() {
+	s.release()
+}
 
 // WaitForLeader waits until a leader is elected. If a leader hasn't been elected in the
 // given timeout return an error.
@@ -445,25 +2091,130 @@ func (s *Store) WaitForLeader(t time.Duration) (string, error) {
 
 // GetServers returns the server currently present in the node.
 func (s *Store) GetServers() ([]*pb.Server, error) {
+	return s.FilterServers(ServerFilter{})
+}
+
+// GetVoters returns the voters currently present in the node.
+func (s *Store) GetVoters() ([]*pb.Server, error) {
+	return s.FilterServers(ServerFilter{VotersOnly: true})
+}
+
+// SetMemberChecker sets the MemberChecker used to report failed servers.
+func (s *Store) SetMemberChecker(mc MemberChecker) {
+	s.membersMu.Lock()
+	defer s.membersMu.Unlock()
+	s.members = mc
+	s.serversChanged()
+}
+
+// ServersVersion returns a number that increases whenever the servers returned by
+// GetServers might have changed, such as when the raft configuration or the leader
+// changes, or the registry reports a member event. Callers can cache the servers
+// until the version changes.
+func (s *Store) ServersVersion() uint64 {
+	return s.serversVersion.Load()
+}
+
+// serversChanged invalidates the cached servers of ServersVersion callers.
+func (s *Store) serversChanged() {
+	s.serversVersion.Add(1)
+}
+
+// StoreConfiguration is called by raft on every node when a configuration change
+// is committed. It implements raft.ConfigurationStore.
+func (s *Store) StoreConfiguration(index uint64, configuration raft.Configuration) {
+	s.serversChanged()
+}
+
+// observeLeaderChanges invalidates the servers whenever this node sees a new
+// leader, until the store is closed.
+func (s *Store) observeLeaderChanges() {
+	ch := make(chan raft.Observation, 1)
+	observer := raft.NewObserver(ch, false, func(o *raft.Observation) bool {
+		_, ok := o.Data.(raft.LeaderObservation)
+		return ok
+	})
+	s.raft.RegisterObserver(observer)
+	defer s.raft.DeregisterObserver(observer)
+
+	for {
+		select {
+		case <-ch:
+			s.serversChanged()
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// FilterServers returns the servers in the configuration that match filter. If no
+// MemberChecker is set, every server is considered alive.
+func (s *Store) FilterServers(filter ServerFilter) ([]*pb.Server, error) {
 	f := s.raft.GetConfiguration()
 	if err := f.Error(); err != nil {
 		return nil, err
 	}
 
-	ss := f.Configuration().Servers
-	srvs := make([]*pb.Server, len(ss))
-	for i := range ss {
-		srvs[i] = &pb.Server{
-			Id:         string(ss[i].ID),
-			RpcAddr:    string(ss[i].Address),
-			IsLeader:   s.raft.Leader() == ss[i].Address,
-			VoteStatus: ss[i].Suffrage.String(),
+	s.membersMu.RLock()
+	members := s.members
+	s.membersMu.RUnlock()
+
+	var srvs []*pb.Server
+	for _, srv := range f.Configuration().Servers {
+		if filter.VotersOnly && srv.Suffrage != raft.Voter {
+			continue
+		}
+
+		failed := members != nil && !members.IsAlive(string(srv.ID))
+		if filter.AliveOnly && failed {
+			continue
 		}
+
+		srvs = append(srvs, &pb.Server{
+			Id:          string(srv.ID),
+			RpcAddr:     s.rpcAddr(members, srv.ID, srv.Address),
+			IsLeader:    s.raft.Leader() == srv.Address,
+			VoteStatus:  srv.Suffrage.String(),
+			Failed:      failed,
+			Paused:      s.isPaused(members, srv.ID),
+			ReadReplica: isReadReplica(members, srv.ID),
+		})
 	}
 
 	return srvs, nil
 }
 
+// isPaused checks whether a server is paused. The state of this node is known
+// locally, other servers are asked from members.
+func (s *Store) isPaused(members MemberChecker, id raft.ServerID) bool {
+	if id == s.conf.LocalID {
+		return s.Paused()
+	}
+	if pc, ok := members.(PauseChecker); ok {
+		return pc.IsPaused(string(id))
+	}
+	return false
+}
+
+// isReadReplica checks whether members reports the server as a read replica.
+func isReadReplica(members MemberChecker, id raft.ServerID) bool {
+	if rc, ok := members.(ReplicaChecker); ok {
+		return rc.IsReadReplica(string(id))
+	}
+	return false
+}
+
+// rpcAddr returns the rpc address of a server, which is the raft address unless
+// members knows a different one.
+func (s *Store) rpcAddr(members MemberChecker, id raft.ServerID, addr raft.ServerAddress) string {
+	if lookup, ok := members.(RPCAddrLookup); ok {
+		if rpc, ok := lookup.RPCAddr(string(id)); ok {
+			return rpc
+		}
+	}
+	return string(addr)
+}
+
 // Stepdown forces the cluster to change the leadership.
 func (s *Store) Stepdown(wait bool) error {
 	if !s.isLeader() {
@@ -477,3 +2228,50 @@ func (s *Store) Stepdown(wait bool) error {
 
 	return f.Error()
 }
+
+// LeaderID returns the ID of the current leader by matching the leader's address
+// against the cluster configuration.
+func (s *Store) LeaderID() (string, error) {
+	addr := s.LeaderAddr()
+	if addr == "" {
+		return "", ErrNoLeaderElected
+	}
+
+	f := s.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return "", err
+	}
+
+	for _, srv := range f.Configuration().Servers {
+		if string(srv.Address) == addr {
+			return string(srv.ID), nil
+		}
+	}
+	return "", ErrUnknownServer
+}
+
+// StepdownTo transfers the leadership to the server with the given ID. Only the
+// leader can transfer leadership.
+func (s *Store) StepdownTo(id string, wait bool) error {
+	if !s.isLeader() {
+		return s.notLeaderErr()
+	}
+
+	f := s.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return err
+	}
+
+	for _, srv := range f.Configuration().Servers {
+		if string(srv.ID) != id {
+			continue
+		}
+
+		tf := s.raft.LeadershipTransferToServer(srv.ID, srv.Address)
+		if !wait {
+			return nil
+		}
+		return tf.Error()
+	}
+	return ErrUnknownServer
+}
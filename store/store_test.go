@@ -1,20 +1,44 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/allegro/bigcache/v3"
 	"github.com/hashicorp/raft"
+	"github.com/nireo/dcache/metrics"
+	"github.com/nireo/dcache/pb"
+	"github.com/soheilhy/cmux"
 	"github.com/stretchr/testify/require"
+	fastlog "github.com/tidwall/raft-fastlog"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 func xd(d []byte) {
 }
 
-func xd1(a1 byte, a2 string, a3 []byte) {
+func xd1(a1 byte, a2 string, a3 []byte, a4 error) {
 }
 
 func BenchmarkSerialize(b *testing.B) {
@@ -40,13 +64,52 @@ func TestSerialization(t *testing.T) {
 	key := "test/entry/very/complicated/yes"
 	data := serializeEntry(SetOperation, key, val)
 
-	flag, key2, val2 := deserializeEntry(data)
+	flag, key2, val2, err := deserializeEntry(data)
+	require.NoError(t, err)
 
 	require.Equal(t, SetOperation, flag, "flag was not equal to set operation")
 	require.Equal(t, key, key2, "decoded key is not the same as the original")
 	require.Equal(t, val, val2, "decoded value is no the same as the original")
 }
 
+func TestDeserializeTruncated(t *testing.T) {
+	data := serializeEntry(SetOperation, "key", []byte("value"))
+
+	// every prefix of the entry is missing some data.
+	for i := 0; i < len(data); i++ {
+		_, _, _, err := deserializeEntry(data[:i])
+		require.Equal(t, ErrMalformedEntry, err, "buffer of length %d", i)
+	}
+}
+
+func TestDeserializeTrailingBytes(t *testing.T) {
+	val := []byte("value")
+	data := serializeEntry(SetOperation, "key", val)
+	data = append(data, serializeEntry(SetOperation, "other", []byte("trailing"))...)
+
+	flag, key, val2, err := deserializeEntry(data)
+	require.NoError(t, err)
+	require.Equal(t, SetOperation, flag)
+	require.Equal(t, "key", key)
+	require.Equal(t, val, val2)
+}
+
+func TestDeserializeBadLengths(t *testing.T) {
+	data := serializeEntry(SetOperation, "key", []byte("value"))
+
+	// key size larger than the whole buffer.
+	bad := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(bad[1:], math.MaxUint32)
+	_, _, _, err := deserializeEntry(bad)
+	require.Equal(t, ErrMalformedEntry, err)
+
+	// value size larger than the remaining bytes.
+	bad = append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(bad[5+len("key"):], math.MaxUint32)
+	_, _, _, err = deserializeEntry(bad)
+	require.Equal(t, ErrMalformedEntry, err)
+}
+
 func getFreePort() (int, error) {
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
 	if err != nil {
@@ -62,7 +125,15 @@ func getFreePort() (int, error) {
 	return l.Addr().(*net.TCPAddr).Port, nil
 }
 
-func newTestStore(t *testing.T, port, id int, bootstrap bool) (*Store, error) {
+func newTestStore(t testing.TB, port, id int, bootstrap bool) (*Store, error) {
+	return newTestStoreWithConf(t, port, id, bootstrap, nil)
+}
+
+// newTestStoreWithConf works like newTestStore, but fn can be used to modify the
+// configuration before the store is created.
+func newTestStoreWithConf(
+	t testing.TB, port, id int, bootstrap bool, fn func(*Config),
+) (*Store, error) {
 	datadir, err := os.MkdirTemp("", "store-test")
 	require.NoError(t, err)
 
@@ -83,6 +154,10 @@ func newTestStore(t *testing.T, port, id int, bootstrap bool) (*Store, error) {
 		ln: ln,
 	}
 
+	if fn != nil {
+		fn(&conf)
+	}
+
 	s, err := New(conf)
 	if err != nil {
 		return nil, err
@@ -96,6 +171,15 @@ func newTestStore(t *testing.T, port, id int, bootstrap bool) (*Store, error) {
 	return s, nil
 }
 
+// clusterTimeouts gives the leader more time to reach the voters joining it. With
+// the short timeouts of newTestStore, the leader can lose its lease while a voter is
+// still catching up.
+func clusterTimeouts(c *Config) {
+	c.HeartbeatTimeout = 200 * time.Millisecond
+	c.ElectionTimeout = 200 * time.Millisecond
+	c.LeaderLeaseTimeout = 100 * time.Millisecond
+}
+
 func TestSingleNode(t *testing.T) {
 	port, _ := getFreePort()
 
@@ -132,7 +216,7 @@ func TestMultipleNodes(t *testing.T) {
 
 	for i := 0; i < nodeCount; i++ {
 		port, _ := getFreePort()
-		stores[i], err = newTestStore(t, port, i, i == 0)
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, clusterTimeouts)
 		require.NoError(t, err)
 
 		if i != 0 {
@@ -206,3 +290,2817 @@ func TestMultipleNodes(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, []byte("value3"), val)
 }
+
+func TestReadAfterRemoval(t *testing.T) {
+	stores := make([]*Store, 2)
+	for i := range stores {
+		port, _ := getFreePort()
+		var err error
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, clusterTimeouts)
+		require.NoError(t, err)
+
+		if i == 0 {
+			_, err = stores[0].WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+			continue
+		}
+		require.NoError(t, stores[0].Join(
+			string(stores[i].conf.LocalID),
+			stores[i].conf.Transport.Addr().String(),
+		))
+	}
+
+	require.NoError(t, stores[0].Set("key", []byte("value")))
+	require.Eventually(t, func() bool {
+		_, err := stores[1].Get("key")
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, stores[0].Leave("1"))
+
+	// the removed node still has the value in its cache, but shouldn't serve it.
+	require.Eventually(t, func() bool {
+		_, err := stores[1].Get("key")
+		return errors.Is(err, ErrNotClusterMember)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	val, err := stores[0].Get("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+}
+
+func TestNamespaces(t *testing.T) {
+	port, _ := getFreePort()
+
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, store.SetNS("app1", "key", []byte("value1")))
+	require.NoError(t, store.SetNS("app2", "key", []byte("value2")))
+	require.NoError(t, store.SetNS("app2", "other", []byte("value3")))
+
+	val, err := store.GetNS("app1", "key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), val)
+
+	val, err = store.GetNS("app2", "key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value2"), val)
+
+	keys, err := store.ScanNS("app2")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"key", "other"}, keys)
+
+	require.NoError(t, store.FlushNS("app2"))
+
+	_, err = store.GetNS("app2", "key")
+	require.Error(t, err)
+
+	keys, err = store.ScanNS("app2")
+	require.NoError(t, err)
+	require.Empty(t, keys)
+
+	val, err = store.GetNS("app1", "key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), val)
+
+	require.Equal(t, ErrInvalidNamespace, store.SetNS("bad\x00ns", "key", nil))
+}
+
+func TestEvictionCounter(t *testing.T) {
+	port, _ := getFreePort()
+
+	store, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.MaxCacheSize = 1
+	})
+	require.NoError(t, err)
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	stats, err := store.Stats()
+	require.NoError(t, err)
+	require.Zero(t, stats.Evictions)
+
+	// a 1MB cache split into 1024 shards only fits one of these entries per shard,
+	// so the oldest ones have to be evicted.
+	val := make([]byte, 512)
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), val))
+	}
+
+	stats, err = store.Stats()
+	require.NoError(t, err)
+	require.NotZero(t, stats.Evictions)
+}
+
+func TestCacheStats(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			port, _ := getFreePort()
+			store, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+				c.CacheStats = enabled
+				c.CacheCleanWindow = 5 * time.Second
+			})
+			require.NoError(t, err)
+
+			_, err = store.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+
+			require.NoError(t, store.Set("key", []byte("value")))
+			_, err = store.Get("key")
+			require.NoError(t, err)
+			_, err = store.Get("missing")
+			require.ErrorIs(t, err, bigcache.ErrEntryNotFound)
+
+			stats, err := store.Stats()
+			require.NoError(t, err)
+			if !enabled {
+				require.Zero(t, stats.Hits)
+				require.Zero(t, stats.Misses)
+				return
+			}
+			require.NotZero(t, stats.Hits)
+			require.NotZero(t, stats.Misses)
+		})
+	}
+}
+
+func TestInjectedLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	port, _ := getFreePort()
+
+	store, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.Logger = zap.New(core)
+	})
+	require.NoError(t, err)
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	require.Equal(t, ErrJoiningSelf, store.Join("1", "localhost:1234"))
+	entries := logs.FilterMessage("join request").All()
+	require.Len(t, entries, 1)
+	require.Equal(t, zapcore.InfoLevel, entries[0].Level)
+
+	// debug messages are below the observer's level so they should be dropped.
+	store.onRemove("key", nil, bigcache.NoSpace)
+	require.Zero(t, logs.FilterMessage("entry evicted").Len())
+}
+
+func TestLeaderChangesMetric(t *testing.T) {
+	before := metrics.LeaderChanges.Value()
+	port, _ := getFreePort()
+
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return metrics.LeaderChanges.Value() > before
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+// BenchmarkHasherDistribution compares how evenly path-like keys are spread across
+// cache shards. The reported max/avg metric is the load of the fullest shard divided
+// by the average load, so lower is better.
+func BenchmarkHasherDistribution(b *testing.B) {
+	const shards = 1024
+	keys := make([]string, 100000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("/users/%d/sessions/%d", i/100, i%100)
+	}
+
+	hashers := map[string]bigcache.Hasher{
+		"fnv":    fnvHasher{},
+		"xxhash": XXHasher{},
+	}
+
+	for name, hasher := range hashers {
+		b.Run(name, func(b *testing.B) {
+			var counts [shards]int
+			for i := 0; i < b.N; i++ {
+				counts = [shards]int{}
+				for _, key := range keys {
+					counts[hasher.Sum64(key)&(shards-1)]++
+				}
+			}
+
+			maxLoad := 0
+			for _, c := range counts {
+				if c > maxLoad {
+					maxLoad = c
+				}
+			}
+			b.ReportMetric(float64(maxLoad)/(float64(len(keys))/shards), "max/avg")
+		})
+	}
+}
+
+func TestCacheSizing(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.MaxEntriesInWindow = 1024 * 20
+		c.MaxEntrySize = 64
+	})
+	require.NoError(t, err)
+	defer store.Close()
+
+	// every shard starts with room for MaxEntriesInWindow/shards entries of
+	// MaxEntrySize bytes.
+	cache := store.cache.(bigcacheCache)
+	require.Equal(t, 1024*20*64, cache.Capacity())
+}
+
+// BenchmarkCacheSizing fills a cache with entries that don't fit into the default
+// initial shards and one sized for them, which doesn't need to grow its shards.
+func BenchmarkCacheSizing(b *testing.B) {
+	const entries = 100000
+	value := make([]byte, 1024)
+	keys := make([]string, entries)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+
+	confs := map[string]Config{
+		"small": {MaxEntriesInWindow: 1024 * 10, MaxEntrySize: 16},
+		"sized": {MaxEntriesInWindow: entries, MaxEntrySize: len(value) + 64},
+	}
+
+	for name, conf := range confs {
+		s := &Store{conf: conf}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				cacheConf := s.bigcacheConfig()
+				cacheConf.Verbose = false
+				cache, err := bigcache.New(context.Background(), cacheConf)
+				require.NoError(b, err)
+				for _, key := range keys {
+					require.NoError(b, cache.Set(key, value))
+				}
+				cache.Close()
+			}
+		})
+	}
+}
+
+// fnvHasher is the same 64-bit FNV-1a that bigcache uses by default.
+type fnvHasher struct{}
+
+func (fnvHasher) Sum64(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func TestCustomHasher(t *testing.T) {
+	port, _ := getFreePort()
+
+	store, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.CacheHasher = XXHasher{}
+	})
+	require.NoError(t, err)
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Set("/a/b/c", []byte("value")))
+	val, err := store.Get("/a/b/c")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+}
+
+func TestCloseTwice(t *testing.T) {
+	port, _ := getFreePort()
+
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, store.Close())
+		}()
+	}
+	wg.Wait()
+
+	require.NoError(t, store.Close())
+}
+
+func TestForceSnapshot(t *testing.T) {
+	port, _ := getFreePort()
+
+	store, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.TrailingLogs = 10
+	})
+	require.NoError(t, err)
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), []byte("value")))
+	}
+
+	firstBefore, err := store.logStore.FirstIndex()
+	require.NoError(t, err)
+
+	res, err := store.ForceSnapshot()
+	require.NoError(t, err)
+	require.Positive(t, res.Size)
+	require.Positive(t, res.Duration)
+
+	snapshots, err := store.snapshots.List()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+
+	// the response points to the snapshot on disk.
+	require.Equal(t, snapshots[0].Size, res.Size)
+	info, err := os.Stat(filepath.Join(res.Path, "state.bin"))
+	require.NoError(t, err)
+	require.Equal(t, res.Size, info.Size())
+
+	// the log should be compacted up to the snapshot, leaving only the trailing logs.
+	firstAfter, err := store.logStore.FirstIndex()
+	require.NoError(t, err)
+	require.Greater(t, firstAfter, firstBefore)
+
+	lastAfter, err := store.logStore.LastIndex()
+	require.NoError(t, err)
+	require.LessOrEqual(t, lastAfter-firstAfter+1, uint64(10))
+
+	// nothing has changed, so there's no need for a new snapshot.
+	_, err = store.ForceSnapshot()
+	require.NoError(t, err)
+}
+
+func TestRetainSnapshots(t *testing.T) {
+	port, _ := getFreePort()
+
+	store, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.RetainSnapshots = 3
+	})
+	require.NoError(t, err)
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), []byte("value")))
+		_, err = store.ForceSnapshot()
+		require.NoError(t, err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(store.conf.DataDir, "raft", "snapshots"))
+	require.NoError(t, err)
+
+	var snapshots int
+	for _, e := range entries {
+		if e.IsDir() {
+			snapshots++
+		}
+	}
+	require.Equal(t, 3, snapshots)
+}
+
+func TestNoLeaderElected(t *testing.T) {
+	port, _ := getFreePort()
+
+	// a node that isn't bootstrapped never elects a leader by itself.
+	store, err := newTestStore(t, port, 1, false)
+	require.NoError(t, err)
+
+	require.Equal(t, ErrNoLeaderElected, store.Set("key", []byte("value")))
+	require.Equal(t, ErrNoLeaderElected, store.FlushNS("ns"))
+}
+
+func TestStepdownTo(t *testing.T) {
+	nodeCount := 3
+	var err error
+	stores := make([]*Store, nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		port, _ := getFreePort()
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, clusterTimeouts)
+		require.NoError(t, err)
+		defer stores[i].Close()
+
+		if i != 0 {
+			err = stores[0].Join(
+				string(stores[i].conf.LocalID),
+				stores[i].conf.Transport.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			_, err = stores[i].WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+	}
+
+	// wait for every node to have the configuration, so the target is caught up
+	// before transferring to it.
+	require.Eventually(t, func() bool {
+		for _, s := range stores {
+			id, err := s.LeaderID()
+			if err != nil || id != "0" {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+
+	require.Equal(t, raft.ErrNotLeader, stores[1].StepdownTo("2", true))
+	require.Equal(t, ErrUnknownServer, stores[0].StepdownTo("unknown", true))
+
+	require.NoError(t, stores[0].StepdownTo("2", true))
+	require.Eventually(t, func() bool {
+		for _, s := range stores {
+			id, err := s.LeaderID()
+			if err != nil || id != "2" {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestGetOrSet(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	// hit returns the existing value without overwriting it.
+	require.NoError(t, store.Set("existing", []byte("old")))
+	val, stored, err := store.GetOrSet("existing", []byte("new"))
+	require.NoError(t, err)
+	require.False(t, stored)
+	require.Equal(t, []byte("old"), val)
+
+	// on a miss exactly one of the concurrent callers stores its value and every
+	// caller sees that value.
+	const callers = 20
+	type result struct {
+		val    []byte
+		stored bool
+	}
+	results := make(chan result, callers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			val, stored, err := store.GetOrSet("missing", []byte(fmt.Sprintf("value%d", i)))
+			require.NoError(t, err)
+			results <- result{val: val, stored: stored}
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	final, err := store.Get("missing")
+	require.NoError(t, err)
+
+	storedCount := 0
+	for r := range results {
+		if r.stored {
+			storedCount++
+		}
+		require.Equal(t, final, r.val)
+	}
+	require.Equal(t, 1, storedCount)
+}
+
+func TestDiagnosticsLag(t *testing.T) {
+	nodeCount := 3
+	var err error
+	stores := make([]*Store, nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		port, _ := getFreePort()
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, clusterTimeouts)
+		require.NoError(t, err)
+		defer stores[i].Close()
+
+		if i != 0 {
+			err = stores[0].Join(
+				string(stores[i].conf.LocalID),
+				stores[i].conf.Transport.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			_, err = stores[i].WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+	}
+
+	// send a burst of writes without waiting for them to be committed.
+	var last raft.ApplyFuture
+	for i := 0; i < 1000; i++ {
+		last = stores[0].raft.Apply(
+			serializeEntry(SetOperation, fmt.Sprintf("key%d", i), []byte("value")),
+			10*time.Second,
+		)
+	}
+
+	leader, err := stores[0].Diagnostics()
+	require.NoError(t, err)
+	follower, err := stores[1].Diagnostics()
+	require.NoError(t, err)
+	require.Greater(t, leader.LastIndex, follower.AppliedIndex)
+	require.Equal(t, leader.Term, follower.Term)
+	require.NotEmpty(t, follower.RaftStats["state"])
+
+	require.NoError(t, last.Error())
+	require.Eventually(t, func() bool {
+		follower, err := stores[1].Diagnostics()
+		require.NoError(t, err)
+		return follower.AppliedIndex == last.Index()
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestNoVoters(t *testing.T) {
+	port, _ := getFreePort()
+	voter, err := newTestStore(t, port, 0, true)
+	require.NoError(t, err)
+	defer voter.Close()
+
+	_, err = voter.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	port, _ = getFreePort()
+	nonVoter, err := newTestStore(t, port, 1, false)
+	require.NoError(t, err)
+	defer nonVoter.Close()
+
+	require.NoError(t, voter.JoinNonVoter("1", nonVoter.conf.Transport.Addr().String()))
+
+	// removing the only voter would leave the cluster without voters.
+	start := time.Now()
+	require.Equal(t, ErrNoVoters, voter.Leave("0"))
+	require.Less(t, time.Since(start), time.Second)
+
+	// the cluster is still usable after the rejected removal.
+	require.NoError(t, voter.Set("key", []byte("value")))
+
+	// raft refuses to create a configuration without voters, so one is written
+	// straight into the log of a node.
+	datadir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(datadir, "raft"), 0755))
+	logStore, err := fastlog.NewFastLogStore(
+		filepath.Join(datadir, "raft", logStoreFile), fastlog.Medium, io.Discard)
+	require.NoError(t, err)
+
+	port, _ = getFreePort()
+	require.NoError(t, logStore.StoreLog(&raft.Log{
+		Index: 1,
+		Term:  1,
+		Type:  raft.LogConfiguration,
+		Data: raft.EncodeConfiguration(raft.Configuration{Servers: []raft.Server{{
+			Suffrage: raft.Nonvoter,
+			ID:       "2",
+			Address:  raft.ServerAddress(fmt.Sprintf("localhost:%d", port)),
+		}}}),
+	}))
+	require.NoError(t, logStore.Close())
+
+	orphan, err := newTestStoreWithConf(t, port, 2, false, func(c *Config) {
+		c.DataDir = datadir
+		c.PersistLog = true
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { orphan.Close() })
+
+	start = time.Now()
+	require.Equal(t, ErrNoVoters, orphan.Set("key", []byte("value")))
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestWarmupFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warmup")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, WriteWarmupEntry(f, fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i))))
+	}
+	require.NoError(t, f.Close())
+
+	port, _ := getFreePort()
+	store, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.WarmupFile = path
+	})
+	require.NoError(t, err)
+	defer store.Close()
+
+	// the entries are readable before a leader has been elected.
+	for i := 0; i < 10; i++ {
+		val, err := store.Get(fmt.Sprintf("key%d", i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("value%d", i)), val)
+	}
+}
+
+func TestWarmupFileTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warmup")
+	entry := serializeEntry(SetOperation, "key", []byte("value"))
+	require.NoError(t, os.WriteFile(path, entry[:len(entry)-1], 0o600))
+
+	port, _ := getFreePort()
+	_, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.WarmupFile = path
+	})
+	require.ErrorIs(t, err, ErrMalformedEntry)
+}
+
+func TestTTLLazyExpiration(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, store.SetTTL("key", []byte("value"), 100*time.Millisecond))
+	val, err := store.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+
+	// without a sweeper the entry is hidden, but still takes space.
+	time.Sleep(150 * time.Millisecond)
+	_, err = store.Get("key")
+	require.Equal(t, bigcache.ErrEntryNotFound, err)
+	require.Equal(t, 1, store.cache.Len())
+
+	// overwriting without a TTL removes the deadline.
+	require.NoError(t, store.Set("key", []byte("new")))
+	val, err = store.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), val)
+}
+
+func TestGetTouch(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.TTLSweepInterval = 50 * time.Millisecond
+	})
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, store.SetTTL("touched", []byte("value"), 300*time.Millisecond))
+	require.NoError(t, store.SetTTL("untouched", []byte("value"), 300*time.Millisecond))
+
+	// reading the key keeps it alive well past its original TTL.
+	for i := 0; i < 20; i++ {
+		val, err := store.GetTouch("touched")
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), val)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	_, err = store.Get("untouched")
+	require.Equal(t, bigcache.ErrEntryNotFound, err)
+
+	// once the reads stop, the key expires after its TTL.
+	require.Eventually(t, func() bool {
+		_, err := store.Get("touched")
+		return err == bigcache.ErrEntryNotFound
+	}, time.Second, 50*time.Millisecond)
+
+	// keys without a TTL are not affected.
+	require.NoError(t, store.Set("permanent", []byte("value")))
+	_, err = store.GetTouch("permanent")
+	require.NoError(t, err)
+	store.expiryMu.Lock()
+	_, ok := store.expiries["permanent"]
+	store.expiryMu.Unlock()
+	require.False(t, ok)
+}
+
+// touchPayload encodes a TouchOperation moving the deadline seen to deadline.
+func touchPayload(seen, deadline time.Time) []byte {
+	payload := make([]byte, 16)
+	binary.LittleEndian.PutUint64(payload, uint64(seen.UnixNano()))
+	binary.LittleEndian.PutUint64(payload[8:], uint64(deadline.UnixNano()))
+	return payload
+}
+
+// ttlPayload encodes a SetTTLOperation of value expiring at deadline.
+func ttlPayload(deadline time.Time, value []byte) []byte {
+	payload := make([]byte, 8+len(value))
+	binary.LittleEndian.PutUint64(payload, uint64(deadline.UnixNano()))
+	copy(payload[8:], value)
+	return payload
+}
+
+func TestTouchAfterSetTTL(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+
+	now := time.Now()
+	first := now.Add(time.Minute)
+	applyAt(s, 1, now, SetTTLOperation, "key", ttlPayload(first, []byte("value")))
+
+	// the touch is started from the first deadline, but the key is set with a
+	// shorter TTL before the touch is applied.
+	touch := touchPayload(first, now.Add(2*time.Minute))
+	second := now.Add(time.Second)
+	applyAt(s, 2, now, SetTTLOperation, "key", ttlPayload(second, []byte("new")))
+	require.NoError(t, applyAt(s, 3, now, TouchOperation, "key", touch).err)
+	require.Equal(t, second.UnixNano(), s.expiries["key"].deadline)
+
+	// a touch started from the current deadline moves it.
+	later := now.Add(3 * time.Second)
+	require.NoError(t, applyAt(s, 4, now, TouchOperation, "key", touchPayload(second, later)).err)
+	require.Equal(t, later.UnixNano(), s.expiries["key"].deadline)
+}
+
+func TestTTLSweep(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.SetTTL(fmt.Sprintf("key%d", i), []byte("value"), 100*time.Millisecond))
+	}
+	require.NoError(t, store.Set("permanent", []byte("value")))
+	require.Equal(t, 11, store.cache.Len())
+
+	// the sweeper isn't running, so the sweep happens only once every key is due.
+	require.Eventually(t, func() bool {
+		return len(store.expiredKeys()) == 10
+	}, 3*time.Second, 10*time.Millisecond)
+
+	before := metrics.ExpiredKeys.Value()
+	store.sweep()
+
+	// the expired entries are physically removed from the cache.
+	require.Equal(t, 1, store.cache.Len())
+	require.Equal(t, uint64(10), metrics.ExpiredKeys.Value()-before)
+
+	val, err := store.Get("permanent")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+}
+
+func TestTTLSweepWhilePaused(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, store.SetTTL("key", []byte("value"), 10*time.Millisecond))
+	require.Eventually(t, func() bool {
+		return len(store.expiredKeys()) == 1
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// pausing the leader takes it out of rotation, but it keeps reclaiming space.
+	store.Pause()
+	require.ErrorIs(t, store.Set("other", []byte("value")), ErrPaused)
+	store.sweep()
+	require.Zero(t, store.cache.Len())
+}
+
+func TestTTLSweepInterval(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.TTLSweepInterval = 50 * time.Millisecond
+	})
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	before := metrics.ExpiredKeys.Value()
+	require.NoError(t, store.SetTTL("key", []byte("value"), 100*time.Millisecond))
+	require.NoError(t, store.Set("permanent", []byte("value")))
+
+	require.Eventually(t, func() bool {
+		return store.cache.Len() == 1
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Equal(t, uint64(1), metrics.ExpiredKeys.Value()-before)
+}
+
+func TestTTLSweepKeepsRewrittenKeys(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, store.SetTTL("rewritten", []byte("old"), 10*time.Millisecond))
+	require.NoError(t, store.SetTTL("refreshed", []byte("old"), 10*time.Millisecond))
+	require.NoError(t, store.SetTTL("expired", []byte("old"), 10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+
+	expired := store.expiredKeys()
+	require.Len(t, expired, 3)
+
+	// the keys are written after the sweeper found them, but before it deletes them.
+	require.NoError(t, store.Set("rewritten", []byte("new")))
+	require.NoError(t, store.SetTTL("refreshed", []byte("new"), time.Minute))
+
+	for key, deadline := range expired {
+		deleted, err := store.expire(key, deadline)
+		require.NoError(t, err)
+		require.Equal(t, key == "expired", deleted)
+	}
+
+	for _, key := range []string{"rewritten", "refreshed"} {
+		val, err := store.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("new"), val)
+	}
+	_, err = store.getLocal("expired")
+	require.ErrorIs(t, err, bigcache.ErrEntryNotFound)
+}
+
+// applyAt applies an entry to s as if the leader had appended it at appendedAt.
+func applyAt(s *Store, index uint64, appendedAt time.Time, flag byte, key string, value []byte) applyResult {
+	return s.Apply(&raft.Log{
+		Index:      index,
+		Data:       serializeEntry(flag, key, value),
+		AppendedAt: appendedAt,
+	}).(applyResult)
+}
+
+func TestApplyGetOrSetUsesAppendTime(t *testing.T) {
+	s, err := newFSM(Config{DataDir: t.TempDir(), Logger: zap.NewNop()})
+	require.NoError(t, err)
+	defer s.cache.Close()
+
+	// the key expires shortly after it's set, but the get-or-set was appended
+	// before the deadline, so every node keeps the existing value no matter when
+	// it applies the entry.
+	appended := time.Now()
+	payload := make([]byte, 8+len("old"))
+	binary.LittleEndian.PutUint64(payload, uint64(appended.Add(10*time.Millisecond).UnixNano()))
+	copy(payload[8:], "old")
+	require.NoError(t, applyAt(s, 1, appended, SetTTLOperation, "key", payload).err)
+
+	time.Sleep(20 * time.Millisecond)
+	res := applyAt(s, 2, appended.Add(5*time.Millisecond), GetOrSetOperation, "key", []byte("new"))
+	require.NoError(t, res.err)
+	require.Equal(t, getOrSetResult{value: []byte("old")}, res.res)
+}
+
+func TestApplySetVersionedUsesAppendTime(t *testing.T) {
+	s, err := newFSM(Config{DataDir: t.TempDir(), Logger: zap.NewNop()})
+	require.NoError(t, err)
+	defer s.cache.Close()
+
+	appended := time.Now()
+	payload := make([]byte, 8+len("old"))
+	binary.LittleEndian.PutUint64(payload, uint64(appended.Add(10*time.Millisecond).UnixNano()))
+	copy(payload[8:], "old")
+	require.NoError(t, applyAt(s, 1, appended, SetTTLOperation, "key", payload).err)
+
+	// the write was appended before the key expired, so the version still matches
+	// even though the deadline has passed by the time it's applied.
+	time.Sleep(20 * time.Millisecond)
+	payload = make([]byte, 12+len("new"))
+	binary.LittleEndian.PutUint64(payload, 1)
+	copy(payload[12:], "new")
+	res := applyAt(s, 2, appended.Add(5*time.Millisecond), SetVersionedOperation, "key", payload)
+	require.NoError(t, res.err)
+	require.Equal(t, uint64(2), res.res)
+}
+
+func TestGetLocalVersionedMatchesValue(t *testing.T) {
+	s, err := newFSM(Config{DataDir: t.TempDir(), Logger: zap.NewNop()})
+	require.NoError(t, err)
+	defer s.cache.Close()
+
+	// every write stores its own index, so a read that mixes the value of one
+	// write with the version of another is caught.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint64(1); i <= 2000; i++ {
+			applyAt(s, i, time.Now(), SetOperation, "key", []byte(strconv.FormatUint(i, 10)))
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		val, version, err := s.getLocalVersioned("key")
+		if errors.Is(err, bigcache.ErrEntryNotFound) {
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, strconv.FormatUint(version, 10), string(val))
+	}
+}
+
+func TestServersVersion(t *testing.T) {
+	stores := make([]*Store, 3)
+	for i := range stores {
+		port, _ := getFreePort()
+		var err error
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, clusterTimeouts)
+		require.NoError(t, err)
+		defer stores[i].Close()
+	}
+
+	_, err := stores[0].WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+	require.NoError(t, stores[0].Join("1", stores[1].conf.Transport.Addr().String()))
+
+	require.Eventually(t, func() bool {
+		servers, err := stores[1].GetServers()
+		return err == nil && len(servers) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// the configuration change is seen by the follower, which wasn't asked to
+	// join anyone itself.
+	before := stores[1].ServersVersion()
+	require.NoError(t, stores[0].Join("2", stores[2].conf.Transport.Addr().String()))
+	require.Eventually(t, func() bool {
+		return stores[1].ServersVersion() > before
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestDuplicateNodeID(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("allow=%v", allow), func(t *testing.T) {
+			stores := make([]*Store, 2)
+			for i := range stores {
+				port, _ := getFreePort()
+				var err error
+				stores[i], err = newTestStoreWithConf(t, port, i, i == 0, func(c *Config) {
+					clusterTimeouts(c)
+					c.AllowAddressChange = allow
+				})
+				require.NoError(t, err)
+				defer stores[i].Close()
+			}
+
+			_, err := stores[0].WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+			require.NoError(t, stores[0].Join("1", stores[1].conf.Transport.Addr().String()))
+
+			// another node started with the same name.
+			port, _ := getFreePort()
+			otherAddr := fmt.Sprintf("localhost:%d", port)
+			err = stores[0].Join("1", otherAddr)
+
+			servers, serr := stores[0].GetServers()
+			require.NoError(t, serr)
+			require.Len(t, servers, 2)
+
+			addrs := make(map[string]string)
+			for _, srv := range servers {
+				addrs[srv.Id] = srv.RpcAddr
+			}
+
+			if allow {
+				require.NoError(t, err)
+				require.Equal(t, otherAddr, addrs["1"])
+				return
+			}
+			require.ErrorIs(t, err, ErrDuplicateNodeID)
+			require.Equal(t, stores[1].conf.Transport.Addr().String(), addrs["1"])
+		})
+	}
+}
+
+func TestStaleReads(t *testing.T) {
+	stores := make([]*Store, 2)
+	for i := range stores {
+		port, _ := getFreePort()
+		var err error
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, func(c *Config) {
+			clusterTimeouts(c)
+			c.StrongConsistency = true
+		})
+		require.NoError(t, err)
+		defer stores[i].Close()
+
+		if i != 0 {
+			err = stores[0].Join(
+				string(stores[i].conf.LocalID),
+				stores[i].conf.Transport.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			_, err = stores[i].WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+	}
+
+	leader, follower := stores[0], stores[1]
+	require.NoError(t, leader.Set("key", []byte("value")))
+
+	// strongly consistent reads on a follower need the leader.
+	_, err := follower.Get("key")
+	require.ErrorIs(t, err, raft.ErrNotLeader)
+
+	require.Eventually(t, func() bool {
+		val, _, err := follower.GetWithOptions("key", GetOptions{Stale: true})
+		return err == nil && bytes.Equal(val, []byte("value"))
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// stale reads are served locally, so they work without a leader.
+	require.NoError(t, leader.Close())
+	val, version, err := follower.GetWithOptions("key", GetOptions{Stale: true})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+	require.NotZero(t, version)
+}
+
+func TestStrongReads(t *testing.T) {
+	stores := make([]*Store, 2)
+	for i := range stores {
+		port, _ := getFreePort()
+		var err error
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, clusterTimeouts)
+		require.NoError(t, err)
+		defer stores[i].Close()
+
+		if i != 0 {
+			err = stores[0].Join(
+				string(stores[i].conf.LocalID),
+				stores[i].conf.Transport.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			_, err = stores[i].WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+	}
+
+	leader, follower := stores[0], stores[1]
+	require.NoError(t, leader.Set("key", []byte("value")))
+
+	val, _, err := leader.GetWithOptions("key", GetOptions{Strong: true})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+
+	// the follower cannot serve strong reads, even though it's configured for
+	// eventually consistent reads.
+	_, _, err = follower.GetWithOptions("key", GetOptions{Strong: true})
+	require.ErrorIs(t, err, raft.ErrNotLeader)
+}
+
+func TestStaleOnLeaderFailure(t *testing.T) {
+	stores := make([]*Store, 2)
+	for i := range stores {
+		port, _ := getFreePort()
+		var err error
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, func(c *Config) {
+			clusterTimeouts(c)
+			c.StrongConsistency = true
+			c.StaleOnLeaderFailure = true
+		})
+		require.NoError(t, err)
+		defer stores[i].Close()
+
+		if i != 0 {
+			err = stores[0].Join(
+				string(stores[i].conf.LocalID),
+				stores[i].conf.Transport.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			_, err = stores[i].WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+	}
+
+	leader, follower := stores[0], stores[1]
+	require.NoError(t, leader.Set("key", []byte("value")))
+
+	res, err := leader.GetWithResult("key", GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), res.Value)
+	require.False(t, res.Stale)
+
+	// the follower knows the leader, so the read isn't served locally.
+	_, err = follower.GetWithResult("key", GetOptions{})
+	require.ErrorIs(t, err, raft.ErrNotLeader)
+
+	require.Eventually(t, func() bool {
+		val, _, err := follower.GetWithOptions("key", GetOptions{Stale: true})
+		return err == nil && bytes.Equal(val, []byte("value"))
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// once the leader is gone the follower serves the value from its cache.
+	require.NoError(t, leader.Close())
+	require.Eventually(t, func() bool {
+		res, err = follower.GetWithResult("key", GetOptions{})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	require.Equal(t, []byte("value"), res.Value)
+	require.True(t, res.Stale)
+}
+
+func TestLinearizableReads(t *testing.T) {
+	nodeCount := 3
+	var err error
+	stores := make([]*Store, nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		port, _ := getFreePort()
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, func(c *Config) {
+			clusterTimeouts(c)
+			c.LinearizableReads = true
+		})
+		require.NoError(t, err)
+		defer stores[i].Close()
+
+		if i != 0 {
+			err = stores[0].Join(
+				string(stores[i].conf.LocalID),
+				stores[i].conf.Transport.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			_, err = stores[i].WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+	}
+
+	leader := stores[0]
+	require.NoError(t, leader.Set("counter", []byte("0")))
+
+	// the writer stores increasing values and records the last acknowledged one.
+	var acked atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 200; i++ {
+			if err := leader.Set("counter", []byte(strconv.Itoa(i))); err != nil {
+				return
+			}
+			acked.Store(int64(i))
+		}
+	}()
+
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+
+		before := acked.Load()
+		val, err := leader.Get("counter")
+		require.NoError(t, err)
+
+		n, err := strconv.Atoi(string(val))
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, int64(n), before)
+	}
+	require.Equal(t, int64(200), acked.Load())
+
+	// followers cannot serve linearizable reads.
+	_, err = stores[1].Get("counter")
+	require.Equal(t, raft.ErrNotLeader, err)
+}
+
+func TestBarrierReads(t *testing.T) {
+	stores := make([]*Store, 2)
+	for i := range stores {
+		port, _ := getFreePort()
+		var err error
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, func(c *Config) {
+			clusterTimeouts(c)
+			c.BarrierReads = true
+		})
+		require.NoError(t, err)
+		defer stores[i].Close()
+
+		if i != 0 {
+			err = stores[0].Join(
+				string(stores[i].conf.LocalID),
+				stores[i].conf.Transport.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			_, err = stores[i].WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+	}
+
+	leader := stores[0]
+	require.NoError(t, leader.Barrier(time.Second))
+	require.NoError(t, leader.Set("counter", []byte("0")))
+
+	// every read sees at least the last write acknowledged before it started.
+	var acked atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 200; i++ {
+			if err := leader.Set("counter", []byte(strconv.Itoa(i))); err != nil {
+				return
+			}
+			acked.Store(int64(i))
+		}
+	}()
+
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+
+		before := acked.Load()
+		val, err := leader.Get("counter")
+		require.NoError(t, err)
+
+		n, err := strconv.Atoi(string(val))
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, int64(n), before)
+	}
+	require.Equal(t, int64(200), acked.Load())
+
+	// only the leader can issue barriers.
+	_, err := stores[1].Get("counter")
+	require.ErrorIs(t, err, raft.ErrNotLeader)
+	require.ErrorIs(t, stores[1].Barrier(time.Second), raft.ErrNotLeader)
+}
+
+type memberChecker map[string]bool
+
+func (m memberChecker) IsAlive(id string) bool {
+	return m[id]
+}
+
+func TestFilterServers(t *testing.T) {
+	nodeCount := 3
+	var err error
+	stores := make([]*Store, nodeCount)
+
+	for i := 0; i < nodeCount; i++ {
+		port, _ := getFreePort()
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, clusterTimeouts)
+		require.NoError(t, err)
+		defer stores[i].Close()
+
+		switch i {
+		case 0:
+			_, err = stores[i].WaitForLeader(3 * time.Second)
+		case 1:
+			err = stores[0].Join("1", stores[i].conf.Transport.Addr().String())
+		case 2:
+			err = stores[0].JoinNonVoter("2", stores[i].conf.Transport.Addr().String())
+		}
+		require.NoError(t, err)
+	}
+
+	ids := func(servers []*pb.Server) []string {
+		var ids []string
+		for _, srv := range servers {
+			ids = append(ids, srv.Id)
+		}
+		return ids
+	}
+
+	// without a member checker every server is alive.
+	servers, err := stores[0].FilterServers(ServerFilter{AliveOnly: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"0", "1", "2"}, ids(servers))
+
+	voters, err := stores[0].GetVoters()
+	require.NoError(t, err)
+	require.Equal(t, []string{"0", "1"}, ids(voters))
+
+	stores[0].SetMemberChecker(memberChecker{"0": true, "2": true})
+
+	servers, err = stores[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, []string{"0", "1", "2"}, ids(servers))
+	require.True(t, servers[1].Failed)
+	require.False(t, servers[2].Failed)
+
+	servers, err = stores[0].FilterServers(ServerFilter{AliveOnly: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"0", "2"}, ids(servers))
+
+	servers, err = stores[0].FilterServers(ServerFilter{VotersOnly: true, AliveOnly: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"0"}, ids(servers))
+}
+
+func TestRestoreBlocksReads(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.cache.Set("old", []byte("value")))
+	// a deadline from before the restore doesn't apply to the restored key.
+	store.expiryMu.Lock()
+	store.expiries["key9"] = expiry{deadline: time.Now().Add(-time.Second).UnixNano()}
+	store.expiryMu.Unlock()
+
+	pr, pw := io.Pipe()
+	restored := make(chan error, 1)
+	go func() {
+		restored <- store.Restore(pr)
+	}()
+
+	// the write only returns once Restore has started reading the snapshot.
+	_, err = pw.Write(serializeEntry(SetOperation, "key0", []byte("value0")))
+	require.NoError(t, err)
+
+	type result struct {
+		val []byte
+		err error
+	}
+	read := make(chan result, 1)
+	go func() {
+		val, err := store.Get("key9")
+		read <- result{val, err}
+	}()
+
+	select {
+	case <-read:
+		t.Fatal("read returned during restore")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 1; i < 10; i++ {
+		_, err = pw.Write(serializeEntry(SetOperation, fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i))))
+		require.NoError(t, err)
+	}
+
+	// key1 had already expired when the snapshot was taken, key2 expires later.
+	expired := expiry{deadline: time.Now().Add(-time.Second).UnixNano(), ttl: time.Minute}
+	_, err = pw.Write(serializeEntry(ExpiryOperation, "key1", encodeExpiry(expired)))
+	require.NoError(t, err)
+	pending := expiry{deadline: time.Now().Add(200 * time.Millisecond).UnixNano(), ttl: time.Minute}
+	_, err = pw.Write(serializeEntry(ExpiryOperation, "key2", encodeExpiry(pending)))
+	require.NoError(t, err)
+
+	require.NoError(t, pw.Close())
+	require.NoError(t, <-restored)
+
+	res := <-read
+	require.NoError(t, res.err)
+	require.Equal(t, []byte("value9"), res.val)
+
+	_, err = store.Get("key1")
+	require.ErrorIs(t, err, bigcache.ErrEntryNotFound)
+	val, err := store.Get("key2")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value2"), val)
+	require.Eventually(t, func() bool {
+		_, err := store.Get("key2")
+		return err == bigcache.ErrEntryNotFound
+	}, time.Second, 50*time.Millisecond)
+
+	_, err = store.Get("old")
+	require.ErrorIs(t, err, bigcache.ErrEntryNotFound)
+}
+
+func TestScanDoesntBlockRestore(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, store.cache.Set(fmt.Sprintf("key%d", i), []byte("value")))
+	}
+
+	// a restore can start while fn is running, for example while a client is slow
+	// to read a scan stream.
+	var keys []string
+	err = store.Scan("key", 0, func(key string, value []byte) error {
+		require.True(t, store.applyMu.TryLock())
+		store.applyMu.Unlock()
+		keys = append(keys, key)
+		return nil
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"key0", "key1", "key2"}, keys)
+}
+
+func TestScanChunks(t *testing.T) {
+	s, err := newFSM(Config{DataDir: t.TempDir(), Logger: zap.NewNop()})
+	require.NoError(t, err)
+	defer s.cache.Close()
+
+	const keys = 3 * scanChunkSize
+	for i := 0; i < keys; i++ {
+		require.NoError(t, s.cache.Set(fmt.Sprintf("key%d", i), []byte("value")))
+	}
+
+	// the limit is applied while copying the entries.
+	var scanned []string
+	err = s.Scan("key", 1, func(key string, value []byte) error {
+		scanned = append(scanned, key)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, scanned, 1)
+
+	// entries can be applied while fn is running.
+	scanned = nil
+	err = s.Scan("key", 0, func(key string, value []byte) error {
+		if len(scanned) == 0 {
+			require.NoError(t, applyAt(s, 1, time.Now(), SetOperation, "other", []byte("value")).err)
+		}
+		scanned = append(scanned, key)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, scanned, keys)
+
+	// a restore replaces the rest of the cache, so the scan is stopped.
+	err = s.Scan("key", 0, func(key string, value []byte) error {
+		return s.Restore(io.NopCloser(bytes.NewReader(nil)))
+	})
+	require.ErrorIs(t, err, ErrScanInterrupted)
+}
+
+func TestPromoteToVoter(t *testing.T) {
+	var err error
+	stores := make([]*Store, 2)
+	for i := range stores {
+		port, _ := getFreePort()
+		stores[i], err = newTestStore(t, port, i, i == 0)
+		require.NoError(t, err)
+		defer stores[i].Close()
+	}
+
+	_, err = stores[0].WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+	require.NoError(t, stores[0].Set("key", []byte("value")))
+
+	require.Equal(t, ErrUnknownServer, stores[0].PromoteToVoter("1"))
+	require.NoError(t, stores[0].JoinNonVoter("1", stores[1].conf.Transport.Addr().String()))
+
+	// wait for the non-voter to catch up before promoting it.
+	require.Eventually(t, func() bool {
+		val, err := stores[1].Get("key")
+		return err == nil && bytes.Equal(val, []byte("value"))
+	}, 3*time.Second, 50*time.Millisecond)
+
+	require.NoError(t, stores[0].PromoteToVoter("1"))
+	require.Equal(t, ErrNotNonVoter, stores[0].PromoteToVoter("1"))
+
+	servers, err := stores[0].GetServers()
+	require.NoError(t, err)
+	require.Len(t, servers, 2)
+	for _, srv := range servers {
+		require.Equal(t, raft.Voter.String(), srv.VoteStatus)
+	}
+}
+
+func TestVersionedSet(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, store.Set("key", []byte("value1")))
+	val, version, err := store.GetVersioned("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), val)
+	require.NotZero(t, version)
+
+	newVersion, err := store.SetVersioned("key", []byte("value2"), version)
+	require.NoError(t, err)
+	require.Greater(t, newVersion, version)
+
+	// the write using the old version is stale.
+	_, err = store.SetVersioned("key", []byte("value3"), version)
+	require.Equal(t, ErrVersionConflict, err)
+
+	val, v, err := store.GetVersioned("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value2"), val)
+	require.Equal(t, newVersion, v)
+
+	// a missing key has no version to match.
+	_, err = store.SetVersioned("missing", []byte("value"), version)
+	require.Equal(t, ErrVersionConflict, err)
+}
+
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (b *bufferSink) ID() string    { return "buffer" }
+func (b *bufferSink) Cancel() error { return nil }
+func (b *bufferSink) Close() error  { return nil }
+
+func TestSnapshotKeepsVersions(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	version, err := store.SetVersioned("key", []byte("value"), 0)
+	require.NoError(t, err)
+
+	snap, err := store.Snapshot()
+	require.NoError(t, err)
+	sink := &bufferSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+
+	port, _ = getFreePort()
+	restored, err := newTestStore(t, port, 2, false)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+
+	val, v, err := restored.GetVersioned("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+	require.Equal(t, version, v)
+}
+
+func TestSnapshotKeepsExpiries(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, store.SetTTL("key", []byte("value"), 300*time.Millisecond))
+	require.NoError(t, store.Set("permanent", []byte("value")))
+
+	snap, err := store.Snapshot()
+	require.NoError(t, err)
+	sink := &bufferSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+
+	port, _ = getFreePort()
+	restored, err := newTestStore(t, port, 2, false)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+
+	// the restored key keeps its deadline and the TTL used to refresh it.
+	store.expiryMu.Lock()
+	want := store.expiries["key"]
+	store.expiryMu.Unlock()
+	restored.expiryMu.Lock()
+	got, ok := restored.expiries["key"]
+	restored.expiryMu.Unlock()
+	require.True(t, ok)
+	require.Equal(t, want, got)
+	require.NotZero(t, got.ttl)
+
+	val, err := restored.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+
+	require.Eventually(t, func() bool {
+		_, err := restored.Get("key")
+		return err == bigcache.ErrEntryNotFound
+	}, time.Second, 50*time.Millisecond)
+
+	_, err = restored.Get("permanent")
+	require.NoError(t, err)
+}
+
+// readSnapshot returns the keys of the values and versions in a persisted
+// snapshot.
+func readSnapshot(t *testing.T, r io.Reader) (map[string]bool, map[string]bool) {
+	values, versions := map[string]bool{}, map[string]bool{}
+	for {
+		flag, key, _, err := readEntry(r)
+		if err == io.EOF {
+			return values, versions
+		}
+		require.NoError(t, err)
+
+		switch flag {
+		case SetOperation:
+			values[key] = true
+		case VersionOperation:
+			versions[key] = true
+		}
+	}
+}
+
+func TestConcurrentSnapshots(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, store.Set(strconv.Itoa(i), []byte("value")))
+	}
+
+	snaps := make([]raft.FSMSnapshot, 3)
+	for i := range snaps {
+		snaps[i], err = store.Snapshot()
+		require.NoError(t, err)
+	}
+
+	// the goroutines report their errors here, since require can only stop the
+	// test from the test goroutine.
+	errs := make(chan error, len(snaps)+1)
+
+	// keep writing while the snapshots are persisted.
+	written := make(chan struct{})
+	go func() {
+		var err error
+		for i := 100; i < 300 && err == nil; i++ {
+			err = store.Set(strconv.Itoa(i), []byte("value"))
+			if i == 150 || err != nil && i < 150 {
+				close(written)
+			}
+		}
+		errs <- err
+	}()
+	<-written
+
+	sinks := make([]*bufferSink, len(snaps))
+	for i, snap := range snaps {
+		sinks[i] = &bufferSink{}
+		go func(snap raft.FSMSnapshot, sink *bufferSink) {
+			defer snap.Release()
+			errs <- snap.Persist(sink)
+		}(snap, sinks[i])
+	}
+	for i := 0; i < cap(errs); i++ {
+		require.NoError(t, <-errs)
+	}
+
+	// every snapshot has exactly the writes applied before it was taken.
+	for _, sink := range sinks {
+		values, versions := readSnapshot(t, &sink.Buffer)
+		require.Len(t, values, 100)
+		require.Equal(t, values, versions)
+		for i := 0; i < 100; i++ {
+			require.True(t, values[strconv.Itoa(i)])
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.IdempotencyKeys = 2
+	})
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	opts := SetOptions{IdempotencyKey: "write-1"}
+	version, err := store.SetWithOptions(context.Background(), "key", []byte("value1"), opts)
+	require.NoError(t, err)
+
+	// the retried write returns the earlier result without applying it again.
+	retried, err := store.SetWithOptions(context.Background(), "key", []byte("value2"), opts)
+	require.NoError(t, err)
+	require.Equal(t, version, retried)
+
+	val, v, err := store.GetVersioned("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value1"), val)
+	require.Equal(t, version, v)
+
+	// the idempotency key of a rejected write also returns the same rejection.
+	conflict := SetOptions{ExpectedVersion: version + 100, IdempotencyKey: "write-2"}
+	_, err = store.SetWithOptions(context.Background(), "key", []byte("value3"), conflict)
+	require.Equal(t, ErrVersionConflict, err)
+	_, err = store.SetWithOptions(context.Background(), "key", []byte("value3"), conflict)
+	require.Equal(t, ErrVersionConflict, err)
+
+	// the oldest keys are forgotten once more keys are remembered.
+	_, err = store.SetWithOptions(context.Background(), "other", []byte("value"), SetOptions{IdempotencyKey: "write-3"})
+	require.NoError(t, err)
+	newVersion, err := store.SetWithOptions(context.Background(), "key", []byte("value4"), opts)
+	require.NoError(t, err)
+	require.Greater(t, newVersion, version)
+}
+
+func TestSnapshotKeepsIdempotencyKeys(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	_, err = store.SetWithOptions(context.Background(), "key", []byte("value"), SetOptions{IdempotencyKey: "write-1"})
+	require.NoError(t, err)
+	_, err = store.SetWithOptions(context.Background(), "key", []byte("value"), SetOptions{
+		ExpectedVersion: 1000,
+		IdempotencyKey:  "write-2",
+	})
+	require.Equal(t, ErrVersionConflict, err)
+
+	snap, err := store.Snapshot()
+	require.NoError(t, err)
+	sink := &bufferSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+
+	port, _ = getFreePort()
+	restored, err := newTestStore(t, port, 2, false)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+
+	want := store.idempotency.entries()
+	require.Equal(t, want, restored.idempotency.entries())
+}
+
+func TestSnapshotKeepsIdempotencyErrors(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	// the idempotency cache is only used from Apply, so the results are added
+	// directly to cover errors that writes rarely fail with. Errors that aren't
+	// returned by Apply alike on every node only keep their message.
+	unknown := errors.New("cache is full")
+	for i, err := range append(idempotencyErrors, unknown) {
+		store.idempotency.add(fmt.Sprintf("write-%d", i), applyResult{err: err})
+	}
+
+	snap, err := store.Snapshot()
+	require.NoError(t, err)
+	sink := &bufferSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+
+	port, _ = getFreePort()
+	restored, err := newTestStore(t, port, 2, false)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+
+	for i, known := range idempotencyErrors {
+		res, ok := restored.idempotency.get(fmt.Sprintf("write-%d", i))
+		require.True(t, ok)
+		require.ErrorIs(t, res.err, known)
+	}
+
+	res, ok := restored.idempotency.get(fmt.Sprintf("write-%d", len(idempotencyErrors)))
+	require.True(t, ok)
+	require.EqualError(t, res.err, unknown.Error())
+}
+
+func TestRecoverFromCorruption(t *testing.T) {
+	datadir, err := os.MkdirTemp("", "store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(datadir)
+
+	persist := func(recover bool) func(*Config) {
+		return func(c *Config) {
+			c.DataDir = datadir
+			c.PersistLog = true
+			c.RecoverFromCorruption = recover
+		}
+	}
+
+	port, _ := getFreePort()
+	store, err := newTestStoreWithConf(t, port, 1, true, persist(false))
+	require.NoError(t, err)
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+	require.NoError(t, store.Set("key", []byte("value")))
+	require.NoError(t, store.Close())
+
+	// write garbage at the end of the log store.
+	path := filepath.Join(datadir, "raft", logStoreFile)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0xff, 0xff})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// a failed New doesn't close the listener, so use another port.
+	port, _ = getFreePort()
+	_, err = newTestStoreWithConf(t, port, 1, true, persist(false))
+	require.ErrorIs(t, err, ErrCorruptLogStore)
+
+	port, _ = getFreePort()
+	store, err = newTestStoreWithConf(t, port, 1, true, persist(true))
+	require.NoError(t, err)
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+	require.NoError(t, store.Set("key2", []byte("value2")))
+
+	val, err := store.Get("key2")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value2"), val)
+
+	moved, err := filepath.Glob(path + ".corrupt-*")
+	require.NoError(t, err)
+	require.Len(t, moved, 1)
+}
+
+// forwardTarget serves the writes forwarded to the leader store.
+type forwardTarget struct {
+	pb.UnimplementedCacheServer
+	store *Store
+}
+
+func (f *forwardTarget) Set(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse, error) {
+	version, err := f.store.SetWithOptions(ctx, req.Key, req.Value, SetOptions{
+		ExpectedVersion: req.ExpectedVersion,
+		IdempotencyKey:  req.IdempotencyKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pb.SetResponse{Version: version}, nil
+}
+
+// newForwardLeader starts a leader store that serves raft and gRPC on the same port
+// like the service does. The forwarded writes are handled by target.
+func newForwardLeader(t *testing.T, target *forwardTarget) (*Store, *grpc.Server) {
+	srv := grpc.NewServer()
+	pb.RegisterCacheServer(srv, target)
+	t.Cleanup(srv.Stop)
+
+	leaderPort, _ := getFreePort()
+	leader, err := newTestStoreWithConf(t, leaderPort, 0, true, func(c *Config) {
+		clusterTimeouts(c)
+		require.NoError(t, c.Transport.ln.Close())
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", leaderPort))
+		require.NoError(t, err)
+
+		mux := cmux.New(ln)
+		c.Transport = &Transport{ln: mux.Match(MatchRaft)}
+
+		go srv.Serve(mux.Match(cmux.Any()))
+		go mux.Serve()
+	})
+	require.NoError(t, err)
+	target.store = leader
+	_, err = leader.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+	return leader, srv
+}
+
+func TestForwardWritesReusesConnection(t *testing.T) {
+	target := &forwardTarget{}
+	leader, _ := newForwardLeader(t, target)
+
+	var dials atomic.Int32
+	followerPort, _ := getFreePort()
+	follower, err := newTestStoreWithConf(t, followerPort, 1, false, func(c *Config) {
+		clusterTimeouts(c)
+		c.ForwardWrites = true
+		c.LeaderDialOptions = []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+				dials.Add(1)
+				var d net.Dialer
+				return d.DialContext(ctx, "tcp", addr)
+			}),
+		}
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, leader.Join("1", follower.conf.Transport.Addr().String()))
+	_, err = follower.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key%d", i)
+		require.NoError(t, follower.Set(key, []byte("value")))
+
+		val, err := leader.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), val)
+	}
+	require.Equal(t, int32(1), dials.Load())
+}
+
+func TestForwardWritesCallOptions(t *testing.T) {
+	target := &forwardTarget{}
+	leader, _ := newForwardLeader(t, target)
+
+	followerPort, _ := getFreePort()
+	follower, err := newTestStoreWithConf(t, followerPort, 1, false, func(c *Config) {
+		clusterTimeouts(c)
+		c.ForwardWrites = true
+		// a compressor that isn't registered makes every call fail, which shows
+		// that the call options are used.
+		c.LeaderCallOptions = []grpc.CallOption{grpc.UseCompressor("unregistered")}
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, leader.Join("1", follower.conf.Transport.Addr().String()))
+	_, err = follower.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	err = follower.Set("key", []byte("value"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unregistered")
+}
+
+func TestForwardWritesResetsUnavailableLeader(t *testing.T) {
+	target := &forwardTarget{}
+	leader, srv := newForwardLeader(t, target)
+
+	followerPort, _ := getFreePort()
+	follower, err := newTestStoreWithConf(t, followerPort, 1, false, func(c *Config) {
+		clusterTimeouts(c)
+		c.ForwardWrites = true
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, leader.Join("1", follower.conf.Transport.Addr().String()))
+	_, err = follower.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, follower.Set("key", []byte("value")))
+	require.NotNil(t, follower.leaderConn)
+
+	// the leader is still the raft leader, but no longer answers gRPC requests.
+	srv.Stop()
+	err = follower.Set("key", []byte("value"))
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Nil(t, follower.leaderConn)
+}
+
+func TestSnapshotKeyDelta(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.SnapshotKeyDelta = 100
+		c.SnapshotCheckInterval = 50 * time.Millisecond
+	})
+	require.NoError(t, err)
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), []byte("value")))
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	snapshots, err := store.snapshots.List()
+	require.NoError(t, err)
+	require.Empty(t, snapshots)
+
+	for i := 50; i < 150; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), []byte("value")))
+	}
+
+	require.Eventually(t, func() bool {
+		snapshots, err := store.snapshots.List()
+		return err == nil && len(snapshots) == 1
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestSnapshotKeyDeltaNothingNew(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	store.snapshotIfGrown(0)
+	snapshots, err := store.snapshots.List()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+
+	// keys added without log entries leave raft nothing new to snapshot.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, store.cache.Set(fmt.Sprintf("key%d", i), []byte("value")))
+	}
+	store.snapshotIfGrown(5)
+	require.Equal(t, int64(10), store.snapshotKeys.Load())
+}
+
+func TestLeaderSnapshotInterval(t *testing.T) {
+	stores := make([]*Store, 2)
+	for i := range stores {
+		port, _ := getFreePort()
+		var err error
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, func(c *Config) {
+			clusterTimeouts(c)
+			c.SnapshotInterval = 100 * time.Millisecond
+		})
+		require.NoError(t, err)
+
+		if i == 0 {
+			_, err = stores[0].WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+			continue
+		}
+		require.NoError(t, stores[0].Join(
+			string(stores[i].conf.LocalID),
+			stores[i].conf.Transport.Addr().String(),
+		))
+	}
+
+	require.NoError(t, stores[0].Set("key", []byte("value")))
+	require.Eventually(t, func() bool {
+		_, err := stores[1].Get("key")
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		snapshots, err := stores[0].snapshots.List()
+		return err == nil && len(snapshots) > 0
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// the follower has the same entries, but shouldn't snapshot them.
+	time.Sleep(300 * time.Millisecond)
+	snapshots, err := stores[1].snapshots.List()
+	require.NoError(t, err)
+	require.Empty(t, snapshots)
+}
+
+func TestMaxVoters(t *testing.T) {
+	var err error
+	stores := make([]*Store, 4)
+	for i := range stores {
+		port, _ := getFreePort()
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, func(c *Config) {
+			clusterTimeouts(c)
+			c.MaxVoters = 2
+		})
+		require.NoError(t, err)
+	}
+
+	_, err = stores[0].WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	for _, s := range stores[1:] {
+		require.NoError(t, stores[0].Join(string(s.conf.LocalID), s.conf.Transport.Addr().String()))
+	}
+
+	servers, err := stores[0].GetServers()
+	require.NoError(t, err)
+	require.Len(t, servers, 4)
+
+	suffrage := make(map[string]string)
+	for _, srv := range servers {
+		suffrage[srv.Id] = srv.VoteStatus
+	}
+	require.Equal(t, raft.Voter.String(), suffrage["0"])
+	require.Equal(t, raft.Voter.String(), suffrage["1"])
+	require.Equal(t, raft.Nonvoter.String(), suffrage["2"])
+	require.Equal(t, raft.Nonvoter.String(), suffrage["3"])
+
+	require.NoError(t, stores[0].PromoteToVoter("2"))
+}
+
+func TestLogEntry(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, store.Set(fmt.Sprintf("key%d", i), []byte("value")))
+	}
+
+	// the version of a key is the index of the entry that wrote it.
+	_, index, err := store.GetVersioned("key2")
+	require.NoError(t, err)
+
+	l, err := store.LogEntry(index)
+	require.NoError(t, err)
+	require.Equal(t, index, l.Index)
+	require.Equal(t, raft.LogCommand, l.Type)
+
+	op, key, value, err := DecodeLogEntry(l.Data)
+	require.NoError(t, err)
+	require.Equal(t, "set", OperationName(op))
+	require.Equal(t, "key2", key)
+	require.Equal(t, []byte("value"), value)
+
+	last, err := store.logStore.LastIndex()
+	require.NoError(t, err)
+	_, err = store.LogEntry(last + 1)
+	require.ErrorIs(t, err, ErrLogIndexOutOfRange)
+	_, err = store.LogEntry(0)
+	require.ErrorIs(t, err, ErrLogIndexOutOfRange)
+}
+
+func TestHotKeys(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.TrackHotKeys = true
+	})
+	require.NoError(t, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	reads := map[string]int{"hot": 2000, "warm": 500}
+	for i := 0; i < 50; i++ {
+		reads[fmt.Sprintf("cold%d", i)] = 20
+	}
+	for key := range reads {
+		require.NoError(t, s.Set(key, []byte("value")))
+	}
+
+	// interleave the reads so the sampling sees every key throughout.
+	for remaining := true; remaining; {
+		remaining = false
+		for key, n := range reads {
+			if n == 0 {
+				continue
+			}
+			_, err := s.Get(key)
+			require.NoError(t, err)
+			reads[key] = n - 1
+			remaining = true
+		}
+	}
+
+	keys, err := s.HotKeys(2)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, "hot", keys[0].Key)
+	require.Equal(t, "warm", keys[1].Key)
+	require.Greater(t, keys[0].Reads, keys[1].Reads)
+}
+
+func TestHotKeysDisabled(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+
+	_, err = s.HotKeys(10)
+	require.ErrorIs(t, err, ErrHotKeysDisabled)
+}
+
+func TestMaxInflightApplies(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.MaxInflightApplies = 1
+	})
+	require.NoError(t, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	// take the only slot as if a write was being applied.
+	s.applySem <- struct{}{}
+
+	start := time.Now()
+	err = s.Set("key", []byte("value"))
+	require.ErrorIs(t, err, ErrTooManyInflightApplies)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	<-s.applySem
+	require.NoError(t, s.Set("key", []byte("value")))
+	require.Empty(t, s.applySem)
+}
+
+// BenchmarkInflightApplies measures concurrent writes with a limited number of
+// in-flight applies. The rejected writes are reported per operation.
+func BenchmarkInflightApplies(b *testing.B) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(b, port, 1, true, func(c *Config) {
+		c.MaxInflightApplies = 64
+	})
+	require.NoError(b, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(b, err)
+
+	var rejected atomic.Int64
+	val := []byte("value")
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			err := s.Set(fmt.Sprintf("key%d", i), val)
+			if errors.Is(err, ErrTooManyInflightApplies) {
+				rejected.Add(1)
+			} else if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+	b.ReportMetric(float64(rejected.Load())/float64(b.N), "rejected/op")
+}
+
+func TestSetWithIndex(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	var last uint64
+	for i := 0; i < 10; i++ {
+		index, err := s.SetWithIndex(fmt.Sprintf("key%d", i), []byte("value"))
+		require.NoError(t, err)
+		require.Greater(t, index, last)
+		last = index
+	}
+	require.GreaterOrEqual(t, s.raft.AppliedIndex(), last)
+
+	// a versioned write is committed at the index of its version.
+	version, err := s.SetVersioned("key0", []byte("new"), 0)
+	require.NoError(t, err)
+	require.Greater(t, version, last)
+}
+
+func TestFastlogLevels(t *testing.T) {
+	for _, level := range []string{FastlogLow, FastlogMedium, FastlogHigh} {
+		t.Run(level, func(t *testing.T) {
+			port, _ := getFreePort()
+			s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+				c.DataDir = t.TempDir()
+				c.PersistLog = true
+				c.FastlogLevel = level
+			})
+			require.NoError(t, err)
+			defer s.Close()
+
+			_, err = s.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+
+			require.NoError(t, s.Set("key", []byte("value")))
+			val, err := s.Get("key")
+			require.NoError(t, err)
+			require.Equal(t, []byte("value"), val)
+		})
+	}
+
+	port, _ := getFreePort()
+	_, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.FastlogLevel = "extreme"
+	})
+	require.ErrorIs(t, err, ErrUnknownFastlogLevel)
+}
+
+func BenchmarkFastlogLevels(b *testing.B) {
+	for _, level := range []string{FastlogLow, FastlogMedium, FastlogHigh} {
+		b.Run(level, func(b *testing.B) {
+			port, _ := getFreePort()
+			s, err := newTestStoreWithConf(b, port, 1, true, func(c *Config) {
+				c.DataDir = b.TempDir()
+				c.PersistLog = true
+				c.FastlogLevel = level
+			})
+			require.NoError(b, err)
+			defer s.Close()
+
+			_, err = s.WaitForLeader(3 * time.Second)
+			require.NoError(b, err)
+
+			val := []byte("value")
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if err := s.Set(fmt.Sprintf("key%d", i), val); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.KeyTransform = func(key string) (string, error) {
+			if strings.ContainsAny(key, " \t") {
+				return "", errors.New("keys cannot contain whitespace")
+			}
+			return strings.ToLower(key), nil
+		}
+		c.ValueTransform = func(value []byte) ([]byte, error) {
+			if len(value) == 0 {
+				return nil, errors.New("empty value")
+			}
+			return value, nil
+		}
+	})
+	require.NoError(t, err)
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	// invalid keys and values are rejected before they are applied.
+	require.ErrorIs(t, s.Set("bad key", []byte("value")), ErrInvalidKey)
+	require.ErrorIs(t, s.Set("key", nil), ErrInvalidValue)
+	_, err = s.Get("bad key")
+	require.ErrorIs(t, err, ErrInvalidKey)
+	require.ErrorIs(t, s.Delete("bad key"), ErrInvalidKey)
+
+	lastIndex := s.raft.LastIndex()
+	_, err = s.SetWithIndex("other key", []byte("value"))
+	require.ErrorIs(t, err, ErrInvalidKey)
+	require.Equal(t, lastIndex, s.raft.LastIndex())
+
+	// keys are normalized for both reads and writes.
+	require.NoError(t, s.Set("Users/Alice", []byte("value")))
+	val, err := s.Get("users/alice")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+
+	val, err = s.Get("USERS/ALICE")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+
+	require.NoError(t, s.Delete("USERS/alice"))
+	_, err = s.Get("users/alice")
+	require.ErrorIs(t, err, bigcache.ErrEntryNotFound)
+}
+
+func TestKeyTransformPrefix(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.TTLSweepInterval = 20 * time.Millisecond
+		c.KeyTransform = func(key string) (string, error) {
+			return "app/" + key, nil
+		}
+	})
+	require.NoError(t, err)
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	// the namespace isn't transformed, so the keys can be scanned and flushed.
+	require.NoError(t, s.SetNS("ns", "key", []byte("value")))
+	val, err := s.GetNS("ns", "key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), val)
+
+	keys, err := s.ScanNS("ns")
+	require.NoError(t, err)
+	require.Equal(t, []string{"app/key"}, keys)
+
+	require.NoError(t, s.FlushNS("ns"))
+	_, err = s.GetNS("ns", "key")
+	require.ErrorIs(t, err, bigcache.ErrEntryNotFound)
+
+	// the sweeper deletes the stored key without transforming it again.
+	require.NoError(t, s.SetTTL("ttl", []byte("value"), 50*time.Millisecond))
+	require.Eventually(t, func() bool {
+		_, err := s.cache.Get("app/ttl")
+		return errors.Is(err, bigcache.ErrEntryNotFound)
+	}, 3*time.Second, 20*time.Millisecond)
+}
+
+func TestRecoverCluster(t *testing.T) {
+	datadirs := make([]string, 3)
+	stores := make([]*Store, 3)
+	for i := range stores {
+		var err error
+		datadirs[i], err = os.MkdirTemp("", "store-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(datadirs[i])
+
+		port, _ := getFreePort()
+		stores[i], err = newTestStoreWithConf(t, port, i, i == 0, func(c *Config) {
+			clusterTimeouts(c)
+			c.DataDir = datadirs[i]
+			c.PersistLog = true
+		})
+		require.NoError(t, err)
+
+		if i != 0 {
+			err = stores[0].Join(
+				string(stores[i].conf.LocalID),
+				stores[i].conf.Transport.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			_, err = stores[i].WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, stores[0].Set(fmt.Sprintf("key%d", i), []byte("value")))
+	}
+	_, err := stores[0].ForceSnapshot()
+	require.NoError(t, err)
+	require.NoError(t, stores[0].Set("after-snapshot", []byte("value")))
+
+	// the other nodes are lost for good, so the cluster has no quorum.
+	for _, s := range stores {
+		require.NoError(t, s.Close())
+	}
+
+	port, _ := getFreePort()
+	conf := Config{
+		DataDir:    datadirs[0],
+		LocalID:    "0",
+		PersistLog: true,
+		Logger:     zap.NewNop(),
+	}
+	err = RecoverCluster(conf, raft.Configuration{
+		Servers: []raft.Server{{
+			ID:      "0",
+			Address: raft.ServerAddress(fmt.Sprintf("localhost:%d", port)),
+		}},
+	})
+	require.NoError(t, err)
+
+	recovered, err := newTestStoreWithConf(t, port, 0, false, func(c *Config) {
+		clusterTimeouts(c)
+		c.DataDir = datadirs[0]
+		c.PersistLog = true
+	})
+	require.NoError(t, err)
+	_, err = recovered.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	servers, err := recovered.GetServers()
+	require.NoError(t, err)
+	require.Len(t, servers, 1)
+
+	// both the snapshot and the log after it are recovered.
+	for _, key := range []string{"key0", "key9", "after-snapshot"} {
+		val, err := recovered.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("value"), val)
+	}
+	require.NoError(t, recovered.Set("new", []byte("value")))
+}
+
+func TestApplyBatching(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.ApplyBatchWindow = 20 * time.Millisecond
+	})
+	require.NoError(t, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	const writes = 50
+	before := s.raft.LastIndex()
+
+	var wg sync.WaitGroup
+	for i := 0; i < writes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, s.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i))))
+		}(i)
+	}
+	wg.Wait()
+
+	// the concurrent writes are applied in fewer log entries than there are writes.
+	require.Less(t, s.raft.LastIndex()-before, uint64(writes))
+
+	for i := 0; i < writes; i++ {
+		val, version, err := s.GetVersioned(fmt.Sprintf("key%d", i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("value%d", i)), val)
+		require.Greater(t, version, before)
+	}
+}
+
+func TestApplyBatchingVersionedSets(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.ApplyBatchWindow = 20 * time.Millisecond
+	})
+	require.NoError(t, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	const writes = 50
+	before := s.raft.LastIndex()
+
+	versions := make([]uint64, writes)
+	var wg sync.WaitGroup
+	for i := 0; i < writes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			version, err := s.SetWithOptions(context.Background(), fmt.Sprintf("key%d", i),
+				[]byte("value"), SetOptions{})
+			require.NoError(t, err)
+			versions[i] = version
+		}(i)
+	}
+	wg.Wait()
+
+	// unconditional writes are batched like Set and get the index of their batch.
+	require.Less(t, s.raft.LastIndex()-before, uint64(writes))
+	for i := 0; i < writes; i++ {
+		_, version, err := s.GetVersioned(fmt.Sprintf("key%d", i))
+		require.NoError(t, err)
+		require.Equal(t, versions[i], version)
+		require.Greater(t, version, before)
+	}
+
+	// conditional writes still check the version of the batched write.
+	_, err = s.SetVersioned("key0", []byte("new"), versions[0]+1)
+	require.ErrorIs(t, err, ErrVersionConflict)
+	version, err := s.SetVersioned("key0", []byte("new"), versions[0])
+	require.NoError(t, err)
+	require.Greater(t, version, versions[0])
+}
+
+func TestApplyBatchingDuplicateKeys(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.ApplyBatchWindow = 50 * time.Millisecond
+	})
+	require.NoError(t, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	values := []string{"first", "second"}
+	versions := make([]uint64, len(values))
+	var wg sync.WaitGroup
+	for i, value := range values {
+		wg.Add(1)
+		go func(i int, value string) {
+			defer wg.Done()
+			version, err := s.SetWithOptions(context.Background(), "key", []byte(value), SetOptions{})
+			require.NoError(t, err)
+			versions[i] = version
+		}(i, value)
+	}
+	wg.Wait()
+
+	// the writes of the same key are applied in different batches, so the version
+	// of the key belongs to exactly one of them.
+	require.NotEqual(t, versions[0], versions[1])
+	val, version, err := s.GetVersioned("key")
+	require.NoError(t, err)
+	last := 0
+	if versions[1] > versions[0] {
+		last = 1
+	}
+	require.Equal(t, versions[last], version)
+	require.Equal(t, []byte(values[last]), val)
+}
+
+func TestApplyBatchingMaxBytes(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.ApplyBatchWindow = 50 * time.Millisecond
+	})
+	require.NoError(t, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	before := s.raft.LastIndex()
+	value := make([]byte, maxBatchBytes/2+1)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, s.Set(fmt.Sprintf("key%d", i), value))
+		}(i)
+	}
+	wg.Wait()
+
+	// the two values don't fit into one batch.
+	require.Equal(t, uint64(2), s.raft.LastIndex()-before)
+}
+
+// BenchmarkApplyBatching compares the throughput of concurrent writes with and
+// without batching. Batching only pays off with many concurrent writers, since a
+// batch cannot be larger than the number of writes waiting for it.
+func BenchmarkApplyBatching(b *testing.B) {
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		b.Run(fmt.Sprintf("window=%s", window), func(b *testing.B) {
+			port, _ := getFreePort()
+			s, err := newTestStoreWithConf(b, port, 1, true, func(c *Config) {
+				c.DataDir = b.TempDir()
+				c.PersistLog = true
+				c.ApplyBatchWindow = window
+			})
+			require.NoError(b, err)
+
+			_, err = s.WaitForLeader(3 * time.Second)
+			require.NoError(b, err)
+
+			val := []byte("value")
+			b.SetParallelism(256)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if err := s.Set(fmt.Sprintf("key%d", i), val); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// chunkReader returns the chunks one at a time and then io.EOF.
+func chunkReader(chunks ...[]byte) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if len(chunks) == 0 {
+			return nil, io.EOF
+		}
+		chunk := chunks[0]
+		chunks = chunks[1:]
+		return chunk, nil
+	}
+}
+
+func TestSetChunked(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	before := s.raft.LastIndex()
+	err = s.SetChunked("key", chunkReader([]byte("chunk1"), []byte("chunk2"), []byte("chunk3")))
+	require.NoError(t, err)
+
+	// every chunk and the commit is its own log entry.
+	require.Equal(t, before+4, s.raft.LastIndex())
+
+	val, version, err := s.GetVersioned("key")
+	require.NoError(t, err)
+	require.Equal(t, []byte("chunk1chunk2chunk3"), val)
+	require.Equal(t, s.raft.LastIndex(), version)
+	require.Empty(t, s.uploads)
+
+	// a failed upload is dropped without setting the key.
+	errRead := errors.New("read failed")
+	next := chunkReader([]byte("chunk1"))
+	err = s.SetChunked("failed", func() ([]byte, error) {
+		chunk, err := next()
+		if err == io.EOF {
+			return nil, errRead
+		}
+		return chunk, err
+	})
+	require.ErrorIs(t, err, errRead)
+
+	_, err = s.Get("failed")
+	require.ErrorIs(t, err, bigcache.ErrEntryNotFound)
+	require.Empty(t, s.uploads)
+
+	// an upload without chunks sets an empty value.
+	require.NoError(t, s.SetChunked("empty", chunkReader()))
+	val, err = s.Get("empty")
+	require.NoError(t, err)
+	require.Empty(t, val)
+}
+
+func TestSetChunkedValueTransform(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.ValueTransform = func(value []byte) ([]byte, error) { return value, nil }
+	})
+	require.NoError(t, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	err = s.SetChunked("key", chunkReader([]byte("value")))
+	require.ErrorIs(t, err, ErrChunkedTransform)
+}
+
+func TestSetChunkedMaxUploadSize(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStoreWithConf(t, port, 1, true, func(c *Config) {
+		c.MaxUploadSize = 10
+	})
+	require.NoError(t, err)
+
+	_, err = s.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetChunked("fits", chunkReader([]byte("chunk"), []byte("chunk"))))
+
+	// the chunk going over the limit is never applied.
+	before := s.raft.LastIndex()
+	err = s.SetChunked("large", chunkReader([]byte("chunk"), []byte("chunk"), []byte("c")))
+	require.ErrorIs(t, err, ErrUploadTooLarge)
+	require.Equal(t, before+3, s.raft.LastIndex(), "two chunks and the abort")
+
+	_, err = s.Get("large")
+	require.ErrorIs(t, err, bigcache.ErrEntryNotFound)
+	require.Empty(t, s.uploads)
+}
+
+func TestDropAbandonedUploads(t *testing.T) {
+	port, _ := getFreePort()
+	s, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+
+	start := time.Now()
+	later := start.Add(uploadTimeout + time.Second)
+	for name, finish := range map[string]func(){
+		"commit": func() { applyAt(s, 3, later, CommitChunksOperation, "other", []byte("key")) },
+		"abort":  func() { applyAt(s, 3, later, AbortChunksOperation, "other", nil) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			applyAt(s, 1, start, ChunkOperation, "abandoned", []byte("chunk"))
+			s.uploads["other"] = &upload{data: []byte("chunk"), updated: later}
+
+			// the abandoned upload is dropped by the entries finishing other
+			// uploads, not only by new chunks.
+			finish()
+			require.Empty(t, s.uploads)
+		})
+	}
+}
+
+func TestSnapshotKeepsUploads(t *testing.T) {
+	port, _ := getFreePort()
+	store, err := newTestStore(t, port, 1, true)
+	require.NoError(t, err)
+
+	_, err = store.WaitForLeader(3 * time.Second)
+	require.NoError(t, err)
+
+	// the upload waits for release after its first chunk has been applied.
+	applied, release := make(chan struct{}), make(chan struct{})
+	next := chunkReader([]byte("chunk1"))
+	done := make(chan error, 1)
+	go func() {
+		done <- store.SetChunked("key", func() ([]byte, error) {
+			chunk, err := next()
+			if err == io.EOF {
+				close(applied)
+				<-release
+			}
+			return chunk, err
+		})
+	}()
+	<-applied
+
+	snap, err := store.Snapshot()
+	require.NoError(t, err)
+	sink := &bufferSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+
+	close(release)
+	require.NoError(t, <-done)
+
+	port, _ = getFreePort()
+	restored, err := newTestStore(t, port, 2, false)
+	require.NoError(t, err)
+	require.NoError(t, restored.Restore(io.NopCloser(&sink.Buffer)))
+
+	// the restored node can finish the upload once the commit is applied.
+	require.Len(t, restored.uploads, 1)
+	for _, u := range restored.uploads {
+		require.Equal(t, []byte("chunk1"), u.data)
+	}
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer used for the spans of the store.
+const tracerName = "github.com/nireo/dcache/store"
+
+// operationNames are the names of the operations used in the apply spans and
+// OperationName.
+var operationNames = map[byte]string{
+	SetOperation:          "set",
+	GetOperation:          "get",
+	FlushOperation:        "flush",
+	GetOrSetOperation:     "get_or_set",
+	DeleteOperation:       "delete",
+	SetTTLOperation:       "set_ttl",
+	SetVersionedOperation: "set_versioned",
+	TouchOperation:        "touch",
+	BatchOperation:        "batch",
+	ChunkOperation:        "chunk",
+	CommitChunksOperation: "commit_chunks",
+	AbortChunksOperation:  "abort_chunks",
+	ExpireOperation:       "expire",
+}
+
+// startApplySpan starts a span around applying an operation through raft. The span
+// is a child of the span in ctx, if there's one.
+func (s *Store) startApplySpan(ctx context.Context, ty byte, key string) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, "store.Apply",
+		trace.WithAttributes(
+			attribute.String("dcache.key", key),
+			attribute.String("dcache.operation", operationNames[ty]),
+		),
+	)
+}
+
+// endSpan records err in span if it's set and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,36 @@
+package store
+
+import "fmt"
+
+// transformKey applies Config.KeyTransform to key. Keys rejected by the transform
+// are returned as ErrInvalidKey.
+func (s *Store) transformKey(key string) (string, error) {
+	if s.conf.KeyTransform == nil {
+		return key, nil
+	}
+
+	k, err := s.conf.KeyTransform(key)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	return k, nil
+}
+
+// transformEntry applies Config.KeyTransform and Config.ValueTransform to a
+// written key-value pair, so invalid writes are rejected before they reach the log.
+func (s *Store) transformEntry(key string, value []byte) (string, []byte, error) {
+	k, err := s.transformKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if s.conf.ValueTransform == nil {
+		return k, value, nil
+	}
+
+	v, err := s.conf.ValueTransform(value)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidValue, err)
+	}
+	return k, v, nil
+}
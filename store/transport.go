@@ -3,17 +3,40 @@ package store
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"time"
 
 	"github.com/hashicorp/raft"
 )
 
+// RaftStreamByte is written as the first byte of every Raft connection. Raft shares
+// the port with the client protocols, so the connection multiplexer uses this byte
+// to route Raft connections. gRPC (HTTP/2) and HTTP/1 connections start with an
+// ASCII letter, so they never collide with this byte.
+const RaftStreamByte byte = 1
+
+// acceptReadTimeout is how long Accept waits for the first byte of a connection.
+// Raft accepts connections one at a time, so a connection that never sends
+// anything would otherwise block every connection after it.
+const acceptReadTimeout = time.Second
+
+// MatchRaft reports whether a connection is a Raft connection by checking that it
+// starts with RaftStreamByte. It can be used as a cmux.Matcher.
+func MatchRaft(r io.Reader) bool {
+	b := make([]byte, 1)
+	if _, err := r.Read(b); err != nil {
+		return false
+	}
+	return b[0] == RaftStreamByte
+}
+
 // Transport handles communications between different raft nodes.
 type Transport struct {
 	ln        net.Listener
 	servertls *tls.Config
 	peertls   *tls.Config
+	advertise net.Addr
 }
 
 // NewTransport creates a new transport instance.
@@ -32,8 +55,8 @@ func NewTLSTransport(ln net.Listener, servertls *tls.Config, peertls *tls.Config
 	}
 }
 
-// Dial creates a connection to a given address. This function appends the RaftRPC identifier
-// (1) to the request's beginning such that raft requests can be properly identified.
+// Dial creates a connection to a given address. This function appends RaftStreamByte to
+// the request's beginning such that raft requests can be properly identified.
 func (tn *Transport) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
 	dialer := &net.Dialer{Timeout: timeout}
 
@@ -42,7 +65,8 @@ func (tn *Transport) Dial(addr raft.ServerAddress, timeout time.Duration) (net.C
 		return nil, err
 	}
 
-	if _, err = conn.Write([]byte{byte(1)}); err != nil {
+	if _, err = conn.Write([]byte{RaftStreamByte}); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
@@ -53,23 +77,35 @@ func (tn *Transport) Dial(addr raft.ServerAddress, timeout time.Duration) (net.C
 	return conn, nil
 }
 
-// Accept acceps a given dial and checks that the RaftRPC identifier is defined
-// at the start; if not then just return an error.
+// Accept acceps a given dial and checks that RaftStreamByte is defined at the start;
+// if not then the connection is closed and an error returned.
 func (tn *Transport) Accept() (net.Conn, error) {
 	conn, err := tn.ln.Accept()
 	if err != nil {
 		return nil, err
 	}
 
+	if err := conn.SetReadDeadline(time.Now().Add(acceptReadTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	b := make([]byte, 1)
 	if _, err = conn.Read(b); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	if b[0] != 1 {
+	if b[0] != RaftStreamByte {
+		conn.Close()
 		return nil, fmt.Errorf("not raft rpc connection")
 	}
 
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	if tn.servertls != nil {
 		return tls.Server(conn, tn.servertls), nil
 	}
@@ -82,7 +118,17 @@ func (tn *Transport) Close() error {
 	return tn.ln.Close()
 }
 
-// Addr returns a net.Addr representing the address Transport is listening on.
+// SetAdvertise sets the address advertised to other raft nodes. It's needed when
+// the listener's address isn't reachable by other nodes, for example behind NAT.
+func (tn *Transport) SetAdvertise(addr net.Addr) {
+	tn.advertise = addr
+}
+
+// Addr returns a net.Addr representing the address Transport is advertised on.
+// Unless an advertise address is set, it's the address Transport is listening on.
 func (tn *Transport) Addr() net.Addr {
+	if tn.advertise != nil {
+		return tn.advertise
+	}
 	return tn.ln.Addr()
 }
@@ -1,6 +1,117 @@
 package store_test
 
-import "testing"
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/nireo/dcache/store"
+	"github.com/soheilhy/cmux"
+	"github.com/stretchr/testify/require"
+)
 
 func TestTransport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	mux := cmux.New(l)
+	raftListener := mux.Match(store.MatchRaft)
+	otherListener := mux.Match(cmux.Any())
+	go mux.Serve()
+	defer mux.Close()
+
+	tn := store.NewTransport(raftListener)
+
+	// a raft dial should be routed to the raft listener.
+	go func() {
+		conn, err := tn.Dial(raft.ServerAddress(l.Addr().String()), time.Second)
+		if err == nil {
+			conn.Write([]byte("raft"))
+		}
+	}()
+
+	conn, err := tn.Accept()
+	require.NoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("raft"), b)
+	conn.Close()
+
+	// a connection starting with any other byte should end up in the other listener.
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			conn.Write([]byte("GET / HTTP/1.1\r\n"))
+		}
+	}()
+
+	conn, err = otherListener.Accept()
+	require.NoError(t, err)
+	b = make([]byte, 3)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("GET"), b)
+	conn.Close()
+}
+
+func TestTransportAcceptClosesBadConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tn := store.NewTransport(l)
+	defer tn.Close()
+
+	// a connection that never sends anything times out instead of blocking the
+	// connections after it.
+	idle, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+
+	_, err = tn.Accept()
+	require.Error(t, err)
+	require.NoError(t, idle.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = idle.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// a connection that isn't a raft connection is closed.
+	other, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer other.Close()
+	_, err = other.Write([]byte("GET / HTTP/1.1\r\n"))
+	require.NoError(t, err)
+
+	_, err = tn.Accept()
+	require.Error(t, err)
+	// the rest of the request wasn't read, so the close can reset the connection.
+	require.NoError(t, other.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = other.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// raft connections are still accepted, without the deadline.
+	go func() {
+		conn, err := tn.Dial(raft.ServerAddress(l.Addr().String()), time.Second)
+		if err == nil {
+			time.Sleep(1500 * time.Millisecond)
+			conn.Write([]byte("raft"))
+		}
+	}()
+
+	conn, err := tn.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("raft"), b)
+}
+
+func TestMatchRaft(t *testing.T) {
+	require.True(t, store.MatchRaft(bytes.NewReader([]byte{store.RaftStreamByte})))
+	require.False(t, store.MatchRaft(bytes.NewReader([]byte("PRI * HTTP/2.0"))))
+	require.False(t, store.MatchRaft(bytes.NewReader(nil)))
 }
@@ -0,0 +1,348 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+	"github.com/nireo/dcache/metrics"
+	"go.uber.org/zap"
+)
+
+// SetTTL applies a key-value pair that expires after ttl. The deadline is computed
+// on the leader and replicated in the log entry, so every node expires the key at
+// the same time. Expired keys are not returned by Get and are deleted from the
+// cluster by the leader's sweeper. Unlike Set, the write isn't forwarded to the
+// leader.
+func (s *Store) SetTTL(key string, value []byte, ttl time.Duration) error {
+	if !s.isLeader() {
+		return s.notLeaderErr()
+	}
+
+	key, value, err := s.transformEntry(key, value)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(ttl).UnixNano()
+	payload := make([]byte, 8+len(value))
+	binary.LittleEndian.PutUint64(payload, uint64(deadline))
+	copy(payload[8:], value)
+
+	res, err := s.createApplyReq(context.Background(), SetTTLOperation, key, payload)
+	if err != nil {
+		return err
+	}
+	return res.(applyResult).err
+}
+
+// GetTouch works like Get, but also refreshes the TTL of the key so that keys that
+// are read often don't expire. The refresh goes through raft in the background, so
+// it doesn't add latency to the read. Only the leader refreshes TTLs, on other
+// nodes GetTouch works like Get. To avoid a write for every read, the TTL is only
+// refreshed once less than half of it remains.
+func (s *Store) GetTouch(key string) ([]byte, error) {
+	key, err := s.transformKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.getWithResult(key, GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if s.isLeader() {
+		s.maybeTouch(key)
+	}
+	return res.Value, nil
+}
+
+// maybeTouch starts refreshing the TTL of key if less than half of it remains and
+// the key isn't already being refreshed.
+func (s *Store) maybeTouch(key string) {
+	s.expiryMu.Lock()
+	e, ok := s.expiries[key]
+	s.expiryMu.Unlock()
+	if !ok || e.ttl == 0 || time.Duration(e.deadline-time.Now().UnixNano()) > e.ttl/2 {
+		return
+	}
+
+	if _, loaded := s.touching.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+
+	go func() {
+		defer s.touching.Delete(key)
+
+		// the deadline that was seen is sent along, so the touch is dropped if the
+		// key is written again before it's applied.
+		var payload [16]byte
+		binary.LittleEndian.PutUint64(payload[:], uint64(e.deadline))
+		binary.LittleEndian.PutUint64(payload[8:], uint64(time.Now().Add(e.ttl).UnixNano()))
+
+		res, err := s.createApplyReq(context.Background(), TouchOperation, key, payload[:])
+		if err == nil {
+			err = res.(applyResult).err
+		}
+		if err != nil {
+			s.logger.Warn("failed to refresh ttl", zap.String("key", key), zap.Error(err))
+		}
+	}()
+}
+
+// Delete removes a key from the cluster. Unlike Set, the delete isn't forwarded to
+// the leader.
+func (s *Store) Delete(key string) error {
+	if !s.isLeader() {
+		return s.notLeaderErr()
+	}
+
+	key, err := s.transformKey(key)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.createApplyReq(context.Background(), DeleteOperation, key, nil)
+	if err != nil {
+		return err
+	}
+	return res.(applyResult).err
+}
+
+// expiry is the expiration of a key set with a TTL.
+type expiry struct {
+	// deadline is the time in unix nanoseconds after which the key has expired.
+	deadline int64
+
+	// ttl is the TTL the key was set with. It's zero if the entry was appended by
+	// a leader that didn't record the append time, in which case the TTL cannot be
+	// refreshed.
+	ttl time.Duration
+}
+
+// copyExpiries copies the expirations of the keys for a snapshot, so keys restored
+// from it still expire.
+func (s *Store) copyExpiries() map[string]expiry {
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	expiries := make(map[string]expiry, len(s.expiries))
+	for key, e := range s.expiries {
+		expiries[key] = e
+	}
+	return expiries
+}
+
+// encodeExpiry encodes the expiration of a key for snapshots.
+func encodeExpiry(e expiry) []byte {
+	// VALUE: (DEADLINE int64 8bytes) + (TTL int64 8bytes)
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint64(buf, uint64(e.deadline))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(e.ttl))
+	return buf
+}
+
+// decodeExpiry decodes an expiration encoded by encodeExpiry.
+func decodeExpiry(buf []byte) (expiry, error) {
+	if len(buf) != 16 {
+		return expiry{}, ErrMalformedEntry
+	}
+	return expiry{
+		deadline: int64(binary.LittleEndian.Uint64(buf)),
+		ttl:      time.Duration(binary.LittleEndian.Uint64(buf[8:])),
+	}, nil
+}
+
+// applySetTTL stores the value of a SetTTLOperation and records its deadline. The
+// TTL is derived from the time the leader appended the entry, so every node
+// refreshes the key by the same amount.
+func (s *Store) applySetTTL(
+	key string, payload []byte, index uint64, appendedAt time.Time,
+) applyResult {
+	if len(payload) < 8 {
+		return applyResult{err: ErrMalformedEntry}
+	}
+
+	deadline := int64(binary.LittleEndian.Uint64(payload))
+	if err := s.cache.Set(key, payload[8:]); err != nil {
+		return applyResult{err: err}
+	}
+
+	var ttl time.Duration
+	if !appendedAt.IsZero() && deadline > appendedAt.UnixNano() {
+		ttl = time.Duration(deadline - appendedAt.UnixNano())
+	}
+
+	s.expiryMu.Lock()
+	s.expiries[key] = expiry{deadline: deadline, ttl: ttl}
+	s.expiryMu.Unlock()
+	s.setVersion(key, index)
+	return applyResult{}
+}
+
+// applyTouch moves the deadline of key to the new deadline in payload, if the key
+// still has the deadline the touch was started with. A key that was overwritten or
+// set with another TTL after the touch was started is left as is, so a touch
+// computed from the old TTL doesn't replace the newer deadline.
+func (s *Store) applyTouch(key string, payload []byte) applyResult {
+	// PAYLOAD: (SEEN_DEADLINE int64 8bytes) + (NEW_DEADLINE int64 8bytes)
+	if len(payload) != 16 {
+		return applyResult{err: ErrMalformedEntry}
+	}
+	seen := int64(binary.LittleEndian.Uint64(payload))
+
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	if e, ok := s.expiries[key]; ok && e.deadline == seen {
+		e.deadline = int64(binary.LittleEndian.Uint64(payload[8:]))
+		s.expiries[key] = e
+	}
+	return applyResult{}
+}
+
+// applyExpire deletes key if its deadline is the one in payload and it has passed
+// by the time the leader appended the entry. A key that was overwritten or
+// refreshed after the sweeper saw it is kept. The result is true if the key was
+// deleted.
+func (s *Store) applyExpire(key string, payload []byte, appendedAt time.Time) applyResult {
+	if len(payload) != 8 {
+		return applyResult{err: ErrMalformedEntry}
+	}
+
+	deadline := int64(binary.LittleEndian.Uint64(payload))
+	now := applyTime(appendedAt)
+
+	s.expiryMu.Lock()
+	e, ok := s.expiries[key]
+	s.expiryMu.Unlock()
+	if !ok || e.deadline != deadline || now.UnixNano() < deadline {
+		return applyResult{res: false}
+	}
+
+	res := s.applyDelete(key)
+	if res.err != nil {
+		return res
+	}
+	return applyResult{res: true}
+}
+
+// applyDelete removes key from the local cache. Deleting a missing key is not an
+// error, since it might have been evicted on this node.
+func (s *Store) applyDelete(key string) applyResult {
+	s.clearExpiry(key)
+	s.clearVersion(key)
+	if err := s.cache.Delete(key); err != nil && err != bigcache.ErrEntryNotFound {
+		return applyResult{err: err}
+	}
+	return applyResult{}
+}
+
+// clearExpiry removes the deadline of key, for example when it's overwritten
+// without a TTL.
+func (s *Store) clearExpiry(key string) {
+	s.expiryMu.Lock()
+	delete(s.expiries, key)
+	s.expiryMu.Unlock()
+}
+
+// expired checks whether key has a deadline that has passed. It reads the local
+// clock, so it's only used for client reads. Applying entries uses expiredAt with
+// the time of the entry instead.
+func (s *Store) expired(key string) bool {
+	return s.expiredAt(key, time.Now())
+}
+
+// expiredAt checks whether key has a deadline that has passed by now.
+func (s *Store) expiredAt(key string, now time.Time) bool {
+	s.expiryMu.Lock()
+	e, ok := s.expiries[key]
+	s.expiryMu.Unlock()
+	return ok && now.UnixNano() >= e.deadline
+}
+
+// applyTime returns the time an entry is applied at, which is the time the leader
+// appended it. Every node applies the entry at a different time, so deciding
+// expiry from the local clock could make the nodes diverge. Entries appended by
+// leaders that don't record the time fall back to the local clock.
+func applyTime(appendedAt time.Time) time.Time {
+	if appendedAt.IsZero() {
+		return time.Now()
+	}
+	return appendedAt
+}
+
+// expiredKeys returns every key whose deadline has passed, along with the deadline.
+func (s *Store) expiredKeys() map[string]int64 {
+	now := time.Now().UnixNano()
+
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	keys := make(map[string]int64)
+	for key, e := range s.expiries {
+		if now >= e.deadline {
+			keys[key] = e.deadline
+		}
+	}
+	return keys
+}
+
+// expire deletes key from the cluster if its deadline is still deadline. The key
+// isn't transformed, since it's already stored in its transformed form. Returns
+// true if the key was deleted.
+func (s *Store) expire(key string, deadline int64) (bool, error) {
+	var payload [8]byte
+	binary.LittleEndian.PutUint64(payload[:], uint64(deadline))
+
+	res, err := s.createApplyReq(context.Background(), ExpireOperation, key, payload[:])
+	if err != nil {
+		return false, err
+	}
+
+	r := res.(applyResult)
+	if r.err != nil {
+		return false, r.err
+	}
+	return r.res.(bool), nil
+}
+
+// runSweeper deletes expired keys every interval until the store is closed. Only
+// the leader sweeps, and the deletes are replicated so that the space is reclaimed
+// on every node.
+func (s *Store) runSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// sweep deletes expired keys if this node is the leader. Sweeping is skipped while
+// a snapshot is being persisted, since it iterates the cache. The keys are only
+// deleted if they haven't been written since they were found, so a write racing
+// with the sweep isn't lost.
+func (s *Store) sweep() {
+	if !s.isLeader() || s.activeSnapshots.Load() > 0 {
+		return
+	}
+
+	for key, deadline := range s.expiredKeys() {
+		deleted, err := s.expire(key, deadline)
+		if err != nil {
+			s.logger.Warn("failed to delete expired key", zap.String("key", key), zap.Error(err))
+			return
+		}
+		if deleted {
+			metrics.ExpiredKeys.Inc()
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+// versionedValue is the result of a GetOperation.
+type versionedValue struct {
+	value   []byte
+	version uint64
+}
+
+// SetOptions changes how a write is applied by SetWithOptions.
+type SetOptions struct {
+	// ExpectedVersion rejects the write with ErrVersionConflict unless the key
+	// still has this version. Zero writes the key unconditionally.
+	ExpectedVersion uint64
+
+	// IdempotencyKey identifies the write, so that a retried write isn't applied
+	// twice. If a write with the same idempotency key has been applied recently,
+	// the write is skipped and the result of the earlier write is returned.
+	IdempotencyKey string
+
+	// MinAcks is sent to the leader with a forwarded write, so the leader waits
+	// until this many followers have applied the write before answering. Writes
+	// applied locally ignore it, the caller waits for the acks itself.
+	MinAcks uint32
+}
+
+// GetOptions changes how a read is done by GetWithOptions.
+type GetOptions struct {
+	// Stale reads the value from the local cache, even if Config.StrongConsistency,
+	// Config.LinearizableReads or Config.BarrierReads is set. The read is fast but
+	// might not see the latest writes.
+	Stale bool
+
+	// Strong reads the value through the leader like Config.StrongConsistency does,
+	// even if the store is configured for eventually consistent reads. Ignored if
+	// Stale is set.
+	Strong bool
+}
+
+// GetResult is the result of a read done with GetWithResult.
+type GetResult struct {
+	Value   []byte
+	Version uint64
+
+	// Stale is set if the leader couldn't be reached and the value was read from
+	// the local cache because of Config.StaleOnLeaderFailure. The value might not
+	// include the latest writes.
+	Stale bool
+}
+
+// SetVersioned applies a key-value pair only if the current version of the key is
+// expected. The version is the index of the log entry that last wrote the key, so
+// it increases with every write. An expected version of zero writes the key
+// unconditionally. Returns the new version of the key, or ErrVersionConflict if the
+// key has been written since the expected version.
+func (s *Store) SetVersioned(key string, value []byte, expected uint64) (uint64, error) {
+	return s.SetWithOptions(context.Background(), key, value, SetOptions{ExpectedVersion: expected})
+}
+
+// SetWithOptions applies a key-value pair using the given options. Returns the new
+// version of the key. The write is traced as a child of the span in ctx.
+func (s *Store) SetWithOptions(
+	ctx context.Context, key string, value []byte, opts SetOptions,
+) (uint64, error) {
+	if !s.isLeader() {
+		if s.conf.ForwardWrites {
+			res, err := s.forwardSet(ctx, key, value, opts)
+			if err != nil {
+				return 0, err
+			}
+			return res.Version, nil
+		}
+		return 0, s.notLeaderErr()
+	}
+
+	key, value, err := s.transformEntry(key, value)
+	if err != nil {
+		return 0, err
+	}
+
+	// unconditional writes don't need the versioned operation, so they can be
+	// batched with the other writes.
+	if s.batcher != nil && opts.ExpectedVersion == 0 && opts.IdempotencyKey == "" {
+		return s.batcher.set(key, value)
+	}
+
+	// PAYLOAD: (EXPECTED_VERSION uint64 8bytes) + (IDEMPOTENCY_KEY_SIZE uint32
+	// 4bytes) + (IDEMPOTENCY_KEY) + (VALUE)
+	payload := make([]byte, 12+len(opts.IdempotencyKey)+len(value))
+	binary.LittleEndian.PutUint64(payload, opts.ExpectedVersion)
+	binary.LittleEndian.PutUint32(payload[8:], uint32(len(opts.IdempotencyKey)))
+	copy(payload[12:], opts.IdempotencyKey)
+	copy(payload[12+len(opts.IdempotencyKey):], value)
+
+	res, err := s.createApplyReq(ctx, SetVersionedOperation, key, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	r := res.(applyResult)
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.res.(uint64), nil
+}
+
+// applySetVersioned stores the value of a SetVersionedOperation if the version of
+// the key matches the expected version. Writes with an idempotency key that has
+// already been applied return the earlier result. Whether the key has expired is
+// decided at now, so every node accepts or rejects the write alike.
+func (s *Store) applySetVersioned(
+	key string, payload []byte, index uint64, now time.Time,
+) applyResult {
+	if len(payload) < 12 {
+		return applyResult{err: ErrMalformedEntry}
+	}
+
+	expected := binary.LittleEndian.Uint64(payload)
+	idemSize := uint64(binary.LittleEndian.Uint32(payload[8:]))
+	if uint64(len(payload)) < 12+idemSize {
+		return applyResult{err: ErrMalformedEntry}
+	}
+	idemKey := string(payload[12 : 12+idemSize])
+	value := payload[12+idemSize:]
+
+	if idemKey != "" {
+		if res, ok := s.idempotency.get(idemKey); ok {
+			return res
+		}
+	}
+
+	res := s.setIfVersion(key, value, expected, index, now)
+	if idemKey != "" {
+		s.idempotency.add(idemKey, res)
+	}
+	return res
+}
+
+// setIfVersion stores value if the key has the expected version at now.
+func (s *Store) setIfVersion(
+	key string, value []byte, expected, index uint64, now time.Time,
+) applyResult {
+	if expected != 0 && s.versionAt(key, now) != expected {
+		return applyResult{err: ErrVersionConflict}
+	}
+
+	s.clearExpiry(key)
+	if err := s.cache.Set(key, value); err != nil {
+		return applyResult{err: err}
+	}
+	s.setVersion(key, index)
+	return applyResult{res: index}
+}
+
+// getLocalVersioned reads key and its version from the local cache. Both are read
+// under applyMu, so the version always belongs to the returned value.
+func (s *Store) getLocalVersioned(key string) ([]byte, uint64, error) {
+	s.applyMu.RLock()
+	defer s.applyMu.RUnlock()
+	return s.getVersionedAt(key, time.Now())
+}
+
+// getVersionedAt works like getLocalVersioned, but keys expire relative to now
+// instead of the local clock. The caller must hold applyMu.
+func (s *Store) getVersionedAt(key string, now time.Time) ([]byte, uint64, error) {
+	val, err := s.getAt(key, now)
+	if err != nil {
+		return nil, 0, err
+	}
+	return val, s.storedVersion(key), nil
+}
+
+// versionAt returns the version of key at now. Missing and expired keys have
+// version zero. The value isn't read, so checking the version doesn't decrypt it
+// or change the eviction order.
+func (s *Store) versionAt(key string, now time.Time) uint64 {
+	if s.expiredAt(key, now) || !s.cache.Has(key) {
+		return 0
+	}
+	return s.storedVersion(key)
+}
+
+// storedVersion returns the recorded version of key without checking that the key
+// still exists.
+func (s *Store) storedVersion(key string) uint64 {
+	s.versionMu.Lock()
+	defer s.versionMu.Unlock()
+	return s.versions[key]
+}
+
+// setVersion records index as the version of key.
+func (s *Store) setVersion(key string, index uint64) {
+	s.versionMu.Lock()
+	s.versions[key] = index
+	s.versionMu.Unlock()
+}
+
+// clearVersion removes the version of key when the key is removed.
+func (s *Store) clearVersion(key string) {
+	s.versionMu.Lock()
+	delete(s.versions, key)
+	s.versionMu.Unlock()
+}
+
+// copyVersions returns a copy of the versions, so that a snapshot can persist them
+// while new entries are applied.
+func (s *Store) copyVersions() map[string]uint64 {
+	s.versionMu.Lock()
+	defer s.versionMu.Unlock()
+
+	versions := make(map[string]uint64, len(s.versions))
+	for key, v := range s.versions {
+		versions[key] = v
+	}
+	return versions
+}
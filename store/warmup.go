@@ -0,0 +1,88 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// WriteWarmupEntry writes a single key-value pair into w in the format expected by
+// Config.WarmupFile. The entries use the same framing as the raft log entries.
+func WriteWarmupEntry(w io.Writer, key string, value []byte) error {
+	_, err := w.Write(serializeEntry(SetOperation, key, value))
+	return err
+}
+
+// loadWarmupFile reads every entry in the file at path into the local cache. The
+// entries are not replicated, since every node loads its own warmup file. Returns
+// the number of entries loaded.
+func (s *Store) loadWarmupFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	count := 0
+	for {
+		key, value, err := ReadWarmupEntry(r)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+
+		if err := s.cache.Set(key, value); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// ReadWarmupEntry reads the next entry written by WriteWarmupEntry from r. io.EOF
+// is only returned if there are no more entries, an entry cut short returns
+// ErrMalformedEntry.
+func ReadWarmupEntry(r io.Reader) (string, []byte, error) {
+	flag, key, value, err := readEntry(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if flag != SetOperation {
+		return "", nil, ErrMalformedEntry
+	}
+	return key, value, nil
+}
+
+// readEntry reads the next entry written using serializeEntry from r. io.EOF is
+// only returned if there are no more entries.
+func readEntry(r io.Reader) (byte, string, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, "", nil, ErrMalformedEntry
+		}
+		return 0, "", nil, err
+	}
+
+	key := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return 0, "", nil, ErrMalformedEntry
+	}
+
+	var valSize [4]byte
+	if _, err := io.ReadFull(r, valSize[:]); err != nil {
+		return 0, "", nil, ErrMalformedEntry
+	}
+
+	value := make([]byte, binary.LittleEndian.Uint32(valSize[:]))
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, "", nil, ErrMalformedEntry
+	}
+
+	return header[0], string(key), value, nil
+}